@@ -1 +1,490 @@
 package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// Client implements an httptun client that opens a tunnel on an httptun server and forwards every connection
+// arriving through that tunnel to a local target. It can also forward local listeners through the server.
+type Client interface {
+	// Opens the tunnel (non-blocking)
+	Start() error
+	// Closes the tunnel
+	Stop()
+	// Blocks until client is stopped
+	Wait()
+}
+
+// Instantiates a default Client and then applies any number of Options.
+// If any of the Options are invalid, then an error will be returned.
+func New(options ...Option) (Client, error) {
+
+	logger := log.New(ioutil.Discard, ``, 0)
+	serverURL, _ := url.Parse(defaultServerURL)
+
+	// initialize
+	c := &client{
+		mu:             &sync.Mutex{},
+		wg:             &sync.WaitGroup{},
+		logger:         logger,
+		serverURL:      serverURL,
+		target:         defaultTarget,
+		targetNetwork:  `tcp`,
+		gate:           http.Header{},
+		transport:      TransportAuto,
+		transportCache: defaultTransportCache(),
+		transportMutex: &sync.Mutex{},
+		connections:    newConnectionRegistry(),
+		control:        nil, // set at runtime
+	}
+
+	// apply all other options designated by developer
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, errors.Wrap(err, `cannot instantiate Client`)
+		}
+	}
+
+	if err := c.resolveProxy(); err != nil {
+		return nil, errors.Wrap(err, `cannot instantiate Client`)
+	}
+
+	if c.disguisePath != `` {
+		if c.transport != TransportAuto && c.transport != shared.TransportPoll {
+			return nil, errors.New(`cannot instantiate Client: disguise mode only uses the poll transport`)
+		}
+		// probing other transports would give the disguise away
+		c.transport = shared.TransportPoll
+	}
+
+	c.streams = c.newStreamTransport()
+	c.requests = c.newHttpClient()
+
+	if len(c.locals) == 0 {
+		// a tunnel to the default target
+		c.tunnel = true
+	}
+
+	if c.udp && c.compression {
+		return nil, errors.New(`cannot instantiate Client: UDP tunnels cannot be compressed`)
+	}
+
+	if c.udp && (c.carriesHttp() || c.proxyProtocol != 0) {
+		return nil, errors.New(`cannot instantiate Client: UDP tunnels cannot be inspected, have headers rewritten or use the PROXY protocol`)
+	}
+
+	if c.udp && (c.gate.Get(shared.HeaderBasicAuth) != `` || c.gate.Get(shared.HeaderBearerToken) != ``) {
+		return nil, errors.New(`cannot instantiate Client: UDP tunnels cannot require credentials`)
+	}
+
+	if c.udp && (c.targetNetwork != `tcp` || c.socket != `` || c.hostname != ``) {
+		return nil, errors.New(`cannot instantiate Client: UDP tunnels require a 'host:port' target and cannot use a socket or hostname`)
+	}
+
+	if c.hostname != `` && (c.socket != `` || c.port != 0) {
+		return nil, errors.New(`cannot instantiate Client: a hostname cannot be combined with a port or socket`)
+	}
+
+	return c, nil
+}
+
+// Instantiates a new Client with the designated Options. Panics if any of the Options are invalid.
+func MustInstantiate(options ...Option) Client {
+
+	c, err := New(options...)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+type client struct {
+	mu     *sync.Mutex
+	wg     *sync.WaitGroup
+	logger *log.Logger
+
+	// server specification
+	serverURL *url.URL
+	tlsConfig *tls.Config
+	serverKey []byte // pinned public key for encryption inside upgraded connections, or nil
+
+	// proxy through which to reach the server, or nil; noProxy ignores proxies configured in the environment
+	proxyURL *url.URL
+	noProxy  bool
+
+	// transport by which to reach the server, or TransportAuto, and the file in which the choices of TransportAuto are
+	// kept, if any; transportMutex guards chosenTransport and choosing, the probes in progress if any
+	transport       string
+	transportCache  string
+	transportMutex  *sync.Mutex
+	chosenTransport string
+	choosing        *transportChoice
+
+	// base path of disguise mode, or empty, and the host to present in the Host header of disguised requests, if not
+	// that of the server URL
+	disguisePath string
+	disguiseHost string
+
+	// clients for the stream and long-poll transports
+	streams  *http.Transport
+	requests *http.Client
+
+	// tunnel specification; port is updated with the port assigned by the server so that it is kept on reconnect
+	target        string
+	targetNetwork string
+	port          int
+	socket        string
+	hostname      string
+	tunnel        bool // whether to open a tunnel at all
+	udp           bool // whether the tunnel carries datagrams
+
+	// listeners forwarded through the server
+	locals []*local
+
+	// headers with which the tunnel's owner asks the server to restrict who may connect to it
+	gate http.Header
+
+	// PROXY protocol version with which to announce remote peers to the target, or zero
+	proxyProtocol int
+
+	// whether to ask the server to compress connections through the tunnel and those dialed through it
+	compression bool
+
+	// records and rewrites HTTP exchanges carried by the tunnel, if enabled
+	inspector *inspector
+	rewrites  *headerRewrite
+
+	// connections being carried, closed by Stop
+	connections *connectionRegistry
+
+	// control connection of the tunnel, its identifier and whether the server agreed to compression, set at runtime
+	control    net.Conn
+	tunnelID   string
+	compressed bool
+	done       chan struct{}
+}
+
+func (c *client) Start() error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done != nil {
+		return errors.New(`client is already started`)
+	}
+
+	c.connections.open()
+
+	if err := c.listenLocals(); err != nil {
+		return err
+	}
+
+	if c.inspector != nil {
+		if err := c.inspector.listen(); err != nil {
+			for _, l := range c.locals {
+				l.listener.Close()
+			}
+			return err
+		}
+		c.logger.Printf(`inspecting requests at http://%s/`, c.inspector.listener.Addr().String())
+	}
+
+	if c.tunnel {
+		if err := c.open(); err != nil {
+			for _, l := range c.locals {
+				l.listener.Close()
+			}
+			if c.inspector != nil {
+				c.inspector.listener.Close()
+			}
+			return errors.Wrap(err, `could not open tunnel`)
+		}
+	}
+
+	c.done = make(chan struct{})
+
+	if c.tunnel {
+		c.wg.Add(1)
+		go c.run(c.control, c.done)
+	}
+
+	for _, l := range c.locals {
+		c.wg.Add(1)
+		go c.serveLocal(l)
+	}
+
+	if c.inspector != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.inspector.serve()
+		}()
+	}
+
+	return nil
+}
+
+func (c *client) Stop() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+
+	if c.control != nil {
+		c.control.Close()
+		c.control = nil
+	}
+
+	for _, l := range c.locals {
+		if l.listener != nil {
+			l.listener.Close()
+		}
+	}
+
+	if c.inspector != nil && c.inspector.listener != nil {
+		c.inspector.listener.Close()
+	}
+
+	c.connections.close()
+}
+
+func (c *client) Wait() {
+
+	c.wg.Wait()
+}
+
+// open upgrades a new connection to the server into the control connection of a tunnel. Must be called with c.mu held.
+func (c *client) open() error {
+
+	header := http.Header{}
+	header.Set(shared.HeaderAction, shared.ActionOpen)
+	capabilities := []string{}
+	if c.udp {
+		header.Set(shared.HeaderNetwork, `udp`)
+		capabilities = append(capabilities, shared.CapabilityUdp)
+	}
+	for key, values := range c.gate {
+		header[key] = values
+	}
+	if c.compression {
+		capabilities = append(capabilities, shared.CapabilityCompression)
+	}
+	shared.NewHandshake(capabilities...).Write(header)
+	if c.hostname != `` {
+		header.Set(shared.HeaderHost, c.hostname)
+	} else if c.socket != `` {
+		header.Set(shared.HeaderSocket, c.socket)
+	} else if c.port != 0 {
+		header.Set(shared.HeaderPort, strconv.Itoa(c.port))
+	}
+
+	control, response, err := c.upgrade(header)
+	if err != nil {
+		return err
+	}
+
+	address := response.Get(shared.HeaderAddress)
+	if c.socket == `` && c.hostname == `` {
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			c.port, _ = strconv.Atoi(port)
+		}
+	}
+
+	c.control = control
+	c.tunnelID = response.Get(shared.HeaderTunnel)
+	c.compressed = grantsCompression(response)
+	c.logger.Printf(`tunnel %s open at %s, forwarding to %s`, c.tunnelID, address, c.target)
+
+	return nil
+}
+
+// run serves the control connection and reopens the tunnel whenever it is lost, until done is closed.
+func (c *client) run(control net.Conn, done <-chan struct{}) {
+
+	defer c.wg.Done()
+
+	for {
+		if c.udp {
+			c.relay(control)
+		} else {
+			c.serve(control)
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		c.logger.Printf(`tunnel %s lost; reconnecting`, c.tunnelID)
+
+		if control = c.reopen(done); control == nil {
+			return
+		}
+	}
+}
+
+// reopen retries opening the tunnel with exponential backoff. It returns nil if done is closed first.
+func (c *client) reopen(done <-chan struct{}) net.Conn {
+
+	interval := defaultRetryIntervalMin
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-time.After(interval):
+		}
+
+		c.mu.Lock()
+		select {
+		case <-done:
+			c.mu.Unlock()
+			return nil
+		default:
+		}
+		err := c.open()
+		control := c.control
+		c.mu.Unlock()
+
+		if err == nil {
+			return control
+		}
+
+		c.logger.Printf(`could not reopen tunnel: %s`, err.Error())
+
+		if interval *= 2; interval > defaultRetryIntervalMax {
+			interval = defaultRetryIntervalMax
+		}
+	}
+}
+
+// serve reads messages from the control connection until it fails.
+func (c *client) serve(control net.Conn) {
+
+	decoder := json.NewDecoder(control)
+
+	for {
+		var message shared.Message
+		if err := decoder.Decode(&message); err != nil {
+			control.Close()
+			return
+		}
+
+		switch message.Type {
+		case shared.MessageConnection:
+			c.wg.Add(1)
+			go c.forward(message)
+		default:
+			c.logger.Printf(`ignoring unknown message type '%s'`, message.Type)
+		}
+	}
+}
+
+// forward attaches to a connection announced by the server and joins it with a new connection to the target.
+func (c *client) forward(message shared.Message) {
+
+	defer c.wg.Done()
+
+	target, targetErr := c.dialTarget()
+
+	c.mu.Lock()
+	tunnelID, compressed := c.tunnelID, c.compressed
+	c.mu.Unlock()
+
+	header := http.Header{}
+	header.Set(shared.HeaderAction, shared.ActionAttach)
+	header.Set(shared.HeaderTunnel, tunnelID)
+	header.Set(shared.HeaderConnection, message.ID)
+	shared.NewHandshake().Write(header)
+
+	attached, _, err := c.upgrade(header)
+	if err != nil {
+		c.logger.Printf(`could not attach connection from %s: %s`, message.Addr, err.Error())
+		if target != nil {
+			target.Close()
+		}
+		return
+	}
+
+	if !c.connections.add(attached) {
+		if target != nil {
+			target.Close()
+		}
+		return
+	}
+	defer c.connections.remove(attached)
+
+	if compressed {
+		attached = shared.NewCompressedConn(attached)
+	}
+
+	if targetErr != nil {
+		// closing the attached connection promptly tells the remote peer that the target is unavailable
+		c.logger.Printf(`could not reach target for connection from %s: %s`, message.Addr, targetErr.Error())
+		attached.Close()
+		return
+	}
+
+	if !c.connections.add(target) {
+		attached.Close()
+		return
+	}
+	defer c.connections.remove(target)
+
+	if c.proxyProtocol != 0 {
+		if err := shared.WriteProxyHeader(target, c.proxyProtocol, message.Addr, message.Local); err != nil {
+			c.logger.Printf(`could not announce connection from %s to target: %s`, message.Addr, err.Error())
+			attached.Close()
+			target.Close()
+			return
+		}
+	}
+
+	if c.carriesHttp() {
+		c.forwardHttp(attached, target, message.Addr)
+		return
+	}
+
+	shared.Join(attached, target)
+}
+
+// carriesHttp reports whether connections carried by the tunnel are parsed as HTTP.
+func (c *client) carriesHttp() bool {
+
+	return c.inspector != nil || c.rewrites != nil
+}
+
+// rewrite returns the header rewrites of the tunnel, creating them if necessary. Used by Options.
+func (c *client) rewrite() *headerRewrite {
+
+	if c.rewrites == nil {
+		c.rewrites = newHeaderRewrite()
+	}
+
+	return c.rewrites
+}
+
+// dialTarget connects to the target of the tunnel.
+func (c *client) dialTarget() (net.Conn, error) {
+
+	return net.DialTimeout(c.targetNetwork, c.target, defaultDialTimeout)
+}
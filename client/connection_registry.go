@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net"
+	"sync"
+)
+
+// connectionRegistry tracks the connections that the client is carrying, such as those accepted by local forwards and
+// proxies and those attached to the tunnel, so that they can be closed when the client stops.
+type connectionRegistry struct {
+	conns  map[net.Conn]bool
+	closed bool
+	mutex  *sync.Mutex
+}
+
+func newConnectionRegistry() *connectionRegistry {
+
+	return &connectionRegistry{
+		conns: map[net.Conn]bool{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// add tracks conns until they are removed. If the registry is closed, it closes them instead and returns false.
+func (cr *connectionRegistry) add(conns ...net.Conn) bool {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if cr.closed {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+
+	for _, conn := range conns {
+		cr.conns[conn] = true
+	}
+
+	return true
+}
+
+// remove stops tracking conns, which the caller has finished with.
+func (cr *connectionRegistry) remove(conns ...net.Conn) {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	for _, conn := range conns {
+		delete(cr.conns, conn)
+	}
+}
+
+// open lets connections be tracked again after the registry was closed, for when the client is restarted.
+func (cr *connectionRegistry) open() {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cr.closed = false
+}
+
+// close closes every tracked connection and any that are added afterwards.
+func (cr *connectionRegistry) close() {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cr.closed = true
+
+	for conn := range cr.conns {
+		conn.Close()
+		delete(cr.conns, conn)
+	}
+}
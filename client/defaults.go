@@ -0,0 +1,43 @@
+package client
+
+import "time"
+
+const (
+	defaultServerURL = `http://127.0.0.1:4235`
+	defaultTarget    = `127.0.0.1:8080`
+
+	defaultDialTimeout = 10 * time.Second
+
+	// how long a transport may take to carry a probe to the server and back before the next is tried
+	defaultProbeTimeout = 5 * time.Second
+
+	// how long a request of a long-poll session may take, and how long the session is given to end on close
+	defaultPollTimeout      = time.Minute
+	defaultPollCloseTimeout = 2 * time.Second
+
+	// how often a request of a long-poll session is made before giving up when it fails on the way, and how long to
+	// wait before making it again
+	maxPollAttempts          = 3
+	defaultPollRetryInterval = time.Second
+
+	// the largest response read from a long poll, plain or disguised; servers send much less
+	maxPollResponse      = 4 * 1024 * 1024
+	maxDisguisedResponse = 8 * 1024 * 1024
+
+	// the browser that requests in disguise mode claim to come from
+	disguiseUserAgent = `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36`
+
+	// how long a connection on an inspected tunnel may stay silent before it is assumed not to carry HTTP
+	defaultSniffTimeout = 2 * time.Second
+
+	// how many exchanges the inspector keeps, and how much of each body
+	defaultInspectCapacity  = 100
+	defaultInspectBodyLimit = 64 * 1024
+
+	// how long a UDP flow is kept without traffic in either direction
+	defaultUdpIdleTimeout = 2 * time.Minute
+
+	// bounds of the exponential backoff between attempts to reconnect a tunnel
+	defaultRetryIntervalMin = 500 * time.Millisecond
+	defaultRetryIntervalMax = 30 * time.Second
+)
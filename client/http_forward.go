@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// methods that a connection must start with to be treated as HTTP
+var httpMethods = []string{
+	`GET `, `HEAD `, `POST `, `PUT `, `PATCH `, `DELETE `, `OPTIONS `, `TRACE `, `CONNECT `,
+}
+
+// forwardHttp carries HTTP requests from attached to target one at a time so that each exchange can be rewritten and
+// recorded.
+// Connections that do not start with an HTTP request, and connections that switch protocols, are joined as-is.
+func (c *client) forwardHttp(attached, target net.Conn, remoteAddr string) {
+
+	attachedReader := bufio.NewReader(attached)
+	targetReader := bufio.NewReader(target)
+
+	defer func() {
+		attached.Close()
+		target.Close()
+	}()
+
+	if !looksLikeHttp(attached, attachedReader) {
+		shared.Join(shared.NewBufferedConn(attached, attachedReader), shared.NewBufferedConn(target, targetReader))
+		return
+	}
+
+	for {
+		req, err := http.ReadRequest(attachedReader)
+		if err != nil {
+			return
+		}
+
+		resp, err := c.exchange(req, remoteAddr, attached, target, targetReader)
+		if err != nil {
+			c.logger.Printf(`could not forward request from %s: %s`, remoteAddr, err.Error())
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			shared.Join(shared.NewBufferedConn(attached, attachedReader), shared.NewBufferedConn(target, targetReader))
+			return
+		}
+
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// exchange rewrites req as configured, writes it to target and relays the responses to attached, recording the
+// exchange if requests are inspected. Interim responses, such as the 100 Continue that a client expecting it waits for
+// before it sends the body, are relayed as they come. It returns the final response once it has been relayed.
+func (c *client) exchange(req *http.Request, remoteAddr string, attached, target io.Writer, targetReader *bufio.Reader) (*http.Response, error) {
+
+	if c.rewrites != nil {
+		c.rewrites.apply(req, remoteAddr)
+	}
+
+	var record *exchangeRecord
+	if c.inspector != nil {
+		record = c.inspector.begin(req, remoteAddr, 0)
+	}
+
+	// Request.Write would otherwise add a User-Agent that the original request did not have
+	if _, ok := req.Header[`User-Agent`]; !ok {
+		req.Header[`User-Agent`] = []string{``}
+	}
+
+	// the body may only come once the target has answered with 100 Continue, so it is written meanwhile
+	written := make(chan error, 1)
+	go func() {
+		written <- req.Write(target)
+	}()
+
+	resp, err := c.relayResponses(req, record, attached, targetReader)
+	if err == nil {
+		err = <-written
+	}
+
+	if err != nil {
+		if record != nil {
+			c.inspector.fail(record, err)
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// relayResponses copies the responses to req from targetReader to attached until the final one, which it returns.
+func (c *client) relayResponses(req *http.Request, record *exchangeRecord, attached io.Writer, targetReader *bufio.Reader) (*http.Response, error) {
+
+	for {
+		resp, err := http.ReadResponse(targetReader, req)
+		if err != nil {
+			return nil, err
+		}
+
+		final := resp.StatusCode >= http.StatusOK || resp.StatusCode == http.StatusSwitchingProtocols
+		if final && record != nil {
+			c.inspector.respond(record, resp)
+		}
+
+		err = resp.Write(attached)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if final {
+			return resp, nil
+		}
+	}
+}
+
+// looksLikeHttp peeks at the start of a connection and reports whether it is an HTTP/1 request. Protocols in which the
+// server speaks first are recognized by the silence of the peer, after a short delay.
+func looksLikeHttp(conn net.Conn, reader *bufio.Reader) bool {
+
+	// long enough for the longest method; shorter requests are not plausible
+	conn.SetReadDeadline(time.Now().Add(defaultSniffTimeout))
+	reader.Peek(8)
+	conn.SetReadDeadline(time.Time{})
+
+	start, _ := reader.Peek(reader.Buffered())
+
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(start, []byte(method)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// captureBody records up to limit bytes of a body as it is read.
+type captureBody struct {
+	io.ReadCloser
+	buf       *bytes.Buffer
+	limit     int
+	size      int64
+	truncated bool
+	done      func(*captureBody)
+	finished  bool
+}
+
+func (cb *captureBody) Read(b []byte) (int, error) {
+
+	n, err := cb.ReadCloser.Read(b)
+
+	cb.size += int64(n)
+	if room := cb.limit - cb.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		cb.buf.Write(b[:room])
+	}
+	if cb.buf.Len() < int(cb.size) {
+		cb.truncated = true
+	}
+
+	if err != nil {
+		cb.finish()
+	}
+
+	return n, err
+}
+
+func (cb *captureBody) Close() error {
+
+	cb.finish()
+	return cb.ReadCloser.Close()
+}
+
+func (cb *captureBody) finish() {
+
+	if !cb.finished {
+		cb.finished = true
+		if cb.done != nil {
+			cb.done(cb)
+		}
+	}
+}
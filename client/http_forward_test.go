@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForwardHttpRelaysInterimResponses(t *testing.T) {
+
+	attached, local := net.Pipe()
+	target, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	c := &client{logger: log.New(io.Discard, ``, 0), inspector: newInspector(`127.0.0.1:0`, nil)}
+	done := make(chan struct{})
+	go func() {
+		c.forwardHttp(attached, target, `203.0.113.7:4321`)
+		close(done)
+	}()
+
+	// the target answers 100 Continue (and an unrelated 103 Early Hints) before it reads the body
+	go func() {
+		reader := bufio.NewReader(remote)
+		for _, body := range []string{`first`, `second`} {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				t.Errorf(`target could not read request: %s`, err.Error())
+				return
+			}
+			io.WriteString(remote, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+			io.WriteString(remote, "HTTP/1.1 100 Continue\r\n\r\n")
+			got, _ := io.ReadAll(req.Body)
+			if string(got) != body {
+				t.Errorf(`target received '%s', want '%s'`, got, body)
+			}
+			io.WriteString(remote, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone")
+		}
+	}()
+
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(local)
+
+	// both requests share the connection, so the second one shows that forwarding carried on after the first
+	for _, body := range []string{`first`, `second`} {
+		io.WriteString(local, "POST /upload HTTP/1.1\r\nHost: app\r\nExpect: 100-continue\r\nContent-Length: "+
+			map[string]string{`first`: `5`, `second`: `6`}[body]+"\r\n\r\n")
+
+		for _, want := range []int{http.StatusEarlyHints, http.StatusContinue} {
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf(`could not read interim response: %s`, err.Error())
+			}
+			if resp.StatusCode != want {
+				t.Fatalf(`got %d, want %d`, resp.StatusCode, want)
+			}
+		}
+
+		io.WriteString(local, body)
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf(`could not read final response: %s`, err.Error())
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(got) != `done` {
+			t.Errorf(`got %d '%s'`, resp.StatusCode, got)
+		}
+	}
+
+	// only the final responses are recorded
+	records := c.inspector.snapshot()
+	if len(records) != 2 {
+		t.Fatalf(`recorded %d exchanges, want 2`, len(records))
+	}
+	for _, record := range records {
+		if record.Response == nil || record.Response.Status != http.StatusOK {
+			t.Errorf(`recorded %+v`, record.Response)
+		}
+	}
+
+	local.Close()
+	<-done
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// hopHeaders are meaningful only for a single connection and are not passed on by the proxy.
+var hopHeaders = []string{
+	`Connection`,
+	`Proxy-Connection`,
+	`Keep-Alive`,
+	`Proxy-Authenticate`,
+	`Proxy-Authorization`,
+	`Te`,
+	`Trailer`,
+	`Upgrade`,
+}
+
+// serveHttpProxy serves HTTP proxy requests on conn. CONNECT requests are carried through the server to the
+// requested destination as-is; requests with an absolute 'http' URI are sent one at a time over a fresh connection
+// through the server, for as long as the proxy client keeps conn alive.
+func (c *client) serveHttpProxy(conn net.Conn) {
+
+	defer c.wg.Done()
+	defer c.connections.remove(conn)
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				c.logger.Printf(`http proxy: connection from %s: %s`, conn.RemoteAddr().String(), err.Error())
+			}
+			conn.Close()
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			c.connect(shared.NewBufferedConn(conn, reader), req)
+			return
+		}
+
+		if !c.proxyRequest(conn, req) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// connect carries a CONNECT request through the server and then joins the two connections.
+func (c *client) connect(conn net.Conn, req *http.Request) {
+
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, `443`)
+	}
+
+	upgraded, err := c.dialThrough(target)
+	if err != nil {
+		c.logger.Printf(`http proxy: could not reach %s for connection from %s: %s`, target, conn.RemoteAddr().String(), err.Error())
+		writeProxyError(conn, req, err)
+		conn.Close()
+		return
+	}
+
+	if !c.connections.add(upgraded) {
+		conn.Close()
+		return
+	}
+	defer c.connections.remove(upgraded)
+
+	if _, err := fmt.Fprintf(conn, "HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor); err != nil {
+		conn.Close()
+		upgraded.Close()
+		return
+	}
+
+	shared.Join(conn, upgraded)
+}
+
+// proxyRequest forwards a single request with an absolute URI and relays the response. It reports whether the
+// connection to the proxy client may be used for another request.
+func (c *client) proxyRequest(conn net.Conn, req *http.Request) bool {
+
+	if !req.URL.IsAbs() || req.URL.Scheme != `http` {
+		writeProxyStatus(conn, req, http.StatusBadRequest, `only CONNECT and absolute 'http' URIs are supported`)
+		return false
+	}
+
+	target := req.URL.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, `80`)
+	}
+
+	upstream, err := c.dialThrough(target)
+	if err != nil {
+		c.logger.Printf(`http proxy: could not reach %s for connection from %s: %s`, target, conn.RemoteAddr().String(), err.Error())
+		writeProxyError(conn, req, err)
+		// an unread request body would be mistaken for the next request
+		return !req.Close && req.ContentLength == 0
+	}
+	defer upstream.Close()
+
+	if !c.connections.add(upstream) {
+		return false
+	}
+	defer c.connections.remove(upstream)
+
+	keepAlive := !req.Close
+
+	removeHopHeaders(req.Header)
+	req.Close = true
+
+	// written in origin form, as the destination is not a proxy
+	if err := req.Write(upstream); err != nil {
+		writeProxyStatus(conn, req, http.StatusBadGateway, `could not send request`)
+		return false
+	}
+
+	reader := bufio.NewReader(upstream)
+	connection := peekConnection(reader)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		writeProxyStatus(conn, req, http.StatusBadGateway, `could not read response`)
+		return false
+	}
+	defer resp.Body.Close()
+
+	resp.Header[`Connection`] = connection
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+
+	return keepAlive
+}
+
+// removeHopHeaders removes the headers that are meaningful only for a single connection: those that always are, and
+// those that the Connection header names.
+func removeHopHeaders(header http.Header) {
+
+	for _, value := range header.Values(`Connection`) {
+		for _, name := range strings.Split(value, `,`) {
+			if name = strings.TrimSpace(name); name != `` {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// peekConnection returns the values of the Connection header of the response at the start of reader without
+// consuming it, since http.ReadResponse drops that header when it asks for the connection to be closed. It returns nil
+// if the head of the response does not fit in the buffer of reader.
+func peekConnection(reader *bufio.Reader) []string {
+
+	for n := 1; n <= reader.Size(); n = reader.Buffered() + 1 {
+		buffered, err := reader.Peek(n)
+
+		if end := bytes.Index(buffered, []byte("\r\n\r\n")); end >= 0 {
+			head := textproto.NewReader(bufio.NewReader(bytes.NewReader(buffered[:end+4])))
+			if _, err := head.ReadLine(); err != nil {
+				return nil
+			}
+			header, _ := head.ReadMIMEHeader()
+			return header[`Connection`]
+		}
+
+		if err != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// writeProxyError answers req with a status that reflects why the server could not reach the destination.
+func writeProxyError(conn net.Conn, req *http.Request, err error) {
+
+	status := http.StatusBadGateway
+	if refusalStatus(err) == http.StatusForbidden {
+		status = http.StatusForbidden
+	}
+
+	writeProxyStatus(conn, req, status, strings.TrimSpace(err.Error()))
+}
+
+func writeProxyStatus(conn net.Conn, req *http.Request, status int, message string) {
+
+	body := message + "\n"
+
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+}
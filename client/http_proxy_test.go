@@ -0,0 +1,56 @@
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+
+	header := http.Header{
+		`Connection`:          {`close, X-Trace`, ` x-session `},
+		`Keep-Alive`:          {`timeout=5`},
+		`Proxy-Authorization`: {`Basic dXNlcjpwYXNz`},
+		`Upgrade`:             {`websocket`},
+		`X-Trace`:             {`1`},
+		`X-Session`:           {`abc`},
+		`Accept`:              {`*/*`},
+		`Cookie`:              {`a=1`},
+	}
+
+	removeHopHeaders(header)
+
+	want := http.Header{
+		`Accept`: {`*/*`},
+		`Cookie`: {`a=1`},
+	}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("kept %v\nwant %v", header, want)
+	}
+}
+
+func TestPeekConnection(t *testing.T) {
+
+	raw := "HTTP/1.1 200 OK\r\nConnection: close, X-Internal\r\nX-Internal: secret\r\nContent-Length: 2\r\n\r\nok"
+	reader := bufio.NewReader(strings.NewReader(raw))
+
+	if got := peekConnection(reader); !reflect.DeepEqual(got, []string{`close, X-Internal`}) {
+		t.Errorf(`peeked %q`, got)
+	}
+
+	// nothing was consumed, though http.ReadResponse itself drops the header
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(`could not read response: %s`, err.Error())
+	}
+	if _, ok := resp.Header[`Connection`]; ok || resp.Header.Get(`X-Internal`) != `secret` {
+		t.Errorf(`read header %v`, resp.Header)
+	}
+
+	if got := peekConnection(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n"))); got != nil {
+		t.Errorf(`peeked %q from a truncated head`, got)
+	}
+}
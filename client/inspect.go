@@ -0,0 +1,394 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// inspector records recent HTTP exchanges carried by the tunnel in a ring buffer and serves them, along with a page
+// to browse them and an action to replay a request against the target, on a local address.
+type inspector struct {
+	address   string
+	listener  net.Listener
+	capacity  int
+	bodyLimit int
+
+	// dials the target of the tunnel for replays
+	dial func() (net.Conn, error)
+
+	mutex   *sync.Mutex
+	records []*exchangeRecord // ring buffer, oldest first once full
+	next    int               // position of the next record in records
+	lastID  int
+}
+
+// exchangeRecord is a request and its response as shown by the inspector. Bodies are kept up to the body limit.
+type exchangeRecord struct {
+	ID       int       `json:"id"`
+	Replayed int       `json:"replayed,omitempty"` // id of the exchange this one replayed
+	Remote   string    `json:"remote"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_ms"`
+	Error    string    `json:"error,omitempty"`
+
+	Request  exchangeMessage  `json:"request"`
+	Response *exchangeMessage `json:"response,omitempty"`
+}
+
+type exchangeMessage struct {
+	Method    string      `json:"method,omitempty"`
+	Host      string      `json:"host,omitempty"`
+	URL       string      `json:"url,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Proto     string      `json:"proto"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body"`
+	Size      int64       `json:"size"`
+	Truncated bool        `json:"truncated"`
+}
+
+func newInspector(address string, dial func() (net.Conn, error)) *inspector {
+
+	return &inspector{
+		address:   address,
+		capacity:  defaultInspectCapacity,
+		bodyLimit: defaultInspectBodyLimit,
+		dial:      dial,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// listen opens the listener of the inspector.
+func (in *inspector) listen() error {
+
+	l, err := net.Listen(`tcp`, in.address)
+	if err != nil {
+		return errors.Wrapf(err, `could not listen on %s`, in.address)
+	}
+
+	in.listener = l
+	return nil
+}
+
+// serve serves the inspector until its listener is closed.
+func (in *inspector) serve() {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/`, in.handlePage)
+	mux.HandleFunc(`/api/requests`, in.handleList)
+	mux.HandleFunc(`/api/requests/`, in.handleRequest)
+
+	server := &http.Server{Handler: in.guard(mux)}
+	server.Serve(in.listener)
+}
+
+// guard refuses requests that a web page in the browser could have made of the inspector: those whose Host is not
+// the inspector's loopback address, as after DNS rebinding, which would let the page read recorded headers, and posts
+// from other origins, which would replay requests.
+func (in *inspector) guard(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+
+		if !in.allowsHost(req.Host) {
+			http.Error(rw, `invalid host`, http.StatusForbidden)
+			return
+		}
+
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Header.Get(`Origin`) != `http://`+req.Host {
+			http.Error(rw, `requests that change anything must come from the inspector's own page`, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// allowsHost reports whether host, the value of a Host header, names the inspector: localhost or a loopback address,
+// with the port on which the inspector listens.
+func (in *inspector) allowsHost(host string) bool {
+
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, `80`
+	}
+
+	if _, listening, _ := net.SplitHostPort(in.listener.Addr().String()); port != listening {
+		return false
+	}
+
+	if strings.EqualFold(hostname, `localhost`) {
+		return true
+	}
+
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hostname, `[`), `]`))
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// begin records the start of an exchange and arranges for the body of req to be captured as it is forwarded.
+func (in *inspector) begin(req *http.Request, remoteAddr string, replayed int) *exchangeRecord {
+
+	record := &exchangeRecord{
+		Replayed: replayed,
+		Remote:   remoteAddr,
+		Started:  time.Now(),
+		Request: exchangeMessage{
+			Method: req.Method,
+			Host:   req.Host,
+			URL:    req.RequestURI,
+			Proto:  req.Proto,
+			Header: cloneHeader(req.Header),
+		},
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = in.capture(req.Body, func(cb *captureBody) {
+			in.mutex.Lock()
+			record.Request.Body, record.Request.Size, record.Request.Truncated = cb.buf.String(), cb.size, cb.truncated
+			in.mutex.Unlock()
+		})
+	}
+
+	in.add(record)
+
+	return record
+}
+
+// respond records the response of an exchange, whose body is captured as it is forwarded.
+func (in *inspector) respond(record *exchangeRecord, resp *http.Response) {
+
+	response := &exchangeMessage{
+		Status: resp.StatusCode,
+		Proto:  resp.Proto,
+		Header: cloneHeader(resp.Header),
+	}
+
+	in.mutex.Lock()
+	record.Response = response
+	record.Duration = milliseconds(time.Since(record.Started))
+	in.mutex.Unlock()
+
+	resp.Body = in.capture(resp.Body, func(cb *captureBody) {
+		in.mutex.Lock()
+		response.Body, response.Size, response.Truncated = cb.buf.String(), cb.size, cb.truncated
+		record.Duration = milliseconds(time.Since(record.Started))
+		in.mutex.Unlock()
+	})
+}
+
+// fail records that an exchange could not be completed.
+func (in *inspector) fail(record *exchangeRecord, err error) {
+
+	in.mutex.Lock()
+	record.Error = err.Error()
+	record.Duration = milliseconds(time.Since(record.Started))
+	in.mutex.Unlock()
+}
+
+func (in *inspector) capture(body io.ReadCloser, done func(*captureBody)) *captureBody {
+
+	return &captureBody{
+		ReadCloser: body,
+		buf:        &bytes.Buffer{},
+		limit:      in.bodyLimit,
+		done:       done,
+	}
+}
+
+// add assigns the next id to record and stores it, replacing the oldest record once the buffer is full.
+func (in *inspector) add(record *exchangeRecord) {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	in.lastID++
+	record.ID = in.lastID
+
+	if len(in.records) < in.capacity {
+		in.records = append(in.records, record)
+	} else {
+		in.records[in.next] = record
+	}
+	in.next = (in.next + 1) % in.capacity
+}
+
+// snapshot returns copies of the stored records, newest first.
+func (in *inspector) snapshot() []exchangeRecord {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	records := make([]exchangeRecord, 0, len(in.records))
+	for i := 1; i <= len(in.records); i++ {
+		record := in.records[(in.next-i+len(in.records))%len(in.records)]
+		records = append(records, copyRecord(record))
+	}
+
+	return records
+}
+
+func (in *inspector) get(id int) (exchangeRecord, bool) {
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	for _, record := range in.records {
+		if record.ID == id {
+			return copyRecord(record), true
+		}
+	}
+
+	return exchangeRecord{}, false
+}
+
+// replay sends the request of a recorded exchange to the target again and records the new exchange.
+func (in *inspector) replay(original exchangeRecord) (exchangeRecord, error) {
+
+	if original.Request.Truncated {
+		return exchangeRecord{}, errors.New(`request body was truncated and cannot be replayed`)
+	}
+
+	req, err := http.NewRequest(original.Request.Method, original.Request.URL, strings.NewReader(original.Request.Body))
+	if err != nil {
+		return exchangeRecord{}, errors.Wrap(err, `could not rebuild request`)
+	}
+	req.Header = cloneHeader(original.Request.Header)
+	req.Header.Del(`Transfer-Encoding`)
+	req.Host = original.Request.Host
+	req.ContentLength = int64(len(original.Request.Body))
+	req.Close = true
+
+	conn, err := in.dial()
+	if err != nil {
+		return exchangeRecord{}, errors.Wrap(err, `could not reach target`)
+	}
+	defer conn.Close()
+
+	record := in.begin(req, `replay`, original.ID)
+
+	if _, ok := req.Header[`User-Agent`]; !ok {
+		req.Header[`User-Agent`] = []string{``}
+	}
+
+	if err = req.Write(conn); err == nil {
+		var resp *http.Response
+		if resp, err = http.ReadResponse(bufio.NewReader(conn), req); err == nil {
+			in.respond(record, resp)
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	if err != nil {
+		in.fail(record, err)
+	}
+
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	return copyRecord(record), nil
+}
+
+func (in *inspector) handlePage(rw http.ResponseWriter, req *http.Request) {
+
+	if req.URL.Path != `/` {
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+	rw.Write([]byte(inspectorPage))
+}
+
+// handleList serves GET /api/requests with the recorded exchanges, newest first.
+func (in *inspector) handleList(rw http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+		http.Error(rw, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJson(rw, http.StatusOK, in.snapshot())
+}
+
+// handleRequest serves GET /api/requests/{id} and POST /api/requests/{id}/replay.
+func (in *inspector) handleRequest(rw http.ResponseWriter, req *http.Request) {
+
+	path := strings.TrimPrefix(req.URL.Path, `/api/requests/`)
+	replay := strings.HasSuffix(path, `/replay`)
+	path = strings.TrimSuffix(path, `/replay`)
+
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	record, ok := in.get(id)
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	switch {
+	case !replay && req.Method == http.MethodGet:
+		writeJson(rw, http.StatusOK, record)
+	case replay && req.Method == http.MethodPost:
+		replayed, err := in.replay(record)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJson(rw, http.StatusOK, replayed)
+	default:
+		http.Error(rw, `method not allowed`, http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(rw http.ResponseWriter, status int, v interface{}) {
+
+	rw.Header().Set(`Content-Type`, `application/json`)
+	rw.WriteHeader(status)
+
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent(``, `  `)
+	encoder.Encode(v)
+}
+
+// copyRecord copies record so that it can be used outside of the mutex. Must be called with the mutex held.
+func copyRecord(record *exchangeRecord) exchangeRecord {
+
+	copied := *record
+	if record.Response != nil {
+		response := *record.Response
+		copied.Response = &response
+	}
+
+	return copied
+}
+
+func cloneHeader(header http.Header) http.Header {
+
+	cloned := make(http.Header, len(header))
+	for key, values := range header {
+		cloned[key] = append([]string(nil), values...)
+	}
+
+	return cloned
+}
+
+func milliseconds(d time.Duration) float64 {
+
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,89 @@
+package client
+
+// inspectorPage lists the exchanges recorded by the inspector and shows the one that is selected. It only uses the
+// JSON endpoints of the inspector.
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>httptun inspector</title>
+<style>
+body { font: 14px sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 4px 8px; border-bottom: 1px solid #eee; white-space: nowrap; }
+tr { cursor: pointer; }
+tr.selected { background: #def; }
+.error { color: #b00; }
+pre { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list"><table id="requests"></table></div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+var selected = null;
+
+function text(s) {
+  var div = document.createElement('div');
+  div.textContent = s;
+  return div.innerHTML;
+}
+
+function headers(h) {
+  var lines = [];
+  for (var key in h) {
+    h[key].forEach(function (value) { lines.push(key + ': ' + value); });
+  }
+  return lines.join('\n');
+}
+
+function message(title, m) {
+  if (!m) {
+    return '';
+  }
+  var body = m.body + (m.truncated ? '\n[truncated; ' + m.size + ' bytes in total]' : '');
+  return '<h3>' + title + '</h3><pre>' + text(headers(m.header)) + '</pre>' + (m.size ? '<pre>' + text(body) + '</pre>' : '');
+}
+
+function show(r) {
+  var summary = r.request.method + ' ' + r.request.host + r.request.url;
+  document.getElementById('detail').innerHTML =
+    '<h2>' + text(summary) + '</h2>' +
+    '<p>#' + r.id + (r.replayed ? ' (replay of #' + r.replayed + ')' : '') + ' from ' + text(r.remote) +
+    ' at ' + text(r.started) + ', ' + r.duration_ms.toFixed(1) + ' ms</p>' +
+    (r.error ? '<p class="error">' + text(r.error) + '</p>' : '') +
+    '<button id="replay"' + (r.request.truncated ? ' disabled' : '') + '>Replay</button>' +
+    message('Request', r.request) + message('Response', r.response);
+  document.getElementById('replay').onclick = function () {
+    fetch('api/requests/' + r.id + '/replay', {method: 'POST'})
+      .then(function (resp) { return resp.ok ? resp.json() : resp.text().then(function (t) { throw t; }); })
+      .then(function (replayed) { selected = replayed.id; refresh(); })
+      .catch(function (e) { alert(e); });
+  };
+}
+
+function refresh() {
+  fetch('api/requests').then(function (resp) { return resp.json(); }).then(function (records) {
+    var rows = records.map(function (r) {
+      var status = r.response ? r.response.status : (r.error ? 'error' : '...');
+      return '<tr data-id="' + r.id + '"' + (r.id === selected ? ' class="selected"' : '') + '>' +
+        '<td>' + r.id + '</td><td>' + text(r.request.method) + '</td><td>' + text(r.request.url) + '</td>' +
+        '<td>' + status + '</td><td>' + r.duration_ms.toFixed(1) + ' ms</td></tr>';
+    });
+    var table = document.getElementById('requests');
+    table.innerHTML = rows.join('');
+    Array.prototype.forEach.call(table.rows, function (row) {
+      row.onclick = function () { selected = Number(row.dataset.id); refresh(); };
+    });
+    records.forEach(function (r) { if (r.id === selected) { show(r); } });
+  });
+}
+
+refresh();
+setInterval(function () { if (!document.hidden) { refresh(); } }, 2000);
+</script>
+</body>
+</html>
+`
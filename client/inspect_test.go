@@ -0,0 +1,233 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordExchange records a request with the given body and a response to it, as forwarding them would.
+func recordExchange(in *inspector, path, requestBody, responseBody string) *exchangeRecord {
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(requestBody))
+	record := in.begin(req, `203.0.113.7:4321`, 0)
+	io.ReadAll(req.Body)
+
+	resp := &http.Response{StatusCode: http.StatusOK, Proto: `HTTP/1.1`, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(responseBody))}
+	in.respond(record, resp)
+	io.ReadAll(resp.Body)
+
+	return record
+}
+
+func TestInspectorKeepsRecentExchanges(t *testing.T) {
+
+	in := newInspector(`127.0.0.1:0`, nil)
+	in.capacity = 3
+
+	for _, path := range []string{`/1`, `/2`, `/3`, `/4`, `/5`} {
+		recordExchange(in, path, `in`+path, `out`+path)
+	}
+
+	records := in.snapshot()
+	if len(records) != 3 {
+		t.Fatalf(`kept %d records, want 3`, len(records))
+	}
+	for i, want := range []int{5, 4, 3} {
+		if records[i].ID != want {
+			t.Errorf(`record %d has id %d, want %d`, i, records[i].ID, want)
+		}
+	}
+
+	record, ok := in.get(4)
+	if !ok {
+		t.Fatalf(`record 4 is missing`)
+	}
+	if record.Request.URL != `/4` || record.Request.Body != `in/4` || record.Request.Size != 4 {
+		t.Errorf(`record 4 has request %+v`, record.Request)
+	}
+	if record.Response == nil || record.Response.Status != http.StatusOK || record.Response.Body != `out/4` {
+		t.Errorf(`record 4 has response %+v`, record.Response)
+	}
+	if record.Remote != `203.0.113.7:4321` {
+		t.Errorf(`record 4 came from %s`, record.Remote)
+	}
+
+	for _, id := range []int{1, 2, 6} {
+		if _, ok := in.get(id); ok {
+			t.Errorf(`record %d is still there`, id)
+		}
+	}
+
+	// copies do not change with the records
+	record.Response.Body = `changed`
+	if again, _ := in.get(4); again.Response.Body != `out/4` {
+		t.Errorf(`changing a copy changed the record`)
+	}
+}
+
+func TestInspectorTruncatesBodies(t *testing.T) {
+
+	in := newInspector(`127.0.0.1:0`, nil)
+	in.bodyLimit = 4
+
+	record := recordExchange(in, `/`, `0123456789`, `ok`)
+
+	got, _ := in.get(record.ID)
+	if got.Request.Body != `0123` || got.Request.Size != 10 || !got.Request.Truncated {
+		t.Errorf(`request recorded as '%s', %d bytes, truncated %t`, got.Request.Body, got.Request.Size, got.Request.Truncated)
+	}
+	if got.Response.Truncated {
+		t.Errorf(`short response recorded as truncated`)
+	}
+
+	if _, err := in.replay(got); err == nil {
+		t.Errorf(`replayed a request whose body was truncated`)
+	}
+}
+
+func TestInspectorReplay(t *testing.T) {
+
+	target, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer target.Close()
+
+	received := make(chan *http.Request, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		received <- req
+
+		io.WriteString(conn, "HTTP/1.1 201 Created\r\nContent-Length: 7\r\n\r\nagain: ")
+	}()
+
+	in := newInspector(`127.0.0.1:0`, func() (net.Conn, error) { return net.Dial(`tcp`, target.Addr().String()) })
+
+	req := httptest.NewRequest(http.MethodPost, `/hook?x=1`, strings.NewReader(`payload`))
+	req.Host = `app.example.com`
+	req.Header.Set(`X-Signature`, `abc`)
+	original := in.begin(req, `203.0.113.7:4321`, 0)
+	io.ReadAll(req.Body)
+
+	copied, _ := in.get(original.ID)
+	replayed, err := in.replay(copied)
+	if err != nil {
+		t.Fatalf(`could not replay: %s`, err.Error())
+	}
+
+	got := <-received
+	body, _ := io.ReadAll(got.Body)
+	if got.Method != http.MethodPost || got.RequestURI != `/hook?x=1` || got.Host != `app.example.com` || got.Header.Get(`X-Signature`) != `abc` || string(body) != `payload` {
+		t.Errorf(`target received %s %s for %s with %v and '%s'`, got.Method, got.RequestURI, got.Host, got.Header, body)
+	}
+
+	if replayed.Replayed != original.ID || replayed.Remote != `replay` || replayed.Response == nil || replayed.Response.Status != http.StatusCreated {
+		t.Errorf(`replay recorded as %+v`, replayed)
+	}
+	if records := in.snapshot(); len(records) != 2 || records[0].ID != replayed.ID {
+		t.Errorf(`replay is not the newest record`)
+	}
+}
+
+func TestInspectorRefusesOtherSites(t *testing.T) {
+
+	in := newInspector(`127.0.0.1:0`, func() (net.Conn, error) { return nil, io.EOF })
+	if err := in.listen(); err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer in.listener.Close()
+	go in.serve()
+
+	_, port, _ := net.SplitHostPort(in.listener.Addr().String())
+	local := `127.0.0.1:` + port
+
+	recordExchange(in, `/`, `secret`, `ok`)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		host       string
+		origin     string
+		wantStatus int
+	}{
+		{`list`, http.MethodGet, `/api/requests`, local, ``, http.StatusOK},
+		{`list as localhost`, http.MethodGet, `/api/requests`, `localhost:` + port, ``, http.StatusOK},
+		{`list over IPv6 loopback`, http.MethodGet, `/api/requests`, `[::1]:` + port, ``, http.StatusOK},
+		{`page`, http.MethodGet, `/`, local, ``, http.StatusOK},
+		{`list after DNS rebinding`, http.MethodGet, `/api/requests`, `attacker.example:` + port, ``, http.StatusForbidden},
+		{`list on another port`, http.MethodGet, `/api/requests`, `127.0.0.1:1`, ``, http.StatusForbidden},
+		{`list without port`, http.MethodGet, `/api/requests`, `127.0.0.1`, ``, http.StatusForbidden},
+		{`replay from the page`, http.MethodPost, `/api/requests/1/replay`, local, `http://` + local, http.StatusConflict},
+		{`replay from another site`, http.MethodPost, `/api/requests/1/replay`, local, `https://attacker.example`, http.StatusForbidden},
+		{`replay from an opaque origin`, http.MethodPost, `/api/requests/1/replay`, local, `null`, http.StatusForbidden},
+		{`replay without origin`, http.MethodPost, `/api/requests/1/replay`, local, ``, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req, _ := http.NewRequest(tt.method, `http://`+in.listener.Addr().String()+tt.path, nil)
+			req.Host = tt.host
+			if tt.origin != `` {
+				req.Header.Set(`Origin`, tt.origin)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf(`request failed: %s`, err.Error())
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf(`got %d '%s', want %d`, resp.StatusCode, strings.TrimSpace(string(body)), tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusForbidden && strings.Contains(string(body), `secret`) {
+				t.Errorf(`refusal carries the recorded exchange`)
+			}
+		})
+	}
+}
+
+func TestInspectorServesRecords(t *testing.T) {
+
+	in := newInspector(`127.0.0.1:0`, nil)
+	record := recordExchange(in, `/hello`, `hi`, `there`)
+
+	rw := httptest.NewRecorder()
+	in.handleRequest(rw, httptest.NewRequest(http.MethodGet, `/api/requests/1`, nil))
+
+	got := exchangeRecord{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+		t.Fatalf(`invalid record: %s`, err.Error())
+	}
+	if got.ID != record.ID || got.Request.URL != `/hello` || got.Response.Body != `there` {
+		t.Errorf(`served %+v`, got)
+	}
+
+	for _, path := range []string{`/api/requests/2`, `/api/requests/one`} {
+		rw := httptest.NewRecorder()
+		in.handleRequest(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf(`%s returned %d`, path, rw.Code)
+		}
+	}
+}
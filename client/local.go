@@ -0,0 +1,124 @@
+package client
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// Kinds of proxies that a local listener may speak to learn the destination of each connection.
+const (
+	proxySocks5 = `socks5`
+	proxyHttp   = `http`
+)
+
+// local listens on the client machine and carries each accepted connection through the server to a remote
+// destination that the server dials on the client's behalf. The destination is either fixed, or requested per
+// connection through a proxy protocol.
+type local struct {
+	address  string
+	remote   string
+	proxy    string
+	listener net.Listener
+}
+
+// listenLocals opens the listener of every local forward. If any of them fails, those already opened are closed.
+// Must be called with c.mu held.
+func (c *client) listenLocals() error {
+
+	for i, l := range c.locals {
+		network, address, err := shared.ParseAddress(l.address)
+		if err == nil {
+			l.listener, err = net.Listen(network, address)
+		}
+		if err != nil {
+			for _, opened := range c.locals[:i] {
+				opened.listener.Close()
+			}
+			return errors.Wrapf(err, `could not listen on %s`, l.address)
+		}
+		if l.proxy != `` {
+			c.logger.Printf(`serving %s proxy on %s through the server`, l.proxy, l.listener.Addr().String())
+		} else {
+			c.logger.Printf(`forwarding %s to %s through the server`, l.listener.Addr().String(), l.remote)
+		}
+	}
+
+	return nil
+}
+
+// serveLocal accepts connections on l until its listener is closed.
+func (c *client) serveLocal(l *local) {
+
+	defer c.wg.Done()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if !c.connections.add(conn) {
+			continue
+		}
+
+		c.wg.Add(1)
+		switch l.proxy {
+		case proxySocks5:
+			go c.serveSocks5(conn)
+		case proxyHttp:
+			go c.serveHttpProxy(conn)
+		default:
+			go c.dialRemote(conn, l.remote)
+		}
+	}
+}
+
+// dialRemote asks the server to dial remote and joins the resulting connection with conn.
+func (c *client) dialRemote(conn net.Conn, remote string) {
+
+	defer c.wg.Done()
+	defer c.connections.remove(conn)
+
+	upgraded, err := c.dialThrough(remote)
+	if err != nil {
+		c.logger.Printf(`could not reach %s for connection from %s: %s`, remote, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	if !c.connections.add(upgraded) {
+		conn.Close()
+		return
+	}
+	defer c.connections.remove(upgraded)
+
+	shared.Join(conn, upgraded)
+}
+
+// dialThrough asks the server to dial remote and returns the upgraded connection that leads to it.
+func (c *client) dialThrough(remote string) (net.Conn, error) {
+
+	header := http.Header{}
+	header.Set(shared.HeaderAction, shared.ActionDial)
+	header.Set(shared.HeaderTarget, remote)
+	if c.compression {
+		shared.NewHandshake(shared.CapabilityCompression).Write(header)
+	} else {
+		shared.NewHandshake().Write(header)
+	}
+
+	upgraded, response, err := c.upgrade(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if grantsCompression(response) {
+		upgraded = shared.NewCompressedConn(upgraded)
+	}
+
+	return upgraded, nil
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// NTLM proxy authentication, as specified in [MS-NLMP]. Only NTLMv2 responses are sent; the older LM and NTLMv1
+// responses are not supported.
+
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNtlm             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiate56               = 0x80000000
+
+	ntlmFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNtlm | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSecurity | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiateMessage returns the first message of the exchange, which announces the capabilities of the client.
+func ntlmNegotiateMessage() []byte {
+
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmFlags)
+	// the domain and workstation fields at 16 and 24 are left empty
+
+	return message
+}
+
+// ntlmAuthenticateMessage answers the challenge message sent by the proxy with an NTLMv2 response computed from the
+// credentials.
+func ntlmAuthenticateMessage(challengeMessage []byte, domain, username, password string) ([]byte, error) {
+
+	if len(challengeMessage) < 32 || !bytes.Equal(challengeMessage[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challengeMessage[8:]) != 2 {
+		return nil, errors.New(`invalid NTLM challenge`)
+	}
+
+	serverChallenge := challengeMessage[24:32]
+
+	var targetInfo []byte
+	if len(challengeMessage) >= 48 {
+		length := int(binary.LittleEndian.Uint16(challengeMessage[40:]))
+		offset := int(binary.LittleEndian.Uint32(challengeMessage[44:]))
+		if offset+length > len(challengeMessage) {
+			return nil, errors.New(`invalid NTLM challenge`)
+		}
+		targetInfo = challengeMessage[offset : offset+length]
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, errors.Wrap(err, `could not generate NTLM client challenge`)
+	}
+
+	ntResponse, lmResponse := ntlmV2Responses(domain, username, password, serverChallenge, clientChallenge, ntlmTimestamp(time.Now()), targetInfo)
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		utf16le(domain),
+		utf16le(username),
+		nil, // workstation
+		nil, // session key
+	}
+
+	message := make([]byte, 64)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 3)
+
+	offset := len(message)
+	for i, field := range fields {
+		header := message[12+8*i:]
+		binary.LittleEndian.PutUint16(header, uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(offset))
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(message[60:], ntlmFlags)
+
+	for _, field := range fields {
+		message = append(message, field...)
+	}
+
+	return message, nil
+}
+
+// ntlmV2Responses computes the NTLMv2 and LMv2 responses to a server challenge.
+func ntlmV2Responses(domain, username, password string, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (ntResponse, lmResponse []byte) {
+
+	responseKey := ntowfV2(domain, username, password)
+
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	proof := hmacMd5(responseKey, append(append([]byte{}, serverChallenge...), blob...))
+	ntResponse = append(proof, blob...)
+
+	lmResponse = hmacMd5(responseKey, append(append([]byte{}, serverChallenge...), clientChallenge...))
+	lmResponse = append(lmResponse, clientChallenge...)
+
+	return ntResponse, lmResponse
+}
+
+// ntowfV2 derives the key with which NTLMv2 responses are computed from the credentials.
+func ntowfV2(domain, username, password string) []byte {
+
+	return hmacMd5(md4Sum(utf16le(password)), utf16le(strings.ToUpper(username)+domain))
+}
+
+// ntlmTimestamp returns t as tenths of microseconds since 1601, little-endian.
+func ntlmTimestamp(t time.Time) []byte {
+
+	const epochOffset = 116444736000000000 // from 1601 to 1970
+
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(t.UnixNano()/100)+epochOffset)
+
+	return timestamp
+}
+
+// splitDomain splits a username given as 'DOMAIN\user' or 'user@DOMAIN'.
+func splitDomain(username string) (domain, user string) {
+
+	if i := strings.Index(username, `\`); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+
+	if i := strings.LastIndex(username, `@`); i >= 0 {
+		return username[i+1:], username[:i]
+	}
+
+	return ``, username
+}
+
+func utf16le(s string) []byte {
+
+	encoded := utf16.Encode([]rune(s))
+
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+
+	return b
+}
+
+func hmacMd5(key, data []byte) []byte {
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// md4Sum returns the MD4 digest of data (RFC 1320), which NTLM requires and the standard library does not provide.
+func md4Sum(data []byte) []byte {
+
+	length := uint64(len(data)) * 8
+
+	message := append(append([]byte{}, data...), 0x80)
+	for len(message)%64 != 56 {
+		message = append(message, 0)
+	}
+	message = binary.LittleEndian.AppendUint64(message, length)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	x := make([]uint32, 16)
+	for block := 0; block < len(message); block += 64 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(message[block+4*i:])
+		}
+
+		aa, bb, cc, dd := a, b, c, d
+
+		round1 := func(a, b, c, d uint32, k int, s int) uint32 {
+			return bits.RotateLeft32(a+((b&c)|(^b&d))+x[k], s)
+		}
+		round2 := func(a, b, c, d uint32, k int, s int) uint32 {
+			return bits.RotateLeft32(a+((b&c)|(b&d)|(c&d))+x[k]+0x5a827999, s)
+		}
+		round3 := func(a, b, c, d uint32, k int, s int) uint32 {
+			return bits.RotateLeft32(a+(b^c^d)+x[k]+0x6ed9eba1, s)
+		}
+
+		for _, k := range []int{0, 4, 8, 12} {
+			a = round1(a, b, c, d, k, 3)
+			d = round1(d, a, b, c, k+1, 7)
+			c = round1(c, d, a, b, k+2, 11)
+			b = round1(b, c, d, a, k+3, 19)
+		}
+		for _, k := range []int{0, 1, 2, 3} {
+			a = round2(a, b, c, d, k, 3)
+			d = round2(d, a, b, c, k+4, 5)
+			c = round2(c, d, a, b, k+8, 9)
+			b = round2(b, c, d, a, k+12, 13)
+		}
+		for _, k := range []int{0, 2, 1, 3} {
+			a = round3(a, b, c, d, k, 3)
+			d = round3(d, a, b, c, k+8, 9)
+			c = round3(c, d, a, b, k+4, 11)
+			b = round3(b, c, d, a, k+12, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	sum := make([]byte, 0, 16)
+	for _, v := range []uint32{a, b, c, d} {
+		sum = binary.LittleEndian.AppendUint32(sum, v)
+	}
+
+	return sum
+}
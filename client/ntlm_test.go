@@ -0,0 +1,247 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ` `, ``))
+	if err != nil {
+		t.Fatalf(`invalid hex '%s'`, s)
+	}
+
+	return b
+}
+
+// the example of [MS-NLMP] 4.2.4, whose target info names the domain 'Domain' and the server 'Server'
+const (
+	ntlmExampleDomain          = `Domain`
+	ntlmExampleUser            = `User`
+	ntlmExamplePassword        = `Password`
+	ntlmExampleServerChallenge = `0123456789abcdef`
+	ntlmExampleClientChallenge = `aaaaaaaaaaaaaaaa`
+	ntlmExampleTargetInfo      = `02000c0044006f006d00610069006e00 01000c005300650072007600650072000000 0000`
+)
+
+func TestMd4Sum(t *testing.T) {
+
+	// the test suite of RFC 1320
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{``, `31d6cfe0d16ae931b73c59d7e0c089c0`},
+		{`a`, `bde52cb31de33e46245e05fbdbd6fb24`},
+		{`abc`, `a448017aaf21d8525fc10ae87aa6729d`},
+		{`message digest`, `d9130a8164549fe818874806e1c7014b`},
+		{`abcdefghijklmnopqrstuvwxyz`, `d79e1c308aa5bbcdeea8ed63df412da9`},
+		{`ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789`, `043f8582f241db351ce627e153e7f0e4`},
+		{strings.Repeat(`1234567890`, 8), `e33b4ddc9c38f2199c3e7b164fcc0536`},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(md4Sum([]byte(tt.input))); got != tt.want {
+			t.Errorf(`md4Sum('%s') = %s, want %s`, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNtowfV2(t *testing.T) {
+
+	got := ntowfV2(ntlmExampleDomain, ntlmExampleUser, ntlmExamplePassword)
+	if want := mustHex(t, `0c868a403bfd7a93a3001ef22ef02e3f`); !bytes.Equal(got, want) {
+		t.Errorf(`ntowfV2 = %x, want %x`, got, want)
+	}
+}
+
+func TestNtlmV2Responses(t *testing.T) {
+
+	ntResponse, lmResponse := ntlmV2Responses(
+		ntlmExampleDomain, ntlmExampleUser, ntlmExamplePassword,
+		mustHex(t, ntlmExampleServerChallenge),
+		mustHex(t, ntlmExampleClientChallenge),
+		make([]byte, 8), // the example is computed at time zero
+		mustHex(t, ntlmExampleTargetInfo),
+	)
+
+	wantNt := mustHex(t, `68cd0ab851e51c96aabc927bebef6a1c`+ // NTProofStr
+		`0101000000000000 0000000000000000 aaaaaaaaaaaaaaaa 00000000`+
+		ntlmExampleTargetInfo+`00000000`)
+	if !bytes.Equal(ntResponse, wantNt) {
+		t.Errorf("NTLMv2 response\n got %x\nwant %x", ntResponse, wantNt)
+	}
+
+	wantLm := mustHex(t, `86c35097ac9cec102554764a57cccc19 aaaaaaaaaaaaaaaa`)
+	if !bytes.Equal(lmResponse, wantLm) {
+		t.Errorf("LMv2 response\n got %x\nwant %x", lmResponse, wantLm)
+	}
+}
+
+// ntlmChallengeMessage returns a challenge message as a proxy sends it, with targetInfo at its end.
+func ntlmChallengeMessage(serverChallenge, targetInfo []byte) []byte {
+
+	message := make([]byte, 48)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[20:], ntlmFlags)
+	copy(message[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(message[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(message[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(message[44:], uint32(len(message)))
+
+	return append(message, targetInfo...)
+}
+
+// ntlmField returns the field of an authenticate message whose header is at offset.
+func ntlmField(t *testing.T, message []byte, offset int) []byte {
+
+	t.Helper()
+
+	length := int(binary.LittleEndian.Uint16(message[offset:]))
+	start := int(binary.LittleEndian.Uint32(message[offset+4:]))
+	if start+length > len(message) {
+		t.Fatalf(`field at %d runs past the end of the message`, offset)
+	}
+
+	return message[start : start+length]
+}
+
+// verifyNtlmAuthenticate checks that an authenticate message answers serverChallenge with the given credentials.
+func verifyNtlmAuthenticate(t *testing.T, message []byte, serverChallenge, targetInfo []byte, domain, user, password string) bool {
+
+	t.Helper()
+
+	if len(message) < 64 || !bytes.Equal(message[:8], ntlmSignature) || binary.LittleEndian.Uint32(message[8:]) != 3 {
+		t.Errorf(`not an authenticate message: %x`, message)
+		return false
+	}
+
+	lmResponse := ntlmField(t, message, 12)
+	ntResponse := ntlmField(t, message, 20)
+	if got := ntlmField(t, message, 28); !bytes.Equal(got, utf16le(domain)) {
+		t.Errorf(`domain is %x, want %x`, got, utf16le(domain))
+	}
+	if got := ntlmField(t, message, 36); !bytes.Equal(got, utf16le(user)) {
+		t.Errorf(`user is %x, want %x`, got, utf16le(user))
+	}
+	if len(ntResponse) < 16+28 {
+		t.Errorf(`NTLMv2 response is only %d bytes`, len(ntResponse))
+		return false
+	}
+
+	// the blob after the proof carries the timestamp and client challenge that the client chose
+	blob := ntResponse[16:]
+	wantNt, wantLm := ntlmV2Responses(domain, user, password, serverChallenge, blob[16:24], blob[8:16], targetInfo)
+
+	return bytes.Equal(ntResponse, wantNt) && bytes.Equal(lmResponse, wantLm)
+}
+
+func TestNtlmAuthenticateMessage(t *testing.T) {
+
+	serverChallenge := mustHex(t, ntlmExampleServerChallenge)
+	targetInfo := mustHex(t, ntlmExampleTargetInfo)
+
+	message, err := ntlmAuthenticateMessage(ntlmChallengeMessage(serverChallenge, targetInfo), `Domain`, `User`, `Password`)
+	if err != nil {
+		t.Fatalf(`ntlmAuthenticateMessage: %s`, err.Error())
+	}
+
+	if !verifyNtlmAuthenticate(t, message, serverChallenge, targetInfo, `Domain`, `User`, `Password`) {
+		t.Errorf(`responses do not match the credentials`)
+	}
+	if verifyNtlmAuthenticate(t, message, serverChallenge, targetInfo, `Domain`, `User`, `password`) {
+		t.Errorf(`responses match the wrong password`)
+	}
+	if got := binary.LittleEndian.Uint32(message[60:]); got != ntlmFlags {
+		t.Errorf(`flags are %08x, want %08x`, got, uint32(ntlmFlags))
+	}
+}
+
+func TestNtlmAuthenticateMessageRejects(t *testing.T) {
+
+	valid := ntlmChallengeMessage(mustHex(t, ntlmExampleServerChallenge), mustHex(t, ntlmExampleTargetInfo))
+
+	tests := []struct {
+		name    string
+		message func() []byte
+	}{
+		{`empty`, func() []byte { return nil }},
+		{`truncated`, func() []byte { return valid[:31] }},
+		{`wrong signature`, func() []byte {
+			m := append([]byte{}, valid...)
+			m[0] = 'X'
+			return m
+		}},
+		{`negotiate message`, func() []byte { return ntlmNegotiateMessage() }},
+		{`target info out of range`, func() []byte { return valid[:len(valid)-1] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if _, err := ntlmAuthenticateMessage(tt.message(), `Domain`, `User`, `Password`); err == nil || err.Error() != `invalid NTLM challenge` {
+				t.Errorf(`returned %v, want invalid NTLM challenge`, err)
+			}
+		})
+	}
+}
+
+func TestNtlmNegotiateMessage(t *testing.T) {
+
+	message := ntlmNegotiateMessage()
+
+	want := append(append([]byte{}, ntlmSignature...), 1, 0, 0, 0)
+	want = binary.LittleEndian.AppendUint32(want, ntlmFlags)
+	want = append(want, make([]byte, 16)...)
+
+	if !bytes.Equal(message, want) {
+		t.Errorf("negotiate message\n got %x\nwant %x", message, want)
+	}
+}
+
+func TestNtlmTimestamp(t *testing.T) {
+
+	tests := []struct {
+		time time.Time
+		want uint64
+	}{
+		{time.Unix(0, 0), 116444736000000000},
+		{time.Unix(1, 500), 116444736010000005},
+	}
+
+	for _, tt := range tests {
+		if got := binary.LittleEndian.Uint64(ntlmTimestamp(tt.time)); got != tt.want {
+			t.Errorf(`ntlmTimestamp(%s) = %d, want %d`, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestSplitDomain(t *testing.T) {
+
+	tests := []struct {
+		username   string
+		wantDomain string
+		wantUser   string
+	}{
+		{`user`, ``, `user`},
+		{`DOMAIN\user`, `DOMAIN`, `user`},
+		{`user@example.com`, `example.com`, `user`},
+		{`first@last@example.com`, `example.com`, `first@last`},
+		{`DOMAIN\user@example.com`, `DOMAIN`, `user@example.com`},
+	}
+
+	for _, tt := range tests {
+		domain, user := splitDomain(tt.username)
+		if domain != tt.wantDomain || user != tt.wantUser {
+			t.Errorf(`splitDomain('%s') = '%s', '%s', want '%s', '%s'`, tt.username, domain, user, tt.wantDomain, tt.wantUser)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// openPoll starts a long-poll session on the server with a request that carries the given headers. Data to the
+// server is posted to the session, and data from it is fetched with long polls, all as ordinary HTTP/1.1 requests.
+func (c *client) openPoll(header http.Header) (net.Conn, http.Header, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+	defer cancel()
+
+	header.Set(shared.HeaderTransport, shared.TransportPoll)
+
+	resp, err := c.pollExchange(ctx, &pollRequest{method: http.MethodPost, header: header})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, `could not start poll session`)
+	}
+
+	if resp.status != http.StatusOK {
+		return nil, nil, resp.refusal(`server refused poll session`)
+	}
+
+	id := resp.header.Get(shared.HeaderSession)
+	if id == `` {
+		return nil, nil, errors.New(`server did not start a poll session`)
+	}
+
+	session := newPollSession(c, id)
+	go session.poll()
+
+	conn := shared.NewStreamConn(session.reader, session, session.closeWrite, session.close, nil, c.serverAddr(shared.TransportPoll))
+
+	return conn, resp.header, nil
+}
+
+// pollSession is the client side of a long-poll session.
+type pollSession struct {
+	c  *client
+	id string
+
+	// data fetched by polls, for the connection to read, and how much of it has been received
+	reader   *io.PipeReader
+	writer   *io.PipeWriter
+	received int64
+
+	// how much data has been posted; writeMutex keeps posts in order, one at a time
+	sent       int64
+	writeMutex *sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   *sync.Once
+}
+
+func newPollSession(c *client, id string) *pollSession {
+
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &pollSession{
+		c:          c,
+		id:         id,
+		reader:     reader,
+		writer:     writer,
+		writeMutex: &sync.Mutex{},
+		ctx:        ctx,
+		cancel:     cancel,
+		once:       &sync.Once{},
+	}
+}
+
+// poll fetches data from the server until it is done sending or the session is closed. Every poll acknowledges what
+// has been received, so the server repeats a response that did not arrive in full.
+func (ps *pollSession) poll() {
+
+	for {
+		header := http.Header{}
+		header.Set(shared.HeaderAck, strconv.FormatInt(ps.received, 10))
+
+		resp, err := ps.send(ps.ctx, http.MethodGet, header, nil)
+		if err != nil {
+			ps.writer.CloseWithError(err)
+			return
+		}
+
+		switch resp.status {
+		case http.StatusOK, http.StatusNoContent:
+		default:
+			ps.writer.CloseWithError(resp.refusal(`server refused poll`))
+			return
+		}
+
+		data, err := ps.unseen(resp)
+		if err != nil {
+			ps.writer.CloseWithError(err)
+			return
+		}
+
+		if len(data) > 0 {
+			if _, err := ps.writer.Write(data); err != nil {
+				return
+			}
+			ps.received += int64(len(data))
+		}
+
+		if resp.header.Get(shared.HeaderEof) != `` {
+			ps.writer.Close()
+			return
+		}
+	}
+}
+
+// unseen returns the data of a poll's response that has not been received before.
+func (ps *pollSession) unseen(resp *pollResponse) ([]byte, error) {
+
+	value := resp.header.Get(shared.HeaderSequence)
+	if value == `` {
+		return resp.data, nil
+	}
+
+	sequence, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sequence < 0 || sequence > ps.received {
+		return nil, errors.Errorf(`poll response is out of sequence (got '%s', expected %d)`, value, ps.received)
+	}
+
+	if skip := ps.received - sequence; skip < int64(len(resp.data)) {
+		return resp.data[skip:], nil
+	}
+
+	return nil, nil
+}
+
+// Write posts b to the session.
+func (ps *pollSession) Write(b []byte) (int, error) {
+
+	ps.writeMutex.Lock()
+	defer ps.writeMutex.Unlock()
+
+	header := http.Header{}
+	header.Set(shared.HeaderSequence, strconv.FormatInt(ps.sent, 10))
+
+	resp, err := ps.send(ps.ctx, http.MethodPost, header, b)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.status != http.StatusOK && resp.status != http.StatusNoContent {
+		return 0, resp.refusal(`server refused data`)
+	}
+
+	ps.sent += int64(len(b))
+
+	return len(b), nil
+}
+
+// closeWrite tells the server that the client is done sending.
+func (ps *pollSession) closeWrite() error {
+
+	ps.writeMutex.Lock()
+	defer ps.writeMutex.Unlock()
+
+	header := http.Header{}
+	header.Set(shared.HeaderSequence, strconv.FormatInt(ps.sent, 10))
+	header.Set(shared.HeaderEof, `1`)
+
+	_, err := ps.send(ps.ctx, http.MethodPost, header, nil)
+
+	return err
+}
+
+// close ends the session on the server and stops polling.
+func (ps *pollSession) close() error {
+
+	ps.once.Do(func() {
+		ps.cancel()
+		ps.reader.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), defaultPollCloseTimeout)
+		defer cancel()
+
+		ps.send(ctx, http.MethodDelete, http.Header{}, nil)
+	})
+
+	return nil
+}
+
+// send makes a request of the session with the given method, headers and data. Since the positions in the headers make
+// every request safe to repeat, one that fails on the way to the server or back, e.g. because a proxy cut it off, is
+// repeated a few times before giving up.
+func (ps *pollSession) send(ctx context.Context, method string, header http.Header, data []byte) (*pollResponse, error) {
+
+	for attempt := 1; ; attempt++ {
+		resp, err := ps.c.pollExchange(ctx, &pollRequest{method: method, session: ps.id, header: header, data: data})
+		if err == nil && !pollRetryable(resp.status) {
+			return resp, nil
+		}
+
+		if attempt == maxPollAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+
+		if err == nil {
+			err = resp.refusal(`proxy failed`)
+		}
+		ps.c.logger.Printf(`poll session %s: repeating %s: %s`, ps.id, method, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(defaultPollRetryInterval):
+		}
+	}
+}
+
+// pollRetryable reports whether a response with the given status is from a proxy that failed to pass on a request.
+func pollRetryable(status int) bool {
+
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// pollRequest is a request of the long-poll transport: a handshake if session is empty, or else a request of that
+// session.
+type pollRequest struct {
+	method  string
+	session string
+	header  http.Header
+	data    []byte
+}
+
+// pollResponse is the answer to a pollRequest. data holds the error message if the request was refused.
+type pollResponse struct {
+	status int
+	header http.Header
+	data   []byte
+}
+
+// refusal returns a refusedError that describes the response.
+func (pr *pollResponse) refusal(message string) error {
+
+	return &refusedError{
+		status:  pr.status,
+		message: fmt.Sprintf(`%s: %d %s: %s`, message, pr.status, http.StatusText(pr.status), strings.TrimSpace(string(pr.data))),
+	}
+}
+
+// pollExchange sends preq to the server, as is or disguised as a JSON API call, and returns the answer.
+func (c *client) pollExchange(ctx context.Context, preq *pollRequest) (*pollResponse, error) {
+
+	if c.disguisePath != `` {
+		return c.pollExchangeDisguised(ctx, preq)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, preq.method, c.serverURL.String(), bytes.NewReader(preq.data))
+	if err != nil {
+		return nil, errors.Wrap(err, `could not create poll request`)
+	}
+
+	for key, values := range preq.header {
+		req.Header[key] = values
+	}
+	if preq.session != `` {
+		req.Header.Set(shared.HeaderSession, preq.session)
+	}
+	req.Header.Set(`Content-Type`, `application/octet-stream`)
+
+	resp, err := c.requests.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPollResponse))
+	if err != nil {
+		return nil, errors.Wrap(err, `could not read poll response`)
+	}
+
+	return &pollResponse{status: resp.StatusCode, header: resp.Header, data: data}, nil
+}
+
+// pollExchangeDisguised sends preq to the server as a JSON request under the disguise path, with the headers a browser
+// would send, and decodes the JSON answer.
+func (c *client) pollExchangeDisguised(ctx context.Context, preq *pollRequest) (*pollResponse, error) {
+
+	u := *c.serverURL
+	u.Path = strings.TrimSuffix(u.Path, `/`) + c.disguisePath + shared.DisguiseSessionsPath
+	if preq.session != `` {
+		u.Path += `/` + preq.session
+		if preq.method != http.MethodDelete {
+			u.Path += shared.DisguiseMessagesPath
+		}
+	}
+
+	if ack := preq.header.Get(shared.HeaderAck); ack != `` {
+		u.RawQuery = url.Values{shared.DisguiseAckParameter: {ack}}.Encode()
+	}
+
+	var body io.Reader
+	if preq.method == http.MethodPost {
+		// the server knows the transport from the path, and the end of data is marked by Done
+		attributes := shared.DisguiseAttributes(preq.header)
+		delete(attributes, `transport`)
+		delete(attributes, `eof`)
+		delete(attributes, `ack`)
+
+		encoded, _ := json.Marshal(&shared.DisguisedRequest{
+			Attributes: attributes,
+			Payload:    preq.data,
+			Done:       preq.header.Get(shared.HeaderEof) != ``,
+			Nonce:      shared.DisguisePadding(),
+		})
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, preq.method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, `could not create request`)
+	}
+
+	host := u.Host
+	if c.disguiseHost != `` {
+		host = c.disguiseHost
+		req.Host = host
+	}
+	origin := u.Scheme + `://` + host
+
+	req.Header.Set(`User-Agent`, disguiseUserAgent)
+	req.Header.Set(`Accept`, `application/json, text/plain, */*`)
+	req.Header.Set(`Accept-Language`, `en-US,en;q=0.9`)
+	req.Header.Set(`Origin`, origin)
+	req.Header.Set(`Referer`, origin+`/`)
+	if body != nil {
+		req.Header.Set(`Content-Type`, `application/json`)
+	}
+
+	resp, err := c.requests.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	decoded := &shared.DisguisedResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDisguisedResponse)).Decode(decoded); err != nil {
+		if resp.StatusCode < http.StatusMultipleChoices {
+			// cut off on the way
+			return nil, errors.Wrap(err, `could not read response`)
+		}
+		// not from an httptun server, e.g. a proxy's error page
+		return &pollResponse{status: resp.StatusCode, header: http.Header{}, data: []byte(resp.Status)}, nil
+	}
+
+	header := shared.UndisguiseAttributes(decoded.Attributes)
+	if decoded.Done {
+		header.Set(shared.HeaderEof, `1`)
+	}
+
+	data := decoded.Payload
+	if decoded.Error != `` {
+		data = []byte(decoded.Error)
+	}
+
+	return &pollResponse{status: resp.StatusCode, header: header, data: data}, nil
+}
+
+// newHttpClient returns a client for ordinary HTTP requests to the server. It goes through the proxy, if there is one,
+// as any other HTTP client would.
+func (c *client) newHttpClient() *http.Client {
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyURL(c.proxyURL),
+		TLSClientConfig:     c.tlsConfig,
+		DialContext:         (&net.Dialer{Timeout: defaultDialTimeout}).DialContext,
+		TLSHandshakeTimeout: defaultDialTimeout,
+		MaxIdleConnsPerHost: 8,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		// long polls are held by the server for well under this
+		Timeout: defaultPollTimeout,
+	}
+}
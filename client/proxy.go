@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// resolveProxy determines the proxy through which to reach the server, unless one was configured explicitly: the
+// HTTPS_PROXY or HTTP_PROXY environment variable, depending on the scheme of the server URL, unless NO_PROXY excludes
+// the server. Connections to localhost never use a proxy from the environment.
+func (c *client) resolveProxy() error {
+
+	if c.proxyURL != nil || c.noProxy {
+		return nil
+	}
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: c.serverURL})
+	if err != nil {
+		return errors.Wrap(err, `invalid proxy in environment`)
+	}
+
+	c.proxyURL = proxyURL
+
+	return nil
+}
+
+// dialProxy connects to address through the proxy with a CONNECT request, authenticating to the proxy if it asks for
+// credentials and the proxy URL carries them.
+func (c *client) dialProxy(address string) (net.Conn, error) {
+
+	conn, reader, resp, err := c.proxyConnect(nil, nil, address, ``)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		conn, reader, resp, err = c.proxyAuthenticate(conn, reader, resp, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &refusedError{
+			status:  resp.StatusCode,
+			message: fmt.Sprintf(`proxy refused to connect to %s: %s`, address, resp.Status),
+		}
+	}
+
+	return shared.NewBufferedConn(conn, reader), nil
+}
+
+// proxyConnect sends a CONNECT request for address with the given Proxy-Authorization, if any, on conn, or on a new
+// connection to the proxy if conn is nil, and reads the response. The body of a response that refuses the request
+// is discarded so that the connection can be reused.
+func (c *client) proxyConnect(conn net.Conn, reader *bufio.Reader, address, authorization string) (net.Conn, *bufio.Reader, *http.Response, error) {
+
+	if conn == nil {
+		var err error
+		if conn, err = c.dialProxyServer(); err != nil {
+			return nil, nil, nil, err
+		}
+		reader = bufio.NewReader(conn)
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Opaque: address},
+		Host:       address,
+		Proto:      `HTTP/1.1`,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	if authorization != `` {
+		req.Header.Set(`Proxy-Authorization`, authorization)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, errors.Wrap(err, `could not send request to proxy`)
+	}
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, errors.Wrap(err, `could not read response from proxy`)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	return conn, reader, resp, nil
+}
+
+// proxyAuthenticate answers a 407 response from the proxy with the credentials of the proxy URL, using NTLM if the
+// proxy offers it, either on its own or inside Negotiate, or else Basic. Kerberos is not supported.
+func (c *client) proxyAuthenticate(conn net.Conn, reader *bufio.Reader, resp *http.Response, address string) (net.Conn, *bufio.Reader, *http.Response, error) {
+
+	if c.proxyURL.User == nil {
+		conn.Close()
+		return nil, nil, nil, errors.New(`proxy requires authentication, but the proxy URL has no credentials`)
+	}
+
+	username := c.proxyURL.User.Username()
+	password, _ := c.proxyURL.User.Password()
+
+	offered := map[string]bool{}
+	for _, challenge := range resp.Header.Values(`Proxy-Authenticate`) {
+		scheme := strings.Fields(challenge + ` `)[0]
+		offered[strings.ToLower(scheme)] = true
+	}
+
+	// a connection that the proxy closes after refusing the request cannot be reused
+	if resp.Close {
+		conn.Close()
+		conn, reader = nil, nil
+	}
+
+	switch {
+	case offered[`ntlm`] || offered[`negotiate`]:
+		scheme := `NTLM`
+		if !offered[`ntlm`] {
+			// proxies that offer Negotiate generally accept NTLM tokens in it when Kerberos is not available
+			scheme = `Negotiate`
+		}
+
+		conn, reader, resp, err := c.proxyConnect(conn, reader, address, scheme+` `+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			return conn, reader, resp, nil
+		}
+		if resp.Close {
+			conn.Close()
+			return nil, nil, nil, errors.New(`proxy closed the connection during NTLM authentication`)
+		}
+
+		var challenge []byte
+		for _, value := range resp.Header.Values(`Proxy-Authenticate`) {
+			if strings.HasPrefix(strings.ToLower(value), strings.ToLower(scheme)+` `) {
+				challenge, _ = base64.StdEncoding.DecodeString(strings.TrimSpace(value[len(scheme)+1:]))
+			}
+		}
+		if challenge == nil {
+			conn.Close()
+			return nil, nil, nil, errors.Errorf(`proxy did not send an NTLM challenge (offered %s)`, strings.Join(resp.Header.Values(`Proxy-Authenticate`), `, `))
+		}
+
+		domain, user := splitDomain(username)
+		message, err := ntlmAuthenticateMessage(challenge, domain, user, password)
+		if err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+
+		return c.proxyConnect(conn, reader, address, scheme+` `+base64.StdEncoding.EncodeToString(message))
+
+	case offered[`basic`]:
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + `:` + password))
+		return c.proxyConnect(conn, reader, address, `Basic `+credentials)
+
+	default:
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, nil, nil, errors.Errorf(`proxy requires unsupported authentication (offered %s)`, strings.Join(resp.Header.Values(`Proxy-Authenticate`), `, `))
+	}
+}
+
+// dialProxyServer connects to the proxy itself, using TLS if the proxy URL calls for it.
+func (c *client) dialProxyServer() (net.Conn, error) {
+
+	host, port := c.proxyURL.Hostname(), c.proxyURL.Port()
+	if port == `` {
+		port = `80`
+		if c.proxyURL.Scheme == `https` {
+			port = `443`
+		}
+	}
+	address := net.JoinHostPort(host, port)
+
+	dialer := &net.Dialer{Timeout: defaultDialTimeout}
+
+	if c.proxyURL.Scheme != `https` {
+		conn, err := dialer.Dial(`tcp`, address)
+		if err != nil {
+			return nil, errors.Wrapf(err, `could not connect to proxy %s`, address)
+		}
+		return conn, nil
+	}
+
+	conn, err := tls.DialWithDialer(dialer, `tcp`, address, &tls.Config{ServerName: host})
+	if err != nil {
+		return nil, errors.Wrapf(err, `could not connect to proxy %s`, address)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,344 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const proxyTestAddress = `tunnel.example.com:443`
+
+// fakeProxy answers CONNECT requests with respond, which is given every request in turn. Once it answers 200, the
+// connection echoes whatever the client sends.
+type fakeProxy struct {
+	listener net.Listener
+	respond  func(req *http.Request) *http.Response
+
+	mutex       *sync.Mutex
+	requests    []*http.Request
+	connections int
+}
+
+func newFakeProxy(t *testing.T, respond func(req *http.Request) *http.Response) *fakeProxy {
+
+	t.Helper()
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	p := &fakeProxy{listener: listener, respond: respond, mutex: &sync.Mutex{}}
+	go p.serve()
+
+	return p
+}
+
+func (p *fakeProxy) serve() {
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		p.connections++
+		p.mutex.Unlock()
+
+		go p.handle(conn)
+	}
+}
+
+func (p *fakeProxy) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		p.requests = append(p.requests, req)
+		resp := p.respond(req)
+		p.mutex.Unlock()
+
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Header.Set(`Content-Length`, `0`)
+		}
+		resp.Write(conn)
+
+		if resp.StatusCode == http.StatusOK {
+			io.Copy(conn, reader)
+			return
+		}
+		if resp.Close {
+			return
+		}
+	}
+}
+
+// authorizations returns the Proxy-Authorization of every request received so far.
+func (p *fakeProxy) authorizations() []string {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var authorizations []string
+	for _, req := range p.requests {
+		authorizations = append(authorizations, req.Header.Get(`Proxy-Authorization`))
+	}
+
+	return authorizations
+}
+
+func proxyResponse(status int, close bool, authenticate ...string) *http.Response {
+
+	resp := &http.Response{StatusCode: status, Header: http.Header{}, Close: close}
+	for _, value := range authenticate {
+		resp.Header.Add(`Proxy-Authenticate`, value)
+	}
+
+	return resp
+}
+
+// ntlmProxy returns a fakeProxy that demands NTLM, offered under scheme, and accepts only the given credentials. If
+// closeFirst, it closes the connection after the first refusal, as some proxies do.
+func ntlmProxy(t *testing.T, scheme string, closeFirst bool, domain, user, password string) *fakeProxy {
+
+	serverChallenge := mustHex(t, ntlmExampleServerChallenge)
+	targetInfo := mustHex(t, ntlmExampleTargetInfo)
+
+	return newFakeProxy(t, func(req *http.Request) *http.Response {
+
+		if req.Method != http.MethodConnect || req.Host != proxyTestAddress {
+			return proxyResponse(http.StatusBadRequest, true)
+		}
+
+		authorization := req.Header.Get(`Proxy-Authorization`)
+		if !strings.HasPrefix(authorization, scheme+` `) {
+			return proxyResponse(http.StatusProxyAuthRequired, closeFirst, `Basic realm="proxy"`, scheme)
+		}
+
+		message, err := base64.StdEncoding.DecodeString(authorization[len(scheme)+1:])
+		if err != nil || len(message) < 12 {
+			return proxyResponse(http.StatusBadRequest, true)
+		}
+
+		switch message[8] {
+		case 1:
+			challenge := ntlmChallengeMessage(serverChallenge, targetInfo)
+			return proxyResponse(http.StatusProxyAuthRequired, false, scheme+` `+base64.StdEncoding.EncodeToString(challenge))
+		case 3:
+			if verifyNtlmAuthenticate(t, message, serverChallenge, targetInfo, domain, user, password) {
+				return proxyResponse(http.StatusOK, false)
+			}
+		}
+
+		return proxyResponse(http.StatusProxyAuthRequired, true, scheme)
+	})
+}
+
+// basicProxy returns a fakeProxy that demands Basic authentication with the given credentials.
+func basicProxy(t *testing.T, username, password string) *fakeProxy {
+
+	want := `Basic ` + base64.StdEncoding.EncodeToString([]byte(username+`:`+password))
+
+	return newFakeProxy(t, func(req *http.Request) *http.Response {
+
+		if req.Header.Get(`Proxy-Authorization`) != want {
+			return proxyResponse(http.StatusProxyAuthRequired, false, `Basic realm="proxy"`)
+		}
+
+		return proxyResponse(http.StatusOK, false)
+	})
+}
+
+// dialThroughProxy creates a client that uses the proxy with the given credentials, which may be empty, and dials
+// proxyTestAddress through it.
+func dialThroughProxy(t *testing.T, p *fakeProxy, credentials string) (net.Conn, error) {
+
+	t.Helper()
+
+	if credentials != `` {
+		credentials += `@`
+	}
+
+	c, err := New(Proxy(`http://` + credentials + p.listener.Addr().String()))
+	if err != nil {
+		t.Fatalf(`could not create client: %s`, err.Error())
+	}
+
+	return c.(*client).dialProxy(proxyTestAddress)
+}
+
+// checkEcho checks that conn reaches the echoing end of a fakeProxy.
+func checkEcho(t *testing.T, conn net.Conn) {
+
+	t.Helper()
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`ping`)); err != nil {
+		t.Fatalf(`write: %s`, err.Error())
+	}
+
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != `ping` {
+		t.Errorf(`read '%s' (%v), want 'ping'`, got, err)
+	}
+}
+
+func TestDialProxyNtlm(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		scheme          string
+		closeFirst      bool
+		credentials     string
+		domain          string
+		user            string
+		wantConnections int
+	}{
+		{`NTLM`, `NTLM`, false, `user:secret`, ``, `user`, 1},
+		{`NTLM with domain`, `NTLM`, false, `EXAMPLE%5Cuser:secret`, `EXAMPLE`, `user`, 1},
+		{`NTLM with user principal name`, `NTLM`, false, `user%40example.com:secret`, `example.com`, `user`, 1},
+		{`NTLM inside Negotiate`, `Negotiate`, false, `user:secret`, ``, `user`, 1},
+		{`NTLM after the proxy closes the connection`, `NTLM`, true, `user:secret`, ``, `user`, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p := ntlmProxy(t, tt.scheme, tt.closeFirst, tt.domain, tt.user, `secret`)
+
+			conn, err := dialThroughProxy(t, p, tt.credentials)
+			if err != nil {
+				t.Fatalf(`dial: %s`, err.Error())
+			}
+			checkEcho(t, conn)
+
+			// without credentials, then the negotiate message, then the authenticate message
+			authorizations := p.authorizations()
+			if len(authorizations) != 3 || authorizations[0] != `` ||
+				!strings.HasPrefix(authorizations[1], tt.scheme+` `) || !strings.HasPrefix(authorizations[2], tt.scheme+` `) {
+				t.Errorf(`proxy received authorizations %q`, authorizations)
+			}
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			if p.connections != tt.wantConnections {
+				t.Errorf(`client opened %d connections to the proxy, want %d`, p.connections, tt.wantConnections)
+			}
+		})
+	}
+}
+
+func TestDialProxyBasic(t *testing.T) {
+
+	p := basicProxy(t, `user`, `p@ss:word`)
+
+	conn, err := dialThroughProxy(t, p, `user:p%40ss%3Aword`)
+	if err != nil {
+		t.Fatalf(`dial: %s`, err.Error())
+	}
+	checkEcho(t, conn)
+
+	if authorizations := p.authorizations(); len(authorizations) != 2 || authorizations[0] != `` {
+		t.Errorf(`proxy received authorizations %q`, authorizations)
+	}
+}
+
+func TestDialProxyWithoutAuthentication(t *testing.T) {
+
+	p := newFakeProxy(t, func(req *http.Request) *http.Response {
+		return proxyResponse(http.StatusOK, false)
+	})
+
+	conn, err := dialThroughProxy(t, p, ``)
+	if err != nil {
+		t.Fatalf(`dial: %s`, err.Error())
+	}
+	checkEcho(t, conn)
+}
+
+func TestDialProxyRefused(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		proxy       func(t *testing.T) *fakeProxy
+		credentials string
+		wantStatus  int
+		wantError   string
+	}{
+		{
+			name:        `wrong NTLM password`,
+			proxy:       func(t *testing.T) *fakeProxy { return ntlmProxy(t, `NTLM`, false, ``, `user`, `secret`) },
+			credentials: `user:wrong`,
+			wantStatus:  http.StatusProxyAuthRequired,
+		},
+		{
+			name:        `wrong Basic password`,
+			proxy:       func(t *testing.T) *fakeProxy { return basicProxy(t, `user`, `secret`) },
+			credentials: `user:wrong`,
+			wantStatus:  http.StatusProxyAuthRequired,
+		},
+		{
+			name:      `no credentials`,
+			proxy:     func(t *testing.T) *fakeProxy { return basicProxy(t, `user`, `secret`) },
+			wantError: `the proxy URL has no credentials`,
+		},
+		{
+			name: `unsupported scheme`,
+			proxy: func(t *testing.T) *fakeProxy {
+				return newFakeProxy(t, func(req *http.Request) *http.Response {
+					return proxyResponse(http.StatusProxyAuthRequired, false, `Kerberos`)
+				})
+			},
+			credentials: `user:secret`,
+			wantError:   `unsupported authentication (offered Kerberos)`,
+		},
+		{
+			name: `forbidden`,
+			proxy: func(t *testing.T) *fakeProxy {
+				return newFakeProxy(t, func(req *http.Request) *http.Response {
+					return proxyResponse(http.StatusForbidden, false)
+				})
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conn, err := dialThroughProxy(t, tt.proxy(t), tt.credentials)
+			if err == nil {
+				conn.Close()
+				t.Fatalf(`dial succeeded`)
+			}
+
+			if tt.wantStatus != 0 {
+				refused, ok := err.(*refusedError)
+				if !ok || refused.status != tt.wantStatus {
+					t.Errorf(`dial returned %v, want a refusal with status %d`, err, tt.wantStatus)
+				}
+			}
+			if tt.wantError != `` && !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf(`dial returned '%s', want '%s'`, err.Error(), tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headerRewrite changes the requests carried by the tunnel before they reach the target.
+type headerRewrite struct {
+	forwarded bool   // whether to add X-Forwarded-* and Forwarded
+	trusted   bool   // whether to keep the X-Forwarded-* and Forwarded headers that requests arrive with
+	host      string // replaces the Host header if set
+	add       http.Header
+	remove    []string
+}
+
+func newHeaderRewrite() *headerRewrite {
+
+	return &headerRewrite{
+		add: http.Header{},
+	}
+}
+
+// apply rewrites req, which was received from remoteAddr. Headers are removed before others are added, so a header
+// can be replaced by removing and adding it.
+func (hr *headerRewrite) apply(req *http.Request, remoteAddr string) {
+
+	if hr.forwarded {
+		addForwarded(req, remoteAddr, hr.trusted)
+	}
+
+	if hr.host != `` {
+		req.Host = hr.host
+	}
+
+	for _, name := range hr.remove {
+		req.Header.Del(name)
+	}
+
+	for name, values := range hr.add {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
+
+// addForwarded sets X-Forwarded-For and Forwarded to the address of the remote peer, and records the original Host
+// and scheme. Whatever the request arrived with is discarded, since anyone can send those headers, unless trusted is
+// set because a proxy in front of the server sets them; then the peer is appended and the Host and scheme are kept.
+func addForwarded(req *http.Request, remoteAddr string, trusted bool) {
+
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	if !trusted {
+		for _, name := range []string{`X-Forwarded-For`, `X-Forwarded-Proto`, `X-Forwarded-Host`, `Forwarded`} {
+			req.Header.Del(name)
+		}
+	}
+
+	proto := `http`
+	if value := req.Header.Get(`X-Forwarded-Proto`); value != `` {
+		proto = value
+	} else {
+		req.Header.Set(`X-Forwarded-Proto`, proto)
+	}
+
+	if prior := strings.Join(req.Header[`X-Forwarded-For`], `, `); prior != `` {
+		req.Header.Set(`X-Forwarded-For`, prior+`, `+ip)
+	} else {
+		req.Header.Set(`X-Forwarded-For`, ip)
+	}
+
+	if req.Header.Get(`X-Forwarded-Host`) == `` {
+		req.Header.Set(`X-Forwarded-Host`, req.Host)
+	}
+
+	// RFC 7239 requires IPv6 addresses to be bracketed
+	node := ip
+	if strings.Contains(ip, `:`) {
+		node = `[` + ip + `]`
+	}
+
+	element := `for=` + forwardedValue(node) + `;host=` + forwardedValue(req.Host) + `;proto=` + forwardedValue(proto)
+	if prior := strings.Join(req.Header[`Forwarded`], `, `); prior != `` {
+		element = prior + `, ` + element
+	}
+	req.Header.Set(`Forwarded`, element)
+}
+
+// forwardedValue returns value as it may appear in a Forwarded header: as is if it is a token, and otherwise as a
+// quoted string, so that quotes, semicolons and commas in it cannot break the header apart.
+func forwardedValue(value string) string {
+
+	if value != `` && strings.IndexFunc(value, func(r rune) bool { return !isTokenChar(r) }) < 0 {
+		return value
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+
+	return `"` + escaped + `"`
+}
+
+// isTokenChar reports whether r may appear in an HTTP token (RFC 7230, section 3.2.6).
+func isTokenChar(r rune) bool {
+
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
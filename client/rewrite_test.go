@@ -0,0 +1,158 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddForwarded(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		trusted    bool
+		incoming   map[string]string
+		want       map[string]string
+	}{
+		{
+			name:       `plain request`,
+			remoteAddr: `203.0.113.7:4321`,
+			host:       `app.example.com`,
+			want: map[string]string{
+				`X-Forwarded-For`:   `203.0.113.7`,
+				`X-Forwarded-Proto`: `http`,
+				`X-Forwarded-Host`:  `app.example.com`,
+				`Forwarded`:         `for=203.0.113.7;host=app.example.com;proto=http`,
+			},
+		},
+		{
+			name:       `IPv6 peer`,
+			remoteAddr: `[2001:db8::1]:4321`,
+			host:       `app.example.com:8080`,
+			want: map[string]string{
+				`X-Forwarded-For`: `2001:db8::1`,
+				`Forwarded`:       `for="[2001:db8::1]";host="app.example.com:8080";proto=http`,
+			},
+		},
+		{
+			name:       `spoofed headers are replaced`,
+			remoteAddr: `203.0.113.7:4321`,
+			host:       `app.example.com`,
+			incoming: map[string]string{
+				`X-Forwarded-For`:   `10.0.0.1`,
+				`X-Forwarded-Proto`: `https`,
+				`X-Forwarded-Host`:  `admin.internal`,
+				`Forwarded`:         `for=10.0.0.1`,
+			},
+			want: map[string]string{
+				`X-Forwarded-For`:   `203.0.113.7`,
+				`X-Forwarded-Proto`: `http`,
+				`X-Forwarded-Host`:  `app.example.com`,
+				`Forwarded`:         `for=203.0.113.7;host=app.example.com;proto=http`,
+			},
+		},
+		{
+			name:       `trusted headers are kept`,
+			remoteAddr: `198.51.100.2:4321`,
+			host:       `app.example.com`,
+			trusted:    true,
+			incoming: map[string]string{
+				`X-Forwarded-For`:   `203.0.113.7`,
+				`X-Forwarded-Proto`: `https`,
+				`X-Forwarded-Host`:  `www.example.com`,
+				`Forwarded`:         `for=203.0.113.7;proto=https`,
+			},
+			want: map[string]string{
+				`X-Forwarded-For`:   `203.0.113.7, 198.51.100.2`,
+				`X-Forwarded-Proto`: `https`,
+				`X-Forwarded-Host`:  `www.example.com`,
+				`Forwarded`:         `for=203.0.113.7;proto=https, for=198.51.100.2;host=app.example.com;proto=https`,
+			},
+		},
+		{
+			name:       `trusted without incoming headers`,
+			remoteAddr: `198.51.100.2:4321`,
+			host:       `app.example.com`,
+			trusted:    true,
+			want: map[string]string{
+				`X-Forwarded-For`:   `198.51.100.2`,
+				`X-Forwarded-Proto`: `http`,
+				`Forwarded`:         `for=198.51.100.2;host=app.example.com;proto=http`,
+			},
+		},
+		{
+			name:       `host with quotes and separators`,
+			remoteAddr: `203.0.113.7:4321`,
+			host:       `a";for=10.0.0.1,b\`,
+			want: map[string]string{
+				`Forwarded`: `for=203.0.113.7;host="a\";for=10.0.0.1,b\\";proto=http`,
+			},
+		},
+		{
+			name:       `trusted proto that is not a token`,
+			remoteAddr: `203.0.113.7:4321`,
+			host:       `app.example.com`,
+			trusted:    true,
+			incoming:   map[string]string{`X-Forwarded-Proto`: `https;for=10.0.0.1`},
+			want: map[string]string{
+				`Forwarded`: `for=203.0.113.7;host=app.example.com;proto="https;for=10.0.0.1"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodGet, `/`, nil)
+			req.Host = tt.host
+			for name, value := range tt.incoming {
+				req.Header.Set(name, value)
+			}
+
+			addForwarded(req, tt.remoteAddr, tt.trusted)
+
+			for name, want := range tt.want {
+				if got := req.Header.Values(name); len(got) != 1 || got[0] != want {
+					t.Errorf(`%s is %q, want '%s'`, name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderRewrite(t *testing.T) {
+
+	hr := newHeaderRewrite()
+	hr.forwarded = true
+	hr.host = `localhost:8080`
+	hr.remove = []string{`Cookie`, `X-Environment`}
+	hr.add.Add(`X-Environment`, `dev`)
+	hr.add.Add(`X-Tag`, `a`)
+	hr.add.Add(`X-Tag`, `b`)
+
+	req := httptest.NewRequest(http.MethodGet, `/`, nil)
+	req.Host = `app.example.com`
+	req.Header.Set(`Cookie`, `session=1`)
+	req.Header.Set(`X-Environment`, `prod`)
+
+	hr.apply(req, `203.0.113.7:4321`)
+
+	if req.Host != `localhost:8080` {
+		t.Errorf(`Host is '%s'`, req.Host)
+	}
+	// the original Host is recorded before it is replaced
+	if got := req.Header.Get(`X-Forwarded-Host`); got != `app.example.com` {
+		t.Errorf(`X-Forwarded-Host is '%s'`, got)
+	}
+	if got := req.Header.Get(`Cookie`); got != `` {
+		t.Errorf(`Cookie is '%s'`, got)
+	}
+	if got := req.Header.Values(`X-Environment`); len(got) != 1 || got[0] != `dev` {
+		t.Errorf(`X-Environment is %q`, got)
+	}
+	if got := req.Header.Values(`X-Tag`); len(got) != 2 || got[0] != `a` || got[1] != `b` {
+		t.Errorf(`X-Tag is %q`, got)
+	}
+}
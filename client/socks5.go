@@ -0,0 +1,165 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// SOCKS5 protocol constants from RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CommandConnect = 0x01
+
+	socks5AddressIPv4   = 0x01
+	socks5AddressDomain = 0x03
+	socks5AddressIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddressNotSupported = 0x08
+)
+
+// serveSocks5 negotiates a SOCKS5 CONNECT request on conn and then carries the connection through the server to the
+// requested destination, which is resolved and dialed by the server.
+func (c *client) serveSocks5(conn net.Conn) {
+
+	defer c.wg.Done()
+	defer c.connections.remove(conn)
+
+	target, err := socks5Handshake(conn)
+	if err != nil {
+		c.logger.Printf(`socks5: connection from %s: %s`, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	upgraded, err := c.dialThrough(target)
+	if err != nil {
+		c.logger.Printf(`socks5: could not reach %s for connection from %s: %s`, target, conn.RemoteAddr().String(), err.Error())
+
+		reply := byte(socks5ReplyGeneralFailure)
+		switch refusalStatus(err) {
+		case http.StatusForbidden:
+			reply = socks5ReplyNotAllowed
+		case http.StatusBadGateway:
+			reply = socks5ReplyHostUnreachable
+		}
+
+		socks5Reply(conn, reply)
+		conn.Close()
+		return
+	}
+
+	if !c.connections.add(upgraded) {
+		conn.Close()
+		return
+	}
+	defer c.connections.remove(upgraded)
+
+	if err := socks5Reply(conn, socks5ReplySucceeded); err != nil {
+		conn.Close()
+		upgraded.Close()
+		return
+	}
+
+	shared.Join(conn, upgraded)
+}
+
+// socks5Handshake performs method negotiation and reads the request, returning the requested destination as
+// 'host:port'. Only CONNECT without authentication is supported; the listener is expected to be bound locally.
+func socks5Handshake(conn net.Conn) (string, error) {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return ``, errors.Wrap(err, `could not read greeting`)
+	}
+
+	if header[0] != socks5Version {
+		return ``, errors.Errorf(`unsupported SOCKS version %d`, header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return ``, errors.Wrap(err, `could not read methods`)
+	}
+
+	acceptable := false
+	for _, method := range methods {
+		if method == socks5MethodNoAuth {
+			acceptable = true
+		}
+	}
+
+	if !acceptable {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return ``, errors.New(`client requires authentication`)
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+		return ``, err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return ``, errors.Wrap(err, `could not read request`)
+	}
+
+	if request[1] != socks5CommandConnect {
+		socks5Reply(conn, socks5ReplyCommandNotSupported)
+		return ``, errors.Errorf(`unsupported command %d`, request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5AddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return ``, errors.Wrap(err, `could not read address`)
+		}
+		host = ip.String()
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return ``, errors.Wrap(err, `could not read address`)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return ``, errors.Wrap(err, `could not read address`)
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5ReplyAddressNotSupported)
+		return ``, errors.Errorf(`unsupported address type %d`, request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return ``, errors.Wrap(err, `could not read port`)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Reply sends a reply with an unspecified bound address, since the real one is on the server.
+func socks5Reply(conn net.Conn, reply byte) error {
+
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
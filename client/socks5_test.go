@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection, which unlike net.Pipe can be half-closed. Both are closed
+// when the test ends.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer listener.Close()
+
+	a, err := net.Dial(`tcp`, listener.Addr().String())
+	if err != nil {
+		t.Fatalf(`could not connect: %s`, err.Error())
+	}
+	b, err := listener.Accept()
+	if err != nil {
+		t.Fatalf(`could not accept: %s`, err.Error())
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestSocks5Handshake(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		sent       []byte
+		wantTarget string
+		wantErr    string
+		wantReply  []byte // everything the handshake writes back
+	}{
+		{
+			name:       `IPv4`,
+			sent:       []byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0x1f, 0x90},
+			wantTarget: `192.0.2.1:8080`,
+			wantReply:  []byte{5, 0},
+		},
+		{
+			name:       `domain`,
+			sent:       append(append([]byte{5, 1, 0, 5, 1, 0, 3, 11}, `db.internal`...), 0x15, 0x38),
+			wantTarget: `db.internal:5432`,
+			wantReply:  []byte{5, 0},
+		},
+		{
+			name:       `IPv6`,
+			sent:       []byte{5, 1, 0, 5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0x01, 0xbb},
+			wantTarget: `[2001:db8::5]:443`,
+			wantReply:  []byte{5, 0},
+		},
+		{
+			name:       `no authentication among several methods`,
+			sent:       []byte{5, 3, 2, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+			wantTarget: `127.0.0.1:80`,
+			wantReply:  []byte{5, 0},
+		},
+		{
+			name:      `authentication required`,
+			sent:      []byte{5, 1, 2},
+			wantErr:   `requires authentication`,
+			wantReply: []byte{5, 0xff},
+		},
+		{
+			name:      `BIND`,
+			sent:      []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80},
+			wantErr:   `unsupported command 2`,
+			wantReply: []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:      `UDP ASSOCIATE`,
+			sent:      []byte{5, 1, 0, 5, 3, 0, 1, 127, 0, 0, 1, 0, 80},
+			wantErr:   `unsupported command 3`,
+			wantReply: []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:      `unknown address type`,
+			sent:      []byte{5, 1, 0, 5, 1, 0, 9},
+			wantErr:   `unsupported address type 9`,
+			wantReply: []byte{5, 0, 5, 8, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    `SOCKS4`,
+			sent:    []byte{4, 1, 0, 80, 127, 0, 0, 1, 0},
+			wantErr: `unsupported SOCKS version 4`,
+		},
+		{
+			name:      `truncated request`,
+			sent:      []byte{5, 1, 0, 5, 1, 0, 1, 127, 0},
+			wantErr:   `could not read address`,
+			wantReply: []byte{5, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conn, peer := tcpPair(t)
+			peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// the peer sends everything and then hangs up, collecting whatever is written back meanwhile
+			go func() {
+				peer.Write(tt.sent)
+				peer.(*net.TCPConn).CloseWrite()
+			}()
+			replies := make(chan []byte, 1)
+			go func() {
+				reply, _ := io.ReadAll(peer)
+				replies <- reply
+			}()
+
+			target, err := socks5Handshake(conn)
+			conn.Close()
+
+			if tt.wantErr != `` {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf(`error = %v, want one containing '%s'`, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf(`unexpected error: %s`, err.Error())
+			} else if target != tt.wantTarget {
+				t.Errorf(`target = '%s', want '%s'`, target, tt.wantTarget)
+			}
+
+			if reply := <-replies; !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf(`replied %v, want %v`, reply, tt.wantReply)
+			}
+		})
+	}
+}
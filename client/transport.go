@@ -0,0 +1,419 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// TransportAuto has the client try each transport that the server supports, in order, and use the first that works.
+const TransportAuto = `auto`
+
+// transportFunc connects to the server over one transport and completes a handshake with the given headers. It returns
+// the connection along with the headers of the server's response.
+type transportFunc func(c *client, header http.Header) (net.Conn, http.Header, error)
+
+var transportFuncs = map[string]transportFunc{
+	shared.TransportUpgrade:   (*client).upgradeConnection,
+	shared.TransportStream:    (*client).openStream,
+	shared.TransportWebSocket: (*client).openWebSocket,
+	shared.TransportPoll:      (*client).openPoll,
+}
+
+// chooseTransport returns the configured transport or, if it is TransportAuto, the first that carries a probe to the
+// server and back. The choice is kept until it stops working.
+func (c *client) chooseTransport() (string, error) {
+
+	if c.transport != TransportAuto {
+		return c.transport, nil
+	}
+
+	c.transportMutex.Lock()
+
+	if c.chosenTransport != `` {
+		transport := c.chosenTransport
+		c.transportMutex.Unlock()
+		return transport, nil
+	}
+
+	if choice := c.choosing; choice != nil {
+		// another connection is probing already, so its choice is shared rather than probing again
+		c.transportMutex.Unlock()
+		<-choice.done
+		return choice.transport, choice.err
+	}
+
+	choice := &transportChoice{done: make(chan struct{})}
+	c.choosing = choice
+	c.transportMutex.Unlock()
+
+	// probing can take several timeouts, so the lock is not held meanwhile
+	choice.transport, choice.err = c.probeTransports()
+
+	c.transportMutex.Lock()
+	c.choosing = nil
+	if choice.err == nil {
+		c.chosenTransport = choice.transport
+	}
+	c.transportMutex.Unlock()
+	close(choice.done)
+
+	return choice.transport, choice.err
+}
+
+// transportChoice is the outcome of probing the transports, which is available once done is closed.
+type transportChoice struct {
+	done      chan struct{}
+	transport string
+	err       error
+}
+
+// probeTransports returns the first transport that carries a probe to the server and back.
+func (c *client) probeTransports() (string, error) {
+
+	var err error
+	for _, transport := range c.candidateTransports() {
+		if err = c.probe(transport); err != nil {
+			c.logger.Printf(`transport %s cannot reach %s: %s`, transport, c.serverURL.String(), err.Error())
+			continue
+		}
+
+		c.logger.Printf(`using transport %s to reach %s`, transport, c.serverURL.String())
+		c.cacheTransport(transport)
+
+		return transport, nil
+	}
+
+	return ``, errors.Wrap(err, `no transport can reach the server`)
+}
+
+// forgetTransport has the next connection choose a transport again if the chosen one is transport.
+func (c *client) forgetTransport(transport string) {
+
+	c.transportMutex.Lock()
+	defer c.transportMutex.Unlock()
+
+	if c.chosenTransport == transport {
+		c.chosenTransport = ``
+	}
+}
+
+// candidateTransports returns the transports that the server supports in the order in which to try them: the one that
+// last worked for the server first, and the rest in the order of shared.Transports. If the server cannot be asked, all
+// are tried.
+func (c *client) candidateTransports() []string {
+
+	supported := shared.Transports
+	if capabilities, err := c.fetchCapabilities(); err == nil {
+		supported = capabilities.Transports
+	} else {
+		c.logger.Printf(`could not fetch capabilities of %s: %s`, c.serverURL.String(), err.Error())
+	}
+
+	candidates := []string{}
+	if cached := c.cachedTransport(); cached != `` && contains(supported, cached) {
+		candidates = append(candidates, cached)
+	}
+
+	for _, transport := range shared.Transports {
+		if contains(supported, transport) && !contains(candidates, transport) {
+			candidates = append(candidates, transport)
+		}
+	}
+
+	return candidates
+}
+
+func contains(values []string, value string) bool {
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchCapabilities asks the server which transports it supports, over plain HTTP requests that any proxy passes.
+func (c *client) fetchCapabilities() (*shared.Capabilities, error) {
+
+	u := *c.serverURL
+	u.Path = strings.TrimSuffix(u.Path, `/`) + shared.CapabilitiesPath
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `could not create capabilities request`)
+	}
+
+	resp, err := c.requests.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(`unexpected response: %s`, resp.Status)
+	}
+
+	capabilities := &shared.Capabilities{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(capabilities); err != nil {
+		return nil, errors.Wrap(err, `invalid capabilities`)
+	}
+
+	return capabilities, nil
+}
+
+// probe connects to the server over transport and checks that a message makes it there and back in time.
+func (c *client) probe(transport string) error {
+
+	result := make(chan error, 1)
+
+	go func() {
+
+		header := http.Header{}
+		header.Set(shared.HeaderAction, shared.ActionProbe)
+		shared.NewHandshake().Write(header)
+
+		conn, _, err := c.upgradeVia(transport, header)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(defaultProbeTimeout))
+
+		if _, err := conn.Write([]byte(shared.ProbeMessage)); err != nil {
+			result <- errors.Wrap(err, `could not send probe`)
+			return
+		}
+
+		echo := make([]byte, len(shared.ProbeMessage))
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			result <- errors.Wrap(err, `could not receive probe`)
+			return
+		}
+
+		if string(echo) != shared.ProbeMessage {
+			result <- errors.New(`probe was altered in transit`)
+			return
+		}
+
+		result <- nil
+	}()
+
+	// transports stuck behind a middlebox that holds requests would otherwise delay the choice for long
+	timer := time.NewTimer(defaultProbeTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.New(`timed out`)
+	}
+}
+
+// transportCacheEntries maps server URLs to the transport that last worked for each.
+type transportCacheEntries map[string]string
+
+// cachedTransport returns the transport that last worked for the server, or an empty string.
+func (c *client) cachedTransport() string {
+
+	if c.transportCache == `` {
+		return ``
+	}
+
+	data, err := os.ReadFile(c.transportCache)
+	if err != nil {
+		return ``
+	}
+
+	entries := transportCacheEntries{}
+	json.Unmarshal(data, &entries)
+
+	return entries[c.serverURL.String()]
+}
+
+// cacheTransport records that transport worked for the server, so that it is tried first next time.
+func (c *client) cacheTransport(transport string) {
+
+	if c.transportCache == `` {
+		return
+	}
+
+	entries := transportCacheEntries{}
+	if data, err := os.ReadFile(c.transportCache); err == nil {
+		json.Unmarshal(data, &entries)
+	}
+
+	if entries[c.serverURL.String()] == transport {
+		return
+	}
+	entries[c.serverURL.String()] = transport
+
+	data, _ := json.MarshalIndent(entries, ``, `  `)
+
+	err := os.MkdirAll(filepath.Dir(c.transportCache), 0700)
+	if err == nil {
+		err = os.WriteFile(c.transportCache, data, 0600)
+	}
+	if err != nil {
+		c.logger.Printf(`could not cache transport: %s`, err.Error())
+	}
+}
+
+// defaultTransportCache returns the file in the user's cache directory in which chosen transports are kept, or an
+// empty string if there is no such directory.
+func defaultTransportCache() string {
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ``
+	}
+
+	return filepath.Join(dir, `httptun`, `transports.json`)
+}
+
+// openWebSocket opens a WebSocket to the server whose handshake carries the given headers.
+func (c *client) openWebSocket(header http.Header) (net.Conn, http.Header, error) {
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := shared.NewWebSocketKey()
+
+	header.Set(`Connection`, `Upgrade`)
+	header.Set(`Upgrade`, `websocket`)
+	header.Set(`Sec-WebSocket-Version`, `13`)
+	header.Set(`Sec-WebSocket-Key`, key)
+	header.Set(`Sec-WebSocket-Protocol`, shared.WebSocketProtocol)
+
+	reader, resp, err := c.switchProtocols(conn, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.Header.Get(`Sec-WebSocket-Accept`) != shared.WebSocketAccept(key) {
+		conn.Close()
+		return nil, nil, errors.New(`invalid WebSocket handshake`)
+	}
+
+	return shared.NewWebSocketConn(conn, reader, true), resp.Header, nil
+}
+
+// openStream sends a request with the given headers to the server over HTTP/2 and carries the connection in the
+// bodies of that request and its response.
+func (c *client) openStream(header http.Header) (net.Conn, http.Header, error) {
+
+	reader, writer := io.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serverURL.String(), reader)
+	if err != nil {
+		cancel()
+		return nil, nil, errors.Wrap(err, `could not create stream request`)
+	}
+	req.Header = header
+	req.Header.Set(shared.HeaderTransport, shared.TransportStream)
+	req.Header.Set(`Content-Type`, `application/octet-stream`)
+
+	// the request stays open for the life of the connection, so only the wait for its response is limited
+	timer := time.AfterFunc(defaultDialTimeout, cancel)
+
+	resp, err := c.streams.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = errors.New(`timed out waiting for response`)
+	}
+	if err != nil {
+		cancel()
+		writer.Close()
+		return nil, nil, errors.Wrap(err, `could not open stream`)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		writer.Close()
+		return nil, nil, refusal(resp, `server refused stream`)
+	}
+
+	close := func() error {
+		writer.Close()
+		resp.Body.Close()
+		cancel()
+		return nil
+	}
+
+	conn := shared.NewStreamConn(resp.Body, writer, writer.Close, close, nil, c.serverAddr(shared.TransportStream))
+
+	return conn, resp.Header, nil
+}
+
+// newStreamTransport returns the HTTP/2 transport over which streams to the server are multiplexed.
+func (c *client) newStreamTransport() *http.Transport {
+
+	protocols := &http.Protocols{}
+	if c.serverURL.Scheme == `https` {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.dialRaw(address)
+		},
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := c.dial(`h2`)
+			if err != nil {
+				return nil, err
+			}
+			if tlsConn, ok := conn.(*tls.Conn); !ok || tlsConn.ConnectionState().NegotiatedProtocol != `h2` {
+				conn.Close()
+				return nil, errors.New(`server does not support HTTP/2`)
+			}
+			return conn, nil
+		},
+	}
+}
+
+// serverAddr stands for the server as the remote address of connections that are not carried by one TCP connection.
+type serverAddr struct {
+	transport string
+	host      string
+}
+
+func (c *client) serverAddr(transport string) net.Addr {
+
+	return &serverAddr{transport: transport, host: c.serverURL.Host}
+}
+
+func (sa *serverAddr) Network() string {
+
+	return sa.transport
+}
+
+func (sa *serverAddr) String() string {
+
+	return sa.host
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// flow relays datagrams between one remote source and the target, using a dedicated local socket so that replies
+// from the target can be told apart by source.
+type flow struct {
+	source string
+	conn   *net.UDPConn
+	active time.Time // when the source last sent something, guarded by the mutex of the flows
+}
+
+// flows holds the flows of a UDP tunnel. A flow is used and expired under the same lock, so that no datagram is sent
+// to a flow that has just been closed.
+type flows struct {
+	bySource map[string]*flow
+	mutex    *sync.Mutex
+	dropped  uint64 // datagrams that could not be sent to the target
+}
+
+// relay reads datagrams framed by the server from stream and sends each one to the target through the flow of its
+// source, creating flows as needed, until stream fails.
+func (c *client) relay(stream net.Conn) {
+
+	fs := &flows{bySource: map[string]*flow{}, mutex: &sync.Mutex{}}
+	wg := &sync.WaitGroup{}
+
+	// replies of all flows share the stream, and not every transport keeps a single write intact
+	writer := &datagramWriter{w: stream, mutex: &sync.Mutex{}}
+
+	reader := bufio.NewReader(stream)
+
+	for {
+		source, payload, err := shared.ReadDatagram(reader)
+		if err != nil {
+			break
+		}
+
+		fs.mutex.Lock()
+
+		f := fs.bySource[source]
+		if f == nil {
+			if f, err = c.newFlow(source); err != nil {
+				fs.dropped++
+				dropped := fs.dropped
+				fs.mutex.Unlock()
+				c.logger.Printf(`could not reach target for datagrams from %s: %s (%d dropped so far)`, source, err.Error(), dropped)
+				continue
+			}
+			fs.bySource[source] = f
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.answer(f, fs, writer)
+			}()
+		}
+
+		// refresh the idle timeout whenever the source sends something
+		f.active = time.Now()
+		f.conn.SetReadDeadline(f.active.Add(defaultUdpIdleTimeout))
+		_, err = f.conn.Write(payload)
+		if err != nil {
+			fs.dropped++
+		}
+		dropped := fs.dropped
+
+		fs.mutex.Unlock()
+
+		if err != nil {
+			c.logger.Printf(`could not send datagram from %s to target: %s (%d dropped so far)`, source, err.Error(), dropped)
+		}
+	}
+
+	stream.Close()
+
+	fs.mutex.Lock()
+	for _, f := range fs.bySource {
+		f.conn.Close()
+	}
+	fs.mutex.Unlock()
+
+	wg.Wait()
+}
+
+func (c *client) newFlow(source string) (*flow, error) {
+
+	address, err := net.ResolveUDPAddr(`udp`, c.target)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP(`udp`, nil, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flow{source: source, conn: conn}, nil
+}
+
+// answer frames the target's replies on f back to its source until f has been idle for too long, and then removes f.
+func (c *client) answer(f *flow, fs *flows, writer *datagramWriter) {
+
+	buf := make([]byte, shared.MaxDatagramSize)
+
+	for {
+		n, err := f.conn.Read(buf)
+		if err != nil {
+			// also reached when the read deadline passes without any traffic in either direction
+			if c.expire(f, fs, err) {
+				return
+			}
+			continue
+		}
+
+		fs.mutex.Lock()
+		f.conn.SetReadDeadline(time.Now().Add(defaultUdpIdleTimeout))
+		fs.mutex.Unlock()
+
+		if err := writer.write(f.source, buf[:n]); err != nil {
+			c.expire(f, fs, err)
+			return
+		}
+	}
+}
+
+// expire closes and removes f after reading from it failed with err, unless err is a timeout and the source has sent
+// something since, in which case relay has already extended the deadline. It reports whether f was removed.
+func (c *client) expire(f *flow, fs *flows, err error) bool {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(f.active) < defaultUdpIdleTimeout {
+		return false
+	}
+
+	f.conn.Close()
+	if fs.bySource[f.source] == f {
+		delete(fs.bySource, f.source)
+	}
+
+	return true
+}
+
+// datagramWriter serializes the frames written to a stream shared by several flows.
+type datagramWriter struct {
+	w     net.Conn
+	mutex *sync.Mutex
+}
+
+func (dw *datagramWriter) write(addr string, payload []byte) error {
+
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	return shared.WriteDatagram(dw.w, addr, payload)
+}
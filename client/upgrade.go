@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// upgrade connects to the server over the chosen transport and completes a handshake with the given headers,
+// establishing an encrypted channel inside the connection if the server key is pinned. On success it returns the
+// connection along with the headers of the server's response.
+func (c *client) upgrade(header http.Header) (net.Conn, http.Header, error) {
+
+	transport, err := c.chooseTransport()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, response, err := c.upgradeVia(transport, header)
+	if err != nil && refusalStatus(err) == 0 {
+		// the transport may have stopped working, e.g. because the network changed
+		c.forgetTransport(transport)
+	}
+
+	return conn, response, err
+}
+
+// upgradeVia connects to the server over the given transport and completes a handshake with the given headers.
+func (c *client) upgradeVia(transport string, header http.Header) (net.Conn, http.Header, error) {
+
+	if c.serverKey != nil {
+		header.Set(shared.HeaderEncryption, shared.EncryptionNoise)
+	}
+
+	conn, response, err := transportFuncs[transport](c, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	agreed, err := shared.ReadHandshake(response)
+	if err == nil && (agreed.Version < shared.MinProtocolVersion || agreed.Version > shared.ProtocolVersion) {
+		err = errors.Errorf(`server speaks protocol version %d, but this client supports %d to %d`, agreed.Version, shared.MinProtocolVersion, shared.ProtocolVersion)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if c.serverKey == nil {
+		return conn, response, nil
+	}
+
+	// never fall back to plaintext, or anything between client and server could strip the header to read the traffic
+	if response.Get(shared.HeaderEncryption) != shared.EncryptionNoise {
+		conn.Close()
+		return nil, nil, errors.New(`server did not agree to encryption`)
+	}
+
+	conn.SetDeadline(time.Now().Add(defaultDialTimeout))
+	channel, err := shared.ClientHandshake(conn, c.serverKey)
+	conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return channel, response, nil
+}
+
+// upgradeConnection switches an HTTP/1.1 connection to the server to the httptun protocol.
+func (c *client) upgradeConnection(header http.Header) (net.Conn, http.Header, error) {
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header.Set(`Connection`, `Upgrade`)
+	header.Set(`Upgrade`, shared.UpgradeProtocol)
+
+	reader, resp, err := c.switchProtocols(conn, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return shared.NewBufferedConn(conn, reader), resp.Header, nil
+}
+
+// switchProtocols sends a GET request with the given headers over conn and reads the response, which must switch
+// protocols. It returns the reader that holds whatever the server sent after the response. conn is closed on failure.
+func (c *client) switchProtocols(conn net.Conn, header http.Header) (*bufio.Reader, *http.Response, error) {
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        c.serverURL,
+		Proto:      `HTTP/1.1`,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       c.serverURL.Host,
+	}
+
+	// something between client and server may swallow the request rather than refuse it
+	conn.SetDeadline(time.Now().Add(defaultDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, `could not send upgrade request`)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, `could not read upgrade response`)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, refusal(resp, `server refused upgrade`)
+	}
+
+	return reader, resp, nil
+}
+
+// refusedError is returned by upgrade when the server answers the handshake with an error.
+type refusedError struct {
+	status  int
+	message string
+}
+
+func (re *refusedError) Error() string {
+
+	return re.message
+}
+
+// refusal reads the body of resp and returns a refusedError that describes it.
+func refusal(resp *http.Response, message string) error {
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	return &refusedError{
+		status:  resp.StatusCode,
+		message: fmt.Sprintf(`%s: %s: %s`, message, resp.Status, strings.TrimSpace(string(body))),
+	}
+}
+
+// refusalStatus returns the HTTP status with which the server refused an upgrade, or zero if err is not a refusal.
+func refusalStatus(err error) int {
+
+	if re, ok := errors.Cause(err).(*refusedError); ok {
+		return re.status
+	}
+
+	return 0
+}
+
+// dial connects to the server, through a proxy if there is one, and using TLS if the server URL calls for it. Over TLS,
+// the given application protocols are offered unless the TLS configuration names its own.
+func (c *client) dial(protocols ...string) (net.Conn, error) {
+
+	host, port := c.serverURL.Hostname(), c.serverURL.Port()
+	if port == `` {
+		port = `80`
+		if c.serverURL.Scheme == `https` {
+			port = `443`
+		}
+	}
+	address := net.JoinHostPort(host, port)
+
+	raw, err := c.dialRaw(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.serverURL.Scheme != `https` {
+		return raw, nil
+	}
+
+	config := &tls.Config{}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+	if config.ServerName == `` {
+		config.ServerName = host
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = protocols
+	}
+
+	conn := tls.Client(raw, config)
+
+	raw.SetDeadline(time.Now().Add(defaultDialTimeout))
+	err = conn.Handshake()
+	raw.SetDeadline(time.Time{})
+
+	if err != nil {
+		raw.Close()
+		return nil, errors.Wrapf(err, `could not connect to %s`, address)
+	}
+
+	return conn, nil
+}
+
+// dialRaw opens a TCP connection to address, through a proxy if there is one.
+func (c *client) dialRaw(address string) (net.Conn, error) {
+
+	if c.proxyURL != nil {
+		return c.dialProxy(address)
+	}
+
+	conn, err := net.DialTimeout(`tcp`, address, defaultDialTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, `could not connect to %s`, address)
+	}
+
+	return conn, nil
+}
+
+// grantsCompression reports whether the server confirmed compression among the capabilities of its response.
+func grantsCompression(response http.Header) bool {
+
+	return shared.ParseCapabilities(response.Get(shared.HeaderCapabilities)).Has(shared.CapabilityCompression)
+}
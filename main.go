@@ -1,59 +1,393 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
 
+	"github.com/RobertGrantEllis/httptun/client"
 	"github.com/RobertGrantEllis/httptun/server"
+	"github.com/RobertGrantEllis/httptun/shared"
 )
 
 func main() {
 
 	if len(os.Args) < 2 {
-		fail(errors.New(`subcommand is required: must be 'connect' or 'serve'`))
+		fail(errors.New(`subcommand is required: must be 'connect', 'serve' or 'keygen'`))
 	}
 
-	subcommand, args := strings.ToLower(os.Args[1]), os.Args[1:]
+	subcommand, args := strings.ToLower(os.Args[1]), os.Args[2:]
 
 	switch subcommand {
 	case `connect`:
 		startClient(args...)
 	case `serve`:
 		startServer(args...)
+	case `keygen`:
+		generateKey(args...)
 	default:
-		fail(errors.Errorf(`invalid subcommand: must be 'connect' or 'serve' (got '%s')`, subcommand))
+		fail(errors.Errorf(`invalid subcommand: must be 'connect', 'serve' or 'keygen' (got '%s')`, subcommand))
 	}
 }
 
 func startClient(args ...string) {
 
-	fail(errors.New(`client not yet implemented`))
+	flags := flag.NewFlagSet(`connect`, flag.ExitOnError)
+	serverURL := flags.String(`server`, `http://127.0.0.1:4235`, `URL of the httptun server`)
+	serverKey := flags.String(`server-key`, ``, "public `key` of the server, as printed by 'httptun keygen', with which to encrypt all traffic to it")
+	port := flags.Int(`port`, 0, `port to request on the server (default: any)`)
+	socket := flags.String(`socket`, ``, `name of a Unix socket to request on the server instead of a port`)
+	udp := flags.Bool(`udp`, false, `forward UDP datagrams to the target instead of TCP connections`)
+	inspect := flags.String(`inspect`, ``, "`address` on which to serve a page for inspecting and replaying HTTP requests, e.g. 127.0.0.1:4040")
+	forwarded := flags.Bool(`forwarded-headers`, false, `add X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded to HTTP requests`)
+	trustForwarded := flags.Bool(`trust-forwarded-headers`, false, `like -forwarded-headers, but keep the forwarded headers requests arrive with, for servers behind a proxy that sets them`)
+	hostHeader := flags.String(`host-header`, ``, `replace the Host header of HTTP requests, e.g. localhost:8080`)
+	var addHeaders stringsFlag
+	flags.Var(&addHeaders, `add-header`, "`name: value` header to add to HTTP requests (repeatable)")
+	var removeHeaders stringsFlag
+	flags.Var(&removeHeaders, `remove-header`, "`name` of a header to remove from HTTP requests (repeatable)")
+	compress := flags.Bool(`compress`, false, `compress traffic between the client and server, e.g. over slow links`)
+	proxyProtocol := flags.Int(`proxy-protocol`, 0, "PROXY protocol `version` (1 or 2) with which to announce remote peers to the target")
+	basicAuth := flags.String(`basic-auth`, ``, "`username:password` that the server requires of HTTP requests to the tunnel")
+	bearerToken := flags.String(`bearer-token`, ``, "bearer `token` that the server requires of HTTP requests to the tunnel")
+	var allowIPs stringsFlag
+	flags.Var(&allowIPs, `allow-ip`, "IP address or CIDR `block` from which the server accepts connections to the tunnel (repeatable)")
+	hostname := flags.String(`hostname`, ``, `name under the server's virtual host domain to request instead of a port`)
+	var locals stringsFlag
+	flags.Var(&locals, `L`, "`[bind_address:]port:host:hostport` to forward through the server (repeatable)")
+	socks5 := flags.String(`socks5`, ``, "`address` on which to run a SOCKS5 proxy through the server, e.g. 127.0.0.1:1080")
+	httpProxy := flags.String(`http-proxy`, ``, "`address` on which to run an HTTP proxy through the server, e.g. 127.0.0.1:3128")
+	insecure := flags.Bool(`insecure`, false, `skip verification of the server's TLS certificate`)
+	proxy := flags.String(`proxy`, ``, "`URL` of a forward proxy through which to reach the server, or 'none' (default: from HTTPS_PROXY, HTTP_PROXY and NO_PROXY)")
+	transport := flags.String(`transport`, client.TransportAuto, "`name` of the transport by which to reach the server: auto, upgrade, stream, websocket or poll")
+	disguise := flags.String(`disguise`, ``, "base `path` under which to disguise traffic as JSON API calls, e.g. /api/v2/sync (the server must use the same)")
+	disguiseHost := flags.String(`disguise-host`, ``, "`host` to send in the Host header in disguise mode instead of the server's, e.g. for domain fronting")
+	transportCache := flags.String(`transport-cache`, ``, "`path` of the file in which transports chosen automatically are kept, or 'none' (default: in the user's cache directory)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: httptun connect [flags] [target]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	logger := log.New(os.Stdout, `httptun `, log.LstdFlags)
+
+	options := []client.Option{
+		client.Logger(logger),
+		client.ServerURL(*serverURL),
+	}
+
+	if *port != 0 {
+		options = append(options, client.Port(*port))
+	}
+
+	if *socket != `` {
+		options = append(options, client.Socket(*socket))
+	}
+
+	if *hostname != `` {
+		options = append(options, client.Hostname(*hostname))
+	}
+
+	if *inspect != `` {
+		options = append(options, client.Inspect(*inspect))
+	}
+
+	if *basicAuth != `` {
+		i := strings.Index(*basicAuth, `:`)
+		if i < 0 {
+			fail(errors.Errorf(`invalid basic auth: must be 'username:password' (got '%s')`, *basicAuth))
+		}
+		options = append(options, client.BasicAuth((*basicAuth)[:i], (*basicAuth)[i+1:]))
+	}
+
+	if *bearerToken != `` {
+		options = append(options, client.BearerToken(*bearerToken))
+	}
+
+	if len(allowIPs) > 0 {
+		options = append(options, client.AllowIPs(allowIPs...))
+	}
+
+	if *proxyProtocol != 0 {
+		options = append(options, client.ProxyProtocol(*proxyProtocol))
+	}
+
+	if *compress {
+		options = append(options, client.Compression())
+	}
+
+	if *trustForwarded {
+		options = append(options, client.TrustForwardedHeaders())
+	} else if *forwarded {
+		options = append(options, client.ForwardedHeaders())
+	}
+
+	if *hostHeader != `` {
+		options = append(options, client.HostHeader(*hostHeader))
+	}
+
+	for _, header := range addHeaders {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			fail(err)
+		}
+		options = append(options, client.AddHeader(name, value))
+	}
+
+	for _, name := range removeHeaders {
+		options = append(options, client.RemoveHeader(name))
+	}
+
+	if *udp {
+		options = append(options, client.Udp())
+	}
+
+	if *insecure {
+		options = append(options, client.TlsConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	switch *proxy {
+	case ``:
+	case `none`:
+		options = append(options, client.NoProxy())
+	default:
+		options = append(options, client.Proxy(*proxy))
+	}
+
+	options = append(options, client.Transport(*transport))
+
+	if *disguise != `` {
+		options = append(options, client.Disguise(*disguise))
+	}
+
+	if *disguiseHost != `` {
+		options = append(options, client.DisguiseHost(*disguiseHost))
+	}
+
+	switch *transportCache {
+	case ``:
+	case `none`:
+		options = append(options, client.TransportCache(``))
+	default:
+		options = append(options, client.TransportCache(*transportCache))
+	}
+
+	if *serverKey != `` {
+		key, err := shared.DecodeKey(*serverKey)
+		if err != nil {
+			fail(err)
+		}
+		options = append(options, client.ServerKey(key))
+	}
+
+	if flags.NArg() > 0 {
+		options = append(options, client.Target(flags.Arg(0)))
+	}
+
+	for _, spec := range locals {
+		address, remote, err := parseLocal(spec)
+		if err != nil {
+			fail(err)
+		}
+		options = append(options, client.Local(address, remote))
+	}
+
+	if *socks5 != `` {
+		options = append(options, client.Socks5(*socks5))
+	}
+
+	if *httpProxy != `` {
+		options = append(options, client.HttpProxy(*httpProxy))
+	}
+
+	c, err := client.New(options...)
+	if err != nil {
+		fail(err)
+	}
+
+	if err := c.Start(); err != nil {
+		fail(err)
+	}
+
+	waitUntilInterrupt(c)
 }
 
 func startServer(args ...string) {
 
+	flags := flag.NewFlagSet(`serve`, flag.ExitOnError)
+	tunnelSocket := flags.String(`tunnel-socket`, ``, `path of a Unix socket on which to listen for tunnels instead of a TCP port`)
+	clientSocketDir := flags.String(`client-socket-dir`, ``, `directory in which clients may expose their tunnels as Unix sockets`)
+	encryptionKey := flags.String(`encryption-key`, ``, "`path` of a private key written by 'httptun keygen', with which clients may encrypt all traffic")
+	disguise := flags.String(`disguise`, ``, "base `path` under which to accept clients in disguise mode and serve a decoy site to all other requests, e.g. /api/v2/sync")
+	decoySite := flags.String(`decoy-site`, ``, "`directory` of static files to serve to requests that are not for a tunnel (default: the status page, or a placeholder page in disguise mode)")
+	statusTemplate := flags.String(`status-template`, ``, "`file` with an html/template to render as the status page instead of the default")
+	handshakePath := flags.String(`handshake-path`, ``, "`path` at which to accept tunnel handshakes, e.g. /tunnel (default: any path)")
+	proxyProtocol := flags.Bool(`proxy-protocol`, false, `require a PROXY protocol header on connections to the tunnel listener, e.g. behind an L4 load balancer`)
+	tunnelBandwidth := flags.String(`tunnel-bandwidth`, ``, "`rate[,burst]` in bytes per second for each tunnel, e.g. 1M or 1M,8M")
+	identityBandwidth := flags.String(`identity-bandwidth`, ``, "`rate[,burst]` in bytes per second for all tunnels of each client")
+	globalBandwidth := flags.String(`global-bandwidth`, ``, "`rate[,burst]` in bytes per second for the whole server")
+	maxClientConnections := flags.Int(`max-client-connections`, 0, `connections that each tunnel may hold open at once (0 for no limit)`)
+	clientConnectionRate := flags.Int(`client-connection-rate`, 0, `new connections per second that each tunnel accepts (0 for no limit)`)
+	clientConnectionBurst := flags.Int(`client-connection-burst`, 0, `new connections that each tunnel accepts in a burst (defaults to the rate)`)
+	maxHandshakes := flags.Int(`max-handshakes`, 0, `tunnel requests that the server handles at once (0 for no limit)`)
+	connectionIdleTimeout := flags.Duration(`connection-idle-timeout`, 0, `close connections through tunnels after this long without traffic (0 for never)`)
+	tunnelIdleTimeout := flags.Duration(`tunnel-idle-timeout`, 0, `close tunnels after this long without connections or traffic (0 for never)`)
+	tunnelLifetime := flags.Duration(`tunnel-lifetime`, 0, `close tunnels after this long regardless of use (0 for never)`)
+	var access accessLists
+	flags.Var(&access.tunnelAllow, `tunnel-allow-ip`, "IP address or CIDR `block` that may connect to the tunnel listener (repeatable)")
+	flags.Var(&access.tunnelDeny, `tunnel-deny-ip`, "IP address or CIDR `block` that may not connect to the tunnel listener (repeatable)")
+	flags.Var(&access.clientAllow, `client-allow-ip`, "IP address or CIDR `block` that may connect to tunnel ports (repeatable)")
+	flags.Var(&access.clientDeny, `client-deny-ip`, "IP address or CIDR `block` that may not connect to tunnel ports (repeatable)")
+	accessFile := flags.String(`access-file`, ``, "`path` of a file with further allow and deny rules, reloaded on SIGUSR1")
+	vhostDomain := flags.String(`vhost-domain`, ``, `domain under which clients may request hostnames, e.g. tunnels.example.com`)
+	vhostPort := flags.Int(`vhost-port`, 0, `port shared by hostname tunnels, routed by the HTTP Host header`)
+	vhostTlsPort := flags.Int(`vhost-tls-port`, 0, `port shared by hostname tunnels, routed by TLS server name without terminating TLS`)
+	var allowDestinations stringsFlag
+	flags.Var(&allowDestinations, `allow-destination`, "`host:ports` that clients may have the server dial, e.g. '10.0.0.0/8:5432' (repeatable)")
+	var denyDestinations stringsFlag
+	flags.Var(&denyDestinations, `deny-destination`, "`host:ports` that clients may never have the server dial (repeatable)")
+	flags.Parse(args)
+
 	logger := log.New(os.Stdout, `httptun `, log.LstdFlags)
 
-	s, err := server.New(server.Logger(logger))
+	options := []server.Option{
+		server.Logger(logger),
+		server.Systemd(),
+	}
+
+	if *tunnelSocket != `` {
+		options = append(options, server.TunnelSocket(*tunnelSocket))
+	}
+
+	if *clientSocketDir != `` {
+		options = append(options, server.ClientSocketDir(*clientSocketDir))
+	}
+
+	if *proxyProtocol {
+		options = append(options, server.TunnelProxyProtocol())
+	}
+
+	if *disguise != `` {
+		options = append(options, server.Disguise(*disguise))
+	}
+
+	if *decoySite != `` {
+		options = append(options, server.DecoySite(*decoySite))
+	}
+
+	if *statusTemplate != `` {
+		options = append(options, server.StatusTemplate(*statusTemplate))
+	}
+
+	if *handshakePath != `` {
+		options = append(options, server.HandshakePath(*handshakePath))
+	}
+
+	if *encryptionKey != `` {
+		encoded, err := ioutil.ReadFile(*encryptionKey)
+		if err != nil {
+			fail(errors.Wrap(err, `could not read encryption key`))
+		}
+		key, err := shared.DecodeKey(string(encoded))
+		if err != nil {
+			fail(err)
+		}
+		options = append(options, server.EncryptionKey(key))
+	}
+
+	for _, bandwidth := range []struct {
+		value  string
+		option func(rate, burst int) server.Option
+	}{
+		{*tunnelBandwidth, server.TunnelBandwidth},
+		{*identityBandwidth, server.IdentityBandwidth},
+		{*globalBandwidth, server.GlobalBandwidth},
+	} {
+		if bandwidth.value == `` {
+			continue
+		}
+		rate, burst, err := parseBandwidth(bandwidth.value)
+		if err != nil {
+			fail(err)
+		}
+		options = append(options, bandwidth.option(rate, burst))
+	}
+
+	if *maxClientConnections != 0 {
+		options = append(options, server.ClientConnectionLimit(*maxClientConnections))
+	}
+
+	if *clientConnectionRate != 0 || *clientConnectionBurst != 0 {
+		options = append(options, server.ClientConnectionRate(*clientConnectionRate, *clientConnectionBurst))
+	}
+
+	if *maxHandshakes != 0 {
+		options = append(options, server.HandshakeLimit(*maxHandshakes))
+	}
+
+	if *connectionIdleTimeout != 0 {
+		options = append(options, server.ConnectionIdleTimeout(*connectionIdleTimeout))
+	}
+
+	if *tunnelIdleTimeout != 0 {
+		options = append(options, server.TunnelIdleTimeout(*tunnelIdleTimeout))
+	}
+
+	if *tunnelLifetime != 0 {
+		options = append(options, server.TunnelLifetime(*tunnelLifetime))
+	}
+
+	if *vhostDomain != `` {
+		options = append(options, server.VirtualHosts(*vhostDomain, *vhostPort, *vhostTlsPort))
+	}
+
+	if len(allowDestinations) > 0 {
+		options = append(options, server.AllowDestinations(allowDestinations...))
+	}
+
+	if len(denyDestinations) > 0 {
+		options = append(options, server.DenyDestinations(denyDestinations...))
+	}
+
+	s, err := server.New(options...)
 	if err != nil {
 		fail(err)
 	}
 
+	if err := access.apply(s, *accessFile); err != nil {
+		fail(err)
+	}
+
 	if err := s.Start(); err != nil {
-		panic(err)
+		fail(err)
 	}
 
+	handoffOnHangup(s, logger)
+	reloadAccessOnSignal(s, access, *accessFile, logger)
 	waitUntilInterrupt(s)
+
+	if err := s.Err(); err != nil {
+		fail(err)
+	}
+}
+
+type stopWaiter interface {
+	Stop()
+	Wait()
 }
 
-func waitUntilInterrupt(s server.Server) {
+func waitUntilInterrupt(s stopWaiter) {
 
 	signals := make(chan os.Signal, 1)
 	stopping := false
@@ -71,6 +405,198 @@ func waitUntilInterrupt(s server.Server) {
 	s.Wait()
 }
 
+// handoffOnHangup hands the server's listeners to a freshly started process whenever SIGHUP is received, so that the
+// binary can be upgraded without closing any ports.
+func handoffOnHangup(s server.Server, logger *log.Logger) {
+
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := s.Handoff(); err != nil {
+				logger.Printf(`%s: %s`, color.RedString(`handoff failed`), err.Error())
+			}
+		}
+	}()
+}
+
+// reloadAccessOnSignal applies the access file again whenever SIGUSR1 is received.
+func reloadAccessOnSignal(s server.Server, access accessLists, path string, logger *log.Logger) {
+
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if err := access.apply(s, path); err != nil {
+				logger.Printf(`%s: %s`, color.RedString(`could not reload access rules`), err.Error())
+				continue
+			}
+			logger.Printf(`reloaded access rules`)
+		}
+	}()
+}
+
+// accessLists holds the allow and deny rules of the tunnel listener and of tunnel ports.
+type accessLists struct {
+	tunnelAllow, tunnelDeny stringsFlag
+	clientAllow, clientDeny stringsFlag
+}
+
+// apply replaces the access rules of s with these rules and those of the access file at path, if any. Each line of
+// the file is '<tunnel|client> <allow|deny> <address or CIDR block>'; blank lines and lines starting with '#' are
+// ignored.
+func (al accessLists) apply(s server.Server, path string) error {
+
+	if path != `` {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, `could not read access file`)
+		}
+
+		lists := map[string]*stringsFlag{
+			`tunnel allow`: &al.tunnelAllow,
+			`tunnel deny`:  &al.tunnelDeny,
+			`client allow`: &al.clientAllow,
+			`client deny`:  &al.clientDeny,
+		}
+
+		for i, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], `#`) {
+				continue
+			}
+			list, ok := lists[strings.Join(fields[:len(fields)-1], ` `)]
+			if len(fields) != 3 || !ok {
+				return errors.Errorf(`invalid access file: line %d must be '<tunnel|client> <allow|deny> <address>'`, i+1)
+			}
+			*list = append(*list, fields[2])
+		}
+	}
+
+	if err := s.SetTunnelAccess(al.tunnelAllow, al.tunnelDeny); err != nil {
+		return errors.Wrap(err, `invalid tunnel access rules`)
+	}
+
+	return errors.Wrap(s.SetClientAccess(al.clientAllow, al.clientDeny), `invalid client access rules`)
+}
+
+// stringsFlag collects the values of a flag that may be repeated.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+
+	return strings.Join(*sf, `,`)
+}
+
+func (sf *stringsFlag) Set(value string) error {
+
+	*sf = append(*sf, value)
+	return nil
+}
+
+// parseLocal parses a forward specification in the style of 'ssh -L', i.e. '[bind_address:]port:host:hostport',
+// into a local address and a remote address. IPv6 addresses must be enclosed in brackets.
+func parseLocal(spec string) (address, remote string, err error) {
+
+	var fields []string
+	for field, rest := ``, spec; rest != ``; {
+		if rest[0] == '[' {
+			end := strings.Index(rest, `]`)
+			if end < 0 {
+				return ``, ``, errors.Errorf(`invalid forward: unterminated '[' (got '%s')`, spec)
+			}
+			field, rest = rest[1:end], rest[end+1:]
+		} else if i := strings.Index(rest, `:`); i >= 0 {
+			field, rest = rest[:i], rest[i:]
+		} else {
+			field, rest = rest, ``
+		}
+		fields = append(fields, field)
+		rest = strings.TrimPrefix(rest, `:`)
+	}
+
+	switch len(fields) {
+	case 3:
+		return net.JoinHostPort(`127.0.0.1`, fields[0]), net.JoinHostPort(fields[1], fields[2]), nil
+	case 4:
+		return net.JoinHostPort(fields[0], fields[1]), net.JoinHostPort(fields[2], fields[3]), nil
+	default:
+		return ``, ``, errors.Errorf(`invalid forward: must be '[bind_address:]port:host:hostport' (got '%s')`, spec)
+	}
+}
+
+// parseBandwidth parses 'rate[,burst]', where both are numbers of bytes that may have a suffix of K, M or G for powers
+// of 1024.
+func parseBandwidth(value string) (rate, burst int, err error) {
+
+	fields := strings.Split(value, `,`)
+	if len(fields) > 2 {
+		return 0, 0, errors.Errorf(`invalid bandwidth: must be 'rate[,burst]' (got '%s')`, value)
+	}
+
+	sizes := make([]int, 2)
+	for i, field := range fields {
+		field = strings.ToUpper(strings.TrimSpace(field))
+		multiplier := 1
+		if j := strings.IndexAny(field, `KMG`); j >= 0 && j == len(field)-1 {
+			multiplier = 1 << (10 * (1 + strings.Index(`KMG`, field[j:])))
+			field = field[:j]
+		}
+		size, err := strconv.Atoi(field)
+		if err != nil || size <= 0 {
+			return 0, 0, errors.Errorf(`invalid bandwidth: must be 'rate[,burst]' (got '%s')`, value)
+		}
+		sizes[i] = size * multiplier
+	}
+
+	return sizes[0], sizes[1], nil
+}
+
+// parseHeader splits a header written as 'name: value'.
+func parseHeader(header string) (name, value string, err error) {
+
+	i := strings.Index(header, `:`)
+	if i <= 0 {
+		return ``, ``, errors.Errorf(`invalid header: must be 'name: value' (got '%s')`, header)
+	}
+
+	return strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]), nil
+}
+
+// generateKey writes a new private key for 'serve -encryption-key' and prints the public key for 'connect -server-key'.
+func generateKey(args ...string) {
+
+	flags := flag.NewFlagSet(`keygen`, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: httptun keygen path\n")
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	private, public, err := shared.GenerateKey()
+	if err != nil {
+		fail(err)
+	}
+
+	file, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail(errors.Wrap(err, `could not create key file`))
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, shared.EncodeKey(private)); err != nil {
+		fail(errors.Wrap(err, `could not write key file`))
+	}
+
+	fmt.Println(shared.EncodeKey(public))
+}
+
 func fail(err error) {
 
 	fmt.Printf("%s: %s\n", color.RedString(`error`), err.Error())
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/RobertGrantEllis/httptun/server"
+)
+
+// accessRecorder records the rules applied to it in place of a Server.
+type accessRecorder struct {
+	server.Server
+	tunnelAllow, tunnelDeny []string
+	clientAllow, clientDeny []string
+}
+
+func (ar *accessRecorder) SetTunnelAccess(allow, deny []string) error {
+
+	ar.tunnelAllow, ar.tunnelDeny = allow, deny
+	return nil
+}
+
+func (ar *accessRecorder) SetClientAccess(allow, deny []string) error {
+
+	ar.clientAllow, ar.clientDeny = allow, deny
+	return nil
+}
+
+func TestAccessListsApply(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), `access`)
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	access := accessLists{tunnelAllow: stringsFlag{`10.0.0.0/8`}}
+	recorder := &accessRecorder{}
+
+	write("# office\ntunnel allow 192.168.0.0/16\n\nclient deny 203.0.113.0/24\n  client allow 0.0.0.0/0  \n")
+	if err := access.apply(recorder, path); err != nil {
+		t.Fatalf(`apply: %s`, err.Error())
+	}
+
+	want := &accessRecorder{
+		tunnelAllow: []string{`10.0.0.0/8`, `192.168.0.0/16`},
+		clientAllow: []string{`0.0.0.0/0`},
+		clientDeny:  []string{`203.0.113.0/24`},
+	}
+	if !reflect.DeepEqual(recorder, want) {
+		t.Errorf("applied %+v\nwant    %+v", recorder, want)
+	}
+
+	// a reload applies the flags and the file as they are now, rather than adding to what was applied before
+	write("tunnel deny 10.9.0.0/16\n")
+	if err := access.apply(recorder, path); err != nil {
+		t.Fatalf(`reload: %s`, err.Error())
+	}
+
+	want = &accessRecorder{
+		tunnelAllow: []string{`10.0.0.0/8`},
+		tunnelDeny:  []string{`10.9.0.0/16`},
+	}
+	if !reflect.DeepEqual(recorder, want) {
+		t.Errorf("reloaded %+v\nwant     %+v", recorder, want)
+	}
+}
+
+func TestAccessListsApplyInvalid(t *testing.T) {
+
+	tests := []string{
+		"tunnel allow\n",
+		"tunnel permit 10.0.0.0/8\n",
+		"server allow 10.0.0.0/8\n",
+		"tunnel allow 10.0.0.0/8 extra\n",
+	}
+
+	for _, content := range tests {
+		path := filepath.Join(t.TempDir(), `access`)
+		os.WriteFile(path, []byte(content), 0600)
+
+		if err := (accessLists{}).apply(&accessRecorder{}, path); err == nil {
+			t.Errorf(`accepted access file '%q'`, content)
+		}
+	}
+
+	if err := (accessLists{}).apply(&accessRecorder{}, filepath.Join(t.TempDir(), `missing`)); err == nil {
+		t.Error(`accepted missing access file`)
+	}
+}
+
+func TestParseLocal(t *testing.T) {
+
+	tests := []struct {
+		spec        string
+		wantAddress string
+		wantRemote  string
+		wantErr     bool
+	}{
+		{`5432:db.internal:5432`, `127.0.0.1:5432`, `db.internal:5432`, false},
+		{`0.0.0.0:8080:10.0.0.5:80`, `0.0.0.0:8080`, `10.0.0.5:80`, false},
+		{`localhost:8080:web:80`, `localhost:8080`, `web:80`, false},
+		{`[::1]:8080:[2001:db8::5]:80`, `[::1]:8080`, `[2001:db8::5]:80`, false},
+		{`8080:[2001:db8::5]:80`, `127.0.0.1:8080`, `[2001:db8::5]:80`, false},
+		{`[::]:8080:web:80`, `[::]:8080`, `web:80`, false},
+		{`8080:web`, ``, ``, true},
+		{`a:b:c:d:e`, ``, ``, true},
+		{`8080:2001:db8::5:80`, ``, ``, true}, // IPv6 without brackets
+		{`[::1:8080:web:80`, ``, ``, true},
+		{``, ``, ``, true},
+	}
+
+	for _, tt := range tests {
+		address, remote, err := parseLocal(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf(`%s: error = %v, want error %v`, tt.spec, err, tt.wantErr)
+			continue
+		}
+		if address != tt.wantAddress || remote != tt.wantRemote {
+			t.Errorf(`%s: parsed as '%s' to '%s', want '%s' to '%s'`, tt.spec, address, remote, tt.wantAddress, tt.wantRemote)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// accessList decides which addresses may connect to one kind of listener. If there are allow rules, an address must
+// match one of them; an address that matches a deny rule is never admitted. Addresses that are not IP addresses,
+// such as those of peers on Unix sockets, are always admitted.
+type accessList struct {
+	rejected uint64 // accessed atomically, so kept first for alignment
+
+	name  string // describes the listeners in logs
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	mutex *sync.RWMutex
+}
+
+func newAccessList(name string) *accessList {
+
+	return &accessList{
+		name:  name,
+		mutex: &sync.RWMutex{},
+	}
+}
+
+// add appends rules to the list.
+func (al *accessList) add(allow, deny []string) error {
+
+	allowNetworks, denyNetworks, err := parseNetworks(allow, deny)
+	if err != nil {
+		return err
+	}
+
+	al.mutex.Lock()
+	al.allow = append(al.allow, allowNetworks...)
+	al.deny = append(al.deny, denyNetworks...)
+	al.mutex.Unlock()
+
+	return nil
+}
+
+// set replaces the rules of the list. If any rule is invalid, the list is left unchanged.
+func (al *accessList) set(allow, deny []string) error {
+
+	allowNetworks, denyNetworks, err := parseNetworks(allow, deny)
+	if err != nil {
+		return err
+	}
+
+	al.mutex.Lock()
+	al.allow, al.deny = allowNetworks, denyNetworks
+	al.mutex.Unlock()
+
+	return nil
+}
+
+// admit reports whether addr may connect. Rejections are counted and logged.
+func (al *accessList) admit(addr net.Addr, logger *log.Logger) bool {
+
+	if al.allows(addr) {
+		return true
+	}
+
+	rejected := atomic.AddUint64(&al.rejected, 1)
+	logger.Printf(`rejected connection from %s to %s (%d rejected so far)`, addr.String(), al.name, rejected)
+
+	return false
+}
+
+func (al *accessList) allows(addr net.Addr) bool {
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+
+	al.mutex.RLock()
+	defer al.mutex.RUnlock()
+
+	for _, network := range al.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(al.allow) == 0 {
+		return true
+	}
+
+	for _, network := range al.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworks(allow, deny []string) (allowNetworks, denyNetworks []*net.IPNet, err error) {
+
+	for _, value := range allow {
+		network, err := shared.ParseNetwork(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		allowNetworks = append(allowNetworks, network)
+	}
+
+	for _, value := range deny {
+		network, err := shared.ParseNetwork(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		denyNetworks = append(denyNetworks, network)
+	}
+
+	return allowNetworks, denyNetworks, nil
+}
+
+// accessListener closes connections that its access list does not admit instead of returning them from Accept.
+type accessListener struct {
+	net.Listener
+	access *accessList
+	logger *log.Logger
+}
+
+func (al *accessListener) Accept() (net.Conn, error) {
+
+	for {
+		conn, err := al.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if al.access.admit(conn.RemoteAddr(), al.logger) {
+			return conn, nil
+		}
+
+		conn.Close()
+	}
+}
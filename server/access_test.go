@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4400}
+}
+
+func TestAccessListAllows(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		addr  net.Addr
+		want  bool
+	}{
+		{`no rules`, nil, nil, tcpAddr(`203.0.113.9`), true},
+		{`allowed block`, []string{`10.0.0.0/8`}, nil, tcpAddr(`10.200.0.1`), true},
+		{`outside allowed block`, []string{`10.0.0.0/8`}, nil, tcpAddr(`172.16.0.1`), false},
+		{`block boundary`, []string{`192.168.0.0/23`}, nil, tcpAddr(`192.168.1.255`), true},
+		{`past block boundary`, []string{`192.168.0.0/23`}, nil, tcpAddr(`192.168.2.0`), false},
+		{`denied`, nil, []string{`10.0.0.0/8`}, tcpAddr(`10.0.0.1`), false},
+		{`not denied`, nil, []string{`10.0.0.0/8`}, tcpAddr(`11.0.0.1`), true},
+		{`deny wins over allow`, []string{`10.0.0.0/8`}, []string{`10.1.0.0/16`}, tcpAddr(`10.1.2.3`), false},
+		{`allowed beside denied`, []string{`10.0.0.0/8`}, []string{`10.1.0.0/16`}, tcpAddr(`10.2.0.1`), true},
+		{`single address`, []string{`127.0.0.1`}, nil, tcpAddr(`127.0.0.1`), true},
+		{`ipv4-mapped ipv6`, []string{`127.0.0.0/8`}, nil, tcpAddr(`::ffff:127.0.0.1`), true},
+		{`ipv6`, []string{`2001:db8::/32`}, nil, tcpAddr(`2001:db8:1::1`), true},
+		{`ipv6 outside`, []string{`2001:db8::/32`}, nil, tcpAddr(`2001:db9::1`), false},
+		{`ipv4 rules and ipv6 peer`, []string{`0.0.0.0/0`}, nil, tcpAddr(`::1`), false},
+		{`udp`, nil, []string{`10.0.0.0/8`}, &net.UDPAddr{IP: net.ParseIP(`10.0.0.1`)}, false},
+		{`unix socket`, []string{`10.0.0.0/8`}, nil, &net.UnixAddr{Name: `@`, Net: `unix`}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			al := newAccessList(`test`)
+			if err := al.set(tt.allow, tt.deny); err != nil {
+				t.Fatalf(`set: %s`, err.Error())
+			}
+			if got := al.allows(tt.addr); got != tt.want {
+				t.Errorf(`allows(%s) = %v, want %v`, tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessListReload(t *testing.T) {
+
+	al := newAccessList(`test`)
+	if err := al.add([]string{`10.0.0.0/8`}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.add([]string{`192.168.0.0/16`}, []string{`10.9.0.0/16`}); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, want := range map[string]bool{`10.0.0.1`: true, `192.168.3.4`: true, `10.9.0.1`: false, `8.8.8.8`: false} {
+		if got := al.allows(tcpAddr(addr)); got != want {
+			t.Errorf(`after add: allows(%s) = %v, want %v`, addr, got, want)
+		}
+	}
+
+	// set replaces every rule
+	if err := al.set([]string{`8.8.8.0/24`}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{`10.0.0.1`: false, `10.9.0.1`: false, `8.8.8.8`: true} {
+		if got := al.allows(tcpAddr(addr)); got != want {
+			t.Errorf(`after set: allows(%s) = %v, want %v`, addr, got, want)
+		}
+	}
+
+	// an invalid reload leaves the list as it was
+	if err := al.set([]string{`1.1.1.0/24`}, []string{`not-an-address`}); err == nil {
+		t.Fatal(`invalid rule was accepted`)
+	}
+	if !al.allows(tcpAddr(`8.8.8.8`)) || al.allows(tcpAddr(`1.1.1.1`)) {
+		t.Error(`invalid reload changed the list`)
+	}
+
+	if err := al.set(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !al.allows(tcpAddr(`10.0.0.1`)) {
+		t.Error(`empty list does not admit everyone`)
+	}
+}
+
+func TestAccessListReloadWhileAdmitting(t *testing.T) {
+
+	al := newAccessList(`test`)
+	logger := log.New(io.Discard, ``, 0)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			al.set([]string{`10.0.0.0/8`}, []string{`10.1.0.0/16`})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			al.admit(tcpAddr(`10.1.0.1`), logger)
+		}
+	}()
+	wg.Wait()
+
+	if al.admit(tcpAddr(`10.1.0.1`), logger) {
+		t.Error(`denied address was admitted`)
+	}
+	if al.rejected == 0 {
+		t.Error(`rejections were not counted`)
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// largest read from or write to a rate-limited connection, so that traffic is spread evenly instead of in bursts of whole buffers
+const maxLimitedRead = 16 * 1024
+
+// tokenBucket limits a rate in bytes per second while allowing bursts of up to its capacity. Takes that exceed the
+// available tokens put the bucket into debt, which the caller pays off by waiting.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// take removes n tokens from the bucket and returns how long the caller must wait before using them.
+func (tb *tokenBucket) take(n int) time.Duration {
+
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// allow removes n tokens from the bucket if that many are available, and reports whether it did.
+func (tb *tokenBucket) allow(n int) bool {
+
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+
+	if tb.tokens < float64(n) {
+		return false
+	}
+
+	tb.tokens -= float64(n)
+	return true
+}
+
+// refill adds the tokens accrued since the last take. Must be called with tb.mutex held.
+func (tb *tokenBucket) refill() {
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// bandwidthLimit is a pair of token buckets, one for each direction of traffic.
+type bandwidthLimit struct {
+	toClient   *tokenBucket
+	fromClient *tokenBucket
+}
+
+// newBandwidthLimit returns a limit of rate bytes per second in each direction with bursts of up to burst bytes, or
+// of one second's worth if burst is zero. It returns nil if rate is zero, i.e. unlimited.
+func newBandwidthLimit(rate, burst int) *bandwidthLimit {
+
+	if rate == 0 {
+		return nil
+	}
+
+	if burst == 0 {
+		burst = rate
+	}
+
+	return &bandwidthLimit{
+		toClient:   newTokenBucket(rate, burst),
+		fromClient: newTokenBucket(rate, burst),
+	}
+}
+
+// bandwidthSpec is the configuration of limits that are created per tunnel or per identity.
+type bandwidthSpec struct {
+	rate  int
+	burst int
+}
+
+// limitClientConn applies limits to a connection upgraded from a request of the httptun client: writes to it carry
+// traffic towards the client, and reads from it carry traffic from the client. Nil limits are ignored.
+func limitClientConn(conn net.Conn, limits ...*bandwidthLimit) net.Conn {
+
+	to, from := buckets(limits, true), buckets(limits, false)
+	if len(to) == 0 {
+		return conn
+	}
+
+	return &limitedConn{Conn: conn, toClient: to, fromClient: from}
+}
+
+// buckets returns the buckets of limits for traffic towards the client, or from it. Nil limits are ignored.
+func buckets(limits []*bandwidthLimit, toClient bool) []*tokenBucket {
+
+	var buckets []*tokenBucket
+	for _, limit := range limits {
+		switch {
+		case limit == nil:
+		case toClient:
+			buckets = append(buckets, limit.toClient)
+		default:
+			buckets = append(buckets, limit.fromClient)
+		}
+	}
+
+	return buckets
+}
+
+// wait takes n tokens from each bucket and sleeps until the slowest of them allows them to be used.
+func wait(buckets []*tokenBucket, n int) {
+
+	var delay time.Duration
+	for _, tb := range buckets {
+		if d := tb.take(n); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedConn is a connection to the httptun client whose reads and writes are paced by token buckets.
+type limitedConn struct {
+	net.Conn
+	toClient   []*tokenBucket
+	fromClient []*tokenBucket
+}
+
+func (lc *limitedConn) Read(b []byte) (int, error) {
+
+	if len(b) > maxLimitedRead {
+		b = b[:maxLimitedRead]
+	}
+
+	n, err := lc.Conn.Read(b)
+	if n > 0 {
+		wait(lc.fromClient, n)
+	}
+
+	return n, err
+}
+
+func (lc *limitedConn) Write(b []byte) (int, error) {
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxLimitedRead {
+			chunk = chunk[:maxLimitedRead]
+		}
+
+		wait(lc.toClient, len(chunk))
+
+		n, err := lc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so, so that joining is unaffected.
+func (lc *limitedConn) CloseWrite() error {
+
+	if cw, ok := lc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return lc.Conn.Close()
+}
+
+// identityRegistry holds the bandwidth limit of each identity that has tunnels or dialed connections, so that all of
+// them share it.
+type identityRegistry struct {
+	spec   bandwidthSpec
+	limits map[string]*bandwidthLimit
+	refs   map[string]int
+	mutex  *sync.Mutex
+}
+
+func newIdentityRegistry() *identityRegistry {
+
+	return &identityRegistry{
+		limits: map[string]*bandwidthLimit{},
+		refs:   map[string]int{},
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// acquire returns the limit of identity, which must be released when it is no longer used. It returns nil if
+// identities are not limited.
+func (ir *identityRegistry) acquire(identity string) *bandwidthLimit {
+
+	if ir.spec.rate == 0 {
+		return nil
+	}
+
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+
+	limit := ir.limits[identity]
+	if limit == nil {
+		limit = newBandwidthLimit(ir.spec.rate, ir.spec.burst)
+		ir.limits[identity] = limit
+	}
+	ir.refs[identity]++
+
+	return limit
+}
+
+func (ir *identityRegistry) release(identity string) {
+
+	if ir.spec.rate == 0 {
+		return
+	}
+
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+
+	if ir.refs[identity]--; ir.refs[identity] <= 0 {
+		delete(ir.refs, identity)
+		delete(ir.limits, identity)
+	}
+}
+
+// identify names the owner of a request for the purpose of sharing limits: the common name of its TLS client
+// certificate if there is one, or else its IP address.
+func identify(req *http.Request) string {
+
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return `cn:` + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return `ip:` + req.RemoteAddr
+	}
+
+	return `ip:` + host
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		tokens  float64       // before the take
+		elapsed time.Duration // since the last take
+		take    int
+		want    float64 // tokens left after the take
+		delay   time.Duration
+	}{
+		{`full bucket`, 500, 0, 100, 400, 0},
+		{`refills at rate`, 0, 200 * time.Millisecond, 100, 100, 0},
+		{`refill is capped at burst`, 0, time.Hour, 100, 400, 0},
+		{`exactly empty`, 100, 0, 100, 0, 0},
+		{`debt is waited for`, 100, 0, 600, -500, 500 * time.Millisecond},
+		{`debt is paid off over time`, -500, 250 * time.Millisecond, 0, -250, 250 * time.Millisecond},
+		{`debt is paid off entirely`, -500, time.Second, 100, 400, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// 1000 bytes per second with bursts of up to 500
+			tb := newTokenBucket(1000, 500)
+			tb.tokens = tt.tokens
+			tb.last = time.Now().Add(-tt.elapsed)
+
+			delay := tb.take(tt.take)
+
+			// the clock moves on between setting last and taking, by far less than a millisecond's worth of tokens
+			if math.Abs(tb.tokens-tt.want) > 1 {
+				t.Errorf(`tokens = %.2f, want %.2f`, tb.tokens, tt.want)
+			}
+			if diff := delay - tt.delay; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf(`delay = %s, want %s`, delay, tt.delay)
+			}
+		})
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+
+	tb := newTokenBucket(1000, 500)
+
+	if !tb.allow(500) {
+		t.Fatal(`a full burst was not allowed`)
+	}
+	if tb.allow(100) {
+		t.Fatal(`more than a burst was allowed`)
+	}
+	// a refused take costs nothing
+	if tb.tokens < 0 {
+		t.Errorf(`tokens = %.2f after refusal, want >= 0`, tb.tokens)
+	}
+
+	tb.last = tb.last.Add(-200 * time.Millisecond)
+	if !tb.allow(150) {
+		t.Error(`tokens accrued over 200ms were not allowed`)
+	}
+}
+
+func TestNewBandwidthLimit(t *testing.T) {
+
+	if newBandwidthLimit(0, 100) != nil {
+		t.Error(`a rate of zero is limited`)
+	}
+
+	limit := newBandwidthLimit(1000, 0)
+	if limit.toClient.burst != 1000 || limit.fromClient.burst != 1000 {
+		t.Errorf(`default burst = %.0f, want one second's worth`, limit.toClient.burst)
+	}
+
+	// the directions are limited independently
+	limit.toClient.take(1000)
+	if limit.fromClient.tokens != 1000 {
+		t.Error(`traffic towards the client drew on the bucket for traffic from it`)
+	}
+}
+
+func TestIdentityRegistrySharesLimits(t *testing.T) {
+
+	ir := newIdentityRegistry()
+	if ir.acquire(`ip:10.0.0.1`) != nil {
+		t.Fatal(`identities are limited without a spec`)
+	}
+
+	ir.spec = bandwidthSpec{rate: 1000}
+
+	a := ir.acquire(`ip:10.0.0.1`)
+	b := ir.acquire(`ip:10.0.0.1`)
+	c := ir.acquire(`ip:10.0.0.2`)
+	if a != b || a == c {
+		t.Fatal(`limits are not shared by identity`)
+	}
+
+	ir.release(`ip:10.0.0.1`)
+	if ir.acquire(`ip:10.0.0.1`) != a {
+		t.Error(`limit was dropped while still in use`)
+	}
+	ir.release(`ip:10.0.0.1`)
+	ir.release(`ip:10.0.0.1`)
+	if ir.acquire(`ip:10.0.0.1`) == a {
+		t.Error(`limit was kept after its last release`)
+	}
+}
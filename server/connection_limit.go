@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// connectionSpec is the configuration of the connection limiter that is created for each tunnel.
+type connectionSpec struct {
+	max   int // concurrent connections, or zero for no limit
+	rate  int // new connections per second, or zero for no limit
+	burst int
+}
+
+// connectionLimiter caps the number of concurrent connections of a tunnel and the rate at which it accepts new ones.
+type connectionLimiter struct {
+	rejected uint64 // accessed atomically, so kept first for alignment
+
+	max    int
+	bucket *tokenBucket // nil if the rate is unlimited
+	active int
+	mutex  *sync.Mutex
+}
+
+// newConnectionLimiter returns a limiter as specified, or nil if spec does not limit anything.
+func newConnectionLimiter(spec connectionSpec) *connectionLimiter {
+
+	if spec.max == 0 && spec.rate == 0 {
+		return nil
+	}
+
+	cl := &connectionLimiter{
+		max:   spec.max,
+		mutex: &sync.Mutex{},
+	}
+
+	if spec.rate != 0 {
+		burst := spec.burst
+		if burst == 0 {
+			burst = spec.rate
+		}
+		cl.bucket = newTokenBucket(spec.rate, burst)
+	}
+
+	return cl
+}
+
+// admit counts conn against the limits and returns it wrapped so that closing it frees its place. If a limit is
+// exceeded, conn is closed and the error says which, along with the number of connections rejected so far.
+func (cl *connectionLimiter) admit(conn net.Conn) (net.Conn, error) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	var reason string
+	switch {
+	case cl.max != 0 && cl.active >= cl.max:
+		reason = `too many concurrent connections`
+	case cl.bucket != nil && !cl.bucket.allow(1):
+		reason = `too many new connections`
+	}
+
+	if reason != `` {
+		conn.Close()
+		rejected := atomic.AddUint64(&cl.rejected, 1)
+		return nil, errors.Errorf(`%s (%d rejected so far)`, reason, rejected)
+	}
+
+	cl.active++
+
+	return &limitedCountConn{Conn: conn, once: &sync.Once{}, release: cl.release}, nil
+}
+
+func (cl *connectionLimiter) release() {
+
+	cl.mutex.Lock()
+	cl.active--
+	cl.mutex.Unlock()
+}
+
+// limitedCountConn frees its place in a connectionLimiter when it is closed.
+type limitedCountConn struct {
+	net.Conn
+	once    *sync.Once
+	release func()
+}
+
+func (lc *limitedCountConn) Close() error {
+
+	lc.once.Do(lc.release)
+	return lc.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so, so that joining is unaffected.
+func (lc *limitedCountConn) CloseWrite() error {
+
+	if cw, ok := lc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return lc.Close()
+}
+
+// handshakeLimiter caps the number of upgrade requests that the Server handles at once.
+type handshakeLimiter struct {
+	rejected uint64 // accessed atomically, so kept first for alignment
+
+	slots chan struct{}
+}
+
+// newHandshakeLimiter returns a limiter of max concurrent handshakes, or nil if max is zero.
+func newHandshakeLimiter(max int) *handshakeLimiter {
+
+	if max == 0 {
+		return nil
+	}
+
+	return &handshakeLimiter{
+		slots: make(chan struct{}, max),
+	}
+}
+
+// acquire takes a slot without waiting and reports whether one was free. Taken slots must be released.
+func (hl *handshakeLimiter) acquire() bool {
+
+	select {
+	case hl.slots <- struct{}{}:
+		return true
+	default:
+		atomic.AddUint64(&hl.rejected, 1)
+		return false
+	}
+}
+
+func (hl *handshakeLimiter) release() {
+
+	<-hl.slots
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// pipe returns one end of a connection whose other end is closed when the test ends.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestConnectionLimiterAdmit(t *testing.T) {
+
+	type step struct {
+		close  int    // index of an admitted connection to close before admitting, or -1
+		reject string // part of the expected error, or empty if the connection is admitted
+	}
+
+	tests := []struct {
+		name  string
+		spec  connectionSpec
+		steps []step
+	}{
+		{`concurrent`, connectionSpec{max: 2}, []step{
+			{-1, ``},
+			{-1, ``},
+			{-1, `too many concurrent connections (1 rejected so far)`},
+			{0, ``},
+			{-1, `too many concurrent connections (2 rejected so far)`},
+		}},
+		{`closing twice frees one place`, connectionSpec{max: 2}, []step{
+			{-1, ``},
+			{-1, ``},
+			{0, ``},
+			{0, `too many concurrent connections`},
+		}},
+		{`rate`, connectionSpec{rate: 1, burst: 2}, []step{
+			{-1, ``},
+			{-1, ``},
+			{-1, `too many new connections`},
+			// closing does not give back tokens
+			{0, `too many new connections`},
+		}},
+		{`both`, connectionSpec{max: 1, rate: 100}, []step{
+			{-1, ``},
+			{-1, `too many concurrent connections`},
+			{0, ``},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := newConnectionLimiter(tt.spec)
+
+			var admitted []net.Conn
+			for i, s := range tt.steps {
+				if s.close >= 0 {
+					admitted[s.close].Close()
+				}
+
+				conn, peer := pipe(t)
+				limited, err := cl.admit(conn)
+
+				if s.reject == `` {
+					if err != nil {
+						t.Fatalf(`step %d: rejected: %s`, i, err.Error())
+					}
+					admitted = append(admitted, limited)
+					continue
+				}
+
+				if err == nil || !strings.Contains(err.Error(), s.reject) {
+					t.Fatalf(`step %d: error = %v, want '%s'`, i, err, s.reject)
+				}
+				// rejected connections are closed
+				if _, err := peer.Write([]byte{0}); err == nil {
+					t.Errorf(`step %d: rejected connection was left open`, i)
+				}
+			}
+		})
+	}
+}
+
+func TestNewConnectionLimiter(t *testing.T) {
+
+	if newConnectionLimiter(connectionSpec{}) != nil {
+		t.Error(`an empty spec limits connections`)
+	}
+
+	if cl := newConnectionLimiter(connectionSpec{rate: 5}); cl.bucket.burst != 5 {
+		t.Errorf(`default burst = %.0f, want 5`, cl.bucket.burst)
+	}
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+
+	if newHandshakeLimiter(0) != nil {
+		t.Fatal(`zero limits handshakes`)
+	}
+
+	hl := newHandshakeLimiter(2)
+
+	if !hl.acquire() || !hl.acquire() {
+		t.Fatal(`free slots were refused`)
+	}
+	if hl.acquire() {
+		t.Fatal(`a third slot was acquired`)
+	}
+
+	hl.release()
+	if !hl.acquire() {
+		t.Error(`a released slot was refused`)
+	}
+
+	if hl.rejected != 1 {
+		t.Errorf(`rejected = %d, want 1`, hl.rejected)
+	}
+}
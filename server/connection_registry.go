@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// connectionRegistry tracks joined connections that do not belong to a tunnel, such as those dialed on behalf of
+// clients, so that they can be closed when the server stops.
+type connectionRegistry struct {
+	conns  map[net.Conn]bool
+	closed bool
+	wg     *sync.WaitGroup
+	mutex  *sync.Mutex
+}
+
+func newConnectionRegistry(wg *sync.WaitGroup) *connectionRegistry {
+
+	return &connectionRegistry{
+		conns: map[net.Conn]bool{},
+		wg:    wg,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// join copies data between a and b in the background until either side is done, and then calls done.
+func (cr *connectionRegistry) join(a, b net.Conn, done func()) {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if cr.closed {
+		a.Close()
+		b.Close()
+		done()
+		return
+	}
+
+	cr.conns[a] = true
+	cr.conns[b] = true
+
+	cr.wg.Add(1)
+	go func() {
+		defer cr.wg.Done()
+
+		shared.Join(a, b)
+
+		cr.mutex.Lock()
+		delete(cr.conns, a)
+		delete(cr.conns, b)
+		cr.mutex.Unlock()
+
+		done()
+	}()
+}
+
+// add tracks conns that are not joined, such as those still being routed, until they are removed. If the registry is
+// closed, it closes them instead and returns false.
+func (cr *connectionRegistry) add(conns ...net.Conn) bool {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if cr.closed {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+
+	for _, conn := range conns {
+		cr.conns[conn] = true
+	}
+
+	return true
+}
+
+// remove stops tracking conns, which the caller has handed on or closed.
+func (cr *connectionRegistry) remove(conns ...net.Conn) {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	for _, conn := range conns {
+		delete(cr.conns, conn)
+	}
+}
+
+// close closes every tracked connection and any that are joined afterwards.
+func (cr *connectionRegistry) close() {
+
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cr.closed = true
+
+	for conn := range cr.conns {
+		conn.Close()
+	}
+}
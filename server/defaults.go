@@ -1,5 +1,7 @@
 package server
 
+import "time"
+
 const (
 	defaultClientIP        = `127.0.0.1`
 	defaultClientPortLower = 4400
@@ -7,4 +9,75 @@ const (
 
 	defaultTunnelIP   = `127.0.0.1`
 	defaultTunnelPort = 4235
+
+	// how long an accepted connection waits for the client to attach to it
+	defaultAttachTimeout = 10 * time.Second
+	// the most accepted connections whose announcements may wait to be written to a client
+	maxPendingNotices = 256
+
+	// how long a source of datagrams on a UDP tunnel may be sent replies after it was last heard from
+	defaultUdpIdleTimeout = 2 * time.Minute
+
+	// how long a connection to the tunnel listener may take to send its PROXY protocol header
+	defaultProxyHeaderTimeout = 10 * time.Second
+
+	// how long a connection on a virtual host port may take to reveal which host it is for
+	defaultRouteTimeout = 10 * time.Second
+
+	// how long a client may take to establish an encrypted channel inside its upgraded connection
+	defaultEncryptionTimeout = 10 * time.Second
+
+	// how long a client may take to send and receive the message that probes a transport
+	defaultProbeTimeout = 10 * time.Second
+
+	// how long a long poll waits for data, and how long a long-poll session lasts without requests
+	defaultPollWait           = 20 * time.Second
+	defaultPollSessionTimeout = time.Minute
+	// the most data returned by one long poll
+	maxPollResponse = 64 * 1024
+
+	// the largest request accepted in disguise mode
+	maxDisguisedRequest = 4 * 1024 * 1024
+
+	// how long the server waits when dialing a destination on behalf of a client
+	defaultDialTimeout = 10 * time.Second
+
+	// how long a handoff waits for the new process to report that it has started
+	defaultHandoffTimeout = 10 * time.Second
+	// how long inherited client listeners wait for their clients to reconnect
+	defaultInheritedGrace = 30 * time.Second
 )
+
+// defaultStatusPage is the template of the page served to requests that are not for a tunnel, unless another is
+// configured.
+const defaultStatusPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>httptun</title>
+</head>
+<body>
+<h1>httptun {{.Version}}</h1>
+<p>This server accepts tunnels from httptun clients.</p>
+<table>
+<tr><th align="left">Status</th><td>{{if .Ready}}healthy{{else}}unavailable{{end}} ({{.State}})</td></tr>
+<tr><th align="left">Tunnels</th><td>{{.Tunnels}}</td></tr>
+<tr><th align="left">Uptime</th><td>{{.Uptime}}</td></tr>
+</table>
+</body>
+</html>
+`
+
+// defaultDecoyPage is served in disguise mode when neither a decoy site nor a status template is configured.
+const defaultDecoyPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Welcome</title>
+</head>
+<body>
+<h1>Welcome</h1>
+<p>This site is under construction. Please check back soon.</p>
+</body>
+</html>
+`
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// destinationRule matches destinations that clients ask the server to dial. A rule is written as 'host:ports' where
+// host is a hostname, a '*.'-prefixed domain suffix, an IP address, a CIDR block, or '*', and ports is a single
+// port, an inclusive range such as '8000-8999', or '*'.
+type destinationRule struct {
+	host      string
+	network   *net.IPNet
+	portLower int
+	portUpper int
+}
+
+func parseDestinationRule(rule string) (*destinationRule, error) {
+
+	index := strings.LastIndex(rule, `:`)
+	if index < 0 {
+		return nil, errors.Errorf(`invalid destination rule: must be 'host:ports' (got '%s')`, rule)
+	}
+
+	host, ports := strings.Trim(rule[:index], `[]`), rule[index+1:]
+	if host == `` {
+		return nil, errors.Errorf(`invalid destination rule: host is required (got '%s')`, rule)
+	}
+
+	dr := &destinationRule{
+		host:      canonicalHost(host),
+		portLower: 1,
+		portUpper: 65535,
+	}
+
+	if strings.Contains(host, `/`) || net.ParseIP(host) != nil {
+		network, err := shared.ParseNetwork(host)
+		if err != nil {
+			return nil, errors.Errorf(`invalid destination rule: bad CIDR block (got '%s')`, rule)
+		}
+		dr.host, dr.network = ``, network
+	}
+
+	if ports != `*` {
+		lower, upper := ports, ports
+		if i := strings.Index(ports, `-`); i >= 0 {
+			lower, upper = ports[:i], ports[i+1:]
+		}
+
+		var err error
+		if dr.portLower, err = strconv.Atoi(lower); err != nil || dr.portLower < 1 || dr.portLower > 65535 {
+			return nil, errors.Errorf(`invalid destination rule: bad port (got '%s')`, rule)
+		}
+		if dr.portUpper, err = strconv.Atoi(upper); err != nil || dr.portUpper < dr.portLower || dr.portUpper > 65535 {
+			return nil, errors.Errorf(`invalid destination rule: bad port (got '%s')`, rule)
+		}
+	}
+
+	return dr, nil
+}
+
+func (dr *destinationRule) matchesPort(port int) bool {
+
+	return port >= dr.portLower && port <= dr.portUpper
+}
+
+// matchesHost reports whether the rule matches the hostname as it was requested.
+func (dr *destinationRule) matchesHost(host string) bool {
+
+	switch {
+	case dr.host == ``:
+		return false
+	case dr.host == `*`:
+		return true
+	case strings.HasPrefix(dr.host, `*.`):
+		return strings.HasSuffix(host, dr.host[1:])
+	default:
+		return host == dr.host
+	}
+}
+
+// matchesIP reports whether the rule matches an address the requested host resolved to.
+func (dr *destinationRule) matchesIP(ip net.IP) bool {
+
+	return dr.network != nil && dr.network.Contains(ip)
+}
+
+// destinationPolicy decides which destinations the server is willing to dial on behalf of clients. Nothing is
+// allowed unless an allow rule matches it, and nothing is allowed that a deny rule matches.
+type destinationPolicy struct {
+	allow []*destinationRule
+	deny  []*destinationRule
+	mutex *sync.RWMutex
+}
+
+func newDestinationPolicy() *destinationPolicy {
+
+	return &destinationPolicy{
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (dp *destinationPolicy) addAllow(rules ...string) error {
+
+	return dp.add(&dp.allow, rules)
+}
+
+func (dp *destinationPolicy) addDeny(rules ...string) error {
+
+	return dp.add(&dp.deny, rules)
+}
+
+func (dp *destinationPolicy) add(list *[]*destinationRule, rules []string) error {
+
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+
+	for _, rule := range rules {
+		dr, err := parseDestinationRule(rule)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, dr)
+	}
+
+	return nil
+}
+
+// resolve checks target against the policy and returns the address that should be dialed. Hostnames are resolved
+// here so that the address that was checked is the address that gets dialed.
+func (dp *destinationPolicy) resolve(target string) (string, error) {
+
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return ``, errors.Errorf(`invalid destination (got '%s')`, target)
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return ``, errors.Errorf(`invalid destination port (got '%s')`, target)
+	}
+
+	ips, err := lookupIP(host)
+	if err != nil {
+		return ``, errors.Errorf(`could not resolve destination '%s'`, host)
+	}
+
+	// rules match the host however it was spelled
+	name := canonicalHost(host)
+
+	dp.mutex.RLock()
+	defer dp.mutex.RUnlock()
+
+	for _, ip := range ips {
+		if dp.allowed(name, ip, port) {
+			return net.JoinHostPort(ip.String(), portString), nil
+		}
+	}
+
+	return ``, errors.Errorf(`destination '%s' is not allowed`, target)
+}
+
+// allowed reports whether host, as resolved to ip, may be dialed on port.
+func (dp *destinationPolicy) allowed(host string, ip net.IP, port int) bool {
+
+	return matchesAny(dp.allow, host, ip, port) && !matchesAny(dp.deny, host, ip, port)
+}
+
+func matchesAny(rules []*destinationRule, host string, ip net.IP, port int) bool {
+
+	for _, dr := range rules {
+		if dr.matchesPort(port) && (dr.matchesHost(host) || dr.matchesIP(ip)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalHost returns host in the form in which rules are matched against it: lower-case, without the trailing dot
+// of a fully qualified name, and, for an IP address, in its shortest form.
+func canonicalHost(host string) string {
+
+	host = strings.TrimRight(strings.ToLower(host), `.`)
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+func lookupIP(host string) ([]net.IP, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	return net.LookupIP(host)
+}
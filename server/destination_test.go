@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDestinationPolicyAllowed(t *testing.T) {
+
+	dp := newDestinationPolicy()
+	if err := dp.addAllow(`*.internal:*`, `db.corp:5432`, `10.0.0.0/8:8000-8999`, `[2001:db8::/32]:443`, `192.0.2.10:22`); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.addDeny(`secret.internal:*`, `*.admin.internal:443`, `10.1.0.0/16:*`, `Secret.Corp.:5432`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string // as requested
+		ip      string // as resolved
+		port    int
+		allowed bool
+	}{
+		{`api.internal`, `192.0.2.1`, 80, true},
+		{`API.Internal`, `192.0.2.1`, 80, true},
+		{`api.internal.`, `192.0.2.1`, 80, true},
+		{`internal`, `192.0.2.1`, 80, false},                 // a suffix does not match the bare domain
+		{`api.internal.example.com`, `192.0.2.1`, 80, false}, // nor a name that merely contains it
+		{`secret.internal`, `192.0.2.1`, 80, false},          // deny takes precedence over allow
+		{`secret.internal.`, `192.0.2.1`, 80, false},
+		{`SECRET.internal..`, `192.0.2.1`, 80, false},
+		{`x.admin.internal`, `192.0.2.1`, 443, false},
+		{`x.admin.internal`, `192.0.2.1`, 444, true}, // the deny rule is limited to a port
+		{`db.corp`, `192.0.2.2`, 5432, true},
+		{`db.corp`, `192.0.2.2`, 5433, false},
+		{`secret.corp`, `192.0.2.3`, 5432, false}, // allowed by nothing
+		{`10.2.3.4`, `10.2.3.4`, 8000, true},
+		{`10.2.3.4`, `10.2.3.4`, 8999, true},
+		{`10.2.3.4`, `10.2.3.4`, 7999, false},
+		{`10.2.3.4`, `10.2.3.4`, 9000, false},
+		{`10.1.3.4`, `10.1.3.4`, 8080, false},    // denied block inside an allowed one
+		{`web.example`, `10.1.3.4`, 8080, false}, // a name that resolves into a denied block
+		{`web.example`, `10.2.3.4`, 8080, true},  // a name that resolves into an allowed block
+		{`2001:db8::1`, `2001:db8::1`, 443, true},
+		{`2001:db8::1`, `2001:db8::1`, 80, false},
+		{`192.0.2.10`, `192.0.2.10`, 22, true},
+		{`::ffff:192.0.2.10`, `192.0.2.10`, 22, true},
+	}
+
+	for _, tt := range tests {
+		if allowed := dp.allowed(canonicalHost(tt.host), net.ParseIP(tt.ip), tt.port); allowed != tt.allowed {
+			t.Errorf(`%s (%s) port %d: allowed = %v, want %v`, tt.host, tt.ip, tt.port, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestDestinationPolicyResolve(t *testing.T) {
+
+	dp := newDestinationPolicy()
+	if err := dp.addAllow(`*:*`); err != nil {
+		t.Fatal(err)
+	}
+	if err := dp.addDeny(`127.0.0.0/8:*`, `[::1]:*`, `169.254.169.254:80`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target  string
+		want    string // empty if refused
+		wantErr string
+	}{
+		{`192.0.2.1:80`, `192.0.2.1:80`, ``},
+		{`[2001:db8::1]:443`, `[2001:db8::1]:443`, ``},
+		{`127.0.0.1:22`, ``, `is not allowed`},
+		{`[::ffff:127.0.0.1]:22`, ``, `is not allowed`},
+		{`[::1]:22`, ``, `is not allowed`},
+		{`[0:0:0:0:0:0:0:1]:22`, ``, `is not allowed`},
+		{`169.254.169.254:80`, ``, `is not allowed`},
+		{`169.254.169.254:81`, `169.254.169.254:81`, ``},
+		{`192.0.2.1`, ``, `invalid destination`},
+		{`192.0.2.1:0`, ``, `invalid destination port`},
+		{`192.0.2.1:65536`, ``, `invalid destination port`},
+	}
+
+	for _, tt := range tests {
+		got, err := dp.resolve(tt.target)
+		if tt.wantErr != `` {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf(`%s: error = %v, want one containing '%s'`, tt.target, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf(`%s: resolved to '%s' (%v), want '%s'`, tt.target, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseDestinationRule(t *testing.T) {
+
+	tests := []struct {
+		rule    string
+		wantErr string
+	}{
+		{`example.com:80`, ``},
+		{`*.example.com:1-65535`, ``},
+		{`[2001:db8::/32]:*`, ``},
+		{`2001:db8::/32:*`, ``},
+		{`example.com`, `must be 'host:ports'`},
+		{`:80`, `host is required`},
+		{`10.0.0.0/33:80`, `bad CIDR block`},
+		{`example.com:0`, `bad port`},
+		{`example.com:90-80`, `bad port`},
+		{`example.com:80-65536`, `bad port`},
+		{`example.com:http`, `bad port`},
+	}
+
+	for _, tt := range tests {
+		_, err := parseDestinationRule(tt.rule)
+		if tt.wantErr == `` && err != nil {
+			t.Errorf(`%s: unexpected error: %s`, tt.rule, err.Error())
+		}
+		if tt.wantErr != `` && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf(`%s: error = %v, want one containing '%s'`, tt.rule, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// disguised handles a request under the disguise path by translating it into a request of the long-poll transport
+// and its response back into JSON.
+func (s *server) disguised(rw http.ResponseWriter, req *http.Request) {
+
+	inner := req.Clone(req.Context())
+	inner.URL.Path = `/`
+	if s.handshakePath != `` {
+		inner.URL.Path = s.handshakePath
+	}
+	inner.Header = http.Header{}
+	inner.Body = http.NoBody
+	inner.ContentLength = 0
+
+	body := &shared.DisguisedRequest{}
+	if req.Method == http.MethodPost {
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxDisguisedRequest)).Decode(body); err != nil {
+			s.page(rw, req)
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, s.disguisePath)
+
+	switch id, rest := splitSession(path); {
+	case path == shared.DisguiseSessionsPath && req.Method == http.MethodPost:
+		inner.Header = shared.UndisguiseAttributes(body.Attributes)
+		inner.Header.Set(shared.HeaderTransport, shared.TransportPoll)
+	case id != `` && rest == shared.DisguiseMessagesPath && (req.Method == http.MethodPost || req.Method == http.MethodGet):
+		inner.Header.Set(shared.HeaderSession, id)
+		if body.Done {
+			inner.Header.Set(shared.HeaderEof, `1`)
+		}
+		// posts say where their data begins, and polls how much data the client has received, like a cursor
+		if sequence := body.Attributes[`sequence`]; sequence != `` {
+			inner.Header.Set(shared.HeaderSequence, sequence)
+		}
+		if ack := req.URL.Query().Get(shared.DisguiseAckParameter); ack != `` {
+			inner.Header.Set(shared.HeaderAck, ack)
+		}
+		inner.Body = io.NopCloser(bytes.NewReader(body.Payload))
+		inner.ContentLength = int64(len(body.Payload))
+	case id != `` && rest == `` && req.Method == http.MethodDelete:
+		inner.Header.Set(shared.HeaderSession, id)
+	default:
+		s.page(rw, req)
+		return
+	}
+
+	writer := newDisguisedWriter(rw)
+	s.handle(writer, inner)
+	writer.send()
+}
+
+// splitSession splits a path of the form '/sessions/<id>[/rest]' into the session identifier and the rest.
+func splitSession(path string) (string, string) {
+
+	if !strings.HasPrefix(path, shared.DisguiseSessionsPath+`/`) {
+		return ``, ``
+	}
+
+	id := strings.TrimPrefix(path, shared.DisguiseSessionsPath+`/`)
+	rest := ``
+	if i := strings.Index(id, `/`); i >= 0 {
+		id, rest = id[:i], id[i:]
+	}
+
+	return id, rest
+}
+
+// disguisedWriter collects the response of the long-poll transport and sends it as a DisguisedResponse, either when
+// it is flushed or when the handler is done.
+type disguisedWriter struct {
+	rw     http.ResponseWriter
+	header http.Header
+	status int
+	body   *bytes.Buffer
+	mutex  *sync.Mutex
+	sent   bool
+}
+
+func newDisguisedWriter(rw http.ResponseWriter) *disguisedWriter {
+
+	return &disguisedWriter{
+		rw:     rw,
+		header: http.Header{},
+		body:   &bytes.Buffer{},
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func (dw *disguisedWriter) Header() http.Header {
+
+	return dw.header
+}
+
+func (dw *disguisedWriter) WriteHeader(status int) {
+
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	if dw.status == 0 {
+		dw.status = status
+	}
+}
+
+func (dw *disguisedWriter) Write(b []byte) (int, error) {
+
+	dw.WriteHeader(http.StatusOK)
+
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	if dw.sent {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	return dw.body.Write(b)
+}
+
+// Flush sends the response at once, for handshakes whose handler goes on to use the session.
+func (dw *disguisedWriter) Flush() {
+
+	dw.send()
+}
+
+// send writes the response collected so far as JSON, unless it has been sent already.
+func (dw *disguisedWriter) send() {
+
+	dw.mutex.Lock()
+	defer dw.mutex.Unlock()
+
+	if dw.sent {
+		return
+	}
+	dw.sent = true
+
+	status := dw.status
+	if status == 0 || status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+
+	response := &shared.DisguisedResponse{
+		Attributes: shared.DisguiseAttributes(dw.header),
+		Done:       dw.header.Get(shared.HeaderEof) != ``,
+		Nonce:      shared.DisguisePadding(),
+	}
+	delete(response.Attributes, `eof`)
+
+	if status >= http.StatusBadRequest {
+		response.Error = strings.TrimSpace(dw.body.String())
+	} else {
+		response.Payload = dw.body.Bytes()
+	}
+
+	encoded, _ := json.Marshal(response)
+
+	// the length lets the client finish reading the response even if the handler carries on
+	dw.rw.Header().Set(`Content-Type`, `application/json; charset=utf-8`)
+	dw.rw.Header().Set(`Content-Length`, strconv.Itoa(len(encoded)))
+	dw.rw.Header().Set(`Cache-Control`, `no-store`)
+	if dw.header.Get(`Connection`) != `` {
+		dw.rw.Header().Set(`Connection`, dw.header.Get(`Connection`))
+	}
+	dw.rw.WriteHeader(status)
+	dw.rw.Write(encoded)
+
+	if flusher, ok := dw.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/client"
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+const disguiseTestPath = `/api/v2/sync`
+
+// newDisguisedServer serves a handler in disguise mode with the given options.
+func newDisguisedServer(t *testing.T, options ...Option) *httptest.Server {
+
+	handler, lifecycle, err := NewHandler(append([]Option{Disguise(disguiseTestPath)}, options...)...)
+	if err != nil {
+		t.Fatalf(`could not instantiate handler: %s`, err.Error())
+	}
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		ts.Close()
+		lifecycle.Stop()
+	})
+
+	return ts
+}
+
+// disguisedExchange sends a request as a browser would, with body encoded as JSON unless it is nil, and returns the
+// response along with its body. Responses must not give httptun away.
+func disguisedExchange(t *testing.T, ts *httptest.Server, method, path string, body interface{}) (*http.Response, []byte) {
+
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		encoded, _ := json.Marshal(b)
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatalf(`could not create request: %s`, err.Error())
+	}
+	req.Header.Set(`Accept`, `application/json, text/plain, */*`)
+	if reader != nil {
+		req.Header.Set(`Content-Type`, `application/json`)
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf(`%s %s: %s`, method, path, err.Error())
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf(`%s %s: could not read response: %s`, method, path, err.Error())
+	}
+
+	for key := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(key), `httptun-`) {
+			t.Errorf(`%s %s: response carries header %s`, method, path, key)
+		}
+	}
+	if bytes.Contains(bytes.ToLower(data), []byte(`httptun`)) {
+		t.Errorf(`%s %s: response names httptun: %s`, method, path, data)
+	}
+
+	return resp, data
+}
+
+// decodeDisguised decodes a DisguisedResponse, failing the test if the response is not one.
+func decodeDisguised(t *testing.T, resp *http.Response, data []byte) *shared.DisguisedResponse {
+
+	t.Helper()
+
+	if got := resp.Header.Get(`Content-Type`); got != `application/json; charset=utf-8` {
+		t.Errorf(`response has content type '%s'`, got)
+	}
+
+	decoded := &shared.DisguisedResponse{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf(`invalid response '%s': %s`, data, err.Error())
+	}
+
+	return decoded
+}
+
+func TestDisguisedSession(t *testing.T) {
+
+	ts := newDisguisedServer(t)
+	sessions := disguiseTestPath + shared.DisguiseSessionsPath
+
+	// the handshake of a probe, which echoes what it is sent
+	handshake := http.Header{}
+	handshake.Set(shared.HeaderAction, shared.ActionProbe)
+	shared.NewHandshake().Write(handshake)
+
+	resp, data := disguisedExchange(t, ts, http.MethodPost, sessions, &shared.DisguisedRequest{
+		Attributes: shared.DisguiseAttributes(handshake),
+		Nonce:      shared.DisguisePadding(),
+	})
+	started := decodeDisguised(t, resp, data)
+	if resp.StatusCode != http.StatusOK || started.Error != `` {
+		t.Fatalf(`session was not started: %d %s`, resp.StatusCode, started.Error)
+	}
+	id := started.Attributes[`session`]
+	if id == `` {
+		t.Fatalf(`session was started without an identifier: %s`, data)
+	}
+	if started.Attributes[`version`] != `1` {
+		t.Errorf(`session was started with attributes %v`, started.Attributes)
+	}
+	messages := sessions + `/` + id + shared.DisguiseMessagesPath
+
+	resp, data = disguisedExchange(t, ts, http.MethodPost, messages, &shared.DisguisedRequest{
+		Attributes: map[string]string{`sequence`: `0`},
+		Payload:    []byte(shared.ProbeMessage),
+		Nonce:      shared.DisguisePadding(),
+	})
+	if posted := decodeDisguised(t, resp, data); resp.StatusCode != http.StatusOK || posted.Error != `` {
+		t.Fatalf(`message was not posted: %d %s`, resp.StatusCode, posted.Error)
+	}
+
+	// polling twice from the start fetches the echo twice, as if the first response had been lost
+	for i := 0; i < 2; i++ {
+		resp, data = disguisedExchange(t, ts, http.MethodGet, messages+`?`+shared.DisguiseAckParameter+`=0`, nil)
+		polled := decodeDisguised(t, resp, data)
+		if resp.StatusCode != http.StatusOK || string(polled.Payload) != shared.ProbeMessage || polled.Attributes[`sequence`] != `0` {
+			t.Fatalf(`poll %d returned %d %v '%s' %s`, i, resp.StatusCode, polled.Attributes, polled.Payload, polled.Error)
+		}
+	}
+
+	resp, data = disguisedExchange(t, ts, http.MethodDelete, sessions+`/`+id, nil)
+	if ended := decodeDisguised(t, resp, data); resp.StatusCode != http.StatusOK || ended.Error != `` {
+		t.Fatalf(`session was not ended: %d %s`, resp.StatusCode, ended.Error)
+	}
+
+	resp, data = disguisedExchange(t, ts, http.MethodGet, messages, nil)
+	if gone := decodeDisguised(t, resp, data); resp.StatusCode != http.StatusNotFound || gone.Error == `` {
+		t.Errorf(`poll of an ended session returned %d %s`, resp.StatusCode, data)
+	}
+}
+
+func TestDisguisedDecoy(t *testing.T) {
+
+	site := t.TempDir()
+	if err := os.WriteFile(filepath.Join(site, `index.html`), []byte(`<h1>Recipes</h1>`), 0644); err != nil {
+		t.Fatalf(`could not write decoy site: %s`, err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(site, `style.css`), []byte(`h1 { color: teal; }`), 0644); err != nil {
+		t.Fatalf(`could not write decoy site: %s`, err.Error())
+	}
+	decoy := http.FileServer(http.Dir(site))
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodGet, `/`, nil},
+		{http.MethodGet, `/style.css`, nil},
+		{http.MethodGet, `/about`, nil},
+		{http.MethodGet, shared.CapabilitiesPath, nil},
+		{http.MethodPost, `/`, nil},
+		{http.MethodGet, disguiseTestPath, nil},
+		{http.MethodGet, disguiseTestPath + `/`, nil},
+		{http.MethodGet, disguiseTestPath + `/users`, nil},
+		{http.MethodGet, disguiseTestPath + shared.DisguiseSessionsPath, nil},
+		{http.MethodPost, disguiseTestPath + shared.DisguiseSessionsPath, `not json`},
+		{http.MethodPut, disguiseTestPath + shared.DisguiseSessionsPath + `/abc` + shared.DisguiseMessagesPath, nil},
+		{http.MethodDelete, disguiseTestPath + shared.DisguiseSessionsPath + `/abc` + shared.DisguiseMessagesPath, nil},
+	}
+
+	ts := newDisguisedServer(t, DecoySite(site))
+
+	for _, tt := range tests {
+		t.Run(tt.method+` `+tt.path, func(t *testing.T) {
+
+			resp, data := disguisedExchange(t, ts, tt.method, tt.path, tt.body)
+
+			// exactly what the decoy site alone would answer
+			want := httptest.NewRecorder()
+			decoy.ServeHTTP(want, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if resp.StatusCode != want.Code || !bytes.Equal(data, want.Body.Bytes()) {
+				t.Errorf(`got %d '%s', want the decoy's %d '%s'`, resp.StatusCode, data, want.Code, want.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestDisguisedPlaceholder(t *testing.T) {
+
+	ts := newDisguisedServer(t)
+
+	resp, data := disguisedExchange(t, ts, http.MethodGet, `/`, nil)
+	if resp.StatusCode != http.StatusOK || string(data) != defaultDecoyPage {
+		t.Errorf(`got %d '%s', want the placeholder page`, resp.StatusCode, data)
+	}
+
+	for _, path := range []string{disguiseTestPath + `/`, disguiseTestPath + shared.DisguiseSessionsPath, shared.CapabilitiesPath} {
+		if resp, data := disguisedExchange(t, ts, http.MethodGet, path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf(`GET %s: got %d '%s', want not found`, path, resp.StatusCode, data)
+		}
+	}
+}
+
+// wireRecorder records what crosses the wire that could give httptun away: headers that name it, in requests or
+// responses, and requests outside the disguise path.
+type wireRecorder struct {
+	handler http.Handler
+	mutex   *sync.Mutex
+	seen    []string
+}
+
+func (wr *wireRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+
+	wr.check(`request to `+req.URL.Path, req.Header)
+	if !strings.HasPrefix(req.URL.Path, disguiseTestPath+`/`) {
+		wr.record(req.Method + ` ` + req.URL.Path)
+	}
+
+	wr.handler.ServeHTTP(rw, req)
+
+	wr.check(`response to `+req.URL.Path, rw.Header())
+}
+
+func (wr *wireRecorder) check(what string, header http.Header) {
+
+	for key := range header {
+		if strings.HasPrefix(strings.ToLower(key), `httptun-`) {
+			wr.record(what + ` carries ` + key)
+		}
+	}
+}
+
+func (wr *wireRecorder) record(problem string) {
+
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+
+	wr.seen = append(wr.seen, problem)
+}
+
+func TestDisguisedClient(t *testing.T) {
+
+	echo := echoServer(t)
+
+	handler, lifecycle, err := NewHandler(Disguise(disguiseTestPath), AllowDestinations(echo), Logger(log.New(io.Discard, ``, 0)))
+	if err != nil {
+		t.Fatalf(`could not instantiate handler: %s`, err.Error())
+	}
+	defer lifecycle.Stop()
+
+	recorder := &wireRecorder{handler: handler, mutex: &sync.Mutex{}}
+	ts := httptest.NewServer(recorder)
+	defer ts.Close()
+
+	local := freeAddress(t)
+
+	c, err := client.New(
+		client.ServerURL(ts.URL),
+		client.Disguise(disguiseTestPath),
+		client.TransportCache(``),
+		client.NoProxy(),
+		client.Local(local, echo),
+		client.Logger(log.New(io.Discard, ``, 0)),
+	)
+	if err != nil {
+		t.Fatalf(`could not instantiate client: %s`, err.Error())
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf(`could not start client: %s`, err.Error())
+	}
+	defer c.Stop()
+
+	conn, err := net.Dial(`tcp`, local)
+	if err != nil {
+		t.Fatalf(`could not connect to the local forward: %s`, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	message := bytes.Repeat([]byte(`disguised `), 10000)
+	go conn.Write(message)
+
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf(`could not read the echo: %s`, err.Error())
+	}
+	if !bytes.Equal(echoed, message) {
+		t.Errorf(`echo differs from what was sent`)
+	}
+
+	conn.Close()
+	c.Stop()
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	for _, problem := range recorder.seen {
+		t.Errorf(`%s`, problem)
+	}
+}
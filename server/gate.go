@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// tunnelGate is required by the owner of a tunnel of everyone who connects to it. Connections from addresses outside
+// the allow-list are closed, and if credentials are set, every request must carry them in its Authorization header,
+// either as HTTP basic auth or as a bearer token.
+type tunnelGate struct {
+	allow    []*net.IPNet
+	username string
+	password string
+	token    string
+}
+
+// newTunnelGate reads the gate requested in the headers of req. It returns nil if no gate was requested.
+func newTunnelGate(req *http.Request) (*tunnelGate, error) {
+
+	tg := &tunnelGate{}
+	gated := false
+
+	if value := req.Header.Get(shared.HeaderAllowIPs); value != `` {
+		for _, field := range strings.Split(value, `,`) {
+			network, err := shared.ParseNetwork(strings.TrimSpace(field))
+			if err != nil {
+				return nil, err
+			}
+			tg.allow = append(tg.allow, network)
+		}
+		gated = true
+	}
+
+	if value := req.Header.Get(shared.HeaderBasicAuth); value != `` {
+		i := strings.Index(value, `:`)
+		if i <= 0 {
+			return nil, errors.New(`invalid basic auth: must be 'username:password'`)
+		}
+		tg.username, tg.password = value[:i], value[i+1:]
+		gated = true
+	}
+
+	if value := req.Header.Get(shared.HeaderBearerToken); value != `` {
+		tg.token = value
+		gated = true
+	}
+
+	if !gated {
+		return nil, nil
+	}
+
+	return tg, nil
+}
+
+// requiresHttp reports whether the gate has to read the requests of a connection.
+func (tg *tunnelGate) requiresHttp() bool {
+
+	return tg.username != `` || tg.token != ``
+}
+
+// allowsAddr reports whether addr is on the allow-list, if there is one.
+func (tg *tunnelGate) allowsAddr(addr net.Addr) bool {
+
+	if len(tg.allow) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		// peers on Unix sockets are local
+		return true
+	}
+
+	for _, network := range tg.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// admit checks conn against the gate. It returns the connection to forward along with a function that must then be
+// run for as long as that connection is used, or nil if there is nothing more to check, or an error after it has
+// refused and closed the connection. With credentials, every request on the connection is checked, not only the
+// first, since clients and reverse proxies send many requests over one connection.
+func (tg *tunnelGate) admit(conn net.Conn) (net.Conn, func(), error) {
+
+	if !tg.allowsAddr(conn.RemoteAddr()) {
+		conn.Close()
+		return nil, nil, errors.New(`address is not allowed`)
+	}
+
+	if !tg.requiresHttp() {
+		return conn, nil, nil
+	}
+
+	reader := bufio.NewReaderSize(conn, maxRouteHeaderSize)
+
+	// the first request is checked before the client hears of the connection
+	conn.SetReadDeadline(time.Now().Add(defaultRouteTimeout))
+	req, err := readRequestHead(reader)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if !tg.authorized(req.Header.Get(`Authorization`)) {
+		tg.refuse(conn)
+		return nil, nil, errors.New(`request is not authorized`)
+	}
+
+	inner, outer := net.Pipe()
+	gated := &gatedConn{Conn: outer, public: conn}
+
+	return gated, func() { tg.serve(conn, reader, inner) }, nil
+}
+
+// serve passes the requests of conn to inner one at a time, provided that each carries the credentials of the gate,
+// which are removed so that they do not reach the target, and passes the responses back. After a response that
+// switches protocols, the connections are joined as they are.
+func (tg *tunnelGate) serve(conn net.Conn, reader *bufio.Reader, inner net.Conn) {
+
+	innerReader := bufio.NewReader(inner)
+
+	defer func() {
+		conn.Close()
+		inner.Close()
+	}()
+
+	for {
+		head, err := readRequestHead(reader)
+		if err != nil {
+			return
+		}
+
+		if !tg.authorized(head.Header.Get(`Authorization`)) {
+			tg.refuse(conn)
+			return
+		}
+
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.Header.Del(`Authorization`)
+
+		// Request.Write would otherwise add a User-Agent that the original request did not have
+		if _, ok := req.Header[`User-Agent`]; !ok {
+			req.Header[`User-Agent`] = []string{``}
+		}
+
+		// the request is written while responses are read, so that a client waiting for 100 Continue gets it
+		written := make(chan error, 1)
+		go func() {
+			written <- req.Write(inner)
+		}()
+
+		resp, err := relayResponses(conn, innerReader, req)
+		if err != nil {
+			return
+		}
+
+		if err := <-written; err != nil {
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			shared.Join(shared.NewBufferedConn(conn, reader), shared.NewBufferedConn(inner, innerReader))
+			return
+		}
+
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// relayResponses copies the responses to req from reader to conn, the interim ones as well as the final one, which it
+// returns.
+func relayResponses(conn net.Conn, reader *bufio.Reader, req *http.Request) (*http.Response, error) {
+
+	for {
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, err
+		}
+
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
+
+// refuse answers that credentials are required and closes conn.
+func (tg *tunnelGate) refuse(conn net.Conn) {
+
+	challenge := `Bearer`
+	if tg.username != `` {
+		challenge = `Basic realm="httptun", charset="UTF-8"`
+	}
+
+	body := "unauthorized\n"
+	fmt.Fprintf(conn, "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", challenge, len(body), body)
+	conn.Close()
+}
+
+// gatedConn is the end of the pipe through which the checked requests of a gated connection pass. It stands in for
+// that connection, whose addresses it reports and which it closes along with itself.
+type gatedConn struct {
+	net.Conn
+	public net.Conn
+}
+
+func (gc *gatedConn) LocalAddr() net.Addr {
+
+	return gc.public.LocalAddr()
+}
+
+func (gc *gatedConn) RemoteAddr() net.Addr {
+
+	return gc.public.RemoteAddr()
+}
+
+func (gc *gatedConn) Close() error {
+
+	gc.public.Close()
+
+	return gc.Conn.Close()
+}
+
+// authorized reports whether the value of an Authorization header satisfies the credentials of the gate.
+func (tg *tunnelGate) authorized(authorization string) bool {
+
+	scheme, credentials := authorization, ``
+	if i := strings.Index(authorization, ` `); i >= 0 {
+		scheme, credentials = authorization[:i], strings.TrimSpace(authorization[i+1:])
+	}
+
+	switch {
+	case strings.EqualFold(scheme, `Basic`) && tg.username != ``:
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return false
+		}
+		expected := tg.username + `:` + tg.password
+		return subtle.ConstantTimeCompare(decoded, []byte(expected)) == 1
+	case strings.EqualFold(scheme, `Bearer`) && tg.token != ``:
+		return subtle.ConstantTimeCompare([]byte(credentials), []byte(tg.token)) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+func basic(credentials string) string {
+
+	return `Basic ` + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+func TestTunnelGateAuthorized(t *testing.T) {
+
+	both := &tunnelGate{username: `alice`, password: `s3cret:with:colons`, token: `t0ken`}
+	basicOnly := &tunnelGate{username: `alice`, password: `pw`}
+	tokenOnly := &tunnelGate{token: `t0ken`}
+
+	tests := []struct {
+		name          string
+		gate          *tunnelGate
+		authorization string
+		want          bool
+	}{
+		{`basic`, both, basic(`alice:s3cret:with:colons`), true},
+		{`basic lowercase scheme`, both, `basic ` + base64.StdEncoding.EncodeToString([]byte(`alice:s3cret:with:colons`)), true},
+		{`basic wrong password`, both, basic(`alice:s3cret`), false},
+		{`basic wrong user`, both, basic(`bob:s3cret:with:colons`), false},
+		{`basic not base64`, both, `Basic !!!`, false},
+		{`bearer`, both, `Bearer t0ken`, true},
+		{`bearer extra spaces`, both, `Bearer   t0ken`, true},
+		{`bearer wrong`, both, `Bearer t0ke`, false},
+		{`bearer without token configured`, basicOnly, `Bearer t0ken`, false},
+		{`basic without credentials configured`, tokenOnly, basic(`alice:pw`), false},
+		{`basic only`, basicOnly, basic(`alice:pw`), true},
+		{`token only`, tokenOnly, `Bearer t0ken`, true},
+		{`missing`, both, ``, false},
+		{`scheme only`, both, `Bearer`, false},
+		{`other scheme`, both, `Digest username="alice"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := tt.gate.authorized(tt.authorization); got != tt.want {
+				t.Errorf(`authorized('%s') = %v, want %v`, tt.authorization, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunnelGateAllowsAddr(t *testing.T) {
+
+	networks := func(cidrs ...string) []*net.IPNet {
+		var result []*net.IPNet
+		for _, cidr := range cidrs {
+			network, err := shared.ParseNetwork(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, network)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name  string
+		allow []*net.IPNet
+		addr  net.Addr
+		want  bool
+	}{
+		{`no list`, nil, &net.TCPAddr{IP: net.ParseIP(`8.8.8.8`), Port: 1}, true},
+		{`in block`, networks(`10.0.0.0/8`), &net.TCPAddr{IP: net.ParseIP(`10.1.2.3`), Port: 1}, true},
+		{`outside block`, networks(`10.0.0.0/8`), &net.TCPAddr{IP: net.ParseIP(`11.0.0.1`), Port: 1}, false},
+		{`single address`, networks(`192.168.1.5`), &net.TCPAddr{IP: net.ParseIP(`192.168.1.5`), Port: 1}, true},
+		{`next to single address`, networks(`192.168.1.5`), &net.TCPAddr{IP: net.ParseIP(`192.168.1.6`), Port: 1}, false},
+		{`second block`, networks(`10.0.0.0/8`, `2001:db8::/32`), &net.TCPAddr{IP: net.ParseIP(`2001:db8::1`), Port: 1}, true},
+		{`ipv6 outside`, networks(`2001:db8::/32`), &net.TCPAddr{IP: net.ParseIP(`2001:db9::1`), Port: 1}, false},
+		{`udp`, networks(`127.0.0.0/8`), &net.UDPAddr{IP: net.ParseIP(`127.0.0.1`), Port: 1}, true},
+		{`udp outside`, networks(`127.0.0.0/8`), &net.UDPAddr{IP: net.ParseIP(`10.0.0.1`), Port: 1}, false},
+		{`unix socket`, networks(`10.0.0.0/8`), &net.UnixAddr{Name: `/run/x.sock`, Net: `unix`}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			gate := &tunnelGate{allow: tt.allow}
+			if got := gate.allowsAddr(tt.addr); got != tt.want {
+				t.Errorf(`allowsAddr(%s) = %v, want %v`, tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTunnelGate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		gated  bool
+		ok     bool
+	}{
+		{`none`, nil, false, true},
+		{`allow list`, map[string]string{shared.HeaderAllowIPs: `10.0.0.0/8, 192.168.1.1`}, true, true},
+		{`bad allow list`, map[string]string{shared.HeaderAllowIPs: `10.0.0.0/33`}, false, false},
+		{`basic auth`, map[string]string{shared.HeaderBasicAuth: `alice:pw`}, true, true},
+		{`basic auth without password`, map[string]string{shared.HeaderBasicAuth: `alice:`}, true, true},
+		{`basic auth without user`, map[string]string{shared.HeaderBasicAuth: `:pw`}, false, false},
+		{`basic auth without colon`, map[string]string{shared.HeaderBasicAuth: `alice`}, false, false},
+		{`bearer token`, map[string]string{shared.HeaderBearerToken: `t0ken`}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := &http.Request{Header: http.Header{}}
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+
+			gate, err := newTunnelGate(req)
+			if (err == nil) != tt.ok {
+				t.Fatalf(`newTunnelGate error = %v, want ok: %v`, err, tt.ok)
+			}
+			if (gate != nil) != tt.gated {
+				t.Errorf(`gated = %v, want %v`, gate != nil, tt.gated)
+			}
+		})
+	}
+}
+
+// gatedPipe admits the server end of a pipe through gate, with first written to the client end meanwhile. It returns
+// the client end, and the connection that the gate forwards with a reader of it, on which the target answers.
+func gatedPipe(t *testing.T, gate *tunnelGate, first string) (net.Conn, net.Conn, *bufio.Reader) {
+
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go io.WriteString(client, first)
+
+	admitted, serve, err := gate.admit(server)
+	if err != nil {
+		t.Fatalf(`first request was refused: %s`, err.Error())
+	}
+	t.Cleanup(func() { admitted.Close() })
+	admitted.SetDeadline(time.Now().Add(5 * time.Second))
+	go serve()
+
+	return client, admitted, bufio.NewReader(admitted)
+}
+
+// respond has the target read a request, with its body, and answer it with body. It returns nil if it fails; it runs
+// in its own goroutine, so it cannot end the test.
+func respond(t *testing.T, target net.Conn, reader *bufio.Reader, body string) *http.Request {
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Errorf(`target could not read request: %s`, err.Error())
+		return nil
+	}
+	io.Copy(io.Discard, req.Body)
+
+	resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, ContentLength: int64(len(body)), Body: io.NopCloser(strings.NewReader(body))}
+	if err := resp.Write(target); err != nil {
+		t.Errorf(`target could not respond: %s`, err.Error())
+		return nil
+	}
+
+	return req
+}
+
+func TestTunnelGateChecksEveryRequest(t *testing.T) {
+
+	gate := &tunnelGate{token: `t0ken`}
+	first := "GET /first HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer t0ken\r\n\r\n"
+
+	client, target, targetReader := gatedPipe(t, gate, first)
+	clientReader := bufio.NewReader(client)
+
+	received := make(chan *http.Request, 1)
+	go func() { received <- respond(t, target, targetReader, `first`) }()
+
+	resp, err := http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf(`first request returned %v, %v`, resp, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	if req := <-received; req != nil && (req.Header.Get(`Authorization`) != `` || req.URL.Path != `/first`) {
+		t.Errorf(`target received %s with Authorization '%s'`, req.URL.Path, req.Header.Get(`Authorization`))
+	}
+
+	// the same connection, now without credentials, as a reverse proxy reusing it for another user would send
+	io.WriteString(client, "GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	resp, err = http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(`second request returned %v, %v`, resp, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	if _, err := target.Read(make([]byte, 1)); err == nil {
+		t.Errorf(`target received the second request`)
+	}
+	if _, err := clientReader.ReadByte(); err != io.EOF {
+		t.Errorf(`connection was not closed after the refusal: %v`, err)
+	}
+}
+
+func TestTunnelGateKeepsAlive(t *testing.T) {
+
+	gate := &tunnelGate{username: `alice`, password: `pw`}
+	request := "POST /hook HTTP/1.1\r\nHost: example.com\r\nAuthorization: " + basic(`alice:pw`) + "\r\nContent-Length: 5\r\n\r\nhello"
+
+	client, target, targetReader := gatedPipe(t, gate, request)
+	clientReader := bufio.NewReader(client)
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			go io.WriteString(client, request)
+		}
+
+		received := make(chan *http.Request, 1)
+		go func() { received <- respond(t, target, targetReader, `ok`) }()
+
+		resp, err := http.ReadResponse(clientReader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf(`request %d returned %v, %v`, i, resp, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+
+		if req := <-received; req != nil && req.Header.Get(`Authorization`) != `` {
+			t.Errorf(`request %d reached the target with credentials`, i)
+		}
+	}
+}
+
+func TestTunnelGateRelaysInterimResponses(t *testing.T) {
+
+	gate := &tunnelGate{token: `t0ken`}
+	head := "POST /hook HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer t0ken\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+
+	client, target, targetReader := gatedPipe(t, gate, head)
+	clientReader := bufio.NewReader(client)
+
+	go func() {
+		req, err := http.ReadRequest(targetReader)
+		if err != nil {
+			return
+		}
+		io.WriteString(target, "HTTP/1.1 100 Continue\r\n\r\n")
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(target, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+	}()
+
+	// the client sends the body only once it is told to continue
+	resp, err := http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusContinue {
+		t.Fatalf(`interim response was %v, %v`, resp, err)
+	}
+	io.WriteString(client, `hello`)
+
+	resp, err = http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf(`final response was %v, %v`, resp, err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != `hello` {
+		t.Errorf(`final response carried '%s'`, body)
+	}
+}
+
+func TestTunnelGateSwitchesProtocols(t *testing.T) {
+
+	gate := &tunnelGate{token: `t0ken`}
+	upgrade := "GET /socket HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer t0ken\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+
+	client, target, targetReader := gatedPipe(t, gate, upgrade)
+	clientReader := bufio.NewReader(client)
+
+	go func() {
+		if _, err := http.ReadRequest(targetReader); err != nil {
+			return
+		}
+		io.WriteString(target, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		// whatever follows is not HTTP, and has no credentials
+		line, _ := targetReader.ReadString('\n')
+		io.WriteString(target, `echo `+line)
+	}()
+
+	resp, err := http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf(`upgrade returned %v, %v`, resp, err)
+	}
+
+	io.WriteString(client, "raw bytes\n")
+	if line, _ := clientReader.ReadString('\n'); line != "echo raw bytes\n" {
+		t.Errorf(`after the upgrade, read '%s'`, line)
+	}
+}
@@ -1,9 +1,487 @@
 package server
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
 
 func (s *server) handle(rw http.ResponseWriter, req *http.Request) {
 
-	// TODO
-	s.logger.Printf(`got request`)
+	path := req.URL.Path
+
+	switch {
+	case s.disguisePath != `` && strings.HasPrefix(path, s.disguisePath+`/`):
+		s.disguised(rw, req)
+	case path == healthPath:
+		s.health(rw, req)
+	case path == readyPath:
+		s.ready(rw, req)
+	case s.disguisePath == `` && req.Method == http.MethodGet && strings.HasSuffix(path, shared.CapabilitiesPath) && s.reserved(strings.TrimSuffix(path, shared.CapabilitiesPath)):
+		s.capabilities(rw, req)
+	case !s.reserved(path):
+		s.page(rw, req)
+	case req.Header.Get(shared.HeaderSession) != ``:
+		// requests that carry data for an existing long-poll session are not handshakes
+		s.polls.serve(rw, req)
+	case transportOf(req) == ``:
+		s.page(rw, req)
+	default:
+		s.handshake(rw, req)
+	}
+}
+
+// reserved reports whether path is where the server accepts tunnel handshakes: the handshake path if one is
+// configured, or else any path.
+func (s *server) reserved(path string) bool {
+
+	if path == `` {
+		path = `/`
+	}
+
+	return s.handshakePath == `` || path == s.handshakePath
+}
+
+// handshake performs the action that req asks for and switches its connection to a tunnel connection.
+func (s *server) handshake(rw http.ResponseWriter, req *http.Request) {
+
+	// the handler of a request carried over HTTP/2 must not return before the connection it becomes is closed
+	holder := &streamHolder{}
+	req = req.WithContext(context.WithValue(req.Context(), streamHolderKey{}, holder))
+	defer func() {
+		if holder.conn != nil {
+			<-holder.conn.Done()
+		}
+	}()
+
+	if state := s.State(); state != StateRunning {
+		http.Error(rw, fmt.Sprintf(`server is %s`, state), http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.handshakes != nil {
+		if !s.handshakes.acquire() {
+			s.logger.Printf(`rejected handshake from %s: too many concurrent handshakes (%d rejected so far)`, req.RemoteAddr, atomic.LoadUint64(&s.handshakes.rejected))
+			http.Error(rw, `too many concurrent handshakes`, http.StatusServiceUnavailable)
+			return
+		}
+		defer s.handshakes.release()
+	}
+
+	if _, err := negotiate(req); err != nil {
+		s.logger.Printf(`refused handshake from %s: %s`, req.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch action := req.Header.Get(shared.HeaderAction); action {
+	case shared.ActionOpen:
+		s.open(rw, req)
+	case shared.ActionAttach:
+		s.attach(rw, req)
+	case shared.ActionDial:
+		s.dial(rw, req)
+	case shared.ActionProbe:
+		s.probe(rw, req)
+	default:
+		http.Error(rw, fmt.Sprintf(`invalid action (got '%s')`, action), http.StatusBadRequest)
+	}
+}
+
+// open creates a new tunnel whose control connection is the upgraded request.
+func (s *server) open(rw http.ResponseWriter, req *http.Request) {
+
+	t, status, err := s.newTunnel(req)
+	if err != nil {
+		s.logger.Printf(`could not open tunnel for %s: %s`, req.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	header := http.Header{}
+	header.Set(shared.HeaderTunnel, t.id)
+	header.Set(shared.HeaderAddress, t.address())
+	if t.port == 0 && t.host == `` {
+		header.Set(shared.HeaderSocket, req.Header.Get(shared.HeaderSocket))
+	}
+
+	control, err := s.upgrade(rw, req, header)
+	if err != nil {
+		t.discard()
+		s.releaseTunnel(t)
+		s.logger.Printf(`could not upgrade connection from %s: %s`, req.RemoteAddr, err.Error())
+		return
+	}
+
+	// tunnels must not be added once the server has begun stopping, or they would never be closed
+	s.mu.Lock()
+	running := s.state == StateRunning
+	if running {
+		s.tunnels.add(t)
+		t.start(control)
+	}
+	s.mu.Unlock()
+
+	if !running {
+		control.Close()
+		t.discard()
+		s.releaseTunnel(t)
+	}
+}
+
+// newTunnel creates a tunnel as requested by the headers of req, guarded by the gate they ask for, if any. On failure
+// it also returns the HTTP status with which to refuse the request.
+func (s *server) newTunnel(req *http.Request) (*tunnel, int, error) {
+
+	gate, err := newTunnelGate(req)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if gate != nil && gate.requiresHttp() && req.Header.Get(shared.HeaderNetwork) == `udp` {
+		return nil, http.StatusBadRequest, errors.New(`UDP tunnels cannot require credentials`)
+	}
+
+	t, status, err := s.listenTunnel(req)
+	if err == nil {
+		t.gate = gate
+		t.access = s.clientAccess
+		t.connections = newConnectionLimiter(s.clientConnections)
+		t.connectionIdleTimeout = s.connectionIdleTimeout
+		t.idleTimeout = s.tunnelIdleTimeout
+		t.lifetime = s.tunnelLifetime
+		t.compressed = wantsCompression(req) && t.packetConn == nil
+		t.identity = identify(req)
+		t.limits = []*bandwidthLimit{
+			newBandwidthLimit(s.tunnelBandwidth.rate, s.tunnelBandwidth.burst),
+			s.identities.acquire(t.identity),
+			s.globalBandwidth,
+		}
+	}
+
+	return t, status, err
+}
+
+// listenTunnel creates a tunnel on the listener requested by the headers of req: on a TCP port by default, on a named
+// Unix socket if Httptun-Socket is given, under a hostname on the virtual host ports if Httptun-Host is given, or on a
+// UDP port if Httptun-Network is 'udp'.
+func (s *server) listenTunnel(req *http.Request) (*tunnel, int, error) {
+
+	requested := 0
+	if value := req.Header.Get(shared.HeaderPort); value != `` {
+		port, err := strconv.Atoi(value)
+		if err == nil {
+			err = shared.ValidatePort(port)
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.Errorf(`invalid port (got '%s')`, value)
+		}
+		requested = port
+	}
+
+	switch network := req.Header.Get(shared.HeaderNetwork); network {
+	case `udp`:
+		packetConn, err := s.listenClientUdp(requested)
+		if err != nil {
+			return nil, http.StatusServiceUnavailable, err
+		}
+		return newUdpTunnel(packetConn, s.wg, s.logger, s.closeTunnel), 0, nil
+	case ``, `tcp`:
+	default:
+		return nil, http.StatusBadRequest, errors.Errorf(`invalid network (got '%s')`, network)
+	}
+
+	if socket := req.Header.Get(shared.HeaderSocket); socket != `` {
+		listener, err := s.listenClientSocket(socket)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return newTunnel(socketListenerKey(socket), 0, listener, s.wg, s.logger, s.closeTunnel), 0, nil
+	}
+
+	if name := req.Header.Get(shared.HeaderHost); name != `` {
+		listener, status, err := s.listenClientHost(name)
+		if err != nil {
+			return nil, status, err
+		}
+		t := newTunnel(``, 0, listener, s.wg, s.logger, s.closeTunnel)
+		t.host = listener.addr.String()
+		return t, 0, nil
+	}
+
+	listener, port, err := s.listenClient(requested)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+
+	return newTunnel(clientListenerKey(port), port, listener, s.wg, s.logger, s.closeTunnel), 0, nil
+}
+
+// attach joins the upgraded request with a connection that is pending on one of the tunnels.
+func (s *server) attach(rw http.ResponseWriter, req *http.Request) {
+
+	t := s.tunnels.get(req.Header.Get(shared.HeaderTunnel))
+	if t == nil {
+		http.Error(rw, `unknown tunnel`, http.StatusNotFound)
+		return
+	}
+
+	pending := t.claim(req.Header.Get(shared.HeaderConnection))
+	if pending == nil {
+		http.Error(rw, `unknown connection`, http.StatusNotFound)
+		return
+	}
+
+	conn, err := s.upgrade(rw, req, nil)
+	if err != nil {
+		pending.Close()
+		s.logger.Printf(`could not upgrade connection from %s: %s`, req.RemoteAddr, err.Error())
+		return
+	}
+
+	// joins must not start once the server has begun stopping, or it could finish waiting for them first
+	s.mu.Lock()
+	running := s.state == StateRunning
+	if running {
+		t.join(conn, pending)
+	}
+	s.mu.Unlock()
+
+	if !running {
+		conn.Close()
+		pending.Close()
+	}
+}
+
+// dial connects to a destination on behalf of the client, if the destination policy allows it, and joins that
+// connection with the upgraded request.
+func (s *server) dial(rw http.ResponseWriter, req *http.Request) {
+
+	target := req.Header.Get(shared.HeaderTarget)
+
+	address, err := s.destinations.resolve(target)
+	if err != nil {
+		s.logger.Printf(`refused to dial for %s: %s`, req.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	conn, err := net.DialTimeout(`tcp`, address, defaultDialTimeout)
+	if err != nil {
+		s.logger.Printf(`could not dial %s for %s: %s`, target, req.RemoteAddr, err.Error())
+		http.Error(rw, fmt.Sprintf(`could not reach '%s'`, target), http.StatusBadGateway)
+		return
+	}
+
+	upgraded, err := s.upgrade(rw, req, nil)
+	if err != nil {
+		conn.Close()
+		s.logger.Printf(`could not upgrade connection from %s: %s`, req.RemoteAddr, err.Error())
+		return
+	}
+
+	identity := identify(req)
+	client := limitClientConn(upgraded, s.identities.acquire(identity), s.globalBandwidth)
+	if wantsCompression(req) {
+		client = shared.NewCompressedConn(client)
+	}
+	client, conn = trackIdle(client, conn, s.connectionIdleTimeout)
+
+	s.mu.Lock()
+	running := s.state == StateRunning
+	if running {
+		s.connections.join(client, conn, func() { s.identities.release(identity) })
+	}
+	s.mu.Unlock()
+
+	if !running {
+		client.Close()
+		conn.Close()
+		s.identities.release(identity)
+	}
+}
+
+// listenClient returns a listener for a tunnel on the requested port, or on any free port if requested is zero.
+// Listeners inherited from a previous process take precedence so that reconnecting clients keep their ports.
+func (s *server) listenClient(requested int) (net.Listener, int, error) {
+
+	if requested != 0 {
+		if l := s.inherited.take(clientListenerKey(requested)); l != nil {
+			return l, requested, nil
+		}
+	}
+
+	port, err := s.portRegistry.allocate(requested)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	address := &net.TCPAddr{
+		IP:   s.clientIP,
+		Port: port,
+	}
+
+	l, err := net.ListenTCP(`tcp`, address)
+	if err != nil {
+		s.portRegistry.release(port)
+		return nil, 0, errors.Wrap(err, `could not instantiate client listener`)
+	}
+
+	return l, port, nil
+}
+
+func (s *server) closeTunnel(t *tunnel) {
+
+	s.tunnels.remove(t)
+	s.releaseTunnel(t)
+	s.logger.Printf(`tunnel %s closed`, t.id)
+}
+
+// releaseTunnel returns the port or hostname of t to the registry it came from, and lets go of the bandwidth limit of
+// its owner. Tunnels on Unix sockets have neither port nor hostname.
+func (s *server) releaseTunnel(t *tunnel) {
+
+	s.identities.release(t.identity)
+
+	switch {
+	case t.host != ``:
+		s.tunnels.releaseHost(t.host)
+	case t.port == 0:
+	case t.packetConn != nil:
+		s.udpPortRegistry.release(t.port)
+	default:
+		s.portRegistry.release(t.port)
+	}
+}
+
+func isUpgrade(req *http.Request) bool {
+
+	if !strings.EqualFold(req.Header.Get(`Upgrade`), shared.UpgradeProtocol) {
+		return false
+	}
+
+	for _, value := range strings.Split(req.Header.Get(`Connection`), `,`) {
+		if strings.EqualFold(strings.TrimSpace(value), `upgrade`) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsCompression reports whether the client asks for compression, which the server grants by confirming the
+// capability in its response.
+func wantsCompression(req *http.Request) bool {
+
+	return shared.ParseCapabilities(req.Header.Get(shared.HeaderCapabilities)).Has(shared.CapabilityCompression)
+}
+
+// serverCapabilities are those that the server grants to clients that ask for them.
+var serverCapabilities = shared.NewCapabilitySet(shared.CapabilityCompression, shared.CapabilityUdp)
+
+// negotiate returns the handshake with which to answer req: the protocol version in effect and the capabilities that
+// the client asked for, provided that the server supports them all and they can be used together.
+func negotiate(req *http.Request) (*shared.Handshake, error) {
+
+	offered, err := shared.ReadHandshake(req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := shared.NegotiateVersion(offered.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, capability := range offered.Capabilities {
+		if !serverCapabilities.Has(capability) {
+			return nil, errors.Errorf(`capability '%s' is not supported (supported: %s)`, capability, serverCapabilities.String())
+		}
+	}
+
+	if err := offered.Capabilities.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &shared.Handshake{Version: version, Capabilities: offered.Capabilities}, nil
+}
+
+// upgrade switches the connection of req to the httptun protocol and, if the client asks for it, establishes an
+// encrypted channel inside it.
+func (s *server) upgrade(rw http.ResponseWriter, req *http.Request, header http.Header) (net.Conn, error) {
+
+	// handle has already refused handshakes that cannot be negotiated
+	handshake, err := negotiate(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	handshake.Write(header)
+
+	encrypted := req.Header.Get(shared.HeaderEncryption) != ``
+	if encrypted {
+		if s.encryptionKey == nil {
+			http.Error(rw, `encryption is not supported`, http.StatusNotImplemented)
+			return nil, errors.New(`client asked for encryption, but the server has no key`)
+		}
+		if req.Header.Get(shared.HeaderEncryption) != shared.EncryptionNoise {
+			http.Error(rw, fmt.Sprintf(`unsupported encryption (supported: '%s')`, shared.EncryptionNoise), http.StatusNotImplemented)
+			return nil, errors.New(`client asked for unsupported encryption`)
+		}
+		header.Set(shared.HeaderEncryption, shared.EncryptionNoise)
+	}
+
+	conn, err := s.switchTransport(rw, req, header)
+	if err != nil || !encrypted {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(defaultEncryptionTimeout))
+	channel, err := shared.ServerHandshake(conn, s.encryptionKey)
+	conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+// hijack takes over the connection underlying rw and completes a protocol switch with the given headers.
+func hijack(rw http.ResponseWriter, header http.Header) (net.Conn, error) {
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, `connection cannot be upgraded`, http.StatusInternalServerError)
+		return nil, errors.New(`response does not support hijacking`)
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, `could not hijack connection`)
+	}
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(buf)
+	buf.WriteString("\r\n")
+
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, `could not complete upgrade`)
+	}
+
+	return shared.NewBufferedConn(conn, buf.Reader), nil
 }
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NewHandler instantiates a Server without a tunnel listener of its own and returns an http.Handler that performs
+// the tunnel handshake, so that tunnels can be accepted by an existing HTTP(S) server, e.g. under '/tunnel' on a
+// ServeMux. Clients then connect with a server URL that includes that path. Options concerning the tunnel listener
+// are ignored, except that TunnelAllowIPs and TunnelDenyIPs are checked against the remote address of each request;
+// those concerning client listeners apply as usual.
+//
+// The returned Lifecycle is already running. Stopping it closes every tunnel along with its client listener, after
+// which the handler refuses new tunnels.
+func NewHandler(options ...Option) (http.Handler, Lifecycle, error) {
+
+	srv, err := New(options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := srv.(*server)
+
+	// virtual host ports are client listeners, so they are opened here as well
+	if err := s.listenVhosts(); err != nil {
+		return nil, nil, errors.Wrap(err, `cannot instantiate handler`)
+	}
+
+	s.state = StateRunning
+	s.started = time.Now()
+
+	return http.HandlerFunc(s.handleAdmitted), s, nil
+}
+
+// handleAdmitted applies the access list of the tunnel listener, which the embedding server does not know about.
+func (s *server) handleAdmitted(rw http.ResponseWriter, req *http.Request) {
+
+	if addr, err := net.ResolveTCPAddr(`tcp`, req.RemoteAddr); err == nil && !s.tunnelAccess.admit(addr, s.logger) {
+		http.Error(rw, `forbidden`, http.StatusForbidden)
+		return
+	}
+
+	s.handle(rw, req)
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNewHandlerLeavesInheritedListeners(t *testing.T) {
+
+	// the handler must not consume what belongs to the process that really listens
+	t.Setenv(envListeners, tunnelListenerName)
+	t.Setenv(envReadyFD, `9`)
+
+	_, lifecycle, err := NewHandler()
+	if err != nil {
+		t.Fatalf(`could not instantiate handler: %s`, err.Error())
+	}
+	defer lifecycle.Stop()
+
+	if got := os.Getenv(envListeners); got != tunnelListenerName {
+		t.Errorf(`%s = '%s', want '%s'`, envListeners, got, tunnelListenerName)
+	}
+	if got := os.Getenv(envReadyFD); got != `9` {
+		t.Errorf(`%s = '%s', want '9'`, envReadyFD, got)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Handoff starts a new process from the current executable with the same arguments and passes it the tunnel
+// listener and the client listener of every tunnel. Once the new process reports that it has started, this Server
+// stops accepting connections and closes the control connection of each tunnel so that clients reconnect to the new
+// process, while connections that are already attached are allowed to finish. The Server is stopped once they have.
+func (s *server) Handoff() error {
+
+	names, files, kept, err := s.prepareHandoff()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// the lock is not held while the new process starts, so that handshakes and health checks are answered meanwhile
+	err = s.startSuccessor(names, files)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handingOff = false
+
+	if err != nil {
+		// this process still owns the socket files; if it was stopped meanwhile, their listeners are already closed
+		if s.state == StateRunning {
+			unlinkOnClose(kept, true)
+		} else {
+			removeSocketFiles(kept)
+		}
+		return errors.Wrap(err, `cannot hand off`)
+	}
+
+	s.stop(nil, true)
+
+	return nil
+}
+
+// prepareHandoff duplicates the file descriptors of every listener and marks the Server as handing off. It returns the
+// Unix listeners whose socket files are no longer removed on close, since the new process will own them.
+func (s *server) prepareHandoff() ([]string, []*os.File, []*net.UnixListener, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != StateRunning {
+		return nil, nil, nil, errors.Errorf(`cannot hand off: server is %s`, s.state)
+	}
+
+	if s.handingOff {
+		return nil, nil, nil, errors.New(`cannot hand off: a handoff is already in progress`)
+	}
+
+	if s.baseListener == nil {
+		return nil, nil, nil, errors.New(`cannot hand off: server is embedded in another HTTP server`)
+	}
+
+	names, files, err := s.listenerFiles()
+	if err != nil {
+		return nil, files, nil, errors.Wrap(err, `cannot hand off`)
+	}
+
+	kept := s.socketListeners()
+	unlinkOnClose(kept, false)
+
+	s.handingOff = true
+
+	return names, files, kept, nil
+}
+
+// startSuccessor starts a new process from the current executable with the same arguments, passing it files as
+// inherited listeners, and waits until it reports that it has started.
+func (s *server) startSuccessor(names []string, files []*os.File) error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, `could not locate executable`)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, `could not create pipe`)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), readyWriter)
+	cmd.Env = append(os.Environ(),
+		envListeners+`=`+strings.Join(names, `,`),
+		envReadyFD+`=`+strconv.Itoa(firstInheritedFD+len(files)),
+	)
+
+	err = cmd.Start()
+	readyWriter.Close()
+
+	// passing the files to the new process put them in blocking mode, and with them the listeners whose open file
+	// descriptions they share, which would leave accept loops stuck where closing the listeners cannot end them
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, `could not start new process`)
+	}
+
+	s.logger.Printf(`handing off to process %d`, cmd.Process.Pid)
+
+	if err := waitUntilReady(ready, defaultHandoffTimeout); err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+
+	// the new process is no longer our concern
+	go cmd.Wait()
+
+	s.logger.Printf(`process %d is ready; draining`, cmd.Process.Pid)
+
+	return nil
+}
+
+// listenerFiles duplicates the file descriptors of the tunnel listener, of the virtual host listeners, of every tunnel's
+// client listener, and of any inherited listeners that are still unclaimed. Tunnels reached by hostname have no
+// listener of their own; their clients claim the hostname again when they reconnect.
+func (s *server) listenerFiles() (names []string, files []*os.File, err error) {
+
+	f, err := listenerFile(s.baseListener)
+	if err != nil {
+		return nil, nil, err
+	}
+	names = append(names, tunnelListenerName)
+	files = append(files, f)
+
+	for name, l := range s.vhostListeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			return names, files, err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	for _, t := range s.tunnels.all() {
+		if t.host != `` {
+			continue
+		}
+
+		var f *os.File
+		if t.packetConn != nil {
+			f, err = packetConnFile(t.packetConn)
+		} else {
+			f, err = listenerFile(t.listener)
+		}
+		if err != nil {
+			return names, files, err
+		}
+		names = append(names, t.name)
+		files = append(files, f)
+	}
+
+	inheritedNames, inheritedFiles := s.inherited.files()
+	names = append(names, inheritedNames...)
+	files = append(files, inheritedFiles...)
+
+	return names, files, nil
+}
+
+// socketListeners returns the tunnel listener and the client listeners of tunnels that are Unix listeners whose socket
+// files belong to this process, which a tunnel listener passed by systemd does not.
+func (s *server) socketListeners() []*net.UnixListener {
+
+	listeners := []net.Listener{}
+	if s.baseListener.Addr().String() == s.tunnelSocket {
+		listeners = append(listeners, s.baseListener)
+	}
+	for _, t := range s.tunnels.all() {
+		listeners = append(listeners, t.listener)
+	}
+
+	sockets := []*net.UnixListener{}
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			sockets = append(sockets, ul)
+		}
+	}
+
+	return sockets
+}
+
+// unlinkOnClose sets whether the socket files of listeners are removed when the listeners are closed.
+func unlinkOnClose(listeners []*net.UnixListener, unlink bool) {
+
+	for _, l := range listeners {
+		l.SetUnlinkOnClose(unlink)
+	}
+}
+
+// removeSocketFiles removes the socket files of listeners that have already been closed.
+func removeSocketFiles(listeners []*net.UnixListener) {
+
+	for _, l := range listeners {
+		if path := l.Addr().String(); !strings.HasPrefix(path, `@`) {
+			os.Remove(path)
+		}
+	}
+}
+
+// waitUntilReady blocks until the new process writes to (or closes) its end of the pipe, or the timeout elapses.
+func waitUntilReady(ready *os.File, timeout time.Duration) error {
+
+	errChan := make(chan error, 1)
+
+	go func() {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(ready, b); err != nil {
+			errChan <- errors.New(`new process exited before it was ready`)
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return errors.New(`new process was not ready in time`)
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envTestSuccessor tells the test binary, started again by a handoff, to act as the new process: 'serve' to take the
+// tunnel listener and answer one connection on it, or 'fail' to exit without reporting that it is ready.
+const envTestSuccessor = `HTTPTUN_TEST_SUCCESSOR`
+
+// TestHandoffSuccessor is the new process started by the handoff tests. It does nothing when run on its own.
+func TestHandoffSuccessor(t *testing.T) {
+
+	mode := os.Getenv(envTestSuccessor)
+	if mode == `` {
+		t.Skip(`only run by a handoff`)
+	}
+
+	if mode == `fail` {
+		time.Sleep(200 * time.Millisecond)
+		os.Exit(1)
+	}
+
+	il, err := inheritListeners()
+	if err != nil || !il.handedOff || os.Getenv(envListeners) != `` || os.Getenv(envReadyFD) != `` {
+		os.Exit(2)
+	}
+
+	l := il.take(tunnelListenerName)
+	if l == nil {
+		os.Exit(3)
+	}
+	il.notifyReady()
+
+	l.(*net.UnixListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	io.WriteString(conn, `successor`)
+	conn.Close()
+
+	// exiting before the test framework reports keeps its output from mixing with that of the test that started it
+	os.Exit(0)
+}
+
+// handoffServer starts a Server listening on a Unix socket and arranges for a handoff to start this test binary again
+// as a successor in the given mode.
+func handoffServer(t *testing.T, mode string) *server {
+
+	s := newTestServerOn(t)
+	if err := s.Start(); err != nil {
+		t.Fatalf(`could not start: %s`, err.Error())
+	}
+
+	// handing off while the listener waits in a blocking accept would leave stop waiting for it, which a signal
+	// never does because it arrives long after the server started accepting
+	conn, err := net.Dial(`unix`, s.tunnelSocket)
+	if err != nil {
+		t.Fatalf(`could not connect: %s`, err.Error())
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	args, stdout := os.Args, os.Stdout
+	os.Args = []string{os.Args[0], `-test.run=^TestHandoffSuccessor$`}
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	t.Cleanup(func() {
+		os.Stdout.Close()
+		os.Args, os.Stdout = args, stdout
+	})
+	t.Setenv(envTestSuccessor, mode)
+
+	return s
+}
+
+func TestHandoff(t *testing.T) {
+
+	s := handoffServer(t, `serve`)
+	socket := s.tunnelSocket
+
+	if err := s.Handoff(); err != nil {
+		t.Fatalf(`could not hand off: %s`, err.Error())
+	}
+
+	// the new process is accepting connections on the same socket meanwhile
+	if !doneWithin(s.Done(), 3*time.Second) {
+		t.Fatal(`server did not stop after the handoff`)
+	}
+
+	// the socket file now belongs to the new process, which answers on it
+	conn, err := net.Dial(`unix`, socket)
+	if err != nil {
+		t.Fatalf(`could not reach the new process: %s`, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if answer, _ := io.ReadAll(conn); string(answer) != `successor` {
+		t.Errorf(`new process answered '%s'`, answer)
+	}
+}
+
+func TestHandoffFailure(t *testing.T) {
+
+	s := handoffServer(t, `fail`)
+
+	if err := s.Handoff(); err == nil || !strings.Contains(err.Error(), `exited before it was ready`) {
+		t.Fatalf(`Handoff returned %v`, err)
+	}
+	if state := s.State(); state != StateRunning {
+		t.Fatalf(`server is %s after a failed handoff`, state)
+	}
+
+	// the server carries on, and still removes its socket file when it stops
+	conn, err := net.Dial(`unix`, s.tunnelSocket)
+	if err != nil {
+		t.Fatalf(`server does not accept connections after a failed handoff: %s`, err.Error())
+	}
+	conn.Close()
+
+	s.Stop()
+	doneWithin(s.Done(), 5*time.Second)
+
+	if _, err := os.Stat(s.tunnelSocket); !os.IsNotExist(err) {
+		t.Errorf(`socket file left behind after Stop: %v`, err)
+	}
+}
+
+func TestHandoffFailureAfterStop(t *testing.T) {
+
+	s := handoffServer(t, `fail`)
+
+	failed := make(chan error, 1)
+	go func() { failed <- s.Handoff() }()
+
+	// stop while the new process is starting
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		s.mu.Lock()
+		handingOff := s.handingOff
+		s.mu.Unlock()
+		if handingOff {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(`handoff did not start`)
+		}
+	}
+	s.Stop()
+
+	if err := <-failed; err == nil {
+		t.Fatal(`Handoff succeeded`)
+	}
+	if !doneWithin(s.Done(), 5*time.Second) {
+		t.Fatal(`server did not stop`)
+	}
+
+	if _, err := os.Stat(s.tunnelSocket); !os.IsNotExist(err) {
+		t.Errorf(`socket file left behind: %v`, err)
+	}
+}
+
+func TestInheritListenersEnvironment(t *testing.T) {
+
+	t.Setenv(envListeners, ``)
+	t.Setenv(envReadyFD, `not a number`)
+
+	if _, err := inheritListeners(); err == nil || !strings.Contains(err.Error(), `invalid `+envReadyFD) {
+		t.Errorf(`error = %v, want one about the ready fd`, err)
+	}
+	if os.Getenv(envReadyFD) != `` {
+		t.Error(`environment was not cleared`)
+	}
+
+	il, err := inheritListeners()
+	if err != nil {
+		t.Fatalf(`could not inherit from an empty environment: %s`, err.Error())
+	}
+	if il.handedOff || il.take(tunnelListenerName) != nil {
+		t.Error(`inherited something from an empty environment`)
+	}
+}
+
+// inheritedForTest returns inherited listeners holding a TCP client listener, a UDP socket and a Unix socket listener.
+func inheritedForTest(t *testing.T) (*inheritedListeners, string) {
+
+	il := newInheritedListeners()
+
+	tcp, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	il.listeners[clientListenerKey(tcp.Addr().(*net.TCPAddr).Port)] = tcp
+
+	udp, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	il.packetConns[udpListenerKey(udp.LocalAddr().(*net.UDPAddr).Port)] = udp
+
+	path := filepath.Join(t.TempDir(), `client.sock`)
+	unix, err := net.Listen(`unix`, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as for a listener that was inherited, closing it would leave the file
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+	il.listeners[socketListenerKey(`client`)] = unix
+
+	t.Cleanup(func() {
+		tcp.Close()
+		udp.Close()
+		unix.Close()
+	})
+
+	return il, path
+}
+
+func TestInheritedListeners(t *testing.T) {
+
+	il, _ := inheritedForTest(t)
+
+	var names []string
+	for name := range il.listeners {
+		names = append(names, name)
+	}
+	for name := range il.packetConns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if ports := il.ports(clientListenerName); len(ports) != 1 || clientListenerKey(ports[0]) != names[0] {
+		t.Errorf(`client ports %v`, ports)
+	}
+	if ports := il.ports(udpListenerName); len(ports) != 1 || udpListenerKey(ports[0]) != names[2] {
+		t.Errorf(`UDP ports %v`, ports)
+	}
+
+	// unclaimed listeners are passed on to the next process
+	fileNames, files := il.files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	sort.Strings(fileNames)
+	if strings.Join(fileNames, `,`) != strings.Join(names, `,`) || len(files) != 3 {
+		t.Errorf(`files for %v, want %v`, fileNames, names)
+	}
+	for _, f := range files {
+		if l, err := net.FileListener(f); err == nil {
+			l.Close()
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			pc.Close()
+		} else {
+			t.Errorf(`file %s is neither a listener nor a socket`, f.Name())
+		}
+	}
+
+	// claimed ones are not
+	if l := il.take(names[0]); l == nil {
+		t.Fatalf(`could not take %s`, names[0])
+	}
+	if pc := il.takePacketConn(names[2]); pc == nil {
+		t.Fatalf(`could not take %s`, names[2])
+	}
+	if il.take(names[0]) != nil || len(il.ports(clientListenerName)) != 0 || len(il.ports(udpListenerName)) != 0 {
+		t.Error(`taken listeners are still held`)
+	}
+	if fileNames, files := il.files(); len(fileNames) != 1 || fileNames[0] != names[1] {
+		t.Errorf(`files for %v after taking, want [%s]`, fileNames, names[1])
+		for _, f := range files {
+			f.Close()
+		}
+	} else {
+		files[0].Close()
+	}
+}
+
+func TestInheritedListenersExpire(t *testing.T) {
+
+	il, path := inheritedForTest(t)
+	tcp := il.listeners[clientListenerKey(il.ports(clientListenerName)[0])]
+
+	claimed := socketListenerKey(`client`)
+	il.take(claimed)
+	defer os.Remove(path)
+
+	expired := make(chan string, 3)
+	il.expire(50*time.Millisecond, func(name string) { expired <- name })
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-expired:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf(`only %v expired`, names)
+		}
+	}
+	sort.Strings(names)
+	if !strings.HasPrefix(names[0], clientListenerName+`:`) || !strings.HasPrefix(names[1], udpListenerName+`:`) {
+		t.Errorf(`expired %v`, names)
+	}
+
+	if _, err := tcp.Accept(); err == nil {
+		t.Error(`expired listener is still open`)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf(`the socket file of a claimed listener was removed: %v`, err)
+	}
+}
+
+func TestInheritedListenersExpireRemovesSockets(t *testing.T) {
+
+	il, path := inheritedForTest(t)
+
+	expired := make(chan string, 3)
+	il.expire(10*time.Millisecond, func(name string) { expired <- name })
+	for i := 0; i < 3; i++ {
+		<-expired
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf(`socket file of an expired listener was left behind: %v`, err)
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+
+	il := newInheritedListeners()
+	il.ready = readyWriter
+
+	il.notifyReady()
+	il.notifyReady() // only once
+
+	if err := waitUntilReady(ready, time.Second); err != nil {
+		t.Errorf(`not ready: %s`, err.Error())
+	}
+	if rest, _ := io.ReadAll(ready); len(rest) != 0 {
+		t.Errorf(`notified %d more times`, len(rest))
+	}
+
+	// a process that exits without notifying, or that takes too long, is not ready
+	closed, closedWriter, _ := os.Pipe()
+	closedWriter.Close()
+	if err := waitUntilReady(closed, time.Second); err == nil || !strings.Contains(err.Error(), `exited`) {
+		t.Errorf(`closed pipe: %v`, err)
+	}
+	slow, slowWriter, _ := os.Pipe()
+	defer slowWriter.Close()
+	if err := waitUntilReady(slow, 20*time.Millisecond); err == nil || !strings.Contains(err.Error(), `in time`) {
+		t.Errorf(`slow pipe: %v`, err)
+	}
+}
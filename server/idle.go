@@ -0,0 +1,168 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activity records when traffic last passed through a pair of joined connections or a tunnel.
+type activity struct {
+	last int64 // unix nanoseconds, accessed atomically
+}
+
+func newActivity() *activity {
+
+	a := &activity{}
+	a.touch()
+
+	return a
+}
+
+func (a *activity) touch() {
+
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idle returns how long it has been since traffic last passed.
+func (a *activity) idle() time.Duration {
+
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// trackIdle wraps a pair of connections about to be joined so that their reads are recorded in activities, and, if
+// timeout is not zero, so that both are closed once neither has carried traffic for that long.
+// The timeout closes the connections rather than setting read deadlines on them, since a deadline that expires in the
+// middle of a compressed, encrypted or WebSocket frame would leave the layer reading it out of step with the stream.
+func trackIdle(a, b net.Conn, timeout time.Duration, activities ...*activity) (net.Conn, net.Conn) {
+
+	if timeout == 0 && len(activities) == 0 {
+		return a, b
+	}
+
+	pair := &idlePair{activity: newActivity(), timeout: timeout, mutex: &sync.Mutex{}}
+	activities = append([]*activity{pair.activity}, activities...)
+
+	pair.conns = []net.Conn{
+		&idleConn{Conn: a, pair: pair, activities: activities},
+		&idleConn{Conn: b, pair: pair, activities: activities},
+	}
+
+	if timeout != 0 {
+		time.AfterFunc(timeout, pair.check)
+	}
+
+	return pair.conns[0], pair.conns[1]
+}
+
+// idlePair closes a pair of joined connections once they have been idle for its timeout.
+type idlePair struct {
+	activity *activity
+	timeout  time.Duration
+	conns    []net.Conn
+
+	mutex  *sync.Mutex
+	closed bool
+}
+
+// check closes the pair if it has been idle for its timeout, or checks again when it could next have been.
+func (ip *idlePair) check() {
+
+	ip.mutex.Lock()
+	closed := ip.closed
+	ip.mutex.Unlock()
+
+	if closed {
+		return
+	}
+
+	if idle := ip.activity.idle(); idle < ip.timeout {
+		time.AfterFunc(ip.timeout-idle, ip.check)
+		return
+	}
+
+	for _, conn := range ip.conns {
+		conn.Close()
+	}
+}
+
+// idleConn is one of a pair of joined connections whose reads record activity.
+type idleConn struct {
+	net.Conn
+	pair       *idlePair   // shared with the other connection of the pair
+	activities []*activity // including that of pair
+}
+
+func (ic *idleConn) Read(b []byte) (int, error) {
+
+	n, err := ic.Conn.Read(b)
+	if n > 0 {
+		for _, a := range ic.activities {
+			a.touch()
+		}
+	}
+
+	return n, err
+}
+
+// Close closes the connection and stops checking whether the pair is idle.
+func (ic *idleConn) Close() error {
+
+	ic.pair.mutex.Lock()
+	ic.pair.closed = true
+	ic.pair.mutex.Unlock()
+
+	return ic.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so, so that joining is unaffected.
+func (ic *idleConn) CloseWrite() error {
+
+	if cw, ok := ic.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return ic.Conn.Close()
+}
+
+// expire schedules the tunnel to be closed once it has had no connections or traffic for its idle timeout, or once it
+// has been open for its lifetime, whichever comes first. Must be called when the tunnel starts.
+func (t *tunnel) expire() {
+
+	if t.lifetime != 0 {
+		t.lifetimeTimer = time.AfterFunc(t.lifetime, func() {
+			t.logger.Printf(`tunnel %s reached its maximum lifetime of %s`, t.id, t.lifetime.String())
+			t.close()
+		})
+	}
+
+	if t.idleTimeout != 0 {
+		time.AfterFunc(t.idleTimeout, t.checkIdle)
+	}
+}
+
+// checkIdle closes the tunnel if it has been idle for its idle timeout, or checks again when it could next have been.
+func (t *tunnel) checkIdle() {
+
+	t.mutex.Lock()
+	closed := t.closed
+	busy := len(t.pending) > 0 || len(t.active) > 0
+	t.mutex.Unlock()
+
+	if closed {
+		return
+	}
+
+	if busy {
+		t.activity.touch()
+	}
+
+	if idle := t.activity.idle(); idle < t.idleTimeout {
+		time.AfterFunc(t.idleTimeout-idle, t.checkIdle)
+		return
+	}
+
+	t.logger.Printf(`tunnel %s was idle for %s`, t.id, t.idleTimeout.String())
+	t.close()
+}
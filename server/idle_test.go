@@ -0,0 +1,217 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleConnTimesOut(t *testing.T) {
+
+	a, _ := pipe(t)
+	b, _ := pipe(t)
+
+	timeout := 50 * time.Millisecond
+	tunnelActivity := newActivity()
+	ia, ib := trackIdle(a, b, timeout, tunnelActivity)
+
+	start := time.Now()
+	_, err := ia.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal(`Read succeeded, want the connection closed`)
+	}
+	if elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf(`closed after %s, want about %s`, elapsed, timeout)
+	}
+	if _, err := ib.Read(make([]byte, 1)); err == nil {
+		t.Error(`the other connection of the pair was not closed`)
+	}
+}
+
+func TestIdleConnKeptAliveByItsPair(t *testing.T) {
+
+	a, _ := pipe(t)
+	b, bPeer := pipe(t)
+
+	timeout := 60 * time.Millisecond
+	ia, ib := trackIdle(a, b, timeout)
+
+	// traffic on the other connection of the pair keeps both alive
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 8; i++ {
+			time.Sleep(timeout / 3)
+			go bPeer.Write([]byte{1})
+			ib.Read(make([]byte, 1))
+		}
+	}()
+
+	start := time.Now()
+	_, err := ia.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	<-done
+
+	if err == nil {
+		t.Fatal(`Read succeeded, want the connection closed once the pair went quiet`)
+	}
+	if elapsed < 8*timeout/3 {
+		t.Errorf(`closed after %s while the pair carried traffic`, elapsed)
+	}
+}
+
+func TestIdleTimeoutKeepsCompressedFramesWhole(t *testing.T) {
+
+	attached, attachedPeer := pipe(t)
+	pending, pendingPeer := pipe(t)
+
+	timeout := 60 * time.Millisecond
+	tun := newTunnel(`test`, 0, nil, &sync.WaitGroup{}, log.New(io.Discard, ``, 0), func(*tunnel) {})
+	tun.compressed = true
+	tun.connectionIdleTimeout = timeout
+	tun.join(attached, pending)
+
+	// the target keeps the pair busy while the client is slow to send a frame
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(timeout / 4):
+				pendingPeer.Write([]byte(`tick`))
+			}
+		}
+	}()
+	go io.Copy(io.Discard, attachedPeer)
+
+	// a raw frame of the compression layer, sent in two halves with a gap longer than the idle timeout between them
+	message := []byte(`hello through a slow client`)
+	frame := append([]byte{0, 0, byte(len(message))}, message...)
+	go func() {
+		attachedPeer.Write(frame[:5])
+		time.Sleep(3 * timeout)
+		attachedPeer.Write(frame[5:])
+	}()
+
+	got := make([]byte, len(message))
+	_, err := io.ReadFull(pendingPeer, got)
+	close(stop)
+
+	if err != nil {
+		t.Fatalf(`could not read the frame: %s`, err.Error())
+	}
+	if string(got) != string(message) {
+		t.Errorf(`got '%s', want '%s'`, got, message)
+	}
+
+	// once nothing passes, the pair is still closed
+	pendingPeer.SetReadDeadline(time.Now().Add(10 * timeout))
+	if _, err := pendingPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf(`Read error = %v once idle, want EOF`, err)
+	}
+}
+
+func TestTrackIdleWithoutTimeout(t *testing.T) {
+
+	a, _ := pipe(t)
+	b, _ := pipe(t)
+
+	if ia, ib := trackIdle(a, b, 0); ia != a || ib != b {
+		t.Error(`connections were wrapped without timeout or activities`)
+	}
+}
+
+// expiringTunnel returns a tunnel that has started its timers, with a control connection but nothing accepted.
+func expiringTunnel(t *testing.T, idleTimeout, lifetime time.Duration) *tunnel {
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control, _ := pipe(t)
+
+	tun := newTunnel(`test`, 0, listener, &sync.WaitGroup{}, log.New(io.Discard, ``, 0), func(*tunnel) {})
+	tun.idleTimeout = idleTimeout
+	tun.lifetime = lifetime
+	tun.control = control
+	tun.expire()
+
+	t.Cleanup(tun.close)
+
+	return tun
+}
+
+func closedWithin(tun *tunnel, d time.Duration) bool {
+
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		tun.mutex.Lock()
+		closed := tun.closed
+		tun.mutex.Unlock()
+		if closed {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestTunnelExpiry(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		lifetime    time.Duration
+		busy        bool // whether the tunnel has an attached connection
+		closed      bool // within 300ms
+	}{
+		{`idle`, 50 * time.Millisecond, 0, false, true},
+		{`busy`, 50 * time.Millisecond, 0, true, false},
+		{`lifetime`, 0, 50 * time.Millisecond, false, true},
+		{`lifetime while busy`, 0, 50 * time.Millisecond, true, true},
+		{`no timers`, 0, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tun := expiringTunnel(t, tt.idleTimeout, tt.lifetime)
+
+			if tt.busy {
+				conn, _ := pipe(t)
+				tun.mutex.Lock()
+				tun.active[conn] = true
+				tun.mutex.Unlock()
+			}
+
+			if closed := closedWithin(tun, 300*time.Millisecond); closed != tt.closed {
+				t.Errorf(`closed = %v, want %v`, closed, tt.closed)
+			}
+		})
+	}
+}
+
+func TestTunnelIdleTimeoutRestartsOnActivity(t *testing.T) {
+
+	tun := expiringTunnel(t, 100*time.Millisecond, 0)
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		tun.activity.touch()
+	}
+
+	if closedWithin(tun, 10*time.Millisecond) {
+		t.Fatal(`tunnel with recent activity was closed`)
+	}
+	if !closedWithin(tun, 300*time.Millisecond) {
+		t.Error(`tunnel was not closed once activity stopped`)
+	}
+}
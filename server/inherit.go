@@ -0,0 +1,240 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// envListeners names the listeners passed to a new process during a handoff, in the order of their file
+	// descriptors starting at 3.
+	envListeners = `HTTPTUN_LISTENERS`
+	// envReadyFD is the file descriptor that a new process writes to once it has started successfully.
+	envReadyFD = `HTTPTUN_READY_FD`
+
+	// firstInheritedFD is the first file descriptor populated by exec.Cmd.ExtraFiles.
+	firstInheritedFD = 3
+
+	tunnelListenerName = `tunnel`
+	clientListenerName = `client`
+	socketListenerName = `socket`
+	udpListenerName    = `udp`
+)
+
+// inheritedListeners holds the listeners (and UDP sockets) that were passed down by a previous process during a
+// handoff until they are claimed.
+type inheritedListeners struct {
+	listeners   map[string]net.Listener
+	packetConns map[string]net.PacketConn
+	ready       *os.File
+	mutex       *sync.Mutex
+
+	// whether this process was started by a handoff
+	handedOff bool
+}
+
+func newInheritedListeners() *inheritedListeners {
+
+	return &inheritedListeners{
+		listeners:   map[string]net.Listener{},
+		packetConns: map[string]net.PacketConn{},
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// inheritListeners consumes the listeners described by the environment, if any. The environment is cleared so that
+// the listeners are not inherited again by unrelated child processes. Only a Server that listens of its own calls
+// it, from Start; an embedded handler leaves the listeners to whoever owns them.
+func inheritListeners() (*inheritedListeners, error) {
+
+	il := newInheritedListeners()
+
+	names := os.Getenv(envListeners)
+	readyFD := os.Getenv(envReadyFD)
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReadyFD)
+
+	if names != `` {
+		for i, name := range strings.Split(names, `,`) {
+			f := os.NewFile(uintptr(firstInheritedFD+i), name)
+			var err error
+			if strings.HasPrefix(name, udpListenerName+`:`) {
+				il.packetConns[name], err = net.FilePacketConn(f)
+			} else {
+				il.listeners[name], err = net.FileListener(f)
+			}
+			f.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, `could not inherit listener '%s'`, name)
+			}
+		}
+	}
+
+	if readyFD != `` {
+		fd, err := strconv.Atoi(readyFD)
+		if err != nil {
+			return nil, errors.Errorf(`invalid %s (got '%s')`, envReadyFD, readyFD)
+		}
+		il.ready = os.NewFile(uintptr(fd), `ready`)
+		il.handedOff = true
+	}
+
+	return il, nil
+}
+
+func clientListenerKey(port int) string {
+
+	return fmt.Sprintf(`%s:%d`, clientListenerName, port)
+}
+
+func udpListenerKey(port int) string {
+
+	return fmt.Sprintf(`%s:%d`, udpListenerName, port)
+}
+
+func socketListenerKey(name string) string {
+
+	return fmt.Sprintf(`%s:%s`, socketListenerName, name)
+}
+
+// take removes and returns the inherited listener with the given name, or nil if there is none.
+func (il *inheritedListeners) take(name string) net.Listener {
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+
+	l := il.listeners[name]
+	delete(il.listeners, name)
+
+	return l
+}
+
+// takePacketConn removes and returns the inherited UDP socket with the given name, or nil if there is none.
+func (il *inheritedListeners) takePacketConn(name string) net.PacketConn {
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+
+	pc := il.packetConns[name]
+	delete(il.packetConns, name)
+
+	return pc
+}
+
+// ports returns the ports of all inherited listeners of the given kind, i.e. clientListenerName or udpListenerName,
+// that have not been claimed yet.
+func (il *inheritedListeners) ports(kind string) []int {
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+
+	var names []string
+	for name := range il.listeners {
+		names = append(names, name)
+	}
+	for name := range il.packetConns {
+		names = append(names, name)
+	}
+
+	var ports []int
+	for _, name := range names {
+		if strings.HasPrefix(name, kind+`:`) {
+			if port, err := strconv.Atoi(strings.TrimPrefix(name, kind+`:`)); err == nil {
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	return ports
+}
+
+// expire closes all listeners that are still unclaimed after the grace period and reports their names.
+func (il *inheritedListeners) expire(grace time.Duration, expired func(name string)) {
+
+	time.AfterFunc(grace, func() {
+		il.mutex.Lock()
+		defer il.mutex.Unlock()
+
+		for name, l := range il.listeners {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(true)
+			}
+			l.Close()
+			delete(il.listeners, name)
+			expired(name)
+		}
+
+		for name, pc := range il.packetConns {
+			pc.Close()
+			delete(il.packetConns, name)
+			expired(name)
+		}
+	})
+}
+
+// files duplicates the file descriptors of all unclaimed listeners so they can be passed on to yet another process.
+func (il *inheritedListeners) files() (names []string, files []*os.File) {
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+
+	for name, l := range il.listeners {
+		if f, err := listenerFile(l); err == nil {
+			names = append(names, name)
+			files = append(files, f)
+		}
+	}
+
+	for name, pc := range il.packetConns {
+		if f, err := packetConnFile(pc); err == nil {
+			names = append(names, name)
+			files = append(files, f)
+		}
+	}
+
+	return names, files
+}
+
+// notifyReady tells the previous process that this one has started and that it may begin draining.
+func (il *inheritedListeners) notifyReady() {
+
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+
+	if il.ready != nil {
+		il.ready.Write([]byte{1})
+		il.ready.Close()
+		il.ready = nil
+	}
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	f, ok := l.(filer)
+	if !ok {
+		return nil, errors.Errorf(`listener on %s cannot be handed off`, l.Addr().String())
+	}
+
+	return f.File()
+}
+
+func packetConnFile(pc net.PacketConn) (*os.File, error) {
+
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil, errors.Errorf(`socket on %s cannot be handed off`, pc.LocalAddr().String())
+	}
+
+	return uc.File()
+}
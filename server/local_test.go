@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/client"
+)
+
+// echoServer returns the address of a TCP server that echoes whatever it is sent, until the test ends.
+func echoServer(t *testing.T) string {
+
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// freeAddress returns a loopback address with a port that was free a moment ago.
+func freeAddress(t *testing.T) string {
+
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// newTestServer serves a handler with the given options until the test ends.
+func newTestServer(t *testing.T, options ...Option) *httptest.Server {
+
+	handler, lifecycle, err := NewHandler(append([]Option{Logger(log.New(io.Discard, ``, 0))}, options...)...)
+	if err != nil {
+		t.Fatalf(`could not instantiate handler: %s`, err.Error())
+	}
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		ts.Close()
+		lifecycle.Stop()
+	})
+
+	return ts
+}
+
+// startClient starts a client of ts with the given options.
+func startClient(t *testing.T, ts *httptest.Server, options ...client.Option) client.Client {
+
+	c, err := client.New(append([]client.Option{
+		client.ServerURL(ts.URL),
+		client.TransportCache(``),
+		client.NoProxy(),
+		client.Logger(log.New(io.Discard, ``, 0)),
+	}, options...)...)
+	if err != nil {
+		t.Fatalf(`could not instantiate client: %s`, err.Error())
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf(`could not start client: %s`, err.Error())
+	}
+	t.Cleanup(c.Stop)
+
+	return c
+}
+
+// echoes sends message over conn and reports whether it comes back.
+func echoes(t *testing.T, conn net.Conn, message string) bool {
+
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Errorf(`could not send: %s`, err.Error())
+		return false
+	}
+
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Errorf(`could not read the echo: %s`, err.Error())
+		return false
+	}
+
+	return string(echoed) == message
+}
+
+func TestLocalForward(t *testing.T) {
+
+	echo := echoServer(t)
+	ts := newTestServer(t, AllowDestinations(echo))
+
+	allowed, denied := freeAddress(t), freeAddress(t)
+	startClient(t, ts, client.Local(allowed, echo), client.Local(denied, `127.0.0.1:1`))
+
+	conn, err := net.Dial(`tcp`, allowed)
+	if err != nil {
+		t.Fatalf(`could not connect to the local forward: %s`, err.Error())
+	}
+	defer conn.Close()
+
+	for _, message := range []string{`hello`, `again`} {
+		if !echoes(t, conn, message) {
+			t.Errorf(`'%s' did not come back`, message)
+		}
+	}
+
+	// a destination the server refuses closes the local connection
+	refused, err := net.Dial(`tcp`, denied)
+	if err != nil {
+		t.Fatalf(`could not connect to the local forward: %s`, err.Error())
+	}
+	defer refused.Close()
+
+	refused.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf(`read %d bytes and %v from a refused forward, want EOF`, n, err)
+	}
+}
+
+func TestClientStopClosesConnections(t *testing.T) {
+
+	echo := echoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+
+	_, tunnelPort, _ := net.SplitHostPort(freeAddress(t))
+	port, _ := strconv.Atoi(tunnelPort)
+	ts := newTestServer(t, AllowDestinations(echo), ClientPortRange(port, port))
+
+	forward, socks, proxy := freeAddress(t), freeAddress(t), freeAddress(t)
+
+	c := startClient(t, ts,
+		client.Local(forward, echo),
+		client.Socks5(socks),
+		client.HttpProxy(proxy),
+		client.Target(echo),
+		client.Port(port),
+	)
+
+	dial := func(address string) net.Conn {
+		conn, err := net.Dial(`tcp`, address)
+		if err != nil {
+			t.Fatalf(`could not connect to %s: %s`, address, err.Error())
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	conns := map[string]net.Conn{}
+
+	conns[`local forward`] = dial(forward)
+
+	conn := dial(socks)
+	p, _ := strconv.Atoi(echoPort)
+	conn.Write([]byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(p >> 8), byte(p)})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf(`SOCKS5 CONNECT failed: %v %v`, reply, err)
+	}
+	conns[`SOCKS5 proxy`] = conn
+
+	conn = dial(proxy)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK || reader.Buffered() != 0 {
+		t.Fatalf(`HTTP CONNECT failed: %v %v`, resp, err)
+	}
+	conns[`HTTP proxy`] = conn
+
+	conns[`tunnel`] = dial(net.JoinHostPort(`127.0.0.1`, tunnelPort))
+
+	for name, conn := range conns {
+		if !echoes(t, conn, `before`) {
+			t.Errorf(`%s does not carry data`, name)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		c.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Wait did not return after Stop with connections open`)
+	}
+
+	for name, conn := range conns {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf(`%s is still open after Stop (read %d bytes)`, name, n)
+		}
+	}
+}
+
+func TestSocks5Replies(t *testing.T) {
+
+	echo := echoServer(t)
+	closed := freeAddress(t)
+	ts := newTestServer(t, AllowDestinations(echo, closed))
+
+	socks := freeAddress(t)
+	startClient(t, ts, client.Socks5(socks))
+
+	tests := []struct {
+		name      string
+		target    string
+		wantReply byte
+	}{
+		{`allowed`, echo, 0x00},
+		{`refused by the server`, `192.0.2.1:80`, 0x02},
+		{`unreachable`, closed, 0x04},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conn, err := net.Dial(`tcp`, socks)
+			if err != nil {
+				t.Fatalf(`could not connect: %s`, err.Error())
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			addr, _ := net.ResolveTCPAddr(`tcp`, tt.target)
+			request := append([]byte{5, 1, 0, 5, 1, 0, 1}, addr.IP.To4()...)
+			request = append(request, byte(addr.Port>>8), byte(addr.Port))
+			conn.Write(request)
+
+			reply := make([]byte, 12)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatalf(`could not read reply: %s`, err.Error())
+			}
+			if reply[3] != tt.wantReply {
+				t.Fatalf(`replied %d, want %d`, reply[3], tt.wantReply)
+			}
+
+			if tt.wantReply == 0 {
+				if !echoes(t, conn, `hello`) {
+					t.Error(`connection does not carry data`)
+				}
+				return
+			}
+
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf(`connection still open after a failure reply: %v`, err)
+			}
+		})
+	}
+}
+
+func TestHttpProxy(t *testing.T) {
+
+	echo := echoServer(t)
+
+	// a web server that hands over the requests it receives
+	received := make(chan *http.Request, 2)
+	web := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.Clone(req.Context())
+		rw.Header().Set(`Connection`, `close, X-Internal`)
+		rw.Header().Set(`X-Internal`, `secret`)
+		rw.Header().Set(`Keep-Alive`, `timeout=5`)
+		io.WriteString(rw, `hello`)
+	}))
+	defer web.Close()
+
+	ts := newTestServer(t, AllowDestinations(echo, web.Listener.Addr().String()))
+
+	proxy := freeAddress(t)
+	startClient(t, ts, client.HttpProxy(proxy))
+
+	t.Run(`absolute form`, func(t *testing.T) {
+
+		conn, err := net.Dial(`tcp`, proxy)
+		if err != nil {
+			t.Fatalf(`could not connect: %s`, err.Error())
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+
+		// two requests on one connection to the proxy
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(conn, "GET %s/path?q=%d HTTP/1.1\r\nHost: %s\r\nConnection: X-Trace, keep-alive\r\nX-Trace: 1\r\n"+
+				"Proxy-Authorization: Basic dXNlcjpwYXNz\r\nProxy-Connection: keep-alive\r\nX-Kept: yes\r\n\r\n", web.URL, i, web.Listener.Addr().String())
+
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf(`could not read response %d: %s`, i, err.Error())
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != `hello` {
+				t.Errorf(`response %d is '%s'`, i, body)
+			}
+
+			got := <-received
+			if want := fmt.Sprintf(`/path?q=%d`, i); got.RequestURI != want {
+				t.Errorf(`target received '%s', want origin form '%s'`, got.RequestURI, want)
+			}
+			for _, name := range []string{`X-Trace`, `Proxy-Authorization`, `Proxy-Connection`} {
+				if value := got.Header.Get(name); value != `` {
+					t.Errorf(`target received %s: %s`, name, value)
+				}
+			}
+			if got.Header.Get(`X-Kept`) != `yes` {
+				t.Errorf(`target did not receive X-Kept`)
+			}
+
+			for _, name := range []string{`X-Internal`, `Keep-Alive`} {
+				if value := resp.Header.Get(name); value != `` {
+					t.Errorf(`proxy client received %s: %s`, name, value)
+				}
+			}
+			if resp.Close {
+				t.Errorf(`response %d closes the connection`, i)
+			}
+		}
+	})
+
+	t.Run(`CONNECT`, func(t *testing.T) {
+
+		tests := []struct {
+			target     string
+			wantStatus int
+		}{
+			{echo, http.StatusOK},
+			{`192.0.2.1:443`, http.StatusForbidden},
+		}
+
+		for _, tt := range tests {
+			conn, err := net.Dial(`tcp`, proxy)
+			if err != nil {
+				t.Fatalf(`could not connect: %s`, err.Error())
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", tt.target, tt.target)
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatalf(`%s: could not read response: %s`, tt.target, err.Error())
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf(`%s: got %d, want %d`, tt.target, resp.StatusCode, tt.wantStatus)
+				continue
+			}
+
+			if tt.wantStatus == http.StatusOK && !echoes(t, conn, `tunnelled`) {
+				t.Errorf(`%s: connection does not carry data`, tt.target)
+			}
+		}
+	})
+}
@@ -3,7 +3,12 @@ package server
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"html/template"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/RobertGrantEllis/httptun/shared"
 )
@@ -48,6 +53,22 @@ func TunnelPort(port int) Option {
 	})
 }
 
+// TunnelSocket configures the Server to listen for incoming tunnels on a Unix socket at path instead of on a TCP
+// port, e.g. for sitting behind a local reverse proxy. TunnelIP and TunnelPort are ignored when it is set.
+func TunnelSocket(path string) Option {
+
+	return Option(func(s *server) error {
+
+		if path == `` {
+			return errors.New(`invalid tunnel socket: path is required`)
+		}
+
+		s.tunnelSocket = path
+
+		return nil
+	})
+}
+
 // TunnelTlsConfig configures TLS handling for incoming tunnels.
 func TunnelTlsConfig(config *tls.Config) Option {
 
@@ -67,6 +88,278 @@ func TunnelTlsConfig(config *tls.Config) Option {
 	})
 }
 
+// TunnelProxyProtocol requires every connection to the tunnel listener to start with a PROXY protocol header of either
+// version, as sent by L4 load balancers such as HAProxy or AWS NLB, so that the Server sees the real address of each
+// client. Connections without a valid header are rejected, so only enable it behind such a load balancer.
+func TunnelProxyProtocol() Option {
+
+	return Option(func(s *server) error {
+
+		s.tunnelProxyProtocol = true
+
+		return nil
+	})
+}
+
+// TunnelAllowIPs only admits connections to the tunnel listener from the given IP addresses and CIDR blocks. Behind a
+// load balancer, combine it with TunnelProxyProtocol so that the real addresses are checked. Rejected connections are
+// counted and logged. The list can be replaced at runtime with SetTunnelAccess.
+func TunnelAllowIPs(networks ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.tunnelAccess.add(networks, nil)
+	})
+}
+
+// TunnelDenyIPs rejects connections to the tunnel listener from the given IP addresses and CIDR blocks, even if they
+// are allowed by TunnelAllowIPs.
+func TunnelDenyIPs(networks ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.tunnelAccess.add(nil, networks)
+	})
+}
+
+// TunnelBandwidth limits each tunnel to rate bytes per second in each direction, allowing bursts of up to burst bytes
+// (one second's worth if zero). Datagrams of UDP tunnels count as well.
+func TunnelBandwidth(rate, burst int) Option {
+
+	return Option(func(s *server) error {
+
+		if rate < 0 || burst < 0 {
+			return fmt.Errorf(`invalid tunnel bandwidth: must not be negative (got %d, %d)`, rate, burst)
+		}
+
+		s.tunnelBandwidth = bandwidthSpec{rate: rate, burst: burst}
+
+		return nil
+	})
+}
+
+// IdentityBandwidth limits all tunnels and dialed connections of the same client to rate bytes per second in each
+// direction together, allowing bursts of up to burst bytes (one second's worth if zero). Clients are identified by the
+// common name of their TLS client certificate, if TunnelTlsConfig requires one, or else by their IP address.
+func IdentityBandwidth(rate, burst int) Option {
+
+	return Option(func(s *server) error {
+
+		if rate < 0 || burst < 0 {
+			return fmt.Errorf(`invalid identity bandwidth: must not be negative (got %d, %d)`, rate, burst)
+		}
+
+		s.identities.spec = bandwidthSpec{rate: rate, burst: burst}
+
+		return nil
+	})
+}
+
+// GlobalBandwidth limits all tunnels and dialed connections of the Server to rate bytes per second in each direction
+// together, allowing bursts of up to burst bytes (one second's worth if zero).
+func GlobalBandwidth(rate, burst int) Option {
+
+	return Option(func(s *server) error {
+
+		if rate < 0 || burst < 0 {
+			return fmt.Errorf(`invalid global bandwidth: must not be negative (got %d, %d)`, rate, burst)
+		}
+
+		s.globalBandwidth = newBandwidthLimit(rate, burst)
+
+		return nil
+	})
+}
+
+// ClientConnectionLimit caps the number of connections that each tunnel holds open at once, pending or attached, to
+// max (zero for no limit). Further connections are closed as soon as they are accepted.
+func ClientConnectionLimit(max int) Option {
+
+	return Option(func(s *server) error {
+
+		if max < 0 {
+			return fmt.Errorf(`invalid client connection limit: must not be negative (got %d)`, max)
+		}
+
+		s.clientConnections.max = max
+
+		return nil
+	})
+}
+
+// ClientConnectionRate caps the number of new connections that each tunnel accepts to rate per second (zero for no
+// limit), allowing bursts of up to burst connections (one second's worth if zero). Further connections are closed as
+// soon as they are accepted.
+func ClientConnectionRate(rate, burst int) Option {
+
+	return Option(func(s *server) error {
+
+		if rate < 0 || burst < 0 {
+			return fmt.Errorf(`invalid client connection rate: must not be negative (got %d, %d)`, rate, burst)
+		}
+
+		s.clientConnections.rate = rate
+		s.clientConnections.burst = burst
+
+		return nil
+	})
+}
+
+// ConnectionIdleTimeout closes connections through tunnels, and connections dialed for clients, once no data has
+// passed in either direction for timeout (zero for no timeout).
+func ConnectionIdleTimeout(timeout time.Duration) Option {
+
+	return Option(func(s *server) error {
+
+		if timeout < 0 {
+			return fmt.Errorf(`invalid connection idle timeout: must not be negative (got %s)`, timeout.String())
+		}
+
+		s.connectionIdleTimeout = timeout
+
+		return nil
+	})
+}
+
+// TunnelIdleTimeout closes tunnels, freeing their ports, once they have had no connections and no traffic for timeout
+// (zero for no timeout).
+func TunnelIdleTimeout(timeout time.Duration) Option {
+
+	return Option(func(s *server) error {
+
+		if timeout < 0 {
+			return fmt.Errorf(`invalid tunnel idle timeout: must not be negative (got %s)`, timeout.String())
+		}
+
+		s.tunnelIdleTimeout = timeout
+
+		return nil
+	})
+}
+
+// TunnelLifetime closes tunnels, freeing their ports, once they have been open for lifetime (zero for no limit),
+// regardless of their connections.
+func TunnelLifetime(lifetime time.Duration) Option {
+
+	return Option(func(s *server) error {
+
+		if lifetime < 0 {
+			return fmt.Errorf(`invalid tunnel lifetime: must not be negative (got %s)`, lifetime.String())
+		}
+
+		s.tunnelLifetime = lifetime
+
+		return nil
+	})
+}
+
+// EncryptionKey lets clients that pin the matching public key establish an encrypted channel inside every upgraded
+// connection, so that a proxy or load balancer that terminates TLS in front of the Server sees only ciphertext. See
+// shared.GenerateKey.
+func EncryptionKey(privateKey []byte) Option {
+
+	return Option(func(s *server) error {
+
+		if _, err := shared.PublicKey(privateKey); err != nil {
+			return err
+		}
+
+		s.encryptionKey = privateKey
+
+		return nil
+	})
+}
+
+// Disguise has the Server accept clients in disguise mode, whose handshakes and data are JSON requests under path,
+// e.g. '/api/v2/sync', and answer every other request that is not for a tunnel with a decoy site, so that it looks
+// like an ordinary web server. See DecoySite.
+func Disguise(path string) Option {
+
+	return Option(func(s *server) error {
+
+		if !strings.HasPrefix(path, `/`) || strings.HasSuffix(path, `/`) || strings.ContainsAny(path, "?# ") {
+			return fmt.Errorf(`invalid disguise path: must start but not end with '/' (got '%s')`, path)
+		}
+
+		s.disguisePath = path
+
+		return nil
+	})
+}
+
+// DecoySite configures the directory of static files served to requests that are not for a tunnel. By default the
+// status page is served, or in disguise mode a placeholder page.
+func DecoySite(dir string) Option {
+
+	return Option(func(s *server) error {
+
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf(`invalid decoy site: %s`, err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf(`invalid decoy site: '%s' is not a directory`, dir)
+		}
+
+		s.decoySite = dir
+
+		return nil
+	})
+}
+
+// StatusTemplate configures the html/template rendered as the page served to requests that are not for a tunnel. It is
+// executed with the fields Version, State, Ready, Tunnels, Uptime and Time. A decoy site takes precedence.
+func StatusTemplate(path string) Option {
+
+	return Option(func(s *server) error {
+
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			return fmt.Errorf(`invalid status template: %s`, err.Error())
+		}
+
+		s.statusTemplate = tmpl
+
+		return nil
+	})
+}
+
+// HandshakePath reserves the path at which the Server accepts tunnel handshakes; every other path is answered with
+// the status page or decoy site. Clients then include the path in the server URL. By default handshakes are accepted
+// at any path.
+func HandshakePath(path string) Option {
+
+	return Option(func(s *server) error {
+
+		if !strings.HasPrefix(path, `/`) {
+			return fmt.Errorf(`invalid handshake path '%s': must begin with '/'`, path)
+		}
+		if path == healthPath || path == readyPath {
+			return fmt.Errorf(`invalid handshake path '%s': reserved for health checks`, path)
+		}
+
+		s.handshakePath = path
+
+		return nil
+	})
+}
+
+// HandshakeLimit caps the number of tunnel requests (open, attach or dial) that the Server handles at once to max
+// (zero for no limit). Further requests are refused with 503 Service Unavailable.
+func HandshakeLimit(max int) Option {
+
+	return Option(func(s *server) error {
+
+		if max < 0 {
+			return fmt.Errorf(`invalid handshake limit: must not be negative (got %d)`, max)
+		}
+
+		s.handshakes = newHandshakeLimiter(max)
+
+		return nil
+	})
+}
+
 // ClientIP configures the IP address on which the server listens for incoming clients.
 func ClientIP(ipString string) Option {
 	//TODO: better differentiate the client ip from the tunnel ip
@@ -110,6 +403,138 @@ func ClientPortRange(portLower, portUpper int) Option {
 	})
 }
 
+// ClientUdpPortRange configures the ports available for UDP tunnels. By default it is the same range as for TCP,
+// since UDP ports are allocated independently.
+func ClientUdpPortRange(portLower, portUpper int) Option {
+
+	return Option(func(s *server) error {
+
+		if err := shared.ValidatePort(portLower); err != nil {
+			return err
+		}
+
+		if err := shared.ValidatePort(portUpper); err != nil {
+			return err
+		}
+
+		s.udpPortRegistry = newPortRegistry(portLower, portUpper)
+
+		return nil
+	})
+}
+
+// ClientAllowIPs only admits connections (and datagrams) to the ports of all tunnels, including the virtual host ports,
+// from the given IP addresses and CIDR blocks. Rejections are counted and logged. The list can be replaced at runtime
+// with SetClientAccess.
+func ClientAllowIPs(networks ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.clientAccess.add(networks, nil)
+	})
+}
+
+// ClientDenyIPs rejects connections (and datagrams) to the ports of all tunnels from the given IP addresses and CIDR
+// blocks, even if they are allowed by ClientAllowIPs.
+func ClientDenyIPs(networks ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.clientAccess.add(nil, networks)
+	})
+}
+
+// ClientSocketDir allows clients to expose their tunnels as Unix sockets, created in dir, instead of on ports from
+// ClientPortRange. The directory must already exist.
+func ClientSocketDir(dir string) Option {
+
+	return Option(func(s *server) error {
+
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf(`invalid client socket directory: %s`, err.Error())
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf(`invalid client socket directory: not a directory (got '%s')`, dir)
+		}
+
+		s.clientSocketDir = dir
+
+		return nil
+	})
+}
+
+// VirtualHosts lets clients request a hostname under domain instead of a port of their own. The Server listens on
+// port on ClientIP and routes each HTTP connection by its Host header, and on tlsPort routes each TLS connection by
+// the server name in its ClientHello without terminating TLS. Either port may be zero to disable it. Point a wildcard
+// DNS record for domain at the Server.
+func VirtualHosts(domain string, port, tlsPort int) Option {
+
+	return Option(func(s *server) error {
+
+		domain = strings.ToLower(strings.Trim(domain, `.`))
+		if domain == `` {
+			return errors.New(`invalid virtual host domain: domain is required`)
+		}
+
+		for _, p := range []int{port, tlsPort} {
+			if p == 0 {
+				continue
+			}
+			if err := shared.ValidatePort(p); err != nil {
+				return err
+			}
+		}
+
+		if port == 0 && tlsPort == 0 {
+			return errors.New(`invalid virtual host ports: at least one port is required`)
+		}
+
+		s.vhostDomain = domain
+		s.vhostPort = port
+		s.vhostTlsPort = tlsPort
+
+		return nil
+	})
+}
+
+// AllowDestinations allows clients to have the Server dial the destinations matched by rules, e.g. to reach an
+// internal database from a client that only has outbound HTTP. Each rule is 'host:ports', where host is a hostname,
+// a domain suffix such as '*.internal', an IP address, a CIDR block such as '10.0.0.0/8', or '*', and ports is a
+// port, a range such as '5432-5439', or '*'. No destination is allowed by default.
+func AllowDestinations(rules ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.destinations.addAllow(rules...)
+	})
+}
+
+// DenyDestinations prevents clients from having the Server dial the destinations matched by rules, even if they are
+// allowed by AllowDestinations. Rules are written as for AllowDestinations; a hostname that resolves to a denied
+// address is only dialed on one of its other addresses.
+func DenyDestinations(rules ...string) Option {
+
+	return Option(func(s *server) error {
+
+		return s.destinations.addDeny(rules...)
+	})
+}
+
+// Systemd integrates the Server with systemd: a tunnel listener passed through socket activation is used instead of
+// listening on TunnelIP and TunnelPort, and readiness, shutdown and watchdog pings are reported over NOTIFY_SOCKET.
+// It has no effect when the process is not run by systemd.
+func Systemd() Option {
+
+	return Option(func(s *server) error {
+
+		s.systemd = true
+
+		return nil
+	})
+}
+
 // Logger configures the Logger for Server
 func Logger(logger *log.Logger) Option {
 
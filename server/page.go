@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// paths at which load balancers check whether the server is alive, and whether it accepts tunnels
+const (
+	healthPath = `/healthz`
+	readyPath  = `/readyz`
+)
+
+var defaultStatusTemplate = template.Must(template.New(`status`).Parse(defaultStatusPage))
+
+// status is the data with which the status template is rendered.
+type status struct {
+	Version string
+	State   string
+	Ready   bool
+	Tunnels int
+	Uptime  time.Duration
+	Time    time.Time
+}
+
+// page answers a request that is not for a tunnel with the static files of the decoy site if there is one, or else
+// with the status template. In disguise mode without a template of its own, a placeholder page is served instead, so
+// that nothing gives the server away.
+func (s *server) page(rw http.ResponseWriter, req *http.Request) {
+
+	if s.decoySite != `` {
+		http.FileServer(http.Dir(s.decoySite)).ServeHTTP(rw, req)
+		return
+	}
+
+	if req.URL.Path != `/` {
+		http.NotFound(rw, req)
+		return
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set(`Allow`, `GET, HEAD`)
+		http.Error(rw, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+
+	if s.disguisePath != `` && s.statusTemplate == nil {
+		io.WriteString(rw, defaultDecoyPage)
+		return
+	}
+
+	tmpl := s.statusTemplate
+	if tmpl == nil {
+		tmpl = defaultStatusTemplate
+		rw.Header().Set(`Cache-Control`, `no-store`)
+	}
+
+	// rendered in full first, so that a failing template does not leave half a page
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, s.status()); err != nil {
+		s.logger.Printf(`could not render status page: %s`, err.Error())
+		http.Error(rw, `internal server error`, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write(buf.Bytes())
+}
+
+func (s *server) status() *status {
+
+	s.mu.Lock()
+	state, handingOff, started := s.state, s.handingOff, s.started
+	s.mu.Unlock()
+
+	uptime := time.Duration(0)
+	if !started.IsZero() {
+		uptime = time.Since(started).Truncate(time.Second)
+	}
+
+	return &status{
+		Version: shared.Version,
+		State:   state.String(),
+		Ready:   state == StateRunning && !handingOff,
+		Tunnels: len(s.tunnels.all()),
+		Uptime:  uptime,
+		Time:    time.Now(),
+	}
+}
+
+// health answers load balancers that the server is alive for as long as it has not stopped.
+func (s *server) health(rw http.ResponseWriter, req *http.Request) {
+
+	rw.Header().Set(`Cache-Control`, `no-store`)
+
+	if state := s.State(); state == StateStopped {
+		http.Error(rw, fmt.Sprintf(`server is %s`, state), http.StatusServiceUnavailable)
+		return
+	}
+
+	io.WriteString(rw, "ok\n")
+}
+
+// ready answers load balancers that the server accepts tunnels, so that they stop sending clients while it starts,
+// stops or hands off to a new process. It never waits for a handoff to finish.
+func (s *server) ready(rw http.ResponseWriter, req *http.Request) {
+
+	rw.Header().Set(`Cache-Control`, `no-store`)
+
+	s.mu.Lock()
+	state, handingOff := s.state, s.handingOff
+	s.mu.Unlock()
+
+	if state != StateRunning {
+		http.Error(rw, fmt.Sprintf(`server is %s`, state), http.StatusServiceUnavailable)
+		return
+	}
+
+	if handingOff {
+		http.Error(rw, `server is handing off to a new process`, http.StatusServiceUnavailable)
+		return
+	}
+
+	io.WriteString(rw, "ready\n")
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+
+	tests := []struct {
+		state      State
+		handingOff bool
+		wantHealth int
+		wantReady  int
+		wantBody   string // of the readiness check
+	}{
+		{StateNew, false, http.StatusOK, http.StatusServiceUnavailable, `server is new`},
+		{StateStarting, false, http.StatusOK, http.StatusServiceUnavailable, `server is starting`},
+		{StateRunning, false, http.StatusOK, http.StatusOK, `ready`},
+		{StateRunning, true, http.StatusOK, http.StatusServiceUnavailable, `server is handing off to a new process`},
+		{StateStopping, false, http.StatusOK, http.StatusServiceUnavailable, `server is stopping`},
+		{StateStopped, false, http.StatusServiceUnavailable, http.StatusServiceUnavailable, `server is stopped`},
+	}
+
+	for _, tt := range tests {
+		name := tt.state.String()
+		if tt.handingOff {
+			name += ` handing off`
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			// the checks answer the same whatever else the server is configured to do
+			for _, options := range [][]Option{nil, {HandshakePath(`/tunnel`)}, {Disguise(`/api/v2/sync`)}} {
+				srv, err := New(options...)
+				if err != nil {
+					t.Fatalf(`could not instantiate server: %s`, err.Error())
+				}
+				s := srv.(*server)
+				s.state, s.handingOff = tt.state, tt.handingOff
+
+				for _, check := range []struct {
+					path       string
+					wantStatus int
+					wantBody   string
+				}{
+					{healthPath, tt.wantHealth, ``},
+					{readyPath, tt.wantReady, tt.wantBody},
+				} {
+					rw := httptest.NewRecorder()
+					s.handle(rw, httptest.NewRequest(http.MethodGet, check.path, nil))
+
+					if rw.Code != check.wantStatus {
+						t.Errorf(`%s returned %d, want %d`, check.path, rw.Code, check.wantStatus)
+					}
+					if check.wantBody != `` && strings.TrimSpace(rw.Body.String()) != check.wantBody {
+						t.Errorf(`%s returned '%s', want '%s'`, check.path, strings.TrimSpace(rw.Body.String()), check.wantBody)
+					}
+					if got := rw.Header().Get(`Cache-Control`); got != `no-store` {
+						t.Errorf(`%s has Cache-Control '%s', want 'no-store'`, check.path, got)
+					}
+				}
+			}
+		})
+	}
+}
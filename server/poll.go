@@ -0,0 +1,302 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// pollRegistry holds the sessions of clients that use the long-poll transport. Each session is a connection whose
+// data from the client arrives in POST requests and whose data to the client is fetched with long-polling GET
+// requests, all of which name the session in the Httptun-Session header.
+type pollRegistry struct {
+	sessions map[string]*pollSession
+	mutex    *sync.Mutex
+}
+
+func newPollRegistry() *pollRegistry {
+
+	return &pollRegistry{
+		sessions: map[string]*pollSession{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+type pollSession struct {
+	conn    *shared.StreamConn
+	inbound *io.PipeWriter
+
+	// how much data from the client has been delivered to inbound; inboundMutex also keeps posts in order
+	received     int64
+	inboundMutex *sync.Mutex
+
+	outbound       chan []byte
+	outboundClosed chan struct{}
+	closeOutbound  *sync.Once
+
+	// data taken by polls that the client has not acknowledged yet, which begins at acked in the data to the client
+	unacked       []byte
+	acked         int64
+	outboundMutex *sync.Mutex
+
+	// closes the session if the client stops polling
+	expiry *time.Timer
+}
+
+// open starts a session for the handshake req, answers it with the given headers and the session's identifier, and
+// returns the session as a connection.
+func (pr *pollRegistry) open(rw http.ResponseWriter, req *http.Request, header http.Header) (net.Conn, error) {
+
+	id := shared.RandomID()
+	reader, writer := io.Pipe()
+
+	session := &pollSession{
+		inbound:        writer,
+		inboundMutex:   &sync.Mutex{},
+		outbound:       make(chan []byte),
+		outboundClosed: make(chan struct{}),
+		closeOutbound:  &sync.Once{},
+		outboundMutex:  &sync.Mutex{},
+	}
+
+	closeWrite := func() error {
+		session.closeOutbound.Do(func() { close(session.outboundClosed) })
+		return nil
+	}
+
+	close := func() error {
+		reader.Close()
+		writer.Close()
+		session.expiry.Stop()
+		pr.remove(id)
+		return nil
+	}
+
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, _ := net.ResolveTCPAddr(`tcp`, req.RemoteAddr)
+
+	session.conn = shared.NewStreamConn(reader, &pollWriter{session: session}, closeWrite, close, local, remote)
+	session.expiry = time.AfterFunc(defaultPollSessionTimeout, func() { session.conn.Close() })
+
+	pr.mutex.Lock()
+	pr.sessions[id] = session
+	pr.mutex.Unlock()
+
+	for key, values := range header {
+		rw.Header()[key] = values
+	}
+	rw.Header().Set(shared.HeaderSession, id)
+	// the handler goes on to use the session, so the response must be complete without returning from it, and the
+	// client must not send further requests on this connection, which is not read again until the handler returns
+	rw.Header().Set(`Content-Length`, `0`)
+	rw.Header().Set(`Connection`, `close`)
+	rw.WriteHeader(http.StatusOK)
+	if flusher, ok := rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return session.conn, nil
+}
+
+func (pr *pollRegistry) remove(id string) {
+
+	pr.mutex.Lock()
+	delete(pr.sessions, id)
+	pr.mutex.Unlock()
+}
+
+// serve handles a request for an existing session: POST delivers data from the client, or the end of it if the
+// Httptun-Eof header is set, GET waits for data to the client, and DELETE closes the session.
+func (pr *pollRegistry) serve(rw http.ResponseWriter, req *http.Request) {
+
+	pr.mutex.Lock()
+	session := pr.sessions[req.Header.Get(shared.HeaderSession)]
+	pr.mutex.Unlock()
+
+	if session == nil {
+		http.Error(rw, `unknown session`, http.StatusNotFound)
+		return
+	}
+
+	session.expiry.Reset(defaultPollSessionTimeout)
+
+	switch req.Method {
+	case http.MethodPost:
+		if status, err := session.receive(req); err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		session.poll(rw, req)
+	case http.MethodDelete:
+		session.conn.Close()
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, `method not allowed`, http.StatusMethodNotAllowed)
+	}
+}
+
+// receive delivers the data of a POST to the session. The client repeats a post whose response it did not see, so
+// whatever part of it was delivered before is skipped. Clients that send no Httptun-Sequence never repeat posts.
+func (ps *pollSession) receive(req *http.Request) (int, error) {
+
+	ps.inboundMutex.Lock()
+	defer ps.inboundMutex.Unlock()
+
+	sequence, err := parseSequence(req.Header.Get(shared.HeaderSequence), ps.received)
+	if err != nil || sequence > ps.received {
+		return http.StatusConflict, errors.Errorf(`data is out of sequence: expected %d`, ps.received)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, req.Body, ps.received-sequence); err != nil {
+		return http.StatusBadRequest, errors.New(`incomplete data`)
+	}
+
+	if req.Header.Get(shared.HeaderEof) != `` {
+		ps.inbound.Close()
+		return http.StatusNoContent, nil
+	}
+
+	n, err := io.Copy(ps.inbound, req.Body)
+	ps.received += n
+	if err == io.ErrClosedPipe {
+		return http.StatusGone, errors.New(`session is closed`)
+	} else if err != nil {
+		// the client repeats the post, and what arrived of it is skipped then
+		return http.StatusBadRequest, errors.New(`incomplete data`)
+	}
+
+	return http.StatusNoContent, nil
+}
+
+// poll answers with the data that the client has not acknowledged yet, waiting until some is written to the session
+// or the poll times out, or else with the end of data. The response is repeated by the next poll until the client
+// acknowledges it, so that data is not lost if the response does not arrive. Clients that send no Httptun-Ack
+// acknowledge every response by polling again.
+func (ps *pollSession) poll(rw http.ResponseWriter, req *http.Request) {
+
+	rw.Header().Set(`Content-Type`, `application/octet-stream`)
+	rw.Header().Set(`Cache-Control`, `no-store`)
+
+	ps.outboundMutex.Lock()
+	ack, err := parseSequence(req.Header.Get(shared.HeaderAck), ps.acked+int64(len(ps.unacked)))
+	if err != nil || ack < ps.acked || ack > ps.acked+int64(len(ps.unacked)) {
+		expected := ps.acked
+		ps.outboundMutex.Unlock()
+		http.Error(rw, fmt.Sprintf(`acknowledgement is out of sequence: expected %d or more`, expected), http.StatusConflict)
+		return
+	}
+	ps.unacked = ps.unacked[ack-ps.acked:]
+	ps.acked = ack
+	waiting := len(ps.unacked) == 0
+	ps.outboundMutex.Unlock()
+
+	if waiting {
+		timer := time.NewTimer(defaultPollWait)
+		defer timer.Stop()
+
+		select {
+		case data := <-ps.outbound:
+			ps.take(data)
+		case <-ps.outboundClosed:
+			if ps.unackedSize() == 0 {
+				rw.Header().Set(shared.HeaderEof, `1`)
+				rw.WriteHeader(http.StatusOK)
+				return
+			}
+		case <-ps.conn.Done():
+			rw.Header().Set(shared.HeaderEof, `1`)
+			rw.WriteHeader(http.StatusOK)
+			return
+		case <-timer.C:
+			if ps.unackedSize() == 0 {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	// take whatever else is ready, so that a burst of small writes is returned at once
+	for ps.unackedSize() < maxPollResponse {
+		select {
+		case data := <-ps.outbound:
+			ps.take(data)
+			continue
+		default:
+		}
+		break
+	}
+
+	ps.outboundMutex.Lock()
+	sequence, data := ps.acked, ps.unacked
+	ps.outboundMutex.Unlock()
+
+	if len(data) > maxPollResponse {
+		data = data[:maxPollResponse]
+	}
+
+	rw.Header().Set(shared.HeaderSequence, strconv.FormatInt(sequence, 10))
+	rw.Write(data)
+}
+
+// take adds data written to the session to what the client has not acknowledged.
+func (ps *pollSession) take(data []byte) {
+
+	ps.outboundMutex.Lock()
+	ps.unacked = append(ps.unacked, data...)
+	ps.outboundMutex.Unlock()
+}
+
+func (ps *pollSession) unackedSize() int {
+
+	ps.outboundMutex.Lock()
+	defer ps.outboundMutex.Unlock()
+
+	return len(ps.unacked)
+}
+
+// parseSequence parses the value of an Httptun-Sequence or Httptun-Ack header, or returns otherwise if it is empty.
+func parseSequence(value string, otherwise int64) (int64, error) {
+
+	if value == `` {
+		return otherwise, nil
+	}
+
+	sequence, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sequence < 0 {
+		return 0, errors.Errorf(`invalid sequence '%s'`, value)
+	}
+
+	return sequence, nil
+}
+
+// pollWriter hands what is written to a session to the next poll, blocking until one takes it.
+type pollWriter struct {
+	session *pollSession
+}
+
+func (pw *pollWriter) Write(b []byte) (int, error) {
+
+	data := append([]byte{}, b...)
+
+	select {
+	case pw.session.outbound <- data:
+		return len(b), nil
+	case <-pw.session.outboundClosed:
+		return 0, net.ErrClosed
+	case <-pw.session.conn.Done():
+		return 0, net.ErrClosed
+	}
+}
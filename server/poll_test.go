@@ -0,0 +1,216 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// openPollSession starts a session and returns it as a connection along with its identifier.
+func openPollSession(t *testing.T, pr *pollRegistry) (net.Conn, string) {
+
+	t.Helper()
+
+	rw := httptest.NewRecorder()
+	conn, err := pr.open(rw, httptest.NewRequest(http.MethodPost, `/`, nil), http.Header{})
+	if err != nil {
+		t.Fatalf(`could not open session: %s`, err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, rw.Header().Get(shared.HeaderSession)
+}
+
+// pollRequest makes a request of a session, with Httptun-Sequence or, for a poll, Httptun-Ack set to position unless
+// it is empty.
+func pollRequest(pr *pollRegistry, id, method, position, data string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, `/`, strings.NewReader(data))
+	req.Header.Set(shared.HeaderSession, id)
+	if position != `` {
+		header := shared.HeaderSequence
+		if method == http.MethodGet {
+			header = shared.HeaderAck
+		}
+		req.Header.Set(header, position)
+	}
+
+	rw := httptest.NewRecorder()
+	pr.serve(rw, req)
+
+	return rw
+}
+
+func TestPollSessionReceive(t *testing.T) {
+
+	type post struct {
+		sequence   string
+		data       string
+		wantStatus int
+	}
+
+	tests := []struct {
+		name  string
+		posts []post
+		want  string
+	}{
+		{`in order`, []post{{`0`, `hello`, 204}, {`5`, ` world`, 204}}, `hello world`},
+		{`repeated`, []post{{`0`, `hello`, 204}, {`0`, `hello`, 204}, {`5`, ` world`, 204}, {`5`, ` world`, 204}}, `hello world`},
+		{`repeated with more`, []post{{`0`, `hel`, 204}, {`0`, `hello`, 204}, {`5`, ` world`, 204}}, `hello world`},
+		{`gap`, []post{{`0`, `hello`, 204}, {`6`, `world`, 409}, {`5`, ` world`, 204}}, `hello world`},
+		{`invalid sequence`, []post{{`0`, `hello`, 204}, {`first`, `!`, 409}, {`-1`, `!`, 409}}, `hello`},
+		{`without sequence`, []post{{``, `hello`, 204}, {``, ` world`, 204}}, `hello world`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pr := newPollRegistry()
+			conn, id := openPollSession(t, pr)
+
+			received := make(chan string, 1)
+			go func() {
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			}()
+
+			for i, p := range tt.posts {
+				if rw := pollRequest(pr, id, http.MethodPost, p.sequence, p.data); rw.Code != p.wantStatus {
+					t.Errorf(`post %d: status %d, want %d: %s`, i, rw.Code, p.wantStatus, rw.Body.String())
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, `/`, nil)
+			req.Header.Set(shared.HeaderSession, id)
+			req.Header.Set(shared.HeaderEof, `1`)
+			pr.serve(httptest.NewRecorder(), req)
+
+			if got := <-received; got != tt.want {
+				t.Errorf(`session received '%s', want '%s'`, got, tt.want)
+			}
+		})
+	}
+}
+
+// pollResult is what a poll returned.
+type pollResult struct {
+	status   int
+	sequence string
+	data     string
+	eof      bool
+}
+
+// pollOnce polls a session, acknowledging ack bytes unless it is -1.
+func pollOnce(pr *pollRegistry, id string, ack int) pollResult {
+
+	position := ``
+	if ack >= 0 {
+		position = strconv.Itoa(ack)
+	}
+	rw := pollRequest(pr, id, http.MethodGet, position, ``)
+
+	return pollResult{
+		status:   rw.Code,
+		sequence: rw.Header().Get(shared.HeaderSequence),
+		data:     rw.Body.String(),
+		eof:      rw.Header().Get(shared.HeaderEof) != ``,
+	}
+}
+
+func TestPollSessionRepeatsUnacknowledgedData(t *testing.T) {
+
+	pr := newPollRegistry()
+	conn, id := openPollSession(t, pr)
+
+	// writes block until a poll takes them
+	written := make(chan error, 1)
+	write := func(data string) {
+		go func() {
+			_, err := conn.Write([]byte(data))
+			written <- err
+		}()
+	}
+
+	write(`abc`)
+	if got, want := pollOnce(pr, id, 0), (pollResult{200, `0`, `abc`, false}); got != want {
+		t.Errorf(`first poll returned %+v, want %+v`, got, want)
+	}
+	<-written
+
+	// the response did not arrive, so the client polls again without acknowledging it
+	if got, want := pollOnce(pr, id, 0), (pollResult{200, `0`, `abc`, false}); got != want {
+		t.Errorf(`repeated poll returned %+v, want %+v`, got, want)
+	}
+
+	// part of it arrived
+	write(`def`)
+	time.Sleep(10 * time.Millisecond)
+	if got, want := pollOnce(pr, id, 2), (pollResult{200, `2`, `cdef`, false}); got != want {
+		t.Errorf(`poll after a partial response returned %+v, want %+v`, got, want)
+	}
+	<-written
+
+	for _, ack := range []int{1, 7} {
+		if got := pollOnce(pr, id, ack); got.status != http.StatusConflict {
+			t.Errorf(`poll acknowledging %d returned %+v, want a conflict`, ack, got)
+		}
+	}
+
+	write(`ghi`)
+	if got, want := pollOnce(pr, id, 6), (pollResult{200, `6`, `ghi`, false}); got != want {
+		t.Errorf(`poll after acknowledging everything returned %+v, want %+v`, got, want)
+	}
+	<-written
+
+	// the end of data is only sent once everything is acknowledged
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	if got, want := pollOnce(pr, id, 6), (pollResult{200, `6`, `ghi`, false}); got != want {
+		t.Errorf(`poll after CloseWrite returned %+v, want %+v`, got, want)
+	}
+	if got, want := pollOnce(pr, id, 9), (pollResult{200, ``, ``, true}); got != want {
+		t.Errorf(`final poll returned %+v, want %+v`, got, want)
+	}
+}
+
+func TestPollSessionWithoutAcknowledgements(t *testing.T) {
+
+	pr := newPollRegistry()
+	conn, id := openPollSession(t, pr)
+
+	go conn.Write([]byte(`abc`))
+	if got, want := pollOnce(pr, id, -1), (pollResult{200, `0`, `abc`, false}); got != want {
+		t.Errorf(`first poll returned %+v, want %+v`, got, want)
+	}
+
+	// polling again acknowledges everything
+	go conn.Write([]byte(`def`))
+	if got, want := pollOnce(pr, id, -1), (pollResult{200, `3`, `def`, false}); got != want {
+		t.Errorf(`second poll returned %+v, want %+v`, got, want)
+	}
+}
+
+func TestPollSessionLimitsResponses(t *testing.T) {
+
+	pr := newPollRegistry()
+	conn, id := openPollSession(t, pr)
+
+	data := strings.Repeat(`x`, maxPollResponse+10)
+	go conn.Write([]byte(data))
+
+	first := pollOnce(pr, id, 0)
+	if first.sequence != `0` || len(first.data) != maxPollResponse {
+		t.Fatalf(`first poll returned %d bytes at %s, want %d at 0`, len(first.data), first.sequence, maxPollResponse)
+	}
+
+	second := pollOnce(pr, id, maxPollResponse)
+	if second.sequence != strconv.Itoa(maxPollResponse) || len(second.data) != 10 {
+		t.Errorf(`second poll returned %d bytes at %s, want 10 at %d`, len(second.data), second.sequence, maxPollResponse)
+	}
+}
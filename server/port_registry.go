@@ -2,12 +2,15 @@ package server
 
 import (
 	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type portRegistry struct {
-	allocated   map[int]bool
-	unallocated chan int
-	mutex       *sync.Mutex
+	min, max  int
+	next      int
+	allocated map[int]bool
+	mutex     *sync.Mutex
 }
 
 func newPortRegistry(min, max int) *portRegistry {
@@ -16,33 +19,55 @@ func newPortRegistry(min, max int) *portRegistry {
 		min, max = max, min
 	}
 
-	num := max - min + 1
+	return &portRegistry{
+		min:       min,
+		max:       max,
+		next:      min,
+		allocated: make(map[int]bool, max-min+1),
+		mutex:     &sync.Mutex{},
+	}
+}
 
-	allocated := make(map[int]bool, num)
-	unallocated := make(chan int, num)
+// allocate returns an unallocated port from the range. If port is non-zero, then exactly that port is allocated.
+func (pr *portRegistry) allocate(port int) (int, error) {
 
-	for i := min; i <= max; i++ {
-		unallocated <- i
-	}
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
 
-	return &portRegistry{
-		allocated:   allocated,
-		unallocated: unallocated,
-		mutex:       &sync.Mutex{},
+	if port != 0 {
+		if !pr.contains(port) {
+			return 0, errors.Errorf(`port %d is outside of the range %d-%d`, port, pr.min, pr.max)
+		}
+		if pr.allocated[port] {
+			return 0, errors.Errorf(`port %d is already allocated`, port)
+		}
+		pr.allocated[port] = true
+		return port, nil
 	}
-}
 
-func (pr *portRegistry) allocate() int {
+	for i := 0; i <= pr.max-pr.min; i++ {
+		candidate := pr.next
+		pr.next++
+		if pr.next > pr.max {
+			pr.next = pr.min
+		}
+		if !pr.allocated[candidate] {
+			pr.allocated[candidate] = true
+			return candidate, nil
+		}
+	}
 
-	return <-pr.unallocated
+	return 0, errors.Errorf(`all ports in the range %d-%d are allocated`, pr.min, pr.max)
 }
 
 func (pr *portRegistry) release(port int) {
 
 	pr.mutex.Lock()
-	if pr.allocated[port] {
-		delete(pr.allocated, port)
-		pr.unallocated <- port
-	}
+	delete(pr.allocated, port)
 	pr.mutex.Unlock()
 }
+
+func (pr *portRegistry) contains(port int) bool {
+
+	return port >= pr.min && port <= pr.max
+}
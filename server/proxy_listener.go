@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// proxyListener accepts connections that start with a PROXY protocol header, as sent by L4 load balancers, and
+// reports the source announced by the header as the remote address of each connection. Headers are read in the
+// background so that a slow peer cannot hold up others; connections without a valid header are closed.
+type proxyListener struct {
+	net.Listener
+	logger *log.Logger
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // why accepting stopped; set before done is closed
+	once  *sync.Once
+}
+
+func newProxyListener(l net.Listener, logger *log.Logger) *proxyListener {
+
+	pl := &proxyListener{
+		Listener: l,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+	}
+
+	go pl.accept()
+
+	return pl
+}
+
+func (pl *proxyListener) accept() {
+
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			pl.err = err
+			pl.once.Do(func() { close(pl.done) })
+			return
+		}
+		go pl.readHeader(conn)
+	}
+}
+
+func (pl *proxyListener) readHeader(conn net.Conn) {
+
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(defaultProxyHeaderTimeout))
+	source, _, err := shared.ReadProxyHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		pl.logger.Printf(`rejected connection from %s: %s`, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	proxied := &proxyConn{
+		BufferedConn: &shared.BufferedConn{Conn: conn, Reader: reader},
+		remote:       source,
+	}
+
+	select {
+	case pl.conns <- proxied:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.err
+	}
+}
+
+// proxyConn is a connection whose remote address was announced by a PROXY protocol header.
+type proxyConn struct {
+	*shared.BufferedConn
+	remote net.Addr // nil if the header did not announce one
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+
+	if pc.remote == nil {
+		return pc.BufferedConn.RemoteAddr()
+	}
+
+	return pc.remote
+}
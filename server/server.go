@@ -2,6 +2,8 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net"
@@ -10,17 +12,37 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
 )
 
 // Server implements an httptun server that accepts incoming requests from httptun clients and then opens a
 // port for accessing that tunnel.
 type Server interface {
-	// Starts the Server (non-blocking)
+	// Starts the Server (non-blocking). A Server can only be started once.
 	Start() error
-	// Stops the server
+	// Starts a new process from the current executable, hands it all listeners, and then drains this Server
+	Handoff() error
+	// Replaces the IP addresses and CIDR blocks allowed and denied on the tunnel listener
+	SetTunnelAccess(allow, deny []string) error
+	// Replaces the IP addresses and CIDR blocks allowed and denied on the ports of all tunnels
+	SetClientAccess(allow, deny []string) error
+
+	Lifecycle
+}
+
+// Lifecycle controls the tunnels established through a Server or a handler returned by NewHandler.
+type Lifecycle interface {
+	// Stops the server and closes all tunnels
 	Stop()
-	// Blocks until server is stopped
+	// Blocks until server is stopped, or returns immediately if it was never started
 	Wait()
+	// Returns the current lifecycle State of the Server
+	State() State
+	// Returns a channel that is closed once the Server has stopped
+	Done() <-chan struct{}
+	// Returns the reason the Server terminated, or nil if it is running or was stopped deliberately
+	Err() error
 }
 
 // Instantiates a default Server and then applies any number of Options.
@@ -31,15 +53,26 @@ func New(options ...Option) (Server, error) {
 
 	// initialize
 	s := &server{
-		mu:           &sync.Mutex{},
-		wg:           &sync.WaitGroup{},
-		logger:       logger,
-		tunnelIP:     net.ParseIP(defaultTunnelIP),
-		tunnelPort:   defaultTunnelPort,
-		clientIP:     net.ParseIP(defaultClientIP),
-		portRegistry: newPortRegistry(defaultClientPortLower, defaultClientPortUpper),
-		listener:     nil, // set at runtime
+		mu:              &sync.Mutex{},
+		wg:              &sync.WaitGroup{},
+		done:            make(chan struct{}),
+		logger:          logger,
+		tunnelIP:        net.ParseIP(defaultTunnelIP),
+		tunnelPort:      defaultTunnelPort,
+		clientIP:        net.ParseIP(defaultClientIP),
+		portRegistry:    newPortRegistry(defaultClientPortLower, defaultClientPortUpper),
+		udpPortRegistry: newPortRegistry(defaultClientPortLower, defaultClientPortUpper),
+		tunnelAccess:    newAccessList(`tunnel listener`),
+		clientAccess:    newAccessList(`client port`),
+		identities:      newIdentityRegistry(),
+		tunnels:         newTunnelRegistry(),
+		polls:           newPollRegistry(),
+		vhostListeners:  map[string]net.Listener{},
+		destinations:    newDestinationPolicy(),
+		inherited:       newInheritedListeners(), // replaced by Start
+		listener:        nil,                     // set at runtime
 	}
+	s.connections = newConnectionRegistry(s.wg)
 
 	// apply all other options designated by developer
 	for _, option := range options {
@@ -67,19 +100,85 @@ type server struct {
 	wg     *sync.WaitGroup
 	logger *log.Logger
 
+	// lifecycle, guarded by mu
+	state   State
+	err     error
+	done    chan struct{}
+	started time.Time
+
+	// whether a new process is being started to take over the listeners, guarded by mu
+	handingOff bool
+
 	// tunnel listener specification
 	tunnelIP        net.IP
 	tunnelPort      int
+	tunnelSocket    string
 	tunnelTlsConfig *tls.Config
 
-	// client listener specification
-	clientIP     net.IP
-	portRegistry *portRegistry
+	// whether connections to the tunnel listener start with a PROXY protocol header
+	tunnelProxyProtocol bool
 
-	// listener derived from specification above
-	listener net.Listener
+	// who may connect to the tunnel listener and to the ports of tunnels
+	tunnelAccess *accessList
+	clientAccess *accessList
 
-	// TODO: Simple API for looking up what tunnels are established
+	// client listener specification
+	clientIP        net.IP
+	portRegistry    *portRegistry
+	udpPortRegistry *portRegistry
+	clientSocketDir string
+
+	// virtual host ports shared by tunnels that are reached by hostname under vhostDomain
+	vhostDomain    string
+	vhostPort      int
+	vhostTlsPort   int
+	vhostListeners map[string]net.Listener
+
+	// listener derived from specification above, and the unwrapped listener beneath any TLS
+	listener     net.Listener
+	baseListener net.Listener
+
+	// limits on the bandwidth of each tunnel, of each identity, and of the Server as a whole
+	tunnelBandwidth bandwidthSpec
+	identities      *identityRegistry
+	globalBandwidth *bandwidthLimit
+
+	// limits on the connections accepted by each tunnel, and on the handshakes in progress at once
+	clientConnections connectionSpec
+	handshakes        *handshakeLimiter
+
+	// how long joined connections and tunnels may be idle, and how long tunnels may stay open; zero for no limit
+	connectionIdleTimeout time.Duration
+	tunnelIdleTimeout     time.Duration
+	tunnelLifetime        time.Duration
+
+	// private key with which clients may establish encrypted channels, or nil
+	encryptionKey []byte
+
+	// tunnels currently established
+	tunnels *tunnelRegistry
+
+	// sessions of clients that use the long-poll transport
+	polls *pollRegistry
+
+	// base path under which the long-poll transport is disguised as a JSON API, or empty
+	disguisePath string
+
+	// path at which tunnel handshakes are accepted, or empty for any path, and what other requests are answered with:
+	// the static files of the decoy site, or else the status template, when they are set
+	handshakePath  string
+	decoySite      string
+	statusTemplate *template.Template
+
+	// destinations that clients may ask the server to dial, and the connections dialed so far
+	destinations *destinationPolicy
+	connections  *connectionRegistry
+
+	// listeners handed down by a previous process, consumed by Start
+	inherited *inheritedListeners
+
+	// whether to integrate with systemd
+	systemd bool
 }
 
 func (s *server) Start() error {
@@ -87,31 +186,165 @@ func (s *server) Start() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.state != StateNew {
+		return errors.Errorf(`cannot start server: server is %s`, s.state)
+	}
+
+	s.state = StateStarting
+
+	inherited, err := inheritListeners()
+	if err != nil {
+		err = errors.Wrap(err, `could not start listener`)
+		s.stop(err, false)
+		return err
+	}
+	s.inherited = inherited
+
 	if err := s.listen(); err != nil {
-		return errors.Wrap(err, `could not start listener`)
+		err = errors.Wrap(err, `could not start listener`)
+		s.stop(err, false)
+		return err
+	}
+
+	if err := s.listenVhosts(); err != nil {
+		err = errors.Wrap(err, `could not start listener`)
+		s.stop(err, false)
+		return err
 	}
 
-	if err := s.serve(); err != nil {
-		return errors.Wrap(err, `could not start server`)
+	s.serve()
+	s.state = StateRunning
+	s.started = time.Now()
+
+	// keep inherited client ports reserved until their clients reconnect
+	for _, port := range s.inherited.ports(clientListenerName) {
+		s.portRegistry.allocate(port)
+	}
+	for _, port := range s.inherited.ports(udpListenerName) {
+		s.udpPortRegistry.allocate(port)
+	}
+	s.inherited.expire(defaultInheritedGrace, func(name string) {
+		var port int
+		if _, err := fmt.Sscanf(name, clientListenerName+`:%d`, &port); err == nil {
+			s.portRegistry.release(port)
+		} else if _, err := fmt.Sscanf(name, udpListenerName+`:%d`, &port); err == nil {
+			s.udpPortRegistry.release(port)
+		}
+	})
+	s.inherited.notifyReady()
+
+	if s.systemd {
+		s.notifyReady()
 	}
 
 	return nil
 }
 
+func (s *server) SetTunnelAccess(allow, deny []string) error {
+
+	return s.tunnelAccess.set(allow, deny)
+}
+
+func (s *server) SetClientAccess(allow, deny []string) error {
+
+	return s.clientAccess.set(allow, deny)
+}
+
 func (s *server) Stop() {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.stop(nil, false)
+}
+
+func (s *server) Wait() {
+
+	s.mu.Lock()
+	neverStarted := s.state == StateNew
+	s.mu.Unlock()
+
+	if neverStarted {
+		return
+	}
+
+	<-s.done
+}
+
+func (s *server) State() State {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+func (s *server) Done() <-chan struct{} {
+
+	return s.done
+}
+
+func (s *server) Err() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// stop closes the tunnel listener and moves to StateStopping, recording err as the reason. If graceful, tunnels
+// are drained so that attached connections can finish; otherwise they are closed outright. Once every goroutine
+// has finished the Server moves to StateStopped and Done is closed. Must be called with s.mu held.
+func (s *server) stop(err error, graceful bool) {
+
+	switch s.state {
+	case StateStopping, StateStopped:
+		return
+	case StateNew:
+		s.state = StateStopped
+		close(s.done)
+		return
+	}
+
+	s.state = StateStopping
+	s.err = err
+
+	if s.systemd && !graceful {
+		// after a handoff the new process is the one serving, so only a real shutdown is reported
+		sdNotify(`STOPPING=1`)
+	}
+
 	if s.listener != nil {
 		s.listener.Close()
 		s.listener = nil
 	}
-}
 
-func (s *server) Wait() {
+	for name, l := range s.vhostListeners {
+		l.Close()
+		delete(s.vhostListeners, name)
+	}
+
+	for _, t := range s.tunnels.all() {
+		if graceful {
+			t.drain()
+		} else {
+			t.close()
+		}
+	}
+
+	if !graceful {
+		s.connections.close()
+	}
+
+	go func() {
+		s.wg.Wait()
 
-	s.wg.Wait()
+		s.mu.Lock()
+		s.state = StateStopped
+		s.mu.Unlock()
+
+		close(s.done)
+	}()
 }
 
 func (s *server) listen() error {
@@ -121,26 +354,58 @@ func (s *server) listen() error {
 		err error
 	)
 
-	address := &net.TCPAddr{
-		IP:   s.tunnelIP,
-		Port: s.tunnelPort,
+	if l = s.inherited.take(tunnelListenerName); l == nil && s.systemd {
+		if l, err = systemdListener(); err != nil {
+			return err
+		}
 	}
 
-	l, err = net.ListenTCP(`tcp`, address)
-	if err != nil {
-		return errors.Wrap(err, `could not instantiate listener`)
+	if l == nil {
+
+		if s.tunnelSocket != `` {
+			l, err = listenUnix(s.tunnelSocket)
+		} else {
+			address := &net.TCPAddr{
+				IP:   s.tunnelIP,
+				Port: s.tunnelPort,
+			}
+			l, err = net.ListenTCP(`tcp`, address)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, `could not instantiate listener`)
+		}
+	} else if ul, ok := l.(*net.UnixListener); ok && ul.Addr().String() == s.tunnelSocket {
+		// the socket file is ours to remove now, unlike one created by systemd
+		ul.SetUnlinkOnClose(true)
+	}
+
+	s.baseListener = l
+
+	if s.tunnelProxyProtocol {
+		s.logger.Print(`expecting PROXY protocol`)
+		l = newProxyListener(l, s.logger)
 	}
 
+	l = &accessListener{Listener: l, access: s.tunnelAccess, logger: s.logger}
+
 	if s.tunnelTlsConfig != nil {
 		s.logger.Print(`using TLS`)
-		l = tls.NewListener(l, s.tunnelTlsConfig)
+		config := s.tunnelTlsConfig
+		if len(config.NextProtos) == 0 {
+			// offer HTTP/2 for the stream transport; clients that upgrade do not ask for it
+			config = config.Clone()
+			config.NextProtos = []string{`h2`, `http/1.1`}
+		}
+		l = tls.NewListener(l, config)
 	}
 
 	s.listener = l
 	return nil
 }
 
-func (s *server) serve() error {
+// serve starts serving HTTP on the tunnel listener in the background. Must be called with s.mu held.
+func (s *server) serve() {
 
 	s.wg.Add(1) // increment for the server we are about to start
 
@@ -149,37 +414,44 @@ func (s *server) serve() error {
 		scheme = `https`
 	}
 
+	// HTTP/2 carries the stream transport, with or without TLS
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
 	server := &http.Server{
-		Handler:  http.HandlerFunc(s.handle),
-		ErrorLog: s.logger,
+		Handler:   http.HandlerFunc(s.handle),
+		ErrorLog:  s.logger,
+		Protocols: protocols,
 	}
 
-	errChan := make(chan error, 1)
+	listener := s.listener
 
-	go func(ch chan<- error) {
+	if address := listener.Addr(); address.Network() == `unix` {
+		s.logger.Printf(`starting %s service on unix:%s`, scheme, address.String())
+	} else {
+		s.logger.Printf(`starting service at %s://%s`, scheme, address.String())
+	}
 
-		s.logger.Printf(`starting service at %s://%s`, scheme, s.listener.Addr().String())
+	if s.encryptionKey != nil {
+		public, _ := shared.PublicKey(s.encryptionKey)
+		s.logger.Printf(`clients may encrypt with server key %s`, shared.EncodeKey(public))
+	}
 
-		if err := server.Serve(s.listener); err != nil {
-			if s.listener != nil {
-				// abnormal quit
-				err = errors.Wrap(err, `server terminated`)
-			} else {
-				// listener was closed so we are deliberately shutting down
-				err = nil
-			}
+	go func() {
 
-			ch <- err
-		}
+		defer s.wg.Done()
 
-		s.wg.Done()
-		close(errChan)
-	}(errChan)
+		err := server.Serve(listener)
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-time.After(10 * time.Millisecond):
-		return nil
-	}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.state == StateRunning {
+			// abnormal quit; if we were stopping then the listener was closed deliberately
+			s.logger.Printf(`server terminated: %s`, err.Error())
+			s.stop(errors.Wrap(err, `server terminated`), false)
+		}
+	}()
 }
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// newTestServerOn instantiates a Server that listens for tunnels on a Unix socket in a temporary directory.
+func newTestServerOn(t *testing.T, options ...Option) *server {
+
+	options = append([]Option{
+		TunnelSocket(filepath.Join(t.TempDir(), `tunnel.sock`)),
+		Logger(log.New(io.Discard, ``, 0)),
+	}, options...)
+
+	srv, err := New(options...)
+	if err != nil {
+		t.Fatalf(`could not instantiate server: %s`, err.Error())
+	}
+	s := srv.(*server)
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+func doneWithin(done <-chan struct{}, d time.Duration) bool {
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+
+	s := newTestServerOn(t)
+
+	if state := s.State(); state != StateNew {
+		t.Fatalf(`new server is %s`, state)
+	}
+	s.Wait() // returns at once for a server that never started
+
+	if err := s.Start(); err != nil {
+		t.Fatalf(`could not start: %s`, err.Error())
+	}
+	if state := s.State(); state != StateRunning {
+		t.Fatalf(`started server is %s`, state)
+	}
+	if err := s.Start(); err == nil || !strings.Contains(err.Error(), `server is running`) {
+		t.Errorf(`second Start returned %v`, err)
+	}
+	if doneWithin(s.Done(), 10*time.Millisecond) {
+		t.Fatal(`Done is closed while running`)
+	}
+
+	// a goroutine that has not finished keeps the server stopping
+	s.wg.Add(1)
+	s.Stop()
+
+	if state := s.State(); state != StateStopping {
+		t.Errorf(`server with work in progress is %s after Stop`, state)
+	}
+	if doneWithin(s.Done(), 50*time.Millisecond) {
+		t.Fatal(`Done is closed before the server has finished`)
+	}
+	if conn, err := net.Dial(`unix`, s.tunnelSocket); err == nil {
+		conn.Close()
+		t.Error(`stopping server still accepts connections`)
+	}
+
+	s.wg.Done()
+
+	if !doneWithin(s.Done(), 5*time.Second) {
+		t.Fatal(`Done is not closed once the server has finished`)
+	}
+	if state := s.State(); state != StateStopped {
+		t.Errorf(`finished server is %s`, state)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf(`server stopped by Stop has error %s`, err.Error())
+	}
+	s.Wait()
+
+	// a stopped server stays stopped
+	s.Stop()
+	if err := s.Start(); err == nil || !strings.Contains(err.Error(), `server is stopped`) {
+		t.Errorf(`Start after Stop returned %v`, err)
+	}
+	if state := s.State(); state != StateStopped {
+		t.Errorf(`server is %s after Start following Stop`, state)
+	}
+}
+
+func TestServerStopBeforeStart(t *testing.T) {
+
+	s := newTestServerOn(t)
+	s.Stop()
+
+	if !doneWithin(s.Done(), time.Second) {
+		t.Fatal(`Done is not closed`)
+	}
+	if state := s.State(); state != StateStopped {
+		t.Errorf(`server is %s`, state)
+	}
+	if err := s.Start(); err == nil {
+		t.Error(`server started after Stop`)
+	}
+}
+
+func TestServerFailedStart(t *testing.T) {
+
+	occupied, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer occupied.Close()
+	port := occupied.Addr().(*net.TCPAddr).Port
+
+	srv, err := New(TunnelIP(`127.0.0.1`), TunnelPort(port), Logger(log.New(io.Discard, ``, 0)))
+	if err != nil {
+		t.Fatalf(`could not instantiate server: %s`, err.Error())
+	}
+	s := srv.(*server)
+
+	startErr := s.Start()
+	if startErr == nil {
+		t.Fatal(`server started on a port in use`)
+	}
+
+	if !doneWithin(s.Done(), 5*time.Second) {
+		t.Fatal(`Done is not closed after a failed start`)
+	}
+	if state := s.State(); state != StateStopped {
+		t.Errorf(`server is %s after a failed start`, state)
+	}
+	if err := s.Err(); err == nil || err.Error() != startErr.Error() {
+		t.Errorf(`Err = %v, want the error of Start (%s)`, err, startErr.Error())
+	}
+	if err := s.Start(); err == nil {
+		t.Error(`server started again after a failed start`)
+	}
+}
+
+func TestAttachWhileStopping(t *testing.T) {
+
+	s := newTestServerOn(t)
+	if err := s.Start(); err != nil {
+		t.Fatalf(`could not start: %s`, err.Error())
+	}
+
+	// keep the server stopping, as if it were still waiting for another connection
+	s.wg.Add(1)
+	s.Stop()
+	defer s.wg.Done()
+
+	// a connection that was pending when the server began stopping, and that a client is attaching to
+	tun := newTunnel(`test`, 0, nil, s.wg, s.logger, func(*tunnel) {})
+	pending, pendingPeer := pipe(t)
+	tun.pending[`1`] = pending
+	s.tunnels.add(tun)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.attach))
+	defer ts.Close()
+
+	conn, err := net.Dial(`tcp`, ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf(`could not connect: %s`, err.Error())
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: %s\r\n%s: %s\r\n%s: 1\r\n\r\n",
+		shared.UpgradeProtocol, shared.HeaderTunnel, tun.id, shared.HeaderConnection)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(`could not read response: %s`, err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf(`attach returned %d`, resp.StatusCode)
+	}
+
+	// the connection that would have been joined is closed instead
+	pendingPeer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := pendingPeer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf(`pending connection was joined while the server was stopping: %v`, err)
+	}
+}
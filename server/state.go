@@ -0,0 +1,38 @@
+package server
+
+import "fmt"
+
+// State describes where a Server is in its lifecycle. A Server moves through the states in order and never returns
+// to an earlier one; a stopped Server cannot be started again.
+type State int
+
+const (
+	// StateNew is the state of a Server that has been instantiated but not started.
+	StateNew State = iota
+	// StateStarting is the state of a Server while Start is opening its listener.
+	StateStarting
+	// StateRunning is the state of a Server that is accepting tunnels.
+	StateRunning
+	// StateStopping is the state of a Server that no longer accepts tunnels but still has connections open.
+	StateStopping
+	// StateStopped is the state of a Server that has released all of its resources.
+	StateStopped
+)
+
+func (st State) String() string {
+
+	switch st {
+	case StateNew:
+		return `new`
+	case StateStarting:
+		return `starting`
+	case StateRunning:
+		return `running`
+	case StateStopping:
+		return `stopping`
+	case StateStopped:
+		return `stopped`
+	default:
+		return fmt.Sprintf(`State(%d)`, int(st))
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables defined by systemd for socket activation (sd_listen_fds) and for service notification
+// (sd_notify).
+const (
+	envListenPID     = `LISTEN_PID`
+	envListenFDs     = `LISTEN_FDS`
+	envListenFDNames = `LISTEN_FDNAMES`
+	envNotifySocket  = `NOTIFY_SOCKET`
+	envWatchdogUsec  = `WATCHDOG_USEC`
+	envWatchdogPID   = `WATCHDOG_PID`
+
+	// first file descriptor passed by systemd
+	firstActivatedFD = 3
+)
+
+// systemdListener returns the tunnel listener passed by systemd through socket activation, or nil if the process
+// was not socket-activated. The socket must either be the only one passed or be named 'tunnel' with
+// FileDescriptorName=. The environment is cleared so that child processes do not mistake the sockets for their own.
+func systemdListener() (net.Listener, error) {
+
+	pid, _ := strconv.Atoi(os.Getenv(envListenPID))
+	count, _ := strconv.Atoi(os.Getenv(envListenFDs))
+	names := strings.Split(os.Getenv(envListenFDNames), `:`)
+
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+
+	if pid != os.Getpid() || count < 1 {
+		return nil, nil
+	}
+
+	var listener net.Listener
+
+	for i := 0; i < count; i++ {
+		fd := firstActivatedFD + i
+		syscall.CloseOnExec(fd)
+
+		name := ``
+		if i < len(names) {
+			name = names[i]
+		}
+
+		if count > 1 && name != tunnelListenerName {
+			return nil, errors.Errorf(`unexpected socket from systemd: name it '%s' with FileDescriptorName= (got '%s')`, tunnelListenerName, name)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, `could not use socket from systemd`)
+		}
+
+		listener = l
+	}
+
+	return listener, nil
+}
+
+// sdNotify sends state to the service manager if the process is running under systemd with Type=notify. It is a
+// no-op otherwise.
+func sdNotify(state string) error {
+
+	path := os.Getenv(envNotifySocket)
+	if path == `` {
+		return nil
+	}
+
+	if path[0] == '@' {
+		// abstract namespace
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix(`unixgram`, nil, &net.UnixAddr{Name: path, Net: `unixgram`})
+	if err != nil {
+		return errors.Wrap(err, `could not notify systemd`)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, `could not notify systemd`)
+	}
+
+	return nil
+}
+
+// watchdogInterval returns how often systemd expects to be pinged, or zero if the watchdog is not enabled for this
+// process. Pings are sent at half the configured timeout, as recommended by sd_watchdog_enabled.
+func watchdogInterval() time.Duration {
+
+	usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv(envWatchdogPID); pid != `` && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady reports readiness to systemd and starts pinging its watchdog. A process started by a handoff also
+// claims to be the main process of the service, which requires NotifyAccess=all in the unit.
+func (s *server) notifyReady() {
+
+	state := `READY=1`
+	if s.inherited.handedOff {
+		state = `MAINPID=` + strconv.Itoa(os.Getpid()) + "\n" + state
+	}
+
+	if err := sdNotify(state); err != nil && s.inherited.handedOff {
+		s.logger.Printf(`warning: systemd may still take the previous process for the main one; the unit needs NotifyAccess=all: %s`, err.Error())
+	} else if err != nil {
+		s.logger.Print(err.Error())
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 && s.inherited.handedOff {
+		// WATCHDOG_PID named the previous process, which is about to exit
+		if usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64); err == nil && usec > 0 {
+			interval = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+
+	if interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				if s.State() == StateRunning {
+					sdNotify(`WATCHDOG=1`)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envTestActivated tells the test binary, started again by TestSystemdListener, to act as a socket-activated process:
+// 'own' to find its own pid in LISTEN_PID, or 'other' to find another one.
+const envTestActivated = `HTTPTUN_TEST_ACTIVATED`
+
+// TestSystemdActivated is the socket-activated process started by TestSystemdListener. It prints the address of the
+// listener it was passed, 'none', or the error. It does nothing when run on its own.
+func TestSystemdActivated(t *testing.T) {
+
+	mode := os.Getenv(envTestActivated)
+	if mode == `` {
+		t.Skip(`only run by TestSystemdListener`)
+	}
+
+	// systemd sets LISTEN_PID after forking, which exec.Cmd cannot do
+	pid := os.Getpid()
+	if mode == `other` {
+		pid = os.Getppid()
+	}
+	os.Setenv(envListenPID, strconv.Itoa(pid))
+
+	l, err := systemdListener()
+	switch {
+	case err != nil:
+		fmt.Print(`error: ` + err.Error())
+	case l == nil:
+		fmt.Print(`none`)
+	default:
+		fmt.Print(l.Addr().String())
+	}
+
+	// exiting before the test framework reports keeps its output from mixing with the answer
+	os.Exit(0)
+}
+
+func TestSystemdListener(t *testing.T) {
+
+	var listeners []net.Listener
+	var files []*os.File
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		defer f.Close()
+
+		listeners = append(listeners, l)
+		files = append(files, f)
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		count int
+		names string
+		want  string
+	}{
+		{`single socket`, `own`, 1, ``, listeners[0].Addr().String()},
+		{`single named socket`, `own`, 1, `web`, listeners[0].Addr().String()},
+		{`named tunnel`, `own`, 2, `tunnel:tunnel`, listeners[1].Addr().String()},
+		{`unnamed sockets`, `own`, 2, ``, `error: unexpected socket from systemd`},
+		{`other socket`, `own`, 2, `tunnel:metrics`, `error: unexpected socket from systemd: name it 'tunnel' with FileDescriptorName= (got 'metrics')`},
+		{`another process`, `other`, 1, ``, `none`},
+		{`no sockets`, `own`, 0, ``, `none`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cmd := exec.Command(os.Args[0], `-test.run=^TestSystemdActivated$`)
+			cmd.Env = append(os.Environ(),
+				envTestActivated+`=`+tt.mode,
+				envListenFDs+`=`+strconv.Itoa(tt.count),
+				envListenFDNames+`=`+tt.names,
+				// the race detector otherwise waits a second before exiting
+				`GORACE=atexit_sleep_ms=0`,
+			)
+			cmd.ExtraFiles = files
+
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf(`activated process failed: %s`, err.Error())
+			}
+			if got := string(out); !strings.HasPrefix(got, tt.want) {
+				t.Errorf(`got '%s', want '%s'`, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemdListenerEnvironment(t *testing.T) {
+
+	t.Setenv(envListenPID, strconv.Itoa(os.Getppid()))
+	t.Setenv(envListenFDs, `1`)
+	t.Setenv(envListenFDNames, `tunnel`)
+
+	// sockets meant for another process are left alone
+	if l, err := systemdListener(); l != nil || err != nil {
+		t.Errorf(`got %v, %v`, l, err)
+	}
+
+	for _, name := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf(`%s was not cleared`, name)
+		}
+	}
+}
+
+// notifySocket listens for notifications at the given address and points NOTIFY_SOCKET at it.
+func notifySocket(t *testing.T, address string) *net.UnixConn {
+
+	name := address
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.ListenUnixgram(`unixgram`, &net.UnixAddr{Name: name, Net: `unixgram`})
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv(envNotifySocket, address)
+
+	return conn
+}
+
+// notification returns the next notification received on conn, or an empty string if none arrives.
+func notification(conn *net.UnixConn) string {
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ``
+	}
+
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+
+	t.Setenv(envNotifySocket, ``)
+	if err := sdNotify(`READY=1`); err != nil {
+		t.Errorf(`notified without a socket: %s`, err.Error())
+	}
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{`path`, filepath.Join(t.TempDir(), `notify.sock`)},
+		{`abstract`, fmt.Sprintf(`@httptun-test-%d-%d`, os.Getpid(), time.Now().UnixNano())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conn := notifySocket(t, tt.address)
+
+			if err := sdNotify(`READY=1`); err != nil {
+				t.Fatalf(`could not notify: %s`, err.Error())
+			}
+			if got := notification(conn); got != `READY=1` {
+				t.Errorf(`received '%s'`, got)
+			}
+		})
+	}
+
+	t.Setenv(envNotifySocket, filepath.Join(t.TempDir(), `missing.sock`))
+	if err := sdNotify(`READY=1`); err == nil || !strings.Contains(err.Error(), `could not notify systemd`) {
+		t.Errorf(`error = %v without a listener`, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+
+	own := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{`disabled`, ``, ``, 0},
+		{`invalid`, `soon`, ``, 0},
+		{`zero`, `0`, ``, 0},
+		{`negative`, `-1000000`, ``, 0},
+		{`any process`, `10000000`, ``, 5 * time.Second},
+		{`this process`, `3000000`, own, 1500 * time.Millisecond},
+		{`another process`, `10000000`, strconv.Itoa(os.Getppid()), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			t.Setenv(envWatchdogUsec, tt.usec)
+			t.Setenv(envWatchdogPID, tt.pid)
+
+			if got := watchdogInterval(); got != tt.want {
+				t.Errorf(`got %s, want %s`, got.String(), tt.want.String())
+			}
+		})
+	}
+}
+
+func TestServerNotifyReady(t *testing.T) {
+
+	t.Setenv(envWatchdogUsec, ``)
+
+	logs := &bytes.Buffer{}
+	s := newTestServerOn(t, Logger(log.New(logs, ``, 0)))
+
+	conn := notifySocket(t, filepath.Join(t.TempDir(), `notify.sock`))
+
+	s.notifyReady()
+	if got := notification(conn); got != `READY=1` {
+		t.Errorf(`received '%s'`, got)
+	}
+
+	// a process started by a handoff claims to be the main one
+	s.inherited.handedOff = true
+	s.notifyReady()
+	if got, want := notification(conn), `MAINPID=`+strconv.Itoa(os.Getpid())+"\nREADY=1"; got != want {
+		t.Errorf(`received '%s', want '%s'`, got, want)
+	}
+
+	// and warns when it cannot
+	conn.Close()
+	s.notifyReady()
+	if !strings.Contains(logs.String(), `NotifyAccess=all`) {
+		t.Errorf(`logged '%s'`, logs.String())
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// transportOf returns the transport by which req asks for a tunnel connection, or an empty string if it does not.
+func transportOf(req *http.Request) string {
+
+	switch {
+	case isUpgrade(req):
+		return shared.TransportUpgrade
+	case isWebSocket(req):
+		return shared.TransportWebSocket
+	case req.Method != http.MethodPost:
+		return ``
+	}
+
+	switch transport := req.Header.Get(shared.HeaderTransport); transport {
+	case shared.TransportStream:
+		if req.ProtoMajor == 2 {
+			return transport
+		}
+	case shared.TransportPoll:
+		return transport
+	}
+
+	return ``
+}
+
+// isWebSocket reports whether req is a WebSocket handshake for the httptun subprotocol.
+func isWebSocket(req *http.Request) bool {
+
+	if !strings.EqualFold(req.Header.Get(`Upgrade`), `websocket`) || !hasToken(req.Header.Get(`Connection`), `upgrade`) {
+		return false
+	}
+
+	return hasToken(req.Header.Get(`Sec-WebSocket-Protocol`), shared.WebSocketProtocol)
+}
+
+// hasToken reports whether the comma-separated header value contains token, ignoring case.
+func hasToken(value, token string) bool {
+
+	for _, field := range strings.Split(value, `,`) {
+		if strings.EqualFold(strings.TrimSpace(field), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// switchTransport completes the handshake of req with the given headers over whichever transport it arrived by, and
+// returns the resulting connection.
+func (s *server) switchTransport(rw http.ResponseWriter, req *http.Request, header http.Header) (net.Conn, error) {
+
+	if header == nil {
+		header = http.Header{}
+	}
+
+	switch transport := transportOf(req); transport {
+	case shared.TransportUpgrade:
+		header.Set(`Connection`, `Upgrade`)
+		header.Set(`Upgrade`, shared.UpgradeProtocol)
+		return hijack(rw, header)
+	case shared.TransportWebSocket:
+		return upgradeWebSocket(rw, req, header)
+	case shared.TransportStream:
+		return openStream(rw, req, header)
+	case shared.TransportPoll:
+		return s.polls.open(rw, req, header)
+	default:
+		http.Error(rw, `not a tunnel request`, http.StatusBadRequest)
+		return nil, errors.New(`request does not use any transport`)
+	}
+}
+
+// upgradeWebSocket completes a WebSocket handshake and returns the WebSocket as a connection.
+func upgradeWebSocket(rw http.ResponseWriter, req *http.Request, header http.Header) (net.Conn, error) {
+
+	key := req.Header.Get(`Sec-WebSocket-Key`)
+	if key == `` || req.Header.Get(`Sec-WebSocket-Version`) != `13` {
+		rw.Header().Set(`Sec-WebSocket-Version`, `13`)
+		http.Error(rw, `invalid WebSocket handshake`, http.StatusBadRequest)
+		return nil, errors.New(`invalid WebSocket handshake`)
+	}
+
+	header.Set(`Connection`, `Upgrade`)
+	header.Set(`Upgrade`, `websocket`)
+	header.Set(`Sec-WebSocket-Accept`, shared.WebSocketAccept(key))
+	header.Set(`Sec-WebSocket-Protocol`, shared.WebSocketProtocol)
+
+	conn, err := hijack(rw, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return shared.NewWebSocketConn(conn, nil, false), nil
+}
+
+// streamHolder receives the connection carried by the HTTP/2 stream of a request, if any. The handler of the request
+// must not return before that connection is closed, since the stream ends with it.
+type streamHolder struct {
+	conn *shared.StreamConn
+}
+
+type streamHolderKey struct{}
+
+// openStream answers an HTTP/2 request with the given headers and returns a connection that reads the request body
+// and writes the response body.
+func openStream(rw http.ResponseWriter, req *http.Request, header http.Header) (net.Conn, error) {
+
+	flusher, ok := rw.(http.Flusher)
+	holder, held := req.Context().Value(streamHolderKey{}).(*streamHolder)
+	if !ok || !held {
+		http.Error(rw, `streams are not supported`, http.StatusInternalServerError)
+		return nil, errors.New(`response does not support streaming`)
+	}
+
+	for key, values := range header {
+		rw.Header()[key] = values
+	}
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	writer := &streamWriter{rw: rw, flusher: flusher, mutex: &sync.Mutex{}}
+
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, _ := net.ResolveTCPAddr(`tcp`, req.RemoteAddr)
+
+	holder.conn = shared.NewStreamConn(req.Body, writer, nil, writer.close, local, remote)
+
+	return holder.conn, nil
+}
+
+// streamWriter writes to the body of a response, flushing every write, until it is closed.
+type streamWriter struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	mutex   *sync.Mutex
+	closed  bool
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.closed {
+		return 0, net.ErrClosed
+	}
+
+	n, err := sw.rw.Write(b)
+	if err == nil {
+		sw.flusher.Flush()
+	}
+
+	return n, err
+}
+
+// close stops all further writes, so that the handler that owns the response can return.
+func (sw *streamWriter) close() error {
+
+	sw.mutex.Lock()
+	sw.closed = true
+	sw.mutex.Unlock()
+
+	return nil
+}
+
+// capabilities describes the server to clients that are choosing a transport.
+func (s *server) capabilities(rw http.ResponseWriter, req *http.Request) {
+
+	rw.Header().Set(`Content-Type`, `application/json`)
+	rw.Header().Set(`Cache-Control`, `no-store`)
+
+	json.NewEncoder(rw).Encode(shared.Capabilities{
+		Version:      shared.ProtocolVersion,
+		MinVersion:   shared.MinProtocolVersion,
+		Capabilities: serverCapabilities,
+		Transports:   shared.Transports,
+	})
+}
+
+// probe echoes ProbeMessage over the connection of req, so that the client can tell whether its transport carries data
+// both ways.
+func (s *server) probe(rw http.ResponseWriter, req *http.Request) {
+
+	conn, err := s.upgrade(rw, req, nil)
+	if err != nil {
+		s.logger.Printf(`could not upgrade connection from %s: %s`, req.RemoteAddr, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	message := make([]byte, len(shared.ProbeMessage))
+
+	conn.SetDeadline(time.Now().Add(defaultProbeTimeout))
+	if _, err := io.ReadFull(conn, message); err == nil {
+		conn.Write(message)
+		// give the echo a chance to be fetched before the connection goes away
+		conn.Read(make([]byte, 1))
+	}
+}
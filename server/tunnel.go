@@ -0,0 +1,312 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// tunnel accepts connections on its client listener and announces them over its control connection so that the
+// httptun client can attach to them. A UDP tunnel instead relays datagrams between its UDP socket and the control
+// connection.
+type tunnel struct {
+	id          string
+	name        string             // identifies the client listener when it is handed off
+	port        int                // zero if the client listener is a Unix socket or virtual
+	host        string             // set if the tunnel is reached through the virtual host ports
+	gate        *tunnelGate        // nil if anyone may connect
+	compressed  bool               // whether attached connections are compressed
+	access      *accessList        // set by the server for all tunnels
+	connections *connectionLimiter // nil if connections are not limited
+	identity    string             // of the owner, whose bandwidth limit the tunnel shares
+	limits      []*bandwidthLimit
+	listener    net.Listener
+
+	// zero for no timeout or no limit
+	connectionIdleTimeout time.Duration
+	idleTimeout           time.Duration
+	lifetime              time.Duration
+	lifetimeTimer         *time.Timer
+	activity              *activity
+
+	packetConn net.PacketConn // instead of listener for UDP tunnels
+	logger     *log.Logger
+
+	control net.Conn
+	notices chan shared.Message // announcements of pending connections, written to control by announce
+
+	mutex   *sync.Mutex
+	wg      *sync.WaitGroup
+	pending map[string]net.Conn
+	active  map[net.Conn]bool
+	peers   map[string]*peer // sources of datagrams, for UDP tunnels
+	closed  bool
+
+	// called exactly once after the tunnel has stopped accepting connections
+	onClose func(*tunnel)
+}
+
+func newTunnel(name string, port int, listener net.Listener, wg *sync.WaitGroup, logger *log.Logger, onClose func(*tunnel)) *tunnel {
+
+	return &tunnel{
+		id:       shared.RandomID(),
+		name:     name,
+		port:     port,
+		listener: listener,
+		logger:   logger,
+		mutex:    &sync.Mutex{},
+		wg:       wg,
+		pending:  map[string]net.Conn{},
+		active:   map[net.Conn]bool{},
+		peers:    map[string]*peer{},
+		notices:  make(chan shared.Message, maxPendingNotices),
+		activity: newActivity(),
+		onClose:  onClose,
+	}
+}
+
+// address returns the address on which the tunnel accepts connections or datagrams.
+func (t *tunnel) address() string {
+
+	if t.packetConn != nil {
+		return t.packetConn.LocalAddr().String()
+	}
+
+	return t.listener.Addr().String()
+}
+
+// discard closes the listener or UDP socket of the tunnel.
+func (t *tunnel) discard() {
+
+	if t.packetConn != nil {
+		t.packetConn.Close()
+	} else {
+		t.listener.Close()
+	}
+}
+
+// start begins accepting connections and announcing them over control.
+func (t *tunnel) start(control net.Conn) {
+
+	t.control = control
+	t.expire()
+
+	if t.packetConn != nil {
+		t.logger.Printf(`tunnel %s relaying datagrams on %s`, t.id, t.address())
+
+		t.wg.Add(2)
+		go t.receive()
+		go t.transmit()
+		return
+	}
+
+	t.logger.Printf(`tunnel %s listening on %s`, t.id, t.address())
+
+	t.wg.Add(3)
+	go t.accept()
+	go t.watch()
+	go t.announce()
+}
+
+func (t *tunnel) accept() {
+
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			break
+		}
+
+		if t.access != nil && !t.access.admit(conn.RemoteAddr(), t.logger) {
+			conn.Close()
+			continue
+		}
+
+		if t.connections != nil {
+			limited, err := t.connections.admit(conn)
+			if err != nil {
+				t.logger.Printf(`tunnel %s: rejected connection from %s: %s`, t.id, conn.RemoteAddr().String(), err.Error())
+				continue
+			}
+			conn = limited
+		}
+
+		if t.gate != nil {
+			t.wg.Add(1)
+			go t.admit(conn)
+			continue
+		}
+
+		t.forward(conn)
+	}
+
+	t.drain()
+	t.onClose(t)
+}
+
+// watch reads from the control connection until the client goes away.
+func (t *tunnel) watch() {
+
+	defer t.wg.Done()
+
+	io.Copy(ioutil.Discard, t.control)
+	t.drain()
+}
+
+// announce writes the announcements of pending connections to the control connection until the tunnel is drained, so
+// that a slow client holds up neither the tunnel's lock nor its accept loop.
+func (t *tunnel) announce() {
+
+	defer t.wg.Done()
+
+	encoder := json.NewEncoder(t.control)
+
+	for message := range t.notices {
+		if err := encoder.Encode(message); err != nil {
+			// the tunnel is drained once watch notices
+			t.control.Close()
+		}
+	}
+}
+
+// admit forwards conn if it passes the gate of the tunnel.
+func (t *tunnel) admit(conn net.Conn) {
+
+	defer t.wg.Done()
+
+	remoteAddr := conn.RemoteAddr().String()
+
+	admitted, serve, err := t.gate.admit(conn)
+	if err != nil {
+		t.logger.Printf(`tunnel %s: refused connection from %s: %s`, t.id, remoteAddr, err.Error())
+		return
+	}
+
+	t.forward(admitted)
+
+	if serve != nil {
+		serve()
+	}
+}
+
+// forward holds conn until the client attaches to it or the attach timeout elapses.
+func (t *tunnel) forward(conn net.Conn) {
+
+	message := shared.Message{
+		Type:  shared.MessageConnection,
+		ID:    shared.RandomID(),
+		Addr:  conn.RemoteAddr().String(),
+		Local: conn.LocalAddr().String(),
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		conn.Close()
+		return
+	}
+
+	// the announcement is written by announce; if too many are waiting, the client cannot keep up
+	select {
+	case t.notices <- message:
+	default:
+		t.logger.Printf(`tunnel %s: refused connection from %s: client is not keeping up with new connections`, t.id, message.Addr)
+		conn.Close()
+		return
+	}
+
+	t.pending[message.ID] = conn
+	t.activity.touch()
+	time.AfterFunc(defaultAttachTimeout, func() {
+		if c := t.claim(message.ID); c != nil {
+			t.logger.Printf(`tunnel %s: connection from %s was not attached in time`, t.id, c.RemoteAddr().String())
+			c.Close()
+		}
+	})
+}
+
+// claim removes and returns the pending connection with the given id, or nil if there is none.
+func (t *tunnel) claim(id string) net.Conn {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conn := t.pending[id]
+	delete(t.pending, id)
+
+	return conn
+}
+
+// join copies data between an attached connection and the pending connection it claimed.
+func (t *tunnel) join(attached, pending net.Conn) {
+
+	t.mutex.Lock()
+	t.active[attached] = true
+	t.active[pending] = true
+	t.mutex.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		// limits count the bytes that actually pass between the server and the client, after any compression
+		client := limitClientConn(attached, t.limits...)
+		if t.compressed {
+			client = shared.NewCompressedConn(client)
+		}
+
+		client, remote := trackIdle(client, pending, t.connectionIdleTimeout, t.activity)
+		shared.Join(client, remote)
+
+		t.mutex.Lock()
+		delete(t.active, attached)
+		delete(t.active, pending)
+		t.mutex.Unlock()
+	}()
+}
+
+// drain stops accepting new connections and closes the control connection, but lets attached connections finish.
+func (t *tunnel) drain() {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+
+	if t.lifetimeTimer != nil {
+		t.lifetimeTimer.Stop()
+	}
+
+	t.discard()
+	t.control.Close()
+	close(t.notices)
+
+	for id, conn := range t.pending {
+		conn.Close()
+		delete(t.pending, id)
+	}
+}
+
+// close drains the tunnel and also closes all attached connections.
+func (t *tunnel) close() {
+
+	t.drain()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for conn := range t.active {
+		conn.Close()
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+)
+
+type tunnelRegistry struct {
+	tunnels map[string]*tunnel
+	hosts   map[string]*tunnel // nil while a host is reserved by a tunnel that is not yet added
+	mutex   *sync.Mutex
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+
+	return &tunnelRegistry{
+		tunnels: map[string]*tunnel{},
+		hosts:   map[string]*tunnel{},
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (tr *tunnelRegistry) add(t *tunnel) {
+
+	tr.mutex.Lock()
+	tr.tunnels[t.id] = t
+	if t.host != `` {
+		tr.hosts[t.host] = t
+	}
+	tr.mutex.Unlock()
+}
+
+func (tr *tunnelRegistry) remove(t *tunnel) {
+
+	tr.mutex.Lock()
+	delete(tr.tunnels, t.id)
+	tr.mutex.Unlock()
+}
+
+func (tr *tunnelRegistry) get(id string) *tunnel {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return tr.tunnels[id]
+}
+
+// reserveHost claims host for a tunnel that is about to be added. It reports false if host is already claimed.
+func (tr *tunnelRegistry) reserveHost(host string) bool {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if _, ok := tr.hosts[host]; ok {
+		return false
+	}
+
+	tr.hosts[host] = nil
+	return true
+}
+
+// releaseHost frees host to be claimed by another tunnel.
+func (tr *tunnelRegistry) releaseHost(host string) {
+
+	tr.mutex.Lock()
+	delete(tr.hosts, host)
+	tr.mutex.Unlock()
+}
+
+// getByHost returns the tunnel reached as host, or nil if there is none.
+func (tr *tunnelRegistry) getByHost(host string) *tunnel {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return tr.hosts[host]
+}
+
+// all returns a snapshot of the registered tunnels.
+func (tr *tunnelRegistry) all() []*tunnel {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tunnels := make([]*tunnel, 0, len(tr.tunnels))
+	for _, t := range tr.tunnels {
+		tunnels = append(tunnels, t)
+	}
+
+	return tunnels
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// listenClientUdp returns a UDP socket for a tunnel on the requested port, or on any free port if requested is zero.
+// A socket inherited from a previous process takes precedence so that reconnecting clients keep their ports.
+func (s *server) listenClientUdp(requested int) (net.PacketConn, error) {
+
+	if requested != 0 {
+		if pc := s.inherited.takePacketConn(udpListenerKey(requested)); pc != nil {
+			return pc, nil
+		}
+	}
+
+	port, err := s.udpPortRegistry.allocate(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	address := &net.UDPAddr{
+		IP:   s.clientIP,
+		Port: port,
+	}
+
+	pc, err := net.ListenUDP(`udp`, address)
+	if err != nil {
+		s.udpPortRegistry.release(port)
+		return nil, errors.Wrap(err, `could not instantiate client socket`)
+	}
+
+	return pc, nil
+}
+
+// peer is a source of datagrams on a UDP tunnel, which may be sent replies until it has been idle for too long.
+type peer struct {
+	addr net.Addr
+	seen time.Time
+}
+
+func newUdpTunnel(pc net.PacketConn, wg *sync.WaitGroup, logger *log.Logger, onClose func(*tunnel)) *tunnel {
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	t := newTunnel(udpListenerKey(port), port, nil, wg, logger, onClose)
+	t.packetConn = pc
+
+	return t
+}
+
+// receive frames every datagram arriving on the UDP socket, along with its source, onto the control connection.
+func (t *tunnel) receive() {
+
+	defer t.wg.Done()
+
+	buf := make([]byte, shared.MaxDatagramSize)
+	pruned := time.Now()
+
+	for {
+		n, addr, err := t.packetConn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		if t.access != nil && !t.access.admit(addr, t.logger) {
+			continue
+		}
+
+		if t.gate != nil && !t.gate.allowsAddr(addr) {
+			continue
+		}
+
+		now := time.Now()
+
+		t.activity.touch()
+
+		t.mutex.Lock()
+		t.peers[addr.String()] = &peer{addr: addr, seen: now}
+		if now.Sub(pruned) > defaultUdpIdleTimeout {
+			for key, p := range t.peers {
+				if now.Sub(p.seen) > defaultUdpIdleTimeout {
+					delete(t.peers, key)
+				}
+			}
+			pruned = now
+		}
+		t.mutex.Unlock()
+
+		wait(buckets(t.limits, true), n)
+
+		if err := shared.WriteDatagram(t.control, addr.String(), buf[:n]); err != nil {
+			break
+		}
+	}
+
+	t.drain()
+	t.onClose(t)
+}
+
+// transmit sends datagrams framed by the client back to the sources they answer. Datagrams addressed anywhere else
+// are dropped so that the server cannot be used to send traffic to arbitrary hosts.
+func (t *tunnel) transmit() {
+
+	defer t.wg.Done()
+
+	reader := bufio.NewReader(t.control)
+
+	for {
+		addr, payload, err := shared.ReadDatagram(reader)
+		if err != nil {
+			break
+		}
+
+		t.mutex.Lock()
+		p := t.peers[addr]
+		t.mutex.Unlock()
+
+		if p == nil {
+			continue
+		}
+
+		t.activity.touch()
+
+		wait(buckets(t.limits, false), len(payload))
+
+		t.packetConn.WriteTo(payload, p.addr)
+	}
+
+	t.drain()
+}
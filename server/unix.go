@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+// listenUnix listens on a Unix socket at path. A socket file left behind by a process that is no longer accepting on
+// it is removed first.
+func listenUnix(path string) (net.Listener, error) {
+
+	address := &net.UnixAddr{Name: path, Net: `unix`}
+
+	l, err := net.ListenUnix(`unix`, address)
+	if err == nil {
+		return l, nil
+	}
+
+	info, statErr := os.Lstat(path)
+	if statErr != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+
+	if conn, dialErr := net.DialTimeout(`unix`, path, time.Second); dialErr == nil {
+		conn.Close()
+		return nil, errors.Errorf(`socket %s is in use`, path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, errors.Wrapf(err, `could not remove stale socket %s`, path)
+	}
+
+	return net.ListenUnix(`unix`, address)
+}
+
+// listenClientSocket returns a listener for a tunnel on a Unix socket with the given name in the client socket
+// directory. A listener inherited from a previous process takes precedence so that reconnecting clients keep their
+// socket.
+func (s *server) listenClientSocket(name string) (net.Listener, error) {
+
+	if s.clientSocketDir == `` {
+		return nil, errors.New(`server does not expose tunnels as Unix sockets`)
+	}
+
+	if err := shared.ValidateSocketName(name); err != nil {
+		return nil, err
+	}
+
+	if l := s.inherited.take(socketListenerKey(name)); l != nil {
+		l.(*net.UnixListener).SetUnlinkOnClose(true)
+		return l, nil
+	}
+
+	path := filepath.Join(s.clientSocketDir, name+`.sock`)
+
+	for _, t := range s.tunnels.all() {
+		if t.name == socketListenerKey(name) {
+			return nil, errors.Errorf(`socket %s is already in use`, path)
+		}
+	}
+
+	l, err := listenUnix(path)
+	if err != nil {
+		return nil, errors.Wrap(err, `could not instantiate client listener`)
+	}
+
+	return l, nil
+}
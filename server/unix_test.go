@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, path string)
+		wantErr string // part of the expected error, or empty if listening succeeds
+	}{
+		{`no file`, func(t *testing.T, path string) {}, ``},
+		{`stale socket`, func(t *testing.T, path string) {
+
+			l, err := net.Listen(`unix`, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// as if the process that listened on it had exited without cleaning up
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+		}, ``},
+		{`live socket`, func(t *testing.T, path string) {
+
+			l, err := net.Listen(`unix`, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+		}, `is in use`},
+		{`regular file`, func(t *testing.T, path string) {
+
+			if err := os.WriteFile(path, []byte(`data`), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, `address already in use`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			path := filepath.Join(t.TempDir(), `test.sock`)
+			tt.prepare(t, path)
+
+			l, err := listenUnix(path)
+
+			if tt.wantErr != `` {
+				if err == nil {
+					l.Close()
+					t.Fatalf(`listened on %s`, path)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf(`error = '%s', want '%s'`, err.Error(), tt.wantErr)
+				}
+				// whatever is at the path is left alone
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf(`file was removed: %s`, err.Error())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf(`could not listen: %s`, err.Error())
+			}
+			defer l.Close()
+
+			conn, err := net.Dial(`unix`, path)
+			if err != nil {
+				t.Fatalf(`could not connect: %s`, err.Error())
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestListenClientSocket(t *testing.T) {
+
+	if _, err := newTestServerOn(t).listenClientSocket(`app`); err == nil || !strings.Contains(err.Error(), `does not expose tunnels`) {
+		t.Errorf(`error = %v without a client socket directory`, err)
+	}
+
+	dir := t.TempDir()
+	s := newTestServerOn(t, ClientSocketDir(dir))
+
+	if _, err := s.listenClientSocket(`../app`); err == nil || !strings.Contains(err.Error(), `invalid socket name`) {
+		t.Errorf(`error = %v for a name outside the directory`, err)
+	}
+
+	// a socket left behind by an earlier process is replaced
+	stale, err := net.Listen(`unix`, filepath.Join(dir, `app.sock`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := s.listenClientSocket(`app`)
+	if err != nil {
+		t.Fatalf(`could not listen: %s`, err.Error())
+	}
+	defer l.Close()
+
+	if _, err := s.listenClientSocket(`app`); err == nil || !strings.Contains(err.Error(), `is in use`) {
+		t.Errorf(`error = %v for a socket in use`, err)
+	}
+
+	// an inherited listener is used in place of a new socket, and its file is removed when it is closed
+	inherited, err := net.Listen(`unix`, filepath.Join(dir, `kept.sock`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited.(*net.UnixListener).SetUnlinkOnClose(false)
+	s.inherited.listeners[socketListenerKey(`kept`)] = inherited
+
+	kept, err := s.listenClientSocket(`kept`)
+	if err != nil {
+		t.Fatalf(`could not take the inherited listener: %s`, err.Error())
+	}
+	if kept != inherited {
+		t.Error(`a new listener was created in place of the inherited one`)
+	}
+	kept.Close()
+
+	if _, err := os.Lstat(filepath.Join(dir, `kept.sock`)); !os.IsNotExist(err) {
+		t.Errorf(`socket file left behind: %v`, err)
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/RobertGrantEllis/httptun/shared"
+)
+
+const (
+	vhostListenerName    = `vhost`
+	vhostTlsListenerName = `vhost-tls`
+
+	// largest request head or TLS ClientHello that is buffered while looking for the host
+	maxRouteHeaderSize = 16 * 1024
+)
+
+// vhostAddr is the address of a tunnel that is reached through the shared virtual host ports.
+type vhostAddr string
+
+func (va vhostAddr) Network() string { return `vhost` }
+func (va vhostAddr) String() string  { return string(va) }
+
+// virtualListener is the listener of a tunnel that is reached by host name. Connections are delivered to it by the
+// router of the shared virtual host ports instead of being accepted from a socket.
+type virtualListener struct {
+	addr  vhostAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func newVirtualListener(host string) *virtualListener {
+
+	return &virtualListener{
+		addr:  vhostAddr(host),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		once:  &sync.Once{},
+	}
+}
+
+func (vl *virtualListener) Accept() (net.Conn, error) {
+
+	select {
+	case conn := <-vl.conns:
+		return conn, nil
+	case <-vl.done:
+		return nil, errors.New(`listener closed`)
+	}
+}
+
+func (vl *virtualListener) Close() error {
+
+	vl.once.Do(func() { close(vl.done) })
+	return nil
+}
+
+func (vl *virtualListener) Addr() net.Addr {
+
+	return vl.addr
+}
+
+// deliver hands conn to whoever accepts on the listener. It reports false if the listener is closed.
+func (vl *virtualListener) deliver(conn net.Conn) bool {
+
+	select {
+	case vl.conns <- conn:
+		return true
+	case <-vl.done:
+		return false
+	}
+}
+
+// listenClientHost returns a virtual listener for a tunnel reached as name under the virtual host domain, along with
+// the HTTP status with which to refuse the request on failure.
+func (s *server) listenClientHost(name string) (*virtualListener, int, error) {
+
+	if s.vhostDomain == `` {
+		return nil, http.StatusBadRequest, errors.New(`server does not route tunnels by hostname`)
+	}
+
+	if err := shared.ValidateHostname(name); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	host := strings.ToLower(name) + `.` + s.vhostDomain
+	if !s.tunnels.reserveHost(host) {
+		return nil, http.StatusConflict, errors.Errorf(`hostname '%s' is already in use`, host)
+	}
+
+	return newVirtualListener(host), 0, nil
+}
+
+// listenVhosts opens the shared virtual host ports, if configured, and starts routing connections arriving on them.
+// Must be called with s.mu held.
+func (s *server) listenVhosts() error {
+
+	ports := []struct {
+		name  string
+		port  int
+		route func(net.Conn)
+	}{
+		{vhostListenerName, s.vhostPort, s.routeHttp},
+		{vhostTlsListenerName, s.vhostTlsPort, s.routeTls},
+	}
+
+	if s.vhostDomain == `` {
+		return nil
+	}
+
+	for _, p := range ports {
+		if p.port == 0 {
+			continue
+		}
+
+		l := s.inherited.take(p.name)
+		if l == nil {
+			var err error
+			l, err = net.ListenTCP(`tcp`, &net.TCPAddr{IP: s.clientIP, Port: p.port})
+			if err != nil {
+				return errors.Wrap(err, `could not instantiate virtual host listener`)
+			}
+		}
+
+		s.vhostListeners[p.name] = l
+		s.logger.Printf(`routing *.%s on %s`, s.vhostDomain, l.Addr().String())
+
+		s.wg.Add(1)
+		go s.acceptVhost(l, p.route)
+	}
+
+	return nil
+}
+
+func (s *server) acceptVhost(l net.Listener, route func(net.Conn)) {
+
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		if !s.clientAccess.admit(conn.RemoteAddr(), s.logger) {
+			conn.Close()
+			continue
+		}
+
+		// routing waits for the head of the first request, so a connection still being routed is closed if the server
+		// stops meanwhile
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			if s.connections.add(conn) {
+				route(conn)
+				s.connections.remove(conn)
+			}
+		}()
+	}
+}
+
+// routeHttp delivers conn to the tunnel named by the Host header of its first request. Connections are routed rather
+// than requests: later requests on a kept-alive connection reach the same tunnel whatever their Host header says.
+func (s *server) routeHttp(conn net.Conn) {
+
+	reader := bufio.NewReaderSize(conn, maxRouteHeaderSize)
+
+	conn.SetReadDeadline(time.Now().Add(defaultRouteTimeout))
+	host, err := readHost(reader)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		s.logger.Printf(`could not route connection from %s: %s`, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	if !s.deliver(host, shared.NewBufferedConn(conn, reader)) {
+		body := fmt.Sprintf("no tunnel for %s\n", host)
+		fmt.Fprintf(conn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+		conn.Close()
+	}
+}
+
+// routeTls delivers conn to the tunnel named by the server name indication of its TLS ClientHello. The TLS session is
+// passed through untouched and terminated by the client's target.
+func (s *server) routeTls(conn net.Conn) {
+
+	reader := bufio.NewReaderSize(conn, maxRouteHeaderSize)
+
+	conn.SetReadDeadline(time.Now().Add(defaultRouteTimeout))
+	host, err := readServerName(reader)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		s.logger.Printf(`could not route connection from %s: %s`, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+
+	if !s.deliver(host, shared.NewBufferedConn(conn, reader)) {
+		conn.Close()
+	}
+}
+
+// deliver hands conn to the tunnel reached as host. It reports false if there is no such tunnel.
+func (s *server) deliver(host string, conn net.Conn) bool {
+
+	t := s.tunnels.getByHost(host)
+	if t == nil {
+		return false
+	}
+
+	return t.listener.(*virtualListener).deliver(conn)
+}
+
+// readHost peeks at the head of an HTTP request and returns its Host without port, leaving reader unconsumed.
+func readHost(reader *bufio.Reader) (string, error) {
+
+	req, err := readRequestHead(reader)
+	if err != nil {
+		return ``, err
+	}
+
+	return normalizeHost(req.Host), nil
+}
+
+// readRequestHead peeks at the head of an HTTP request and parses it, leaving reader unconsumed. The body of the
+// returned request is not available.
+func readRequestHead(reader *bufio.Reader) (*http.Request, error) {
+
+	for size := 1; ; size = reader.Buffered() + 1 {
+		if _, err := reader.Peek(size); err != nil {
+			return nil, errors.Wrap(err, `could not read request`)
+		}
+
+		// everything received so far, which may be more than was asked for
+		head, _ := reader.Peek(reader.Buffered())
+
+		if i := bytes.Index(head, []byte("\r\n\r\n")); i >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head[:i+4])))
+			if err != nil {
+				return nil, errors.Wrap(err, `could not parse request`)
+			}
+			return req, nil
+		}
+
+		if len(head) >= maxRouteHeaderSize {
+			return nil, errors.New(`request head is too large`)
+		}
+	}
+}
+
+// readServerName peeks at a TLS ClientHello and returns its server name indication, leaving reader unconsumed.
+func readServerName(reader *bufio.Reader) (string, error) {
+
+	header, err := reader.Peek(5)
+	if err != nil {
+		return ``, errors.Wrap(err, `could not read TLS record`)
+	}
+
+	if header[0] != 0x16 {
+		return ``, errors.New(`not a TLS handshake`)
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if 5+length > maxRouteHeaderSize {
+		return ``, errors.New(`TLS ClientHello is too large`)
+	}
+
+	record, err := reader.Peek(5 + length)
+	if err != nil {
+		return ``, errors.Wrap(err, `could not read TLS ClientHello`)
+	}
+
+	name, ok := parseServerName(record[5:])
+	if !ok {
+		return ``, errors.New(`TLS ClientHello has no server name`)
+	}
+
+	return normalizeHost(name), nil
+}
+
+// parseServerName extracts the host_name entry of the server_name extension (RFC 6066) from a ClientHello handshake
+// message.
+func parseServerName(msg []byte) (string, bool) {
+
+	// handshake type, 3-byte length, client version, random
+	if len(msg) < 38 || msg[0] != 0x01 {
+		return ``, false
+	}
+	msg = msg[38:]
+
+	// session id, cipher suites, compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		if len(msg) < lengthSize {
+			return ``, false
+		}
+		n := int(msg[0])
+		if lengthSize == 2 {
+			n = int(binary.BigEndian.Uint16(msg))
+		}
+		if len(msg) < lengthSize+n {
+			return ``, false
+		}
+		msg = msg[lengthSize+n:]
+	}
+
+	if len(msg) < 2 {
+		return ``, false
+	}
+	msg = msg[2:]
+
+	for len(msg) >= 4 {
+		extType := binary.BigEndian.Uint16(msg)
+		extLength := int(binary.BigEndian.Uint16(msg[2:]))
+		if len(msg) < 4+extLength {
+			return ``, false
+		}
+		ext := msg[4 : 4+extLength]
+		msg = msg[4+extLength:]
+
+		if extType != 0x0000 || len(ext) < 2 {
+			continue
+		}
+
+		for list := ext[2:]; len(list) >= 3; {
+			nameType := list[0]
+			nameLength := int(binary.BigEndian.Uint16(list[1:]))
+			if len(list) < 3+nameLength {
+				return ``, false
+			}
+			if nameType == 0x00 {
+				return string(list[3 : 3+nameLength]), true
+			}
+			list = list[3+nameLength:]
+		}
+	}
+
+	return ``, false
+}
+
+func normalizeHost(host string) string {
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, `.`))
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record that a client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf(`could not read ClientHello: %s`, err.Error())
+	}
+
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf(`could not read ClientHello: %s`, err.Error())
+	}
+
+	return record
+}
+
+func TestParseServerName(t *testing.T) {
+
+	tests := []struct {
+		serverName string
+		want       string
+		ok         bool
+	}{
+		{`example.com`, `example.com`, true},
+		{`app.tunnels.example.com`, `app.tunnels.example.com`, true},
+		// crypto/tls sends no server name for IP addresses
+		{`127.0.0.1`, ``, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+
+			record := clientHello(t, tt.serverName)
+
+			got, ok := parseServerName(record[5:])
+			if got != tt.want || ok != tt.ok {
+				t.Errorf(`parseServerName = ('%s', %v), want ('%s', %v)`, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseServerNameMalformed(t *testing.T) {
+
+	msg := clientHello(t, `example.com`)[5:]
+
+	// every truncation must be rejected rather than read out of bounds
+	for n := 0; n < len(msg); n++ {
+		if name, ok := parseServerName(msg[:n]); ok && name != `example.com` {
+			t.Errorf(`truncated to %d bytes: got '%s'`, n, name)
+		}
+	}
+
+	notHello := append([]byte{0x02}, msg[1:]...)
+	if _, ok := parseServerName(notHello); ok {
+		t.Error(`a handshake message other than ClientHello was parsed`)
+	}
+}
+
+func TestReadServerName(t *testing.T) {
+
+	record := clientHello(t, `Example.COM.`)
+
+	reader := bufio.NewReader(bytes.NewReader(record))
+	name, err := readServerName(reader)
+	if err != nil {
+		t.Fatalf(`readServerName: %s`, err.Error())
+	}
+	if name != `example.com` {
+		t.Errorf(`readServerName = '%s', want 'example.com'`, name)
+	}
+	if reader.Buffered() != len(record) {
+		t.Errorf(`readServerName consumed the ClientHello`)
+	}
+
+	if _, err := readServerName(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Error(`plain HTTP was read as a ClientHello`)
+	}
+}
+
+func TestReadRequestHead(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		input string
+		host  string
+		ok    bool
+	}{
+		{`simple`, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", `example.com`, true},
+		{`with body`, "POST /x HTTP/1.1\r\nHost: a.example.com:8080\r\nContent-Length: 3\r\n\r\nabc", `a.example.com:8080`, true},
+		{`incomplete`, "GET / HTTP/1.1\r\nHost: example.com\r\n", ``, false},
+		{`garbage`, "\x16\x03\x01\x00\x05hello\r\n\r\n", ``, false},
+		{`too large`, "GET / HTTP/1.1\r\nX-Padding: " + strings.Repeat(`a`, maxRouteHeaderSize) + "\r\n\r\n", ``, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// as on the virtual host ports
+			reader := bufio.NewReaderSize(strings.NewReader(tt.input), maxRouteHeaderSize)
+
+			req, err := readRequestHead(reader)
+			if (err == nil) != tt.ok {
+				t.Fatalf(`readRequestHead error = %v, want ok: %v`, err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if req.Host != tt.host {
+				t.Errorf(`Host = '%s', want '%s'`, req.Host, tt.host)
+			}
+			// the request must be left for the tunnel to forward
+			if reader.Buffered() != len(tt.input) {
+				t.Errorf(`%d bytes buffered, want %d`, reader.Buffered(), len(tt.input))
+			}
+		})
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{`example.com`, `example.com`},
+		{`Example.COM`, `example.com`},
+		{`example.com:8080`, `example.com`},
+		{`example.com.`, `example.com`},
+		{`EXAMPLE.com.:443`, `example.com`},
+		{`[::1]:80`, `::1`},
+		{``, ``},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeHost(tt.host); got != tt.want {
+			t.Errorf(`normalizeHost('%s') = '%s', want '%s'`, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestStopClosesConnectionsBeingRouted(t *testing.T) {
+
+	_, portString, _ := net.SplitHostPort(freeAddress(t))
+	port, _ := strconv.Atoi(portString)
+
+	s := newTestServerOn(t, ClientIP(`127.0.0.1`), VirtualHosts(`tunnels.example`, port, 0))
+	if err := s.Start(); err != nil {
+		t.Fatalf(`could not start: %s`, err.Error())
+	}
+
+	// a visitor that never sends a request keeps its connection waiting to be routed
+	conn, err := net.Dial(`tcp`, net.JoinHostPort(`127.0.0.1`, portString))
+	if err != nil {
+		t.Fatalf(`could not connect: %s`, err.Error())
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	s.Stop()
+	if !doneWithin(s.Done(), 2*time.Second) {
+		t.Fatal(`server waited for the connection to be routed`)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf(`connection was left open: %v`, err)
+	}
+}
@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// largest chunk of a write that is sent as one frame
+	maxFrameSize = 32 * 1024
+
+	// chunks smaller than this are not worth compressing
+	minCompressSize = 128
+
+	// after a chunk fails to compress, this many chunks are sent as-is before compression is tried again
+	compressBackoff = 16
+
+	frameRaw      = 0
+	frameDeflated = 1
+)
+
+// magic numbers at the start of common formats that are already compressed
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},             // gzip
+	{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+	{'P', 'K', 0x03, 0x04},   // zip and formats based on it
+	{0x89, 'P', 'N', 'G'},    // png
+	{0xff, 0xd8, 0xff},       // jpeg
+	{'G', 'I', 'F', '8'},     // gif
+	{'B', 'Z', 'h'},          // bzip2
+	{0xfd, '7', 'z', 'X'},    // xz
+	{'7', 'z', 0xbc, 0xaf},   // 7z
+	{'%', 'P', 'D', 'F'},     // pdf
+}
+
+// CompressedConn compresses what is written to a connection with DEFLATE and decompresses what is read from it. Data
+// is sent in frames, each of which is compressed on its own so that it can be delivered without waiting for more.
+// Frames that look like they are already compressed, or that do not shrink, are sent as they are.
+//
+// Each frame consists of a type byte, a 2-byte big-endian length and the payload.
+type CompressedConn struct {
+	net.Conn
+
+	reader     *bufio.Reader
+	decompress io.ReadCloser
+	pending    []byte // decompressed but not yet read
+
+	writeMutex *sync.Mutex
+	compress   *flate.Writer
+	compressed *bytes.Buffer
+	skip       int // chunks still to be sent as-is since compression last failed
+}
+
+// NewCompressedConn returns conn with compression applied in both directions. The peer must do the same.
+func NewCompressedConn(conn net.Conn) *CompressedConn {
+
+	compressed := &bytes.Buffer{}
+	compress, _ := flate.NewWriter(compressed, flate.DefaultCompression)
+
+	return &CompressedConn{
+		Conn:       conn,
+		reader:     bufio.NewReader(conn),
+		decompress: flate.NewReader(bytes.NewReader(nil)),
+		writeMutex: &sync.Mutex{},
+		compress:   compress,
+		compressed: compressed,
+	}
+}
+
+func (cc *CompressedConn) Read(b []byte) (int, error) {
+
+	for len(cc.pending) == 0 {
+		if err := cc.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, cc.pending)
+	cc.pending = cc.pending[n:]
+
+	return n, nil
+}
+
+func (cc *CompressedConn) readFrame() error {
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(cc.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.New(`truncated compressed frame`)
+		}
+		return err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(cc.reader, payload); err != nil {
+		return errors.New(`truncated compressed frame`)
+	}
+
+	switch header[0] {
+	case frameRaw:
+		cc.pending = payload
+	case frameDeflated:
+		cc.decompress.(flate.Resetter).Reset(bytes.NewReader(payload), nil)
+		// a frame never holds more than maxFrameSize, so anything beyond is a decompression bomb
+		data, err := ioutil.ReadAll(io.LimitReader(cc.decompress, maxFrameSize+1))
+		if err != nil {
+			return errors.Wrap(err, `invalid compressed frame`)
+		}
+		if len(data) > maxFrameSize {
+			return errors.Errorf(`invalid compressed frame: inflates to more than %d bytes`, maxFrameSize)
+		}
+		cc.pending = data
+	default:
+		return errors.Errorf(`invalid compressed frame type %d`, header[0])
+	}
+
+	return nil
+}
+
+func (cc *CompressedConn) Write(b []byte) (int, error) {
+
+	cc.writeMutex.Lock()
+	defer cc.writeMutex.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+
+		if err := cc.writeFrame(chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (cc *CompressedConn) writeFrame(chunk []byte) error {
+
+	frameType, payload := byte(frameRaw), chunk
+
+	switch {
+	case len(chunk) < minCompressSize:
+	case cc.skip > 0:
+		cc.skip--
+	case looksCompressed(chunk):
+		cc.skip = compressBackoff
+	default:
+		cc.compressed.Reset()
+		cc.compress.Reset(cc.compressed)
+		cc.compress.Write(chunk)
+		cc.compress.Close()
+		if cc.compressed.Len() < len(chunk)*9/10 {
+			frameType, payload = frameDeflated, cc.compressed.Bytes()
+		} else {
+			cc.skip = compressBackoff
+		}
+	}
+
+	frame := make([]byte, 3+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[3:], payload)
+
+	_, err := cc.Conn.Write(frame)
+	return err
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so.
+func (cc *CompressedConn) CloseWrite() error {
+
+	return closeWrite(cc.Conn)
+}
+
+// looksCompressed reports whether chunk starts like a format that is already compressed.
+func looksCompressed(chunk []byte) bool {
+
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(chunk, magic) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package shared
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// compressedPipe returns both ends of a connection compressed in both directions.
+func compressedPipe(t *testing.T) (*CompressedConn, *CompressedConn) {
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return NewCompressedConn(a), NewCompressedConn(b)
+}
+
+func randomBytes(n int) []byte {
+
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return b
+}
+
+func TestCompressedConnRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{`tiny`, []byte(`hello`)},
+		{`text`, []byte(strings.Repeat(`GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n`, 100))},
+		{`several frames`, bytes.Repeat([]byte(`abcdefgh`), 3*maxFrameSize/8+17)},
+		{`random`, randomBytes(2*maxFrameSize + 1)},
+		{`gzip`, append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte{0}, 4096)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a, b := compressedPipe(t)
+
+			go func() {
+				a.Write(tt.data)
+				a.Conn.Close()
+			}()
+
+			got, err := io.ReadAll(b)
+			if err != nil {
+				t.Fatalf(`read: %s`, err.Error())
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf(`read %d bytes, want the %d written`, len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+// frames records the frames written by a CompressedConn.
+func frames(t *testing.T, data []byte) [][]byte {
+
+	t.Helper()
+
+	a, b := net.Pipe()
+	defer b.Close()
+
+	go func() {
+		NewCompressedConn(a).Write(data)
+		a.Close()
+	}()
+
+	raw, _ := io.ReadAll(b)
+
+	var result [][]byte
+	for len(raw) > 0 {
+		n := 3 + int(binary.BigEndian.Uint16(raw[1:]))
+		result = append(result, raw[:n])
+		raw = raw[n:]
+	}
+
+	return result
+}
+
+func TestCompressedConnFrames(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		data  []byte
+		types []byte
+	}{
+		{`too small to compress`, bytes.Repeat([]byte(`a`), minCompressSize-1), []byte{frameRaw}},
+		{`compressible`, bytes.Repeat([]byte(`a`), 1000), []byte{frameDeflated}},
+		{`already compressed`, append([]byte{0x89, 'P', 'N', 'G'}, bytes.Repeat([]byte{0}, 1000)...), []byte{frameRaw}},
+		{`incompressible`, randomBytes(1000), []byte{frameRaw}},
+		{`split`, bytes.Repeat([]byte(`a`), maxFrameSize+1000), []byte{frameDeflated, frameDeflated}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got := frames(t, tt.data)
+
+			if len(got) != len(tt.types) {
+				t.Fatalf(`%d frames, want %d`, len(got), len(tt.types))
+			}
+			for i, frame := range got {
+				if frame[0] != tt.types[i] {
+					t.Errorf(`frame %d has type %d, want %d`, i, frame[0], tt.types[i])
+				}
+			}
+		})
+	}
+}
+
+// deflatedFrame returns a frame of type frameDeflated that inflates to data.
+func deflatedFrame(data []byte) []byte {
+
+	compressed := &bytes.Buffer{}
+	w, _ := flate.NewWriter(compressed, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+
+	frame := []byte{frameDeflated, 0, 0}
+	binary.BigEndian.PutUint16(frame[1:], uint16(compressed.Len()))
+
+	return append(frame, compressed.Bytes()...)
+}
+
+func TestCompressedConnRejects(t *testing.T) {
+
+	bomb := deflatedFrame(make([]byte, 64*1024*1024))
+	if len(bomb) > 0xffff {
+		t.Fatalf(`bomb does not fit in a frame (%d bytes)`, len(bomb))
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{`decompression bomb`, bomb, `inflates to more than`},
+		{`just too large`, deflatedFrame(make([]byte, maxFrameSize+1)), `inflates to more than`},
+		{`invalid type`, []byte{7, 0, 1, 0}, `invalid compressed frame type 7`},
+		{`invalid deflate`, []byte{frameDeflated, 0, 3, 0xff, 0xff, 0xff}, `invalid compressed frame`},
+		{`truncated header`, []byte{frameRaw, 0}, `truncated compressed frame`},
+		{`truncated payload`, []byte{frameRaw, 0, 5, 'a'}, `truncated compressed frame`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a, b := net.Pipe()
+			defer b.Close()
+			go func() {
+				a.Write(tt.input)
+				a.Close()
+			}()
+
+			_, err := io.ReadAll(NewCompressedConn(b))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf(`error = %v, want '%s'`, err, tt.err)
+			}
+		})
+	}
+
+	// the largest frame that can be written is accepted
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		a.Write(deflatedFrame(bytes.Repeat([]byte(`x`), maxFrameSize)))
+		a.Close()
+	}()
+	if got, err := io.ReadAll(NewCompressedConn(b)); err != nil || len(got) != maxFrameSize {
+		t.Errorf(`full frame: read %d bytes, error %v`, len(got), err)
+	}
+}
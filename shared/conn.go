@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+)
+
+// BufferedConn is a net.Conn whose reads are served from a bufio.Reader first. It is used where bytes beyond the
+// HTTP upgrade may already have been buffered.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+// NewBufferedConn returns conn as-is if reader has nothing buffered, or a BufferedConn otherwise.
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) net.Conn {
+
+	if reader == nil || reader.Buffered() == 0 {
+		return conn
+	}
+
+	return &BufferedConn{Conn: conn, Reader: reader}
+}
+
+// Read reads from the buffer first and then from the underlying connection.
+func (bc *BufferedConn) Read(b []byte) (int, error) {
+
+	return bc.Reader.Read(b)
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so.
+func (bc *BufferedConn) CloseWrite() error {
+
+	return closeWrite(bc.Conn)
+}
+
+// Join copies data between a and b in both directions until both directions are finished, and then closes both.
+// Where supported, the write side of each connection is shut down once its source reaches EOF so that the peer can
+// finish sending.
+func Join(a, b net.Conn) {
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if closeWrite(dst) != nil {
+			dst.Close()
+		}
+		wg.Done()
+	}
+
+	go pipe(a, b)
+	go pipe(b, a)
+
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func closeWrite(conn net.Conn) error {
+
+	type closeWriter interface {
+		CloseWrite() error
+	}
+
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return conn.Close()
+}
+
+// RandomID returns a random hexadecimal identifier suitable for naming tunnels and connections.
+func RandomID() string {
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,52 @@
+package shared
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDatagramSize is the largest UDP payload that can be framed.
+const MaxDatagramSize = 65535
+
+// WriteDatagram frames a UDP payload together with the address it came from (server to client) or should be sent
+// back to (client to server). A frame is the payload length as a 2-byte big-endian integer, the address length as a
+// single byte, the address as text, and then the payload.
+func WriteDatagram(w io.Writer, addr string, payload []byte) error {
+
+	if len(addr) > 255 {
+		return errors.Errorf(`datagram address is too long (got '%s')`, addr)
+	}
+
+	if len(payload) > MaxDatagramSize {
+		return errors.Errorf(`datagram is too large (got %d bytes)`, len(payload))
+	}
+
+	frame := make([]byte, 3+len(addr)+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	frame[2] = byte(len(addr))
+	copy(frame[3:], addr)
+	copy(frame[3+len(addr):], payload)
+
+	// a frame is written at once, but only callers that serialize their calls can be sure that frames from several
+	// goroutines are not interleaved, since some transports split a write
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a frame written by WriteDatagram.
+func ReadDatagram(r io.Reader) (addr string, payload []byte, err error) {
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ``, nil, err
+	}
+
+	body := make([]byte, int(header[2])+int(binary.BigEndian.Uint16(header)))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return ``, nil, errors.Wrap(err, `truncated datagram`)
+	}
+
+	return string(body[:header[2]]), body[header[2]:], nil
+}
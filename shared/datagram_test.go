@@ -0,0 +1,91 @@
+package shared
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		addr    string
+		payload []byte
+		frame   []byte // nil to skip comparing the encoding
+	}{
+		{`empty`, ``, []byte{}, []byte{0, 0, 0}},
+		{`small`, `1.2.3.4:53`, []byte(`hi`), append(append([]byte{0, 2, 10}, `1.2.3.4:53`...), `hi`...)},
+		{`ipv6`, `[::1]:5353`, []byte{0, 1, 2, 255}, nil},
+		{`longest address`, strings.Repeat(`a`, 255), []byte(`x`), nil},
+		{`largest payload`, `h:1`, bytes.Repeat([]byte{7}, MaxDatagramSize), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := &bytes.Buffer{}
+			if err := WriteDatagram(buf, tt.addr, tt.payload); err != nil {
+				t.Fatalf(`could not write: %s`, err.Error())
+			}
+
+			if tt.frame != nil && !bytes.Equal(buf.Bytes(), tt.frame) {
+				t.Errorf(`frame = %v, want %v`, buf.Bytes(), tt.frame)
+			}
+
+			addr, payload, err := ReadDatagram(buf)
+			if err != nil {
+				t.Fatalf(`could not read: %s`, err.Error())
+			}
+			if addr != tt.addr || !bytes.Equal(payload, tt.payload) {
+				t.Errorf(`read ('%s', %d bytes), want ('%s', %d bytes)`, addr, len(payload), tt.addr, len(tt.payload))
+			}
+			if buf.Len() != 0 {
+				t.Errorf(`%d bytes left unread`, buf.Len())
+			}
+		})
+	}
+}
+
+func TestDatagramFramingRejects(t *testing.T) {
+
+	if err := WriteDatagram(io.Discard, strings.Repeat(`a`, 256), nil); err == nil {
+		t.Error(`address of 256 bytes was accepted`)
+	}
+
+	if err := WriteDatagram(io.Discard, `h:1`, make([]byte, MaxDatagramSize+1)); err == nil {
+		t.Error(`payload larger than MaxDatagramSize was accepted`)
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	WriteDatagram(buf, `h:1`, []byte(`payload`))
+	frame := buf.Bytes()
+
+	tests := []struct {
+		name  string
+		frame []byte
+		eof   bool // whether the stream ended cleanly between frames
+	}{
+		{`nothing`, nil, true},
+		{`partial header`, frame[:2], false},
+		{`partial address`, frame[:4], false},
+		{`partial payload`, frame[:len(frame)-1], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, _, err := ReadDatagram(bytes.NewReader(tt.frame))
+			if err == nil {
+				t.Fatal(`truncated frame was read`)
+			}
+			if (err == io.EOF) != tt.eof {
+				t.Errorf(`err = %v, want EOF: %v`, err, tt.eof)
+			}
+		})
+	}
+}
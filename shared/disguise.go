@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// Paths under the base path of disguise mode. Sessions are started with a POST to DisguiseSessionsPath, and then
+// DisguiseSessionsPath + '/<id>' + DisguiseMessagesPath takes data with POST and returns it with GET, while a DELETE of
+// DisguiseSessionsPath + '/<id>' ends the session. A GET names how much data the client has received in the
+// DisguiseAckParameter query parameter, the Httptun-Ack header of a plain poll.
+const (
+	DisguiseSessionsPath = `/sessions`
+	DisguiseMessagesPath = `/messages`
+	DisguiseAckParameter = `after`
+)
+
+// maxDisguisePadding is the most padding added to a request or response in disguise mode.
+const maxDisguisePadding = 256
+
+// DisguisedRequest is the JSON body of a request in disguise mode. It carries what the long-poll transport otherwise
+// sends in headers and bodies, so that nothing but JSON is exchanged.
+type DisguisedRequest struct {
+	// headers of the handshake; see DisguiseAttributes
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Payload    []byte            `json:"payload,omitempty"`
+	// whether the client is done sending
+	Done  bool   `json:"done,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// DisguisedResponse is the JSON body of a response in disguise mode.
+type DisguisedResponse struct {
+	// headers of the handshake response; see DisguiseAttributes
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Payload    []byte            `json:"payload,omitempty"`
+	// whether the server is done sending
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// DisguiseAttributes returns the httptun headers in header as attributes of a disguised request or response, named
+// without the telltale prefix, e.g. 'action' for Httptun-Action.
+func DisguiseAttributes(header http.Header) map[string]string {
+
+	attributes := map[string]string{}
+
+	for key, values := range header {
+		if strings.HasPrefix(key, headerPrefix) && len(values) > 0 {
+			attributes[strings.ToLower(strings.TrimPrefix(key, headerPrefix))] = values[0]
+		}
+	}
+
+	return attributes
+}
+
+// UndisguiseAttributes returns the httptun headers named by the attributes of a disguised request or response.
+func UndisguiseAttributes(attributes map[string]string) http.Header {
+
+	header := http.Header{}
+
+	for key, value := range attributes {
+		header.Set(headerPrefix+key, value)
+	}
+
+	return header
+}
+
+const headerPrefix = `Httptun-`
+
+// DisguisePadding returns a random string of random length, so that the sizes of disguised requests and responses do
+// not give away what they carry.
+func DisguisePadding() string {
+
+	length, err := rand.Int(rand.Reader, big.NewInt(maxDisguisePadding))
+	if err != nil {
+		return ``
+	}
+
+	padding := make([]byte, length.Int64())
+	rand.Read(padding)
+
+	return base64.RawURLEncoding.EncodeToString(padding)
+}
@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Versions of the httptun protocol that this build speaks. A client sends the highest it speaks in the Httptun-Version
+// header and the server answers with the version in effect, which is the lower of that and its own.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Capabilities that a client may ask to use on a connection in the Httptun-Capabilities header.
+const (
+	// CapabilityCompression compresses the connections of a tunnel, or a dialed connection, with DEFLATE.
+	CapabilityCompression = `compression`
+	// CapabilityMultiplexing carries several connections over one. Reserved; no server grants it yet.
+	CapabilityMultiplexing = `multiplexing`
+	// CapabilityUdp opens a tunnel that relays datagrams.
+	CapabilityUdp = `udp`
+	// CapabilityHeartbeats exchanges keepalive messages on the control connection. Reserved; no server grants it yet.
+	CapabilityHeartbeats = `heartbeats`
+)
+
+// Handshake is the part of every handshake request and response that negotiates the protocol.
+type Handshake struct {
+	Version      int
+	Capabilities CapabilitySet
+}
+
+// NewHandshake returns the handshake with which a client of this build asks for the given capabilities.
+func NewHandshake(capabilities ...string) *Handshake {
+
+	return &Handshake{
+		Version:      ProtocolVersion,
+		Capabilities: NewCapabilitySet(capabilities...),
+	}
+}
+
+// ReadHandshake decodes the handshake in header. Peers that predate versioning send no version and speak version 1.
+func ReadHandshake(header http.Header) (*Handshake, error) {
+
+	h := &Handshake{
+		Version:      1,
+		Capabilities: ParseCapabilities(header.Get(HeaderCapabilities)),
+	}
+
+	if value := header.Get(HeaderVersion); value != `` {
+		version, err := strconv.Atoi(value)
+		if err != nil || version < 1 {
+			return nil, errors.Errorf(`invalid protocol version (got '%s')`, value)
+		}
+		h.Version = version
+	}
+
+	return h, nil
+}
+
+// Write encodes the handshake into header.
+func (h *Handshake) Write(header http.Header) {
+
+	header.Set(HeaderVersion, strconv.Itoa(h.Version))
+
+	if len(h.Capabilities) > 0 {
+		header.Set(HeaderCapabilities, h.Capabilities.String())
+	} else {
+		header.Del(HeaderCapabilities)
+	}
+}
+
+// NegotiateVersion returns the protocol version in effect when a peer offers the given version, or an error if this
+// build no longer speaks it.
+func NegotiateVersion(offered int) (int, error) {
+
+	if offered > ProtocolVersion {
+		return ProtocolVersion, nil
+	}
+
+	if offered < MinProtocolVersion {
+		return 0, errors.Errorf(`protocol version %d is not supported (supported: %d to %d)`, offered, MinProtocolVersion, ProtocolVersion)
+	}
+
+	return offered, nil
+}
+
+// CapabilitySet is a sorted set of capabilities without duplicates.
+type CapabilitySet []string
+
+// NewCapabilitySet returns the set of the given capabilities.
+func NewCapabilitySet(capabilities ...string) CapabilitySet {
+
+	set := CapabilitySet{}
+
+	for _, capability := range capabilities {
+		capability = strings.ToLower(strings.TrimSpace(capability))
+		if capability != `` && !set.Has(capability) {
+			set = append(set, capability)
+		}
+	}
+
+	sort.Strings(set)
+
+	return set
+}
+
+// ParseCapabilities decodes the comma-separated value of the Httptun-Capabilities header.
+func ParseCapabilities(value string) CapabilitySet {
+
+	return NewCapabilitySet(strings.Split(value, `,`)...)
+}
+
+// Has reports whether the set contains capability.
+func (cs CapabilitySet) Has(capability string) bool {
+
+	for _, c := range cs {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate returns an error if the set combines capabilities that cannot be used together.
+func (cs CapabilitySet) Validate() error {
+
+	if cs.Has(CapabilityUdp) && cs.Has(CapabilityCompression) {
+		return errors.New(`compression cannot be used with UDP tunnels`)
+	}
+
+	return nil
+}
+
+// String encodes the set as the value of the Httptun-Capabilities header.
+func (cs CapabilitySet) String() string {
+
+	return strings.Join(cs, `,`)
+}
@@ -0,0 +1,223 @@
+package shared
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// update rewrites the golden files with what the tests produce: go test ./shared -run Handshake -update
+var update = flag.Bool(`update`, false, `update golden files`)
+
+// checkGolden compares got with the golden file testdata/handshake/<name>.golden.
+func checkGolden(t *testing.T, name, got string) {
+
+	t.Helper()
+
+	path := filepath.Join(`testdata`, `handshake`, name+`.golden`)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf(`could not update %s: %s`, path, err.Error())
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf(`could not read %s: %s`, path, err.Error())
+	}
+	if got != string(want) {
+		t.Errorf(`%s does not match:\ngot:\n%s\nwant:\n%s`, path, got, want)
+	}
+}
+
+// formatHeader writes header one field per line, sorted by name.
+func formatHeader(header http.Header) string {
+
+	keys := []string{}
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(b, "%s: %s\n", key, value)
+		}
+	}
+
+	return b.String()
+}
+
+// readHeader reads the header in testdata/handshake/<name>.header.
+func readHeader(t *testing.T, name string) http.Header {
+
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(`testdata`, `handshake`, name+`.header`))
+	if err != nil {
+		t.Fatalf(`could not read header: %s`, err.Error())
+	}
+
+	// the blank line ends the header
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(string(data) + "\n"))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf(`invalid header: %s`, err.Error())
+	}
+
+	return http.Header(header)
+}
+
+func TestWriteHandshake(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		handshake *Handshake
+	}{
+		{`write-plain`, NewHandshake()},
+		{`write-compression`, NewHandshake(CapabilityCompression)},
+		{`write-udp`, NewHandshake(CapabilityUdp)},
+		{`write-unsorted`, NewHandshake(` Heartbeats`, CapabilityUdp, ``, `multiplexing`, `heartbeats`)},
+		{`write-newer`, &Handshake{Version: 2, Capabilities: NewCapabilitySet(CapabilityCompression)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// writing replaces whatever capabilities the header held before
+			header := http.Header{}
+			header.Set(HeaderAction, ActionOpen)
+			header.Set(HeaderCapabilities, `stale`)
+			tt.handshake.Write(header)
+
+			checkGolden(t, tt.name, formatHeader(header))
+
+			read, err := ReadHandshake(header)
+			if err != nil {
+				t.Fatalf(`could not read the handshake back: %s`, err.Error())
+			}
+			if !reflect.DeepEqual(read, tt.handshake) {
+				t.Errorf(`read back %+v, want %+v`, read, tt.handshake)
+			}
+		})
+	}
+}
+
+// TestReadHandshake checks what a server makes of the handshakes of various clients: the handshake it reads, the
+// version in effect and whether the capabilities can be used together, or why it refuses.
+func TestReadHandshake(t *testing.T) {
+
+	for _, name := range []string{
+		`read-current`,
+		`read-legacy`,
+		`read-newer`,
+		`read-too-old`,
+		`read-negative`,
+		`read-unknown-version`,
+		`read-messy-capabilities`,
+		`read-compressed-udp`,
+	} {
+		t.Run(name, func(t *testing.T) {
+
+			checkGolden(t, name, describeHandshake(readHeader(t, name)))
+		})
+	}
+}
+
+// describeHandshake reads the handshake in header and negotiates it, and describes the outcome.
+func describeHandshake(header http.Header) string {
+
+	handshake, err := ReadHandshake(header)
+	if err != nil {
+		return fmt.Sprintf("refused: %s\n", err.Error())
+	}
+
+	description := fmt.Sprintf("offered: version %d, capabilities [%s]\n", handshake.Version, handshake.Capabilities.String())
+
+	version, err := NegotiateVersion(handshake.Version)
+	if err != nil {
+		return description + fmt.Sprintf("refused: %s\n", err.Error())
+	}
+	description += fmt.Sprintf("agreed: version %d\n", version)
+
+	if err := handshake.Capabilities.Validate(); err != nil {
+		return description + fmt.Sprintf("refused: %s\n", err.Error())
+	}
+
+	return description
+}
+
+func TestNegotiateVersion(t *testing.T) {
+
+	tests := []struct {
+		offered int
+		want    int
+		wantErr bool
+	}{
+		{MinProtocolVersion, MinProtocolVersion, false},
+		{ProtocolVersion, ProtocolVersion, false},
+		{ProtocolVersion + 1, ProtocolVersion, false},
+		{1000, ProtocolVersion, false},
+		{MinProtocolVersion - 1, 0, true},
+		{-1, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := NegotiateVersion(tt.offered)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf(`NegotiateVersion(%d) = %d, %v, want %d (error: %t)`, tt.offered, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+
+	tests := []struct {
+		value string
+		want  CapabilitySet
+	}{
+		{``, CapabilitySet{}},
+		{` , ,`, CapabilitySet{}},
+		{`udp`, CapabilitySet{`udp`}},
+		{`udp,compression`, CapabilitySet{`compression`, `udp`}},
+		{` UDP , Compression,udp`, CapabilitySet{`compression`, `udp`}},
+		{`telepathy`, CapabilitySet{`telepathy`}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseCapabilities(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf(`ParseCapabilities('%s') = %q, want %q`, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCapabilitySetValidate(t *testing.T) {
+
+	tests := []struct {
+		capabilities CapabilitySet
+		wantErr      bool
+	}{
+		{NewCapabilitySet(), false},
+		{NewCapabilitySet(CapabilityCompression), false},
+		{NewCapabilitySet(CapabilityUdp), false},
+		{NewCapabilitySet(CapabilityUdp, CapabilityHeartbeats), false},
+		{NewCapabilitySet(CapabilityCompression, CapabilityMultiplexing), false},
+		{NewCapabilitySet(CapabilityUdp, CapabilityCompression), true},
+		{NewCapabilitySet(CapabilityUdp, CapabilityCompression, CapabilityHeartbeats), true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.capabilities.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf(`Validate of [%s] returned %v`, tt.capabilities.String(), err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"net"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -29,3 +30,92 @@ func ValidatePort(port int) error {
 
 	return nil
 }
+
+// ValidateSocketName validates the name of a Unix socket that a client requests for its tunnel. Names are used as
+// file names on the server, so only letters, digits, '.', '_' and '-' are permitted and they must not start with '.'.
+// If the name is invalid, the returned error will have an embedded stacktrace and friendly message.
+func ValidateSocketName(name string) error {
+
+	if name == `` || len(name) > 64 || name[0] == '.' {
+		return errors.Errorf(`invalid socket name: must be 1 to 64 characters and not start with '.' (got '%s')`, name)
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return errors.Errorf(`invalid socket name: may only contain letters, digits, '.', '_' and '-' (got '%s')`, name)
+		}
+	}
+
+	return nil
+}
+
+// ValidateHostname validates the name under which a client requests that its tunnel be reached through the
+// server's virtual host ports. Names become a single DNS label, so only letters, digits and '-' are permitted and
+// they must not start or end with '-'. If the name is invalid, the returned error will have an embedded stacktrace
+// and friendly message.
+func ValidateHostname(name string) error {
+
+	if name == `` || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return errors.Errorf(`invalid hostname: must be 1 to 63 characters and not start or end with '-' (got '%s')`, name)
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+		default:
+			return errors.Errorf(`invalid hostname: may only contain letters, digits and '-' (got '%s')`, name)
+		}
+	}
+
+	return nil
+}
+
+// ParseNetwork parses a CIDR block such as '10.0.0.0/8', or a single IP address, which is treated as a block of one.
+// If it is invalid, the returned error will have an embedded stacktrace and friendly message.
+func ParseNetwork(value string) (*net.IPNet, error) {
+
+	if strings.Contains(value, `/`) {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Errorf(`invalid CIDR block (got '%s')`, value)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Errorf(`invalid IP address or CIDR block (got '%s')`, value)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// ParseAddress splits an address into the network and address expected by net.Dial. Addresses of the form
+// 'unix:/path' and absolute paths denote Unix sockets; anything else must be a TCP 'host:port'.
+func ParseAddress(address string) (network string, addr string, err error) {
+
+	switch {
+	case strings.HasPrefix(address, `unix:`):
+		network, addr = `unix`, strings.TrimPrefix(address, `unix:`)
+	case strings.HasPrefix(address, `/`):
+		network, addr = `unix`, address
+	default:
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return ``, ``, errors.Wrapf(err, `invalid address (got '%s')`, address)
+		}
+		return `tcp`, address, nil
+	}
+
+	if addr == `` {
+		return ``, ``, errors.Errorf(`invalid address: socket path is required (got '%s')`, address)
+	}
+
+	return network, addr, nil
+}
@@ -0,0 +1,389 @@
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionNoise is the value of the Httptun-Encryption header with which a client asks for, and the server agrees
+// to, an encrypted channel inside the upgraded connection. It names the Noise protocol that establishes the channel:
+// the NK pattern, in which the client already knows the server's static key, over X25519, AES-GCM and SHA-256.
+const EncryptionNoise = `Noise_NK_25519_AESGCM_SHA256`
+
+// KeySize is the size of private and public keys.
+const KeySize = 32
+
+const (
+	// bound into every handshake so that keys cannot be confused with those of other protocols
+	noisePrologue = `httptun`
+
+	// each handshake message is an ephemeral public key followed by the tag of an empty encrypted payload
+	noiseMessageSize = KeySize + noiseTagSize
+	noiseTagSize     = 16
+
+	// largest plaintext sent in one encrypted frame
+	maxPlaintextSize = 16 * 1024
+)
+
+// GenerateKey returns a new private key for the server and the public key that clients pin.
+func GenerateKey() (private, public []byte, err error) {
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, `could not generate key`)
+	}
+
+	return key.Bytes(), key.PublicKey().Bytes(), nil
+}
+
+// PublicKey returns the public key that belongs to private.
+func PublicKey(private []byte) ([]byte, error) {
+
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, errors.Errorf(`invalid private key: must be %d bytes`, KeySize)
+	}
+
+	return key.PublicKey().Bytes(), nil
+}
+
+// EncodeKey returns key as base64, as it is written in key files and on the command line.
+func EncodeKey(key []byte) string {
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeKey parses a key written by EncodeKey.
+func DecodeKey(encoded string) ([]byte, error) {
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != KeySize {
+		return nil, errors.Errorf(`invalid key: must be %d bytes in base64`, KeySize)
+	}
+
+	return key, nil
+}
+
+// ClientHandshake establishes an encrypted channel over conn with a server whose public key is serverKey. It fails
+// unless the peer holds the matching private key, so that anything relaying conn only ever sees ciphertext.
+func ClientHandshake(conn net.Conn, serverKey []byte) (net.Conn, error) {
+
+	rs, err := ecdh.X25519().NewPublicKey(serverKey)
+	if err != nil {
+		return nil, errors.Errorf(`invalid server key: must be %d bytes`, KeySize)
+	}
+
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, `could not generate ephemeral key`)
+	}
+
+	return clientHandshake(conn, rs, e, []byte(noisePrologue))
+}
+
+// clientHandshake performs the client side of the handshake with the ephemeral key e.
+func clientHandshake(conn net.Conn, rs *ecdh.PublicKey, e *ecdh.PrivateKey, prologue []byte) (net.Conn, error) {
+
+	ss := newSymmetricState(prologue)
+	ss.mixHash(rs.Bytes())
+
+	// -> e, es
+	ss.mixHash(e.PublicKey().Bytes())
+	if err := ss.mixDH(e, rs); err != nil {
+		return nil, err
+	}
+	message := append(e.PublicKey().Bytes(), ss.encryptAndHash(nil)...)
+	if _, err := conn.Write(message); err != nil {
+		return nil, errors.Wrap(err, `could not send handshake`)
+	}
+
+	// <- e, ee
+	reply := make([]byte, noiseMessageSize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		if err == io.EOF {
+			// the server closes the connection when the client does not know its key
+			return nil, errors.New(`handshake failed: server does not hold the pinned key`)
+		}
+		return nil, errors.Wrap(err, `could not read handshake`)
+	}
+	re, err := ecdh.X25519().NewPublicKey(reply[:KeySize])
+	if err != nil {
+		return nil, errors.New(`invalid handshake`)
+	}
+	ss.mixHash(reply[:KeySize])
+	if err := ss.mixDH(e, re); err != nil {
+		return nil, err
+	}
+	if _, err := ss.decryptAndHash(reply[KeySize:]); err != nil {
+		return nil, errors.New(`handshake failed: server does not hold the pinned key`)
+	}
+
+	send, receive := ss.split()
+	return newEncryptedConn(conn, send, receive), nil
+}
+
+// ServerHandshake answers ClientHandshake on conn with the server's private key.
+func ServerHandshake(conn net.Conn, privateKey []byte) (net.Conn, error) {
+
+	s, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Errorf(`invalid private key: must be %d bytes`, KeySize)
+	}
+
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, `could not generate ephemeral key`)
+	}
+
+	return serverHandshake(conn, s, e, []byte(noisePrologue))
+}
+
+// serverHandshake performs the server side of the handshake with the ephemeral key e.
+func serverHandshake(conn net.Conn, s, e *ecdh.PrivateKey, prologue []byte) (net.Conn, error) {
+
+	ss := newSymmetricState(prologue)
+	ss.mixHash(s.PublicKey().Bytes())
+
+	// -> e, es
+	message := make([]byte, noiseMessageSize)
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, errors.Wrap(err, `could not read handshake`)
+	}
+	re, err := ecdh.X25519().NewPublicKey(message[:KeySize])
+	if err != nil {
+		return nil, errors.New(`invalid handshake`)
+	}
+	ss.mixHash(message[:KeySize])
+	if err := ss.mixDH(s, re); err != nil {
+		return nil, err
+	}
+	if _, err := ss.decryptAndHash(message[KeySize:]); err != nil {
+		return nil, errors.New(`handshake failed: client does not know the server key`)
+	}
+
+	// <- e, ee
+	ss.mixHash(e.PublicKey().Bytes())
+	if err := ss.mixDH(e, re); err != nil {
+		return nil, err
+	}
+	reply := append(e.PublicKey().Bytes(), ss.encryptAndHash(nil)...)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, errors.Wrap(err, `could not send handshake`)
+	}
+
+	receive, send := ss.split()
+	return newEncryptedConn(conn, send, receive), nil
+}
+
+// symmetricState holds the chaining key and handshake hash of a Noise handshake, and the key derived so far.
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	cs *cipherState // nil until the first key is mixed in
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+
+	// protocol names of 32 bytes or fewer are used as the initial hash directly, padded with zeros
+	h := make([]byte, sha256.Size)
+	copy(h, EncryptionNoise)
+
+	ss := &symmetricState{ck: h, h: h}
+	ss.mixHash(prologue)
+
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+
+	sum := sha256.Sum256(append(append([]byte{}, ss.h...), data...))
+	ss.h = sum[:]
+}
+
+// mixDH mixes the shared secret of a private and a public key into the chaining key and derives a new key from it.
+func (ss *symmetricState) mixDH(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return errors.New(`invalid handshake`)
+	}
+
+	output := noiseHkdf(ss.ck, secret)
+	ss.ck, ss.cs = output[:sha256.Size], newCipherState(output[sha256.Size:])
+
+	return nil
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) []byte {
+
+	ciphertext := ss.cs.encrypt(ss.h, plaintext)
+	ss.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+
+	plaintext, err := ss.cs.decrypt(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns the keys for traffic from the initiator and for traffic to it.
+func (ss *symmetricState) split() (*cipherState, *cipherState) {
+
+	output := noiseHkdf(ss.ck, nil)
+
+	return newCipherState(output[:sha256.Size]), newCipherState(output[sha256.Size:])
+}
+
+// noiseHkdf derives two keys from a chaining key and input key material, as specified by Noise.
+func noiseHkdf(ck, ikm []byte) []byte {
+
+	output, err := hkdf.Key(sha256.New, ikm, ck, ``, 2*sha256.Size)
+	if err != nil {
+		// only possible if the requested length is too large
+		panic(err)
+	}
+
+	return output
+}
+
+// cipherState encrypts or decrypts a sequence of messages with one key and an incrementing nonce.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	return &cipherState{aead: aead}
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) []byte {
+
+	return cs.aead.Seal(nil, cs.nextNonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+
+	plaintext, err := cs.aead.Open(nil, cs.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, errors.New(`could not decrypt message`)
+	}
+
+	return plaintext, nil
+}
+
+func (cs *cipherState) nextNonce() []byte {
+
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+
+	return nonce
+}
+
+// EncryptedConn carries data over a connection in frames encrypted with the keys established by a handshake. Each
+// frame consists of a 2-byte big-endian length and the ciphertext.
+type EncryptedConn struct {
+	net.Conn
+
+	receive *cipherState
+	pending []byte // decrypted but not yet read
+
+	writeMutex *sync.Mutex
+	send       *cipherState
+}
+
+func newEncryptedConn(conn net.Conn, send, receive *cipherState) *EncryptedConn {
+
+	return &EncryptedConn{
+		Conn:       conn,
+		receive:    receive,
+		writeMutex: &sync.Mutex{},
+		send:       send,
+	}
+}
+
+func (ec *EncryptedConn) Read(b []byte) (int, error) {
+
+	for len(ec.pending) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(ec.Conn, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errors.New(`truncated encrypted frame`)
+			}
+			return 0, err
+		}
+
+		ciphertext := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(ec.Conn, ciphertext); err != nil {
+			return 0, errors.New(`truncated encrypted frame`)
+		}
+
+		plaintext, err := ec.receive.decrypt(nil, ciphertext)
+		if err != nil {
+			return 0, err
+		}
+		ec.pending = plaintext
+	}
+
+	n := copy(b, ec.pending)
+	ec.pending = ec.pending[n:]
+
+	return n, nil
+}
+
+func (ec *EncryptedConn) Write(b []byte) (int, error) {
+
+	ec.writeMutex.Lock()
+	defer ec.writeMutex.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPlaintextSize {
+			chunk = chunk[:maxPlaintextSize]
+		}
+
+		ciphertext := ec.send.encrypt(nil, chunk)
+		frame := make([]byte, 2+len(ciphertext))
+		binary.BigEndian.PutUint16(frame, uint16(len(ciphertext)))
+		copy(frame[2:], ciphertext)
+
+		if _, err := ec.Conn.Write(frame); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection if it supports doing so.
+func (ec *EncryptedConn) CloseWrite() error {
+
+	return closeWrite(ec.Conn)
+}
@@ -0,0 +1,302 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingConn records everything written to and read from a connection.
+type recordingConn struct {
+	net.Conn
+
+	mutex   *sync.Mutex
+	written [][]byte
+	read    []byte
+}
+
+func newRecordingConn(conn net.Conn) *recordingConn {
+
+	return &recordingConn{Conn: conn, mutex: &sync.Mutex{}}
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+
+	rc.mutex.Lock()
+	rc.written = append(rc.written, append([]byte{}, b...))
+	rc.mutex.Unlock()
+
+	return rc.Conn.Write(b)
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+
+	n, err := rc.Conn.Read(b)
+
+	rc.mutex.Lock()
+	rc.read = append(rc.read, b[:n]...)
+	rc.mutex.Unlock()
+
+	return n, err
+}
+
+func mustHex(t *testing.T, s string) []byte {
+
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf(`invalid hex '%s'`, s)
+	}
+
+	return b
+}
+
+func mustPrivateKey(t *testing.T, s string) *ecdh.PrivateKey {
+
+	t.Helper()
+
+	key, err := ecdh.X25519().NewPrivateKey(mustHex(t, s))
+	if err != nil {
+		t.Fatalf(`invalid private key: %s`, err.Error())
+	}
+
+	return key
+}
+
+// encryptedFrame prefixes ciphertext with its length, as EncryptedConn sends it.
+func encryptedFrame(ciphertext []byte) []byte {
+
+	return append([]byte{byte(len(ciphertext) >> 8), byte(len(ciphertext))}, ciphertext...)
+}
+
+// handshake runs both sides of a handshake over a pipe and returns the results.
+func handshake(t *testing.T, client func(net.Conn) (net.Conn, error), server func(net.Conn) (net.Conn, error)) (net.Conn, net.Conn, error, error) {
+
+	t.Helper()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := server(b)
+		if err != nil {
+			// as the server does, so that the client is not left waiting for a reply
+			b.Close()
+		}
+		done <- result{conn, err}
+	}()
+
+	clientConn, clientErr := client(a)
+	r := <-done
+
+	return clientConn, r.conn, clientErr, r.err
+}
+
+// TestNoiseKnownAnswer checks the handshake and the first transport messages against the
+// Noise_NK_25519_AESGCM_SHA256 vector of the cacophony test suite, which uses an empty prologue and empty handshake
+// payloads.
+func TestNoiseKnownAnswer(t *testing.T) {
+
+	var (
+		responderStatic    = mustPrivateKey(t, `0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20`)
+		initiatorEphemeral = mustPrivateKey(t, `202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f`)
+		responderEphemeral = mustPrivateKey(t, `4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60`)
+
+		message0 = mustHex(t, `358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd16625418e3e3b9a33b9d5f680ee08fbf20d03f`)
+		message1 = mustHex(t, `64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466a2c11719e1aac7b6b2efc4871618f8bf`)
+
+		payload2 = mustHex(t, `79656c6c6f777375626d6172696e65`)
+		message2 = mustHex(t, `95922788fcef822a17b42f450fa14d05d8e6a4377ca0aea3b4804f03db74a2`)
+		payload3 = mustHex(t, `7375626d6172696e6579656c6c6f77`)
+		message3 = mustHex(t, `0976cd4a786c253b37489b6bc3867b2df0dddf9f939b218da54092c6d3eca4`)
+	)
+
+	var recorder *recordingConn
+	client, server, clientErr, serverErr := handshake(t,
+		func(conn net.Conn) (net.Conn, error) {
+			recorder = newRecordingConn(conn)
+			return clientHandshake(recorder, responderStatic.PublicKey(), initiatorEphemeral, nil)
+		},
+		func(conn net.Conn) (net.Conn, error) {
+			return serverHandshake(conn, responderStatic, responderEphemeral, nil)
+		},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf(`handshake failed: client: %v, server: %v`, clientErr, serverErr)
+	}
+
+	if len(recorder.written) != 1 || !bytes.Equal(recorder.written[0], message0) {
+		t.Errorf(`client sent %x, want %x`, recorder.written, message0)
+	}
+	if !bytes.Equal(recorder.read, message1) {
+		t.Errorf(`server sent %x, want %x`, recorder.read, message1)
+	}
+
+	// the initiator sends first after the handshake, then the responder
+	go client.Write(payload2)
+	got := make([]byte, len(payload2))
+	if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, payload2) {
+		t.Fatalf(`server read %x (%v), want %x`, got, err, payload2)
+	}
+	if want := encryptedFrame(message2); len(recorder.written) != 2 || !bytes.Equal(recorder.written[1], want) {
+		t.Errorf(`client sent %x, want %x`, recorder.written[1:], want)
+	}
+
+	go server.Write(payload3)
+	got = make([]byte, len(payload3))
+	if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, payload3) {
+		t.Fatalf(`client read %x (%v), want %x`, got, err, payload3)
+	}
+	if want := encryptedFrame(message3); !bytes.Equal(recorder.read[len(message1):], want) {
+		t.Errorf(`server sent %x, want %x`, recorder.read[len(message1):], want)
+	}
+}
+
+// encryptedPipe returns both ends of a connection after a handshake, the client's recording what it writes.
+func encryptedPipe(t *testing.T) (client net.Conn, server net.Conn, recorder *recordingConn) {
+
+	t.Helper()
+
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatalf(`could not generate key: %s`, err.Error())
+	}
+
+	client, server, clientErr, serverErr := handshake(t,
+		func(conn net.Conn) (net.Conn, error) {
+			recorder = newRecordingConn(conn)
+			return ClientHandshake(recorder, public)
+		},
+		func(conn net.Conn) (net.Conn, error) {
+			return ServerHandshake(conn, private)
+		},
+	)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf(`handshake failed: client: %v, server: %v`, clientErr, serverErr)
+	}
+
+	return client, server, recorder
+}
+
+func TestEncryptedConnRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		size   int
+		frames int
+	}{
+		{`one byte`, 1, 1},
+		{`just under a frame`, maxPlaintextSize - 1, 1},
+		{`exactly a frame`, maxPlaintextSize, 1},
+		{`just over a frame`, maxPlaintextSize + 1, 2},
+		{`several frames`, 3*maxPlaintextSize + 5, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			client, server, recorder := encryptedPipe(t)
+			data := randomBytes(tt.size)
+
+			// both directions, since each has its own key
+			for _, direction := range []struct {
+				from, to net.Conn
+			}{{client, server}, {server, client}} {
+
+				go direction.from.Write(data)
+
+				got := make([]byte, len(data))
+				if _, err := io.ReadFull(direction.to, got); err != nil {
+					t.Fatalf(`read: %s`, err.Error())
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf(`read different bytes than the %d written`, len(data))
+				}
+			}
+
+			// the handshake message, then the frames
+			if len(recorder.written) != 1+tt.frames {
+				t.Fatalf(`wrote %d frames, want %d`, len(recorder.written)-1, tt.frames)
+			}
+			for _, frame := range recorder.written[1:] {
+				if len(frame) > 2+maxPlaintextSize+noiseTagSize {
+					t.Errorf(`wrote a frame of %d bytes`, len(frame))
+				}
+				if len(data) >= 16 && bytes.Contains(frame, data[:16]) {
+					t.Errorf(`frame contains plaintext`)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedConnRejectsTamperedFrame(t *testing.T) {
+
+	client, server, _ := encryptedPipe(t)
+
+	// a frame encrypted with the client's key, with one bit flipped
+	raw := client.(*EncryptedConn).Conn
+	ciphertext := client.(*EncryptedConn).send.encrypt(nil, []byte(`hello`))
+	ciphertext[0] ^= 1
+	go raw.Write(encryptedFrame(ciphertext))
+
+	if _, err := server.Read(make([]byte, 16)); err == nil || err.Error() != `could not decrypt message` {
+		t.Errorf(`read returned %v, want could not decrypt message`, err)
+	}
+}
+
+func TestHandshakeRejectsWrongStaticKey(t *testing.T) {
+
+	private, _, err := GenerateKey()
+	if err != nil {
+		t.Fatalf(`could not generate key: %s`, err.Error())
+	}
+	_, other, err := GenerateKey()
+	if err != nil {
+		t.Fatalf(`could not generate key: %s`, err.Error())
+	}
+
+	client, server, clientErr, serverErr := handshake(t,
+		func(conn net.Conn) (net.Conn, error) {
+			return ClientHandshake(conn, other)
+		},
+		func(conn net.Conn) (net.Conn, error) {
+			return ServerHandshake(conn, private)
+		},
+	)
+
+	if client != nil || clientErr == nil || !strings.Contains(clientErr.Error(), `server does not hold the pinned key`) {
+		t.Errorf(`client returned %v, %v; want the pinned key to be refused`, client, clientErr)
+	}
+	if server != nil || serverErr == nil || !strings.Contains(serverErr.Error(), `client does not know the server key`) {
+		t.Errorf(`server returned %v, %v; want the client to be refused`, server, serverErr)
+	}
+}
+
+func TestHandshakeRejectsInvalidKeys(t *testing.T) {
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := ClientHandshake(a, make([]byte, KeySize-1)); err == nil || !strings.Contains(err.Error(), `invalid server key`) {
+		t.Errorf(`ClientHandshake returned %v, want invalid server key`, err)
+	}
+	if _, err := ServerHandshake(b, make([]byte, KeySize+1)); err == nil || !strings.Contains(err.Error(), `invalid private key`) {
+		t.Errorf(`ServerHandshake returned %v, want invalid private key`, err)
+	}
+}
@@ -0,0 +1,74 @@
+package shared
+
+// UpgradeProtocol is the value of the Upgrade header used when an HTTP connection is converted into a tunnel
+// connection.
+const UpgradeProtocol = `httptun`
+
+// Headers exchanged while upgrading a connection.
+const (
+	// The protocol version and capabilities negotiated in every handshake; see Handshake.
+	HeaderVersion      = `Httptun-Version`
+	HeaderCapabilities = `Httptun-Capabilities`
+
+	HeaderAction     = `Httptun-Action`
+	HeaderTunnel     = `Httptun-Tunnel`
+	HeaderConnection = `Httptun-Connection`
+	HeaderPort       = `Httptun-Port`
+	HeaderSocket     = `Httptun-Socket`
+	HeaderAddress    = `Httptun-Address`
+	HeaderTarget     = `Httptun-Target`
+	HeaderNetwork    = `Httptun-Network`
+	HeaderHost       = `Httptun-Host`
+
+	// Encryption inside the upgraded connection that the client asks for and the server confirms in its response.
+	HeaderEncryption = `Httptun-Encryption`
+
+	// The transport that carries the connection when it is not an upgrade, and the session of the long-poll transport
+	// that a request belongs to, along with the end of the data sent in one direction of that session.
+	HeaderTransport = `Httptun-Transport`
+	HeaderSession   = `Httptun-Session`
+	HeaderEof       = `Httptun-Eof`
+
+	// Positions in the data of a long-poll session, counted in bytes, so that a request or response lost on the way
+	// can be repeated without losing or duplicating data: where the data of a POST or a poll's response begins, and
+	// how much of the server's data the client has received, sent with every poll.
+	HeaderSequence = `Httptun-Sequence`
+	HeaderAck      = `Httptun-Ack`
+
+	// Requirements that a tunnel's owner places on everyone connecting to it, enforced by the server.
+	HeaderAllowIPs    = `Httptun-Allow-Ips`
+	HeaderBasicAuth   = `Httptun-Basic-Auth`
+	HeaderBearerToken = `Httptun-Bearer-Token`
+)
+
+// Actions that may be requested by a client in the Httptun-Action header.
+const (
+	// ActionOpen requests a new tunnel. The upgraded connection becomes the control connection of the tunnel.
+	ActionOpen = `open`
+	// ActionAttach joins the upgraded connection with a pending connection that was accepted by the tunnel.
+	ActionAttach = `attach`
+	// ActionDial asks the server to dial the destination in the Httptun-Target header and join it with the upgraded
+	// connection.
+	ActionDial = `dial`
+	// ActionProbe asks the server to echo ProbeMessage over the upgraded connection, to test a transport.
+	ActionProbe = `probe`
+)
+
+// Message types sent over the control connection of a tunnel.
+const (
+	// MessageConnection announces a connection accepted by the server that is waiting to be attached.
+	MessageConnection = `connection`
+)
+
+// Message is exchanged as a line of JSON over the control connection of a tunnel.
+type Message struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Addr string `json:"addr,omitempty"`
+	// the address on which the server accepted the connection
+	Local string `json:"local,omitempty"`
+}
+
+// Version is the release of httptun, set when building with
+// -ldflags "-X github.com/RobertGrantEllis/httptun/shared.Version=<version>".
+var Version = `dev`
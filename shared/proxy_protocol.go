@@ -0,0 +1,211 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Versions of the PROXY protocol (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt).
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+// proxyV2Signature starts every version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// longest version 1 header, including the trailing CRLF
+	proxyV1MaxLength = 107
+
+	proxyV2CommandLocal = 0x20
+	proxyV2CommandProxy = 0x21
+	proxyV2FamilyTcp4   = 0x11
+	proxyV2FamilyTcp6   = 0x21
+	proxyV2FamilyUnspec = 0x00
+)
+
+// WriteProxyHeader writes a PROXY protocol header of the given version announcing a TCP connection from source to
+// destination, both 'ip:port'. If either is not a TCP address of the same family, e.g. because the connection came
+// in over a Unix socket, the header says that the addresses are unknown.
+func WriteProxyHeader(w io.Writer, version int, source, destination string) error {
+
+	src, srcErr := net.ResolveTCPAddr(`tcp`, source)
+	dst, dstErr := net.ResolveTCPAddr(`tcp`, destination)
+
+	known := srcErr == nil && dstErr == nil && src.IP != nil && dst.IP != nil &&
+		(src.IP.To4() == nil) == (dst.IP.To4() == nil)
+
+	var header []byte
+
+	switch version {
+	case ProxyProtocolV1:
+		switch {
+		case !known:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case src.IP.To4() != nil:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+		}
+	case ProxyProtocolV2:
+		var family byte
+		var addresses []byte
+		switch {
+		case !known:
+			family = proxyV2FamilyUnspec
+		case src.IP.To4() != nil:
+			family = proxyV2FamilyTcp4
+			addresses = append(append(addresses, src.IP.To4()...), dst.IP.To4()...)
+		default:
+			family = proxyV2FamilyTcp6
+			addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+		}
+		if known {
+			ports := make([]byte, 4)
+			binary.BigEndian.PutUint16(ports, uint16(src.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+			addresses = append(addresses, ports...)
+		}
+
+		header = append(header, proxyV2Signature...)
+		header = append(header, proxyV2CommandProxy, family, 0, 0)
+		binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addresses)))
+		header = append(header, addresses...)
+	default:
+		return errors.Errorf(`invalid PROXY protocol version (got %d)`, version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// ReadProxyHeader consumes a PROXY protocol header of either version from reader and returns the source and
+// destination it announces. Both are nil if the header does not carry addresses, e.g. for health checks by the proxy
+// itself, in which case the connection's own addresses apply.
+func ReadProxyHeader(reader *bufio.Reader) (source, destination net.Addr, err error) {
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, `could not read PROXY protocol header`)
+	}
+
+	if first[0] == proxyV2Signature[0] {
+		return readProxyV2Header(reader)
+	}
+
+	return readProxyV1Header(reader)
+}
+
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, `could not read PROXY protocol header`)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errors.New(`PROXY protocol header is too long`)
+		}
+	}
+
+	if !bytes.HasPrefix(line, []byte(`PROXY `)) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New(`missing PROXY protocol header`)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == `UNKNOWN` {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != `TCP4` && fields[1] != `TCP6`) {
+		return nil, nil, errors.Errorf(`invalid PROXY protocol header (got '%s')`, strings.TrimSpace(string(line)))
+	}
+
+	source, err := parseProxyV1Address(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	destination, err := parseProxyV1Address(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return source, destination, nil
+}
+
+func parseProxyV1Address(ipString, portString string) (*net.TCPAddr, error) {
+
+	ip := net.ParseIP(ipString)
+	port, err := strconv.Atoi(portString)
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.Errorf(`invalid address in PROXY protocol header (got '%s %s')`, ipString, portString)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, errors.Wrap(err, `could not read PROXY protocol header`)
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, nil, errors.New(`missing PROXY protocol header`)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, errors.Wrap(err, `could not read PROXY protocol header`)
+	}
+
+	switch header[12] {
+	case proxyV2CommandLocal:
+		return nil, nil, nil
+	case proxyV2CommandProxy:
+	default:
+		return nil, nil, errors.Errorf(`invalid PROXY protocol command (got 0x%02x)`, header[12])
+	}
+
+	var size int
+	switch header[13] {
+	case proxyV2FamilyTcp4:
+		size = net.IPv4len
+	case proxyV2FamilyTcp6:
+		size = net.IPv6len
+	default:
+		// UDP, Unix sockets and unspecified families carry nothing that applies to a TCP connection
+		return nil, nil, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New(`truncated PROXY protocol header`)
+	}
+
+	source := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+
+	return source, destination, nil
+}
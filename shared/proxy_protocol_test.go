@@ -0,0 +1,144 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+
+	v2 := func(rest ...byte) []byte {
+		return append(append([]byte{}, proxyV2Signature...), rest...)
+	}
+
+	tests := []struct {
+		name        string
+		version     int
+		source      string
+		destination string
+		want        []byte
+	}{
+		{`v1 tcp4`, ProxyProtocolV1, `192.168.0.1:56324`, `192.168.0.11:443`, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")},
+		{`v1 tcp6`, ProxyProtocolV1, `[2001:db8::1]:1000`, `[::1]:80`, []byte("PROXY TCP6 2001:db8::1 ::1 1000 80\r\n")},
+		{`v1 mixed families`, ProxyProtocolV1, `1.2.3.4:1`, `[::1]:80`, []byte("PROXY UNKNOWN\r\n")},
+		{`v1 unix socket`, ProxyProtocolV1, `@`, `/run/httptun.sock`, []byte("PROXY UNKNOWN\r\n")},
+		{`v2 tcp4`, ProxyProtocolV2, `10.0.0.1:1234`, `10.0.0.2:80`, v2(0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xd2, 0, 80)},
+		{`v2 tcp6`, ProxyProtocolV2, `[::1]:1`, `[::2]:2`, v2(0x21, 0x21, 0, 36,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+			0, 1, 0, 2)},
+		{`v2 unknown`, ProxyProtocolV2, `@`, `@`, v2(0x21, 0x00, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := &bytes.Buffer{}
+			if err := WriteProxyHeader(buf, tt.version, tt.source, tt.destination); err != nil {
+				t.Fatalf(`WriteProxyHeader: %s`, err.Error())
+			}
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("header = %q\nwant     %q", buf.Bytes(), tt.want)
+			}
+		})
+	}
+
+	if err := WriteProxyHeader(io.Discard, 3, `1.2.3.4:1`, `1.2.3.4:2`); err == nil {
+		t.Error(`version 3 was accepted`)
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		source      string
+		destination string
+	}{
+		{`192.168.0.1:56324`, `192.168.0.11:443`},
+		{`[2001:db8::1]:1000`, `[::1]:80`},
+		{`255.255.255.255:65535`, `0.0.0.0:0`},
+	}
+
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, tt := range tests {
+			buf := &bytes.Buffer{}
+			WriteProxyHeader(buf, version, tt.source, tt.destination)
+			buf.WriteString(`payload`)
+
+			reader := bufio.NewReader(buf)
+			source, destination, err := ReadProxyHeader(reader)
+			if err != nil {
+				t.Errorf(`v%d %s: %s`, version, tt.source, err.Error())
+				continue
+			}
+			if source.String() != tt.source || destination.String() != tt.destination {
+				t.Errorf(`v%d: read %s -> %s, want %s -> %s`, version, source, destination, tt.source, tt.destination)
+			}
+
+			// only the header is consumed
+			if rest, _ := io.ReadAll(reader); string(rest) != `payload` {
+				t.Errorf(`v%d: left '%s' unread, want 'payload'`, version, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+
+	v2 := func(rest ...byte) string {
+		return string(append(append([]byte{}, proxyV2Signature...), rest...))
+	}
+
+	tests := []struct {
+		name        string
+		input       string
+		source      string // empty if no addresses are announced
+		destination string
+		ok          bool
+	}{
+		{`v1 unknown`, "PROXY UNKNOWN\r\n", ``, ``, true},
+		{`v1 unknown with addresses`, "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", ``, ``, true},
+		{`v1 longest`, "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			`[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535`, `[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535`, true},
+		{`v1 missing CR`, "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n", ``, ``, false},
+		{`v1 bad port`, "PROXY TCP4 1.2.3.4 5.6.7.8 1 65536\r\n", ``, ``, false},
+		{`v1 bad address`, "PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n", ``, ``, false},
+		{`v1 udp`, "PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n", ``, ``, false},
+		{`v1 too long`, "PROXY TCP4 " + strings.Repeat(`1`, 120) + "\r\n", ``, ``, false},
+		{`no header`, "GET / HTTP/1.1\r\n\r\n", ``, ``, false},
+		{`v2 local`, v2(0x20, 0x00, 0, 0), ``, ``, true},
+		{`v2 tcp4 with TLVs`, v2(0x21, 0x11, 0, 16, 10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xd2, 0, 80, 0x04, 0, 1, 0xff),
+			`10.0.0.1:1234`, `10.0.0.2:80`, true},
+		{`v2 udp`, v2(0x21, 0x12, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0, 1, 0, 2), ``, ``, true},
+		{`v2 truncated addresses`, v2(0x21, 0x11, 0, 4, 10, 0, 0, 1), ``, ``, false},
+		{`v2 truncated body`, v2(0x21, 0x11, 0, 12, 10, 0), ``, ``, false},
+		{`v2 bad command`, v2(0x22, 0x11, 0, 0), ``, ``, false},
+		{`v2 bad signature`, "\r\n\r\n\x00\r\nQUIT\r\x21\x11\x00\x00", ``, ``, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			source, destination, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err == nil) != tt.ok {
+				t.Fatalf(`ReadProxyHeader error = %v, want ok: %v`, err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+
+			if tt.source == `` {
+				if source != nil || destination != nil {
+					t.Errorf(`announced %s -> %s, want no addresses`, source, destination)
+				}
+				return
+			}
+			if source == nil || source.String() != tt.source || destination.String() != tt.destination {
+				t.Errorf(`announced %v -> %v, want %s -> %s`, source, destination, tt.source, tt.destination)
+			}
+		})
+	}
+}
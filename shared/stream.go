@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// StreamConn is a net.Conn over a pair of streams that do not support deadlines themselves, such as the bodies of an
+// HTTP request and its response. Reads happen in the background so that read deadlines can interrupt them; write
+// deadlines are not supported.
+type StreamConn struct {
+	reader     io.Reader
+	writer     io.Writer
+	closeWrite func() error // nil if the writer cannot be closed on its own
+	close      func() error
+	local      net.Addr
+	remote     net.Addr
+
+	readMutex *sync.Mutex
+	started   bool
+	chunks    chan streamChunk
+	pending   []byte
+	readErr   error
+
+	deadlineMutex *sync.Mutex
+	readDeadline  time.Time
+
+	done chan struct{}
+	once *sync.Once
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// NewStreamConn returns a connection that reads from reader and writes to writer. closeWrite, if not nil, ends the
+// writer so that the peer reads EOF, and close releases both streams.
+func NewStreamConn(reader io.Reader, writer io.Writer, closeWrite, close func() error, local, remote net.Addr) *StreamConn {
+
+	return &StreamConn{
+		reader:        reader,
+		writer:        writer,
+		closeWrite:    closeWrite,
+		close:         close,
+		local:         local,
+		remote:        remote,
+		readMutex:     &sync.Mutex{},
+		chunks:        make(chan streamChunk),
+		deadlineMutex: &sync.Mutex{},
+		done:          make(chan struct{}),
+		once:          &sync.Once{},
+	}
+}
+
+// receive reads from the underlying reader until it fails, handing each chunk to Read.
+func (sc *StreamConn) receive() {
+
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := sc.reader.Read(buf)
+
+		select {
+		case sc.chunks <- streamChunk{data: buf[:n], err: err}:
+		case <-sc.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (sc *StreamConn) Read(b []byte) (int, error) {
+
+	sc.readMutex.Lock()
+	defer sc.readMutex.Unlock()
+
+	if !sc.started {
+		sc.started = true
+		go sc.receive()
+	}
+
+	for len(sc.pending) == 0 {
+		if sc.readErr != nil {
+			return 0, sc.readErr
+		}
+		if err := sc.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, sc.pending)
+	sc.pending = sc.pending[n:]
+
+	return n, nil
+}
+
+// next waits for the next chunk from the background reader until the read deadline, if any.
+func (sc *StreamConn) next() error {
+
+	sc.deadlineMutex.Lock()
+	deadline := sc.readDeadline
+	sc.deadlineMutex.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case chunk := <-sc.chunks:
+		sc.pending, sc.readErr = chunk.data, chunk.err
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-sc.done:
+		return net.ErrClosed
+	}
+}
+
+func (sc *StreamConn) Write(b []byte) (int, error) {
+
+	select {
+	case <-sc.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return sc.writer.Write(b)
+}
+
+// CloseWrite ends the writer if it supports doing so, or else closes the connection.
+func (sc *StreamConn) CloseWrite() error {
+
+	if sc.closeWrite == nil {
+		return sc.Close()
+	}
+
+	return sc.closeWrite()
+}
+
+func (sc *StreamConn) Close() error {
+
+	var err error
+	sc.once.Do(func() {
+		close(sc.done)
+		err = sc.close()
+	})
+
+	return err
+}
+
+// Done is closed when the connection is closed.
+func (sc *StreamConn) Done() <-chan struct{} {
+
+	return sc.done
+}
+
+func (sc *StreamConn) LocalAddr() net.Addr {
+
+	return sc.local
+}
+
+func (sc *StreamConn) RemoteAddr() net.Addr {
+
+	return sc.remote
+}
+
+func (sc *StreamConn) SetDeadline(t time.Time) error {
+
+	return sc.SetReadDeadline(t)
+}
+
+func (sc *StreamConn) SetReadDeadline(t time.Time) error {
+
+	sc.deadlineMutex.Lock()
+	sc.readDeadline = t
+	sc.deadlineMutex.Unlock()
+
+	return nil
+}
+
+// SetWriteDeadline is accepted for compatibility, but has no effect.
+func (sc *StreamConn) SetWriteDeadline(t time.Time) error {
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package shared
+
+// Transports by which a client may reach the server, in the order in which clients try them.
+const (
+	// TransportUpgrade switches an HTTP/1.1 connection to the httptun protocol with the Upgrade header.
+	TransportUpgrade = `upgrade`
+	// TransportStream carries the connection in the bodies of an HTTP/2 request and its response.
+	TransportStream = `stream`
+	// TransportWebSocket carries the connection in the binary messages of a WebSocket.
+	TransportWebSocket = `websocket`
+	// TransportPoll carries the connection in ordinary HTTP requests: data from the client is posted, and data from
+	// the server is fetched with long polls. It passes through proxies that allow nothing else.
+	TransportPoll = `poll`
+)
+
+// Transports lists every transport in the order in which clients try them.
+var Transports = []string{TransportUpgrade, TransportStream, TransportWebSocket, TransportPoll}
+
+// CapabilitiesPath is the suffix of the path at which the server describes itself to clients without authentication.
+const CapabilitiesPath = `/.httptun/capabilities`
+
+// Capabilities is served as JSON at CapabilitiesPath.
+type Capabilities struct {
+	// the range of protocol versions that the server speaks, and the capabilities it grants
+	Version      int           `json:"version"`
+	MinVersion   int           `json:"min_version"`
+	Capabilities CapabilitySet `json:"capabilities"`
+
+	Transports []string `json:"transports"`
+}
+
+// ProbeMessage is echoed by the server on connections upgraded with ActionProbe.
+const ProbeMessage = `httptun-probe`
+
+// WebSocketProtocol is the subprotocol requested in the Sec-WebSocket-Protocol header of WebSocket handshakes.
+const WebSocketProtocol = `httptun`
@@ -0,0 +1,269 @@
+package shared
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// WebSocket framing as specified in RFC 6455, limited to what tunnels need: data is sent as binary messages, pings are
+// answered, and a close frame ends one direction of the connection, like a TCP half-close.
+
+const (
+	webSocketGuid = `258EAFA5-E914-47DA-95CA-C5AB0DC85B11`
+
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	// largest payload sent in one frame
+	maxWebSocketPayload = 32 * 1024
+)
+
+// NewWebSocketKey returns a random value for the Sec-WebSocket-Key header of a handshake.
+func NewWebSocketKey() string {
+
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// WebSocketAccept returns the value of the Sec-WebSocket-Accept header that answers key.
+func WebSocketAccept(key string) string {
+
+	sum := sha1.Sum([]byte(key + webSocketGuid))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WebSocketConn carries a connection in the binary messages of a WebSocket. The client side masks what it sends, as
+// the protocol requires.
+type WebSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool
+
+	// state of the data frame being read
+	remaining uint64
+	mask      []byte // nil if the frame is not masked
+	offset    int
+	eof       bool
+
+	writeMutex *sync.Mutex
+	closeSent  bool
+}
+
+// NewWebSocketConn returns conn, whose WebSocket handshake is complete, as a stream of bytes. reader may hold data
+// buffered from conn during the handshake, or be nil.
+func NewWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *WebSocketConn {
+
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+
+	return &WebSocketConn{
+		Conn:       conn,
+		reader:     reader,
+		client:     client,
+		writeMutex: &sync.Mutex{},
+	}
+}
+
+func (wc *WebSocketConn) Read(b []byte) (int, error) {
+
+	for wc.remaining == 0 {
+		if wc.eof {
+			return 0, io.EOF
+		}
+		if err := wc.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > wc.remaining {
+		b = b[:wc.remaining]
+	}
+
+	n, err := wc.reader.Read(b)
+	wc.unmask(b[:n])
+	wc.remaining -= uint64(n)
+
+	return n, err
+}
+
+// readHeader reads frames until the header of one that carries data, handling control frames along the way.
+func (wc *WebSocketConn) readHeader() error {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(wc.reader, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(wc.reader, extended); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(wc.reader, extended); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	wc.mask, wc.offset = nil, 0
+	if masked {
+		wc.mask = make([]byte, 4)
+		if _, err := io.ReadFull(wc.reader, wc.mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		wc.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New(`invalid WebSocket control frame`)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(wc.reader, payload); err != nil {
+			return err
+		}
+		wc.unmask(payload)
+		switch opcode {
+		case opClose:
+			wc.eof = true
+		case opPing:
+			return wc.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return errors.Errorf(`invalid WebSocket opcode %d`, opcode)
+	}
+}
+
+func (wc *WebSocketConn) unmask(b []byte) {
+
+	if wc.mask == nil {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= wc.mask[(wc.offset+i)%4]
+	}
+	wc.offset += len(b)
+}
+
+// Write sends b in binary frames. It holds the lock for all of them, so that the frames of concurrent writes, and the
+// pongs of the reader, do not end up between them.
+func (wc *WebSocketConn) Write(b []byte) (int, error) {
+
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxWebSocketPayload {
+			chunk = chunk[:maxWebSocketPayload]
+		}
+
+		if err := wc.writeFrameLocked(opBinary, chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (wc *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+
+	return wc.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked sends one frame. Must be called with wc.writeMutex held.
+func (wc *WebSocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+
+	if wc.closeSent {
+		return errors.New(`WebSocket is closed for writing`)
+	}
+	if opcode == opClose {
+		wc.closeSent = true
+	}
+
+	frame := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !wc.client {
+		_, err := wc.Conn.Write(append(frame, payload...))
+		return err
+	}
+
+	frame[1] |= 0x80
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+
+	_, err := wc.Conn.Write(frame)
+	return err
+}
+
+// CloseWrite sends a close frame, after which the peer reads EOF.
+func (wc *WebSocketConn) CloseWrite() error {
+
+	wc.writeMutex.Lock()
+	sent := wc.closeSent
+	wc.writeMutex.Unlock()
+
+	if sent {
+		return nil
+	}
+
+	// status 1000, normal closure
+	return wc.writeFrame(opClose, []byte{0x03, 0xe8})
+}
+
+func (wc *WebSocketConn) Close() error {
+
+	wc.CloseWrite()
+
+	return wc.Conn.Close()
+}
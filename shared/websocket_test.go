@@ -0,0 +1,340 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webSocketPipe returns the client end of a WebSocket and the raw connection of the server end, or the other way
+// around if client is false.
+func webSocketPipe(t *testing.T, client bool) (*WebSocketConn, net.Conn) {
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return NewWebSocketConn(a, nil, client), b
+}
+
+// readAllAsync reads everything from conn in the background until it is closed.
+func readAllAsync(conn net.Conn) <-chan []byte {
+
+	result := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(conn)
+		result <- data
+	}()
+
+	return result
+}
+
+// webSocketFrame is a frame as parsed by readWebSocketFrame, with the payload unmasked.
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// readWebSocketFrames parses a stream of frames.
+func readWebSocketFrames(t *testing.T, data []byte) []webSocketFrame {
+
+	t.Helper()
+
+	var frames []webSocketFrame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatalf(`truncated frame header`)
+		}
+
+		frame := webSocketFrame{fin: data[0]&0x80 != 0, opcode: data[0] & 0x0f, masked: data[1]&0x80 != 0}
+		length := uint64(data[1] & 0x7f)
+		data = data[2:]
+
+		switch length {
+		case 126:
+			length, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+		case 127:
+			length, data = binary.BigEndian.Uint64(data), data[8:]
+		}
+
+		var mask []byte
+		if frame.masked {
+			mask, data = data[:4], data[4:]
+		}
+
+		if uint64(len(data)) < length {
+			t.Fatalf(`truncated frame payload`)
+		}
+		frame.payload, data = append([]byte{}, data[:length]...), data[length:]
+		for i := range frame.payload {
+			if mask != nil {
+				frame.payload[i] ^= mask[i%4]
+			}
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
+
+func TestWebSocketAccept(t *testing.T) {
+
+	// the example of RFC 6455 section 1.3
+	if got := WebSocketAccept(`dGhlIHNhbXBsZSBub25jZQ==`); got != `s3pPLMBiTxaQ9kYGzzhZRbK+xOo=` {
+		t.Errorf(`WebSocketAccept = %s`, got)
+	}
+}
+
+func TestWebSocketConnRead(t *testing.T) {
+
+	hello := []byte(`Hello`)
+	long := bytes.Repeat([]byte(`0123456789abcdef`), 16)
+	longer := bytes.Repeat([]byte(`0123456789abcdef`), 4096)
+
+	tests := []struct {
+		name      string
+		frames    []byte
+		want      []byte
+		wantPongs [][]byte
+	}{
+		// the examples of RFC 6455 section 5.7
+		{`unmasked text`, []byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'}, hello, nil},
+		{`masked text`, []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, hello, nil},
+		{`fragmented`, []byte{0x01, 0x03, 'H', 'e', 'l', 0x80, 0x02, 'l', 'o'}, hello, nil},
+		{`ping between fragments`, []byte{0x01, 0x03, 'H', 'e', 'l', 0x89, 0x05, 'H', 'e', 'l', 'l', 'o', 0x80, 0x02, 'l', 'o'}, hello, [][]byte{hello}},
+		{`masked ping`, []byte{0x89, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, nil, [][]byte{hello}},
+		{`pong`, []byte{0x8a, 0x05, 'H', 'e', 'l', 'l', 'o', 0x82, 0x01, 'x'}, []byte(`x`), nil},
+		{`16-bit length`, append([]byte{0x82, 0x7e, 0x01, 0x00}, long...), long, nil},
+		{`64-bit length`, append([]byte{0x82, 0x7f, 0, 0, 0, 0, 0, 1, 0, 0}, longer...), longer, nil},
+		{`empty`, []byte{0x82, 0x00, 0x82, 0x01, 'x'}, []byte(`x`), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			wc, raw := webSocketPipe(t, false)
+
+			// the frames, then the close frame that ends the data
+			go func() {
+				raw.Write(tt.frames)
+				raw.Write([]byte{0x88, 0x02, 0x03, 0xe8})
+			}()
+
+			// pongs are written while reading, so they must be read meanwhile
+			written := readAllAsync(raw)
+
+			got, err := io.ReadAll(wc)
+			if err != nil {
+				t.Fatalf(`read: %s`, err.Error())
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf(`read %q, want %q`, got, tt.want)
+			}
+
+			wc.Close()
+			var pongs [][]byte
+			for _, frame := range readWebSocketFrames(t, <-written) {
+				if frame.opcode == opPong {
+					if frame.masked {
+						t.Errorf(`server masked a pong`)
+					}
+					pongs = append(pongs, frame.payload)
+				}
+			}
+			if len(pongs) != len(tt.wantPongs) || (len(pongs) > 0 && !bytes.Equal(pongs[0], tt.wantPongs[0])) {
+				t.Errorf(`answered with pongs %q, want %q`, pongs, tt.wantPongs)
+			}
+		})
+	}
+}
+
+func TestWebSocketConnReadRejects(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		frames  []byte
+		wantErr string
+	}{
+		{`unknown opcode`, []byte{0x83, 0x00}, `invalid WebSocket opcode 3`},
+		{`long control frame`, append([]byte{0x89, 0x7e, 0x00, 0x7e}, make([]byte, 126)...), `invalid WebSocket control frame`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			wc, raw := webSocketPipe(t, false)
+			go raw.Write(tt.frames)
+
+			if _, err := wc.Read(make([]byte, 16)); err == nil || err.Error() != tt.wantErr {
+				t.Errorf(`read returned %v, want %s`, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebSocketConnWrite(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		size       int
+		wantHeader []byte // of the first frame, from the server
+		wantSizes  []int  // of the frames
+	}{
+		{`short`, 5, []byte{0x82, 0x05}, []int{5}},
+		{`longest with 7-bit length`, 125, []byte{0x82, 0x7d}, []int{125}},
+		{`shortest with 16-bit length`, 126, []byte{0x82, 0x7e, 0x00, 0x7e}, []int{126}},
+		{`one frame`, maxWebSocketPayload, []byte{0x82, 0x7e, 0x80, 0x00}, []int{maxWebSocketPayload}},
+		{`two frames`, maxWebSocketPayload + 1, []byte{0x82, 0x7e, 0x80, 0x00}, []int{maxWebSocketPayload, 1}},
+	}
+
+	for _, tt := range tests {
+		for _, client := range []bool{false, true} {
+			name := tt.name + ` from server`
+			if client {
+				name = tt.name + ` from client`
+			}
+
+			t.Run(name, func(t *testing.T) {
+
+				wc, raw := webSocketPipe(t, client)
+				written := readAllAsync(raw)
+
+				data := randomBytes(tt.size)
+				if n, err := wc.Write(data); n != len(data) || err != nil {
+					t.Fatalf(`write returned %d, %v`, n, err)
+				}
+				wc.Conn.Close()
+
+				stream := <-written
+				if !client && !bytes.HasPrefix(stream, tt.wantHeader) {
+					t.Errorf(`frame starts with %x, want %x`, stream[:len(tt.wantHeader)], tt.wantHeader)
+				}
+
+				var payload []byte
+				frames := readWebSocketFrames(t, stream)
+				if len(frames) != len(tt.wantSizes) {
+					t.Fatalf(`wrote %d frames, want %d`, len(frames), len(tt.wantSizes))
+				}
+				for i, frame := range frames {
+					if !frame.fin || frame.opcode != opBinary || frame.masked != client || len(frame.payload) != tt.wantSizes[i] {
+						t.Errorf(`frame %d: fin %t, opcode %d, masked %t, %d bytes`, i, frame.fin, frame.opcode, frame.masked, len(frame.payload))
+					}
+					payload = append(payload, frame.payload...)
+				}
+				if !bytes.Equal(payload, data) {
+					t.Errorf(`frames carry different bytes than the %d written`, len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestWebSocketConnWriteMasksWithFreshKeys(t *testing.T) {
+
+	wc, raw := webSocketPipe(t, true)
+	written := readAllAsync(raw)
+
+	wc.Write(make([]byte, 8))
+	wc.Write(make([]byte, 8))
+	wc.Conn.Close()
+
+	// zeros masked are the mask itself, repeated
+	stream := <-written
+	if len(stream) != 2*(2+4+8) {
+		t.Fatalf(`wrote %d bytes`, len(stream))
+	}
+	first, second := stream[2:6], stream[16:20]
+	if !bytes.Equal(stream[6:10], first) || !bytes.Equal(stream[10:14], first) {
+		t.Errorf(`payload %x is not masked with %x`, stream[6:14], first)
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf(`both frames are masked with %x`, first)
+	}
+}
+
+// slowConn takes a while to write, so that waiting writers get a chance to take over.
+type slowConn struct {
+	net.Conn
+}
+
+func (sc *slowConn) Write(b []byte) (int, error) {
+
+	time.Sleep(2 * time.Millisecond)
+
+	return sc.Conn.Write(b)
+}
+
+func TestWebSocketConnConcurrentWrites(t *testing.T) {
+
+	// writes larger than a frame must not be interleaved with each other, even when frames are slow to send
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	writer := NewWebSocketConn(&slowConn{a}, nil, true)
+	reader := NewWebSocketConn(b, nil, false)
+
+	const writers = 4
+	size := 3*maxWebSocketPayload + 7
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(fill byte) {
+			defer wg.Done()
+			writer.Write(bytes.Repeat([]byte{fill}, size))
+		}(byte('a' + i))
+	}
+	go func() {
+		wg.Wait()
+		writer.CloseWrite()
+	}()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf(`read: %s`, err.Error())
+	}
+	if len(got) != writers*size {
+		t.Fatalf(`read %d bytes, want %d`, len(got), writers*size)
+	}
+
+	seen := map[byte]bool{}
+	for offset := 0; offset < len(got); offset += size {
+		fill := got[offset]
+		if seen[fill] || !bytes.Equal(got[offset:offset+size], bytes.Repeat([]byte{fill}, size)) {
+			t.Fatalf(`write at %d is interleaved with another`, offset)
+		}
+		seen[fill] = true
+	}
+}
+
+func TestWebSocketConnCloseWrite(t *testing.T) {
+
+	wc, raw := webSocketPipe(t, false)
+	written := readAllAsync(raw)
+
+	if err := wc.CloseWrite(); err != nil {
+		t.Fatalf(`CloseWrite: %s`, err.Error())
+	}
+	if err := wc.CloseWrite(); err != nil {
+		t.Errorf(`second CloseWrite: %s`, err.Error())
+	}
+	if _, err := wc.Write([]byte(`late`)); err == nil || !strings.Contains(err.Error(), `closed for writing`) {
+		t.Errorf(`write after CloseWrite returned %v`, err)
+	}
+	wc.Conn.Close()
+
+	if got, want := <-written, []byte{0x88, 0x02, 0x03, 0xe8}; !bytes.Equal(got, want) {
+		t.Errorf(`wrote %x, want one close frame %x`, got, want)
+	}
+}